@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// age file format
+//
+// As an alternative to the SIMG container, images can be written and read in
+// the age v1 format (https://age-encryption.org/v1), so they interoperate with
+// the age CLI and libraries. A file is a text header followed by the payload:
+//
+//	age-encryption.org/v1
+//	-> X25519 <ephemeral share>
+//	<wrapped file key, base64 in 64 column lines>
+//	--- <header MAC>
+//	nonce(16) | STREAM chunks of 64 KiB, ChaCha20-Poly1305
+//
+// Only the scrypt (password) and X25519 recipient types are supported; other
+// stanzas are skipped when decrypting. X25519 keys are the same keys used for
+// SIMG recipients, and ParsePublicKey and ParsePrivateKey accept them in the
+// age "age1..." and "AGE-SECRET-KEY-1..." encodings.
+//
+// Armored age files ("-----BEGIN AGE ENCRYPTED FILE-----") are decoded by
+// detectTextEncoding like SIMG armor.
+
+const (
+	ageMagic         = "age-encryption.org/v1"
+	ageX25519Label   = "age-encryption.org/v1/X25519"
+	ageScryptLabel   = "age-encryption.org/v1/scrypt"
+	ageFileKeySize   = 16
+	ageNonceSize     = 16
+	ageChunkSize     = 64 * 1024
+	ageStanzaColumns = 64
+	ageScryptSalt    = 16
+
+	// ageDefaultWorkFactor is the scrypt log2(N) used by the age CLI
+	ageDefaultWorkFactor = 18
+
+	// Bech32 human-readable parts of age keys
+	ageRecipientHRP = "age"
+	ageIdentityHRP  = "AGE-SECRET-KEY-"
+
+	ageArmorBegin = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorEnd   = "-----END AGE ENCRYPTED FILE-----"
+)
+
+// ErrMalformedAge is returned for age files whose header cannot be parsed
+var ErrMalformedAge = errors.New("malformed age header")
+
+// ageBase64 is the canonical unpadded base64 used in age headers
+var ageBase64 = base64.RawStdEncoding.Strict()
+
+// ageStanza is a recipient stanza of an age header
+type ageStanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// isAge reports whether data starts with the age v1 header line
+func isAge(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageMagic+"\n"))
+}
+
+// EncryptAgeStream reads plaintext from src and writes an age v1 file to dst,
+// encrypted either to a password (scrypt) or to X25519 recipients. age does
+// not allow both at once. opts.KDF sets the scrypt work factor if it selects
+// scrypt; key IDs, signatures, metadata and cipher suites other than
+// ChaCha20-Poly1305 have no age equivalent and are refused.
+func EncryptAgeStream(dst io.Writer, src io.Reader, password []byte, opts EncryptOptions) error {
+	switch {
+	case len(password) > 0 && len(opts.Recipients) > 0:
+		return errors.New("age files are encrypted either to a password or to recipients, not both")
+	case len(password) == 0 && len(opts.Recipients) == 0:
+		return errors.New("a password or at least one recipient is required")
+	case len(opts.KeyIDs) > 0 || opts.SigningKey != nil || opts.Metadata != nil || opts.ImageMetadata != nil:
+		return errors.New("key IDs, signatures and metadata are not supported in age files")
+	case opts.Padding != PaddingNone || opts.Compression != CompressionNone || opts.Policy != nil:
+		return errors.New("padding, compression and decrypt policies are not supported in age files")
+	case opts.Cipher != 0 && opts.Cipher != SuiteChaCha20Poly1305:
+		return fmt.Errorf("age files always use %s", SuiteChaCha20Poly1305)
+	}
+
+	fileKey := make([]byte, ageFileKeySize)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return err
+	}
+	defer wipe(fileKey)
+
+	var stanzas []ageStanza
+	if len(password) > 0 {
+		workFactor := ageDefaultWorkFactor
+		if opts.KDF.Algorithm == KDFScrypt && opts.KDF.Time != 0 {
+			workFactor = int(opts.KDF.Time)
+		}
+		stanza, err := wrapAgeScrypt(fileKey, password, workFactor)
+		if err != nil {
+			return err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+	for _, recipient := range opts.Recipients {
+		stanza, err := wrapAgeX25519(fileKey, recipient)
+		if err != nil {
+			return err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	if _, err := dst.Write(marshalAgeHeader(stanzas, fileKey)); err != nil {
+		return err
+	}
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	if _, err := dst.Write(nonce); err != nil {
+		return err
+	}
+
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return err
+	}
+
+	// Read one chunk ahead to know which chunk is the last one
+	br := bufio.NewReaderSize(src, ageChunkSize)
+	chunk := make([]byte, ageChunkSize, ageChunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		sealed := aead.Seal(chunk[:0], ageChunkNonce(counter, last), chunk[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		chunk = chunk[:ageChunkSize]
+	}
+}
+
+// decryptAge reads an age v1 file from src and writes the plaintext to dst
+func decryptAge(dst io.Writer, src *bufio.Reader, opts DecryptOptions) error {
+	stanzas, headerBytes, mac, err := parseAgeHeader(src)
+	if err != nil {
+		return err
+	}
+
+	fileKey, err := unwrapAgeFileKey(stanzas, opts)
+	if err != nil {
+		return err
+	}
+	defer wipe(fileKey)
+	if !hmac.Equal(mac, ageHeaderMAC(fileKey, headerBytes)) {
+		return ErrHeaderAuthentication
+	}
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err := io.ReadFull(src, nonce); err != nil {
+		return fmt.Errorf("%w: missing payload nonce", ErrStreamTruncated)
+	}
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, ageChunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(src, chunk)
+		if err == io.EOF {
+			// Only reached when the previous chunk was not marked final
+			return ErrStreamTruncated
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err == io.ErrUnexpectedEOF
+		if !last {
+			if _, err := src.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		if n < aead.Overhead() || (last && n == aead.Overhead() && counter > 0) {
+			return ErrStreamTruncated
+		}
+
+		plaintext, err := aead.Open(chunk[:0], ageChunkNonce(counter, last), chunk[:n], nil)
+		if err != nil {
+			return fmt.Errorf("decryption failed: %w", ErrAuthenticationFailed)
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// ageChunkNonce returns the STREAM nonce: 11-byte counter | last flag
+func ageChunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// agePayloadAEAD returns the payload cipher for a file key and nonce
+func agePayloadAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "payload", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return chacha20poly1305.New(key)
+}
+
+// ageHeaderMAC returns the MAC over the header up to and including "---"
+func ageHeaderMAC(fileKey, headerBytes []byte) []byte {
+	key, err := hkdf.Key(sha256.New, fileKey, nil, "header", sha256.Size)
+	if err != nil {
+		panic(err) // cannot happen for a 32-byte output
+	}
+	defer wipe(key)
+	h := hmac.New(sha256.New, key)
+	h.Write(headerBytes)
+	return h.Sum(nil)
+}
+
+// marshalAgeHeader encodes the stanzas and the header MAC
+func marshalAgeHeader(stanzas []ageStanza, fileKey []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(ageMagic + "\n")
+	for _, stanza := range stanzas {
+		b.WriteString("-> " + stanza.Type)
+		for _, arg := range stanza.Args {
+			b.WriteString(" " + arg)
+		}
+		b.WriteString("\n")
+
+		// The last body line is always shorter than a full line, even if empty
+		body := ageBase64.EncodeToString(stanza.Body)
+		for len(body) >= ageStanzaColumns {
+			b.WriteString(body[:ageStanzaColumns] + "\n")
+			body = body[ageStanzaColumns:]
+		}
+		b.WriteString(body + "\n")
+	}
+	b.WriteString("---")
+	mac := ageHeaderMAC(fileKey, b.Bytes())
+	b.WriteString(" " + ageBase64.EncodeToString(mac) + "\n")
+	return b.Bytes()
+}
+
+// parseAgeHeader reads the header of an age file and returns its stanzas, the
+// header bytes covered by the MAC, and the MAC
+func parseAgeHeader(src *bufio.Reader) ([]ageStanza, []byte, []byte, error) {
+	var header bytes.Buffer
+	readLine := func() (string, error) {
+		line, err := src.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("%w: unexpected end of header", ErrMalformedAge)
+		}
+		if header.Len()+len(line) > maxHeaderSize {
+			return "", fmt.Errorf("%w: header too large", ErrMalformedAge)
+		}
+		header.WriteString(line)
+		line = line[:len(line)-1]
+		for _, c := range []byte(line) {
+			if c < 0x20 || c > 0x7e {
+				return "", fmt.Errorf("%w: invalid character in header", ErrMalformedAge)
+			}
+		}
+		return line, nil
+	}
+
+	if line, err := readLine(); err != nil || line != ageMagic {
+		return nil, nil, nil, fmt.Errorf("%w: unsupported version line", ErrMalformedAge)
+	}
+
+	var stanzas []ageStanza
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if macText, found := strings.CutPrefix(line, "--- "); found {
+			mac, err := ageBase64.DecodeString(macText)
+			if err != nil || len(mac) != sha256.Size {
+				return nil, nil, nil, fmt.Errorf("%w: invalid header MAC", ErrMalformedAge)
+			}
+			// The MAC covers the header up to and including "---"
+			headerBytes := header.Bytes()[:header.Len()-len(line)-1+len("---")]
+			return stanzas, headerBytes, mac, nil
+		}
+
+		args, found := strings.CutPrefix(line, "-> ")
+		if !found {
+			return nil, nil, nil, fmt.Errorf("%w: expected a stanza or the MAC line", ErrMalformedAge)
+		}
+		fields := strings.Split(args, " ")
+		for _, field := range fields {
+			if field == "" {
+				return nil, nil, nil, fmt.Errorf("%w: empty stanza argument", ErrMalformedAge)
+			}
+		}
+		stanza := ageStanza{Type: fields[0], Args: fields[1:]}
+
+		// Body lines are full 64 columns, except the last one
+		for {
+			line, err := readLine()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if len(line) > ageStanzaColumns {
+				return nil, nil, nil, fmt.Errorf("%w: stanza body line too long", ErrMalformedAge)
+			}
+			chunk, err := ageBase64.DecodeString(line)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%w: invalid stanza body", ErrMalformedAge)
+			}
+			stanza.Body = append(stanza.Body, chunk...)
+			if len(line) < ageStanzaColumns {
+				break
+			}
+		}
+		stanzas = append(stanzas, stanza)
+	}
+}
+
+// unwrapAgeFileKey recovers the file key with the password or identities
+func unwrapAgeFileKey(stanzas []ageStanza, opts DecryptOptions) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if stanza.Type == "scrypt" && len(stanzas) != 1 {
+			return nil, fmt.Errorf("%w: an scrypt stanza must be the only stanza", ErrMalformedAge)
+		}
+	}
+
+	for _, stanza := range stanzas {
+		switch stanza.Type {
+		case "scrypt":
+			if len(opts.Password) == 0 {
+				continue
+			}
+			return unwrapAgeScrypt(stanza, opts.Password)
+		case "X25519":
+			share, err := parseAgeX25519Stanza(stanza)
+			if err != nil {
+				return nil, err
+			}
+			for _, identity := range opts.Identities {
+				fileKey, err := unwrapAgeX25519(stanza.Body, share, identity)
+				if errors.Is(err, ErrMalformedAge) {
+					return nil, err
+				}
+				if err == nil {
+					return fileKey, nil
+				}
+			}
+		}
+		// Other stanza types are meant for other recipients
+	}
+	return nil, ErrNoMatchingIdentity
+}
+
+// wrapAgeX25519 wraps the file key for an X25519 recipient
+func wrapAgeX25519(fileKey []byte, recipient *ecdh.PublicKey) (ageStanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return ageStanza{}, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return ageStanza{}, err
+	}
+	defer wipe(shared)
+
+	share := ephemeral.PublicKey().Bytes()
+	body, err := ageWrap(shared, append(append([]byte{}, share...), recipient.Bytes()...), ageX25519Label, fileKey)
+	if err != nil {
+		return ageStanza{}, err
+	}
+	return ageStanza{Type: "X25519", Args: []string{ageBase64.EncodeToString(share)}, Body: body}, nil
+}
+
+// parseAgeX25519Stanza returns the ephemeral share of an X25519 stanza
+func parseAgeX25519Stanza(stanza ageStanza) (*ecdh.PublicKey, error) {
+	if len(stanza.Args) != 1 {
+		return nil, fmt.Errorf("%w: X25519 stanza needs one argument", ErrMalformedAge)
+	}
+	raw, err := ageBase64.DecodeString(stanza.Args[0])
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("%w: invalid X25519 share", ErrMalformedAge)
+	}
+	if len(stanza.Body) != ageFileKeySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("%w: invalid X25519 stanza body", ErrMalformedAge)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// unwrapAgeX25519 unwraps the file key of an X25519 stanza with an identity
+func unwrapAgeX25519(body []byte, share *ecdh.PublicKey, identity *ecdh.PrivateKey) ([]byte, error) {
+	shared, err := identity.ECDH(share)
+	if err != nil {
+		// Low-order shares give an all-zero secret, which is refused
+		return nil, fmt.Errorf("%w: invalid X25519 share", ErrMalformedAge)
+	}
+	defer wipe(shared)
+	salt := append(append([]byte{}, share.Bytes()...), identity.PublicKey().Bytes()...)
+	return ageUnwrap(shared, salt, ageX25519Label, body)
+}
+
+// wrapAgeScrypt wraps the file key with a password
+func wrapAgeScrypt(fileKey, password []byte, workFactor int) (ageStanza, error) {
+	if workFactor < 1 || workFactor > maxScryptLogN {
+		return ageStanza{}, fmt.Errorf("scrypt work factor %d out of range", workFactor)
+	}
+	if err := checkScryptCost(workFactor, 8, 1); err != nil {
+		return ageStanza{}, err
+	}
+	salt := make([]byte, ageScryptSalt)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return ageStanza{}, err
+	}
+
+	key, err := scrypt.Key(password, append([]byte(ageScryptLabel), salt...), 1<<workFactor, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return ageStanza{}, err
+	}
+	defer wipe(key)
+	body, err := ageSeal(key, fileKey)
+	if err != nil {
+		return ageStanza{}, err
+	}
+	args := []string{ageBase64.EncodeToString(salt), strconv.Itoa(workFactor)}
+	return ageStanza{Type: "scrypt", Args: args, Body: body}, nil
+}
+
+// unwrapAgeScrypt unwraps the file key of an scrypt stanza with a password
+func unwrapAgeScrypt(stanza ageStanza, password []byte) ([]byte, error) {
+	if len(stanza.Args) != 2 {
+		return nil, fmt.Errorf("%w: scrypt stanza needs two arguments", ErrMalformedAge)
+	}
+	salt, err := ageBase64.DecodeString(stanza.Args[0])
+	if err != nil || len(salt) != ageScryptSalt {
+		return nil, fmt.Errorf("%w: invalid scrypt salt", ErrMalformedAge)
+	}
+
+	// The work factor is a plain decimal number without leading zeros
+	logN := stanza.Args[1]
+	if logN == "" || logN[0] == '0' || strings.Trim(logN, "0123456789") != "" {
+		return nil, fmt.Errorf("%w: invalid scrypt work factor", ErrMalformedAge)
+	}
+	workFactor, err := strconv.Atoi(logN)
+	if err != nil || workFactor > maxScryptLogN || checkScryptCost(workFactor, 8, 1) != nil {
+		return nil, fmt.Errorf("%w: scrypt work factor %s is too large", ErrMalformedAge, logN)
+	}
+	if len(stanza.Body) != ageFileKeySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("%w: invalid scrypt stanza body", ErrMalformedAge)
+	}
+
+	key, err := scrypt.Key(password, append([]byte(ageScryptLabel), salt...), 1<<workFactor, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	fileKey, err := ageOpen(key, stanza.Body)
+	if err != nil {
+		return nil, ErrNoMatchingIdentity
+	}
+	return fileKey, nil
+}
+
+// ageWrap derives a wrapping key with HKDF and seals the file key with it
+func ageWrap(secret, salt []byte, label string, fileKey []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, label, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return ageSeal(key, fileKey)
+}
+
+// ageUnwrap derives a wrapping key with HKDF and opens the file key with it
+func ageUnwrap(secret, salt []byte, label string, body []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, label, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return ageOpen(key, body)
+}
+
+// ageSeal seals a file key with a single-use key and a zero nonce
+func ageSeal(key, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+// ageOpen opens a file key sealed by ageSeal
+func ageOpen(key, body []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+}
+
+// ageArmorWriter writes an armored age file: padded base64 in 64 column lines
+// between BEGIN and END lines
+type ageArmorWriter struct {
+	dst     io.Writer
+	lines   *lineWrapper
+	encoder io.WriteCloser
+	started bool
+}
+
+// NewAgeArmorWriter returns a writer that armors the age file written to it
+// into dst. Close writes the END line; it does not close dst.
+func NewAgeArmorWriter(dst io.Writer) io.WriteCloser {
+	lines := &lineWrapper{w: dst}
+	return &ageArmorWriter{dst: dst, lines: lines, encoder: base64.NewEncoder(base64.StdEncoding, lines)}
+}
+
+// Write encodes p, writing the BEGIN line first
+func (a *ageArmorWriter) Write(p []byte) (int, error) {
+	if !a.started {
+		if _, err := io.WriteString(a.dst, ageArmorBegin+"\n"); err != nil {
+			return 0, err
+		}
+		a.started = true
+	}
+	return a.encoder.Write(p)
+}
+
+// Close flushes the encoding and writes the END line
+func (a *ageArmorWriter) Close() error {
+	if _, err := a.Write(nil); err != nil {
+		return err
+	}
+	if err := a.encoder.Close(); err != nil {
+		return err
+	}
+	if a.lines.column > 0 {
+		if _, err := io.WriteString(a.dst, "\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(a.dst, ageArmorEnd+"\n")
+	return err
+}
+
+// isAgeArmored reports whether data starts with the age armor BEGIN line
+func isAgeArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(ageArmorBegin))
+}
+
+// decodeAgeArmor decodes an armored age file. The format is strict: lines
+// end in LF or CRLF, every line but the last has 64 columns and is canonical
+// base64 on its own, and only whitespace may surround the armor.
+func decodeAgeArmor(src io.Reader) ([]byte, error) {
+	data, err := readAllLimited(src, maxLegacySize)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 || lines[0] != ageArmorBegin {
+		return nil, fmt.Errorf("%w: missing age BEGIN line", ErrMalformedArmor)
+	}
+
+	var decoded []byte
+	for i, line := range lines[1:] {
+		if line == ageArmorEnd {
+			if strings.TrimSpace(strings.Join(lines[i+2:], "\n")) != "" {
+				return nil, fmt.Errorf("%w: data after age END line", ErrMalformedArmor)
+			}
+			return decoded, nil
+		}
+		if len(decoded)%(ageStanzaColumns/4*3) != 0 {
+			return nil, fmt.Errorf("%w: short line before the age END line", ErrMalformedArmor)
+		}
+		if line == "" || len(line) > ageStanzaColumns || strings.ContainsAny(line, "\r\n") {
+			return nil, fmt.Errorf("%w: invalid age armor line", ErrMalformedArmor)
+		}
+		chunk, err := base64.StdEncoding.Strict().DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid base64 in age armor", ErrMalformedArmor)
+		}
+		decoded = append(decoded, chunk...)
+	}
+	return nil, fmt.Errorf("%w: missing age END line", ErrMalformedArmor)
+}
+
+// Bech32 (BIP 173) encoding of age keys, without the 90 character limit
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Polymod computes the BCH checksum of 5-bit values
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32HRPExpand expands the human-readable part for the checksum
+func bech32HRPExpand(hrp string) []byte {
+	values := make([]byte, 0, len(hrp)*2+1)
+	for _, c := range []byte(hrp) {
+		values = append(values, c>>5)
+	}
+	values = append(values, 0)
+	for _, c := range []byte(hrp) {
+		values = append(values, c&31)
+	}
+	return values
+}
+
+// convertBits regroups bits, e.g. bytes into 5-bit values
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	var out []byte
+	maxValue := uint32(1)<<to - 1
+	for _, b := range data {
+		if uint32(b)>>from != 0 {
+			return nil, errors.New("invalid data range")
+		}
+		acc = acc<<from | uint32(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxValue))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxValue))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxValue != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return out, nil
+}
+
+// bech32Encode encodes data with the lowercase human-readable part hrp
+func bech32Encode(hrp string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	hrp = strings.ToLower(hrp)
+	checksumInput := append(bech32HRPExpand(hrp), values...)
+	polymod := bech32Polymod(append(checksumInput, 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var b strings.Builder
+	b.WriteString(hrp + "1")
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		b.WriteByte(bech32Charset[polymod>>(5*(5-i))&31])
+	}
+	return b.String(), nil
+}
+
+// bech32Decode decodes a bech32 string and returns its lowercase
+// human-readable part and data
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("separator in the wrong place")
+	}
+	hrp := s[:pos]
+	for _, c := range []byte(hrp) {
+		if c < 33 || c > 126 {
+			return "", nil, errors.New("invalid character in human-readable part")
+		}
+	}
+
+	values := make([]byte, 0, len(s)-pos-1)
+	for _, c := range []byte(s[pos+1:]) {
+		v := strings.IndexByte(bech32Charset, c)
+		if v < 0 {
+			return "", nil, errors.New("invalid character in data part")
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, errors.New("invalid checksum")
+	}
+
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
+
+// AgeRecipient returns the "age1..." encoding of an X25519 public key
+func AgeRecipient(pub *ecdh.PublicKey) string {
+	s, _ := bech32Encode(ageRecipientHRP, pub.Bytes())
+	return s
+}
+
+// AgeIdentity returns the "AGE-SECRET-KEY-1..." encoding of an X25519 private key
+func AgeIdentity(priv *ecdh.PrivateKey) string {
+	s, _ := bech32Encode(ageIdentityHRP, priv.Bytes())
+	return strings.ToUpper(s)
+}
+
+// isAgeRecipient reports whether s looks like an "age1..." public key
+func isAgeRecipient(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), ageRecipientHRP+"1")
+}
+
+// parseAgeRecipient decodes an "age1..." public key
+func parseAgeRecipient(s string) (*ecdh.PublicKey, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient: %v", err)
+	}
+	if hrp != ageRecipientHRP {
+		return nil, fmt.Errorf("invalid age recipient: unexpected type %q", hrp)
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// parseAgeIdentity decodes an "AGE-SECRET-KEY-1..." private key. Identity
+// files as written by age-keygen are accepted too; comment lines are skipped.
+func parseAgeIdentity(s string) (*ecdh.PrivateKey, error) {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, data, err := bech32Decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age identity: %v", err)
+		}
+		if hrp != strings.ToLower(ageIdentityHRP) {
+			return nil, fmt.Errorf("invalid age identity: unexpected type %q", hrp)
+		}
+		return ecdh.X25519().NewPrivateKey(data)
+	}
+	return nil, errors.New("invalid age identity: no key found")
+}
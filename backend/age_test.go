@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	agetest "c2sp.org/CCTV/age"
+)
+
+// ageVector is a test vector of the age test kit (c2sp.org/CCTV/age)
+type ageVector struct {
+	expect      string
+	payloadHash []byte
+	passphrases []string
+	identities  []string
+	armored     bool
+	file        []byte
+}
+
+// parseAgeVector splits a test vector into its textual header and the age
+// file that follows the first empty line
+func parseAgeVector(t *testing.T, data []byte) ageVector {
+	t.Helper()
+	var v ageVector
+	compressed := false
+	for {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			t.Fatal("vector has no empty line after its header")
+		}
+		data = rest
+		if len(line) == 0 {
+			break
+		}
+		key, value, _ := strings.Cut(string(line), ": ")
+		switch key {
+		case "expect":
+			v.expect = value
+		case "payload":
+			v.payloadHash, _ = hex.DecodeString(value)
+		case "passphrase":
+			v.passphrases = append(v.passphrases, value)
+		case "identity":
+			v.identities = append(v.identities, value)
+		case "armored":
+			v.armored = value == "yes"
+		case "compressed":
+			compressed = value == "zlib"
+		case "file key", "comment":
+		default:
+			t.Skipf("unknown header %q", key)
+		}
+	}
+
+	v.file = data
+	if compressed {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.file, err = io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return v
+}
+
+func TestAgeTestKit(t *testing.T) {
+	names, err := fs.Glob(agetest.Vectors, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			data, err := fs.ReadFile(agetest.Vectors, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := parseAgeVector(t, data)
+
+			opts := DecryptOptions{}
+			if len(v.passphrases) > 0 {
+				opts.Password = []byte(v.passphrases[0])
+			}
+			for _, value := range v.identities {
+				identity, err := ParsePrivateKey(value)
+				if err != nil {
+					// Only X25519 identities are supported
+					t.Skipf("unsupported identity: %v", err)
+				}
+				opts.Identities = append(opts.Identities, identity)
+			}
+
+			// DecryptDataWithOptions returns no plaintext at all unless the
+			// whole file checks out, which is stricter than the test kit asks
+			// for: it allows the chunks before a payload failure to be
+			// released
+			plaintext, _, err := DecryptDataWithOptions(v.file, opts)
+			if v.expect == "success" {
+				if err != nil {
+					t.Fatalf("decryption failed: %v", err)
+				}
+				if sum := sha256.Sum256(plaintext); !bytes.Equal(sum[:], v.payloadHash) {
+					t.Errorf("payload hash %x, want %x", sum, v.payloadHash)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("decryption succeeded, want a %s", v.expect)
+			}
+			if plaintext != nil {
+				t.Errorf("%d bytes of plaintext returned with the error", len(plaintext))
+			}
+
+			// Files that do not start with the age header line are not
+			// recognised as age files, and the payload nonce is read as part
+			// of the payload, so those header failures surface differently
+			if v.armored || !isAge(v.file) {
+				return
+			}
+			switch v.expect {
+			case "no match":
+				if !errors.Is(err, ErrNoMatchingIdentity) {
+					t.Errorf("got error %v, want ErrNoMatchingIdentity", err)
+				}
+			case "HMAC failure":
+				if !errors.Is(err, ErrHeaderAuthentication) {
+					t.Errorf("got error %v, want ErrHeaderAuthentication", err)
+				}
+			case "header failure":
+				if !errors.Is(err, ErrMalformedAge) && !errors.Is(err, ErrStreamTruncated) {
+					t.Errorf("got error %v, want ErrMalformedAge", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	plaintext := make([]byte, 2*ageChunkSize+100)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eve, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recipients and identities go through their bech32 encodings, as they
+	// would when exchanged with the age CLI
+	parseRecipient := func(pub *ecdh.PublicKey) *ecdh.PublicKey {
+		encoded := AgeRecipient(pub)
+		if !strings.HasPrefix(encoded, "age1") {
+			t.Fatalf("recipient %q does not start with age1", encoded)
+		}
+		parsed, err := ParsePublicKey(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	parseIdentity := func(priv *ecdh.PrivateKey) *ecdh.PrivateKey {
+		encoded := AgeIdentity(priv)
+		if !strings.HasPrefix(encoded, "AGE-SECRET-KEY-1") {
+			t.Fatalf("identity %q does not start with AGE-SECRET-KEY-1", encoded)
+		}
+		parsed, err := ParsePrivateKey("# created: by a test\n" + encoded + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name     string
+		password []byte
+		opts     EncryptOptions
+		unlock   DecryptOptions
+		wrong    DecryptOptions
+	}{
+		{
+			name:     "scrypt",
+			password: []byte("age round trip"),
+			opts:     EncryptOptions{KDF: KDFParams{Algorithm: KDFScrypt, Time: 10}},
+			unlock:   DecryptOptions{Password: []byte("age round trip")},
+			wrong:    DecryptOptions{Password: []byte("not the password")},
+		},
+		{
+			name:   "X25519",
+			opts:   EncryptOptions{Recipients: []*ecdh.PublicKey{parseRecipient(alice.PublicKey()), parseRecipient(bob.PublicKey())}},
+			unlock: DecryptOptions{Identities: []*ecdh.PrivateKey{parseIdentity(eve), parseIdentity(bob)}},
+			wrong:  DecryptOptions{Identities: []*ecdh.PrivateKey{parseIdentity(eve)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encrypted bytes.Buffer
+			if err := EncryptAgeStream(&encrypted, bytes.NewReader(plaintext), tt.password, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if !isAge(encrypted.Bytes()) {
+				t.Fatal("output does not start with the age header")
+			}
+
+			var decrypted bytes.Buffer
+			header, err := DecryptStreamWithOptions(&decrypted, bytes.NewReader(encrypted.Bytes()), tt.unlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header != nil {
+				t.Error("age files have no container header")
+			}
+			if !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Error("decrypted data differs from the original")
+			}
+
+			// The stanzas are the only way in
+			_, err = DecryptStreamWithOptions(io.Discard, bytes.NewReader(encrypted.Bytes()), tt.wrong)
+			if !errors.Is(err, ErrNoMatchingIdentity) && !errors.Is(err, ErrAuthenticationFailed) {
+				t.Errorf("got error %v, want no match", err)
+			}
+
+			// Armored output decodes the same way
+			var armored bytes.Buffer
+			w := NewAgeArmorWriter(&armored)
+			if _, err := w.Write(encrypted.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			decrypted.Reset()
+			if _, err := DecryptStreamWithOptions(&decrypted, &armored, tt.unlock); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Error("armored file decrypted differently")
+			}
+		})
+	}
+}
+
+func TestEncryptAgeStreamRefusesUnsupportedOptions(t *testing.T) {
+	pub, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		password []byte
+		opts     EncryptOptions
+	}{
+		"no credentials":         {},
+		"password and recipient": {password: []byte("pw"), opts: EncryptOptions{Recipients: []*ecdh.PublicKey{pub.PublicKey()}}},
+		"key IDs":                {password: []byte("pw"), opts: EncryptOptions{KeyIDs: []string{"env:team"}}},
+		"compression":            {password: []byte("pw"), opts: EncryptOptions{Compression: CompressionZstd}},
+		"cipher suite":           {password: []byte("pw"), opts: EncryptOptions{Cipher: SuiteAES256GCM}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := EncryptAgeStream(io.Discard, strings.NewReader("image"), tt.password, tt.opts); err == nil {
+				t.Error("EncryptAgeStream accepted the options")
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ASCII armor
+//
+// Encrypted images can be written as text so they survive email and chat.
+// The format follows OpenPGP armor (RFC 4880, section 6.2):
+//
+//	-----BEGIN SIMG ENCRYPTED IMAGE-----
+//	Cipher: AES-256-GCM
+//	Filename: photo.jpg
+//
+//	U0lNRwMAAAB...            base64 of the binary container, 64 columns
+//	=nWLk                     base64 of the CRC-24 of the binary container
+//	-----END SIMG ENCRYPTED IMAGE-----
+//
+// The header lines are informational only and are not authenticated; the
+// container header inside the armor is what decryption relies on.
+//
+// Decryption tells the input formats apart by their first bytes: the
+// container magic "SIMG" for binary data, the BEGIN line (optionally after
+// whitespace) for armor, and "U0lNRw", the base64 encoding of the magic, for
+// bare base64 as written by EncryptToBase64. Armored age files and base64
+// "openssl enc -a" output are decoded as well (see age.go and openssl.go).
+// Anything else is the headerless legacy format.
+
+const (
+	armorBegin = "-----BEGIN SIMG ENCRYPTED IMAGE-----"
+	armorEnd   = "-----END SIMG ENCRYPTED IMAGE-----"
+
+	// armorLineLength is the number of base64 characters per armored line
+	armorLineLength = 64
+
+	// armorPeekSize is how far ahead detectTextEncoding looks for the BEGIN line
+	armorPeekSize = 512
+
+	// base64Magic is the base64 encoding of the container magic
+	base64Magic = "U0lNRw"
+
+	crc24Init = 0xb704ce
+	crc24Poly = 0x1864cfb
+)
+
+// ErrArmorChecksum is returned when the CRC-24 of armored data does not match,
+// which means the text was damaged in transit
+var ErrArmorChecksum = errors.New("armor checksum mismatch, the text was damaged")
+
+// ErrMalformedArmor is returned for armored text that cannot be parsed
+var ErrMalformedArmor = errors.New("malformed armored data")
+
+// crc24 updates the OpenPGP CRC-24 of data
+func crc24(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+// armorWriter encodes a binary container as armored text
+type armorWriter struct {
+	dst     io.Writer
+	begin   string // BEGIN line and headers, until they are written
+	lines   *lineWrapper
+	encoder io.WriteCloser
+	crc     uint32
+}
+
+// NewArmorWriter returns a writer that armors the binary container written to
+// it into dst. Nothing reaches dst before the first Write, so errors that
+// occur before any output can still be reported by the caller. Close must be
+// called to write the checksum and END line; it does not close dst.
+func NewArmorWriter(dst io.Writer, headers map[string]string) io.WriteCloser {
+	var b strings.Builder
+	b.WriteString(armorBegin + "\n")
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(headers[key])
+		if key == "" || strings.ContainsAny(key, ": \r\n") || value == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\n", key, value)
+	}
+	b.WriteString("\n")
+
+	lines := &lineWrapper{w: dst}
+	return &armorWriter{
+		dst:     dst,
+		begin:   b.String(),
+		lines:   lines,
+		encoder: base64.NewEncoder(base64.StdEncoding, lines),
+		crc:     crc24Init,
+	}
+}
+
+// writeBegin writes the BEGIN line and headers once
+func (a *armorWriter) writeBegin() error {
+	if a.begin == "" {
+		return nil
+	}
+	_, err := io.WriteString(a.dst, a.begin)
+	a.begin = ""
+	return err
+}
+
+// Write encodes p
+func (a *armorWriter) Write(p []byte) (int, error) {
+	if err := a.writeBegin(); err != nil {
+		return 0, err
+	}
+	a.crc = crc24(a.crc, p)
+	return a.encoder.Write(p)
+}
+
+// Close flushes the encoding and writes the checksum and END line
+func (a *armorWriter) Close() error {
+	if err := a.writeBegin(); err != nil {
+		return err
+	}
+	if err := a.encoder.Close(); err != nil {
+		return err
+	}
+	if a.lines.column > 0 {
+		if _, err := io.WriteString(a.dst, "\n"); err != nil {
+			return err
+		}
+	}
+	crc := []byte{byte(a.crc >> 16), byte(a.crc >> 8), byte(a.crc)}
+	_, err := fmt.Fprintf(a.dst, "=%s\n%s\n", base64.StdEncoding.EncodeToString(crc), armorEnd)
+	return err
+}
+
+// lineWrapper breaks the base64 output into lines
+type lineWrapper struct {
+	w      io.Writer
+	column int
+}
+
+// Write copies p, inserting a newline every armorLineLength characters
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(armorLineLength-l.column, len(p))
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		l.column += n
+		if l.column == armorLineLength {
+			if _, err := io.WriteString(l.w, "\n"); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+	}
+	return written, nil
+}
+
+// base64LineWriter writes bare base64 in lines of armorLineLength, the text
+// form of "openssl enc -a"
+type base64LineWriter struct {
+	dst     io.Writer
+	lines   *lineWrapper
+	encoder io.WriteCloser
+}
+
+// NewBase64LineWriter returns a writer that encodes the data written to it as
+// line wrapped base64 into dst. Close flushes the last line; it does not
+// close dst.
+func NewBase64LineWriter(dst io.Writer) io.WriteCloser {
+	lines := &lineWrapper{w: dst}
+	return &base64LineWriter{dst: dst, lines: lines, encoder: base64.NewEncoder(base64.StdEncoding, lines)}
+}
+
+// Write encodes p
+func (b *base64LineWriter) Write(p []byte) (int, error) {
+	return b.encoder.Write(p)
+}
+
+// Close flushes the encoding and ends the last line
+func (b *base64LineWriter) Close() error {
+	if err := b.encoder.Close(); err != nil {
+		return err
+	}
+	if b.lines.column > 0 {
+		_, err := io.WriteString(b.dst, "\n")
+		return err
+	}
+	return nil
+}
+
+// ArmorData returns the armored text of a binary container
+func ArmorData(data []byte, headers map[string]string) ([]byte, error) {
+	var out bytes.Buffer
+	aw := NewArmorWriter(&out, headers)
+	if _, err := aw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// armorReader decodes armored text back into the binary container
+type armorReader struct {
+	src       *bufio.Reader
+	Headers   map[string]string
+	firstLine string // body line read while looking for the headers
+	pending   []byte // decoded bytes not yet returned
+	carry     string // base64 characters not yet decoded
+	crc       uint32
+	done      bool
+}
+
+// newArmorReader parses the BEGIN line and headers in src
+func newArmorReader(src *bufio.Reader) (*armorReader, error) {
+	a := &armorReader{src: src, Headers: make(map[string]string), crc: crc24Init}
+
+	line, err := a.readLine()
+	for err == nil && line == "" {
+		line, err = a.readLine()
+	}
+	if err != nil || line != armorBegin {
+		return nil, fmt.Errorf("%w: missing BEGIN line", ErrMalformedArmor)
+	}
+
+	// Header lines run up to a blank line. Text pasted through tools that
+	// drop blank lines goes straight to the base64 body, which never
+	// contains ": ".
+	for {
+		line, err := a.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("%w: missing END line", ErrMalformedArmor)
+		}
+		if line == "" {
+			return a, nil
+		}
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			a.firstLine = line
+			return a, nil
+		}
+		a.Headers[key] = value
+	}
+}
+
+// readLine returns the next line without its line ending and surrounding spaces
+func (a *armorReader) readLine() (string, error) {
+	line, err := a.src.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: line too long", ErrMalformedArmor)
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// Read returns decoded container bytes
+func (a *armorReader) Read(p []byte) (int, error) {
+	for len(a.pending) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		if err := a.decodeLine(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, a.pending)
+	a.pending = a.pending[n:]
+	return n, nil
+}
+
+// decodeLine decodes the next body line, or checks the checksum and END
+// line once the body is over
+func (a *armorReader) decodeLine() error {
+	line := a.firstLine
+	a.firstLine = ""
+	if line == "" {
+		var err error
+		if line, err = a.readLine(); err == io.EOF {
+			return fmt.Errorf("%w: missing END line", ErrMalformedArmor)
+		} else if err != nil {
+			return err
+		}
+	}
+	if line == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "=") || line == armorEnd {
+		if err := a.finish(line); err != nil {
+			return err
+		}
+		a.done = true
+		return nil
+	}
+
+	// Decode whole groups of four characters so that the text may be
+	// wrapped at any width
+	a.carry += line
+	n := len(a.carry) / 4 * 4
+	decoded, err := base64.StdEncoding.DecodeString(a.carry[:n])
+	if err != nil {
+		return fmt.Errorf("%w: invalid base64", ErrMalformedArmor)
+	}
+	a.carry = a.carry[n:]
+	a.crc = crc24(a.crc, decoded)
+	a.pending = decoded
+	return nil
+}
+
+// finish verifies the checksum line and the END line
+func (a *armorReader) finish(line string) error {
+	if a.carry != "" {
+		return fmt.Errorf("%w: truncated base64", ErrMalformedArmor)
+	}
+	if line == armorEnd {
+		return fmt.Errorf("%w: missing checksum", ErrMalformedArmor)
+	}
+
+	crc, err := base64.StdEncoding.DecodeString(line[1:])
+	if err != nil || len(crc) != 3 {
+		return fmt.Errorf("%w: invalid checksum line", ErrMalformedArmor)
+	}
+	if uint32(crc[0])<<16|uint32(crc[1])<<8|uint32(crc[2]) != a.crc {
+		return ErrArmorChecksum
+	}
+
+	end, err := a.readLine()
+	if err != nil || end != armorEnd {
+		return fmt.Errorf("%w: missing END line", ErrMalformedArmor)
+	}
+	return nil
+}
+
+// isArmored reports whether data starts with an armor BEGIN line
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armorBegin))
+}
+
+// detectTextEncoding returns a reader over the binary form of the data in
+// src, decoding ASCII armor or bare base64 if src starts with either. The
+// armor headers are returned as well, or nil for other input.
+func detectTextEncoding(src *bufio.Reader) (*bufio.Reader, map[string]string, error) {
+	peeked, err := src.Peek(armorPeekSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+
+	switch {
+	case isContainer(peeked):
+		return src, nil, nil
+	case isArmored(peeked):
+		armor, err := newArmorReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bufio.NewReader(armor), armor.Headers, nil
+	case isAgeArmored(peeked):
+		decoded, err := decodeAgeArmor(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bufio.NewReader(bytes.NewReader(decoded)), nil, nil
+	case bytes.HasPrefix(peeked, []byte(base64Magic)), bytes.HasPrefix(peeked, []byte(base64OpenSSLMagic)):
+		lines := newlineStripper{src}
+		return bufio.NewReader(base64.NewDecoder(base64.StdEncoding, lines)), nil, nil
+	}
+	return src, nil, nil
+}
+
+// newlineStripper drops line breaks from wrapped base64
+type newlineStripper struct {
+	r io.Reader
+}
+
+// Read returns the data of r without '\r' and '\n'
+func (s newlineStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		kept := 0
+		for _, b := range p[:n] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// armorHeaders returns the informational armor headers for an image
+// encrypted with opts
+func armorHeaders(opts EncryptOptions, filename string) map[string]string {
+	suite := opts.Cipher
+	if suite == 0 {
+		suite = SuiteAES256GCM
+	}
+	headers := map[string]string{
+		"Version": fmt.Sprintf("%d", ContainerVersion),
+		"Cipher":  suite.String(),
+	}
+	if len(opts.KeyIDs) > 0 {
+		headers["Key-ID"] = strings.Join(opts.KeyIDs, ", ")
+	}
+	if filename != "" {
+		headers["Filename"] = filename
+	}
+	return headers
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// textEncodings returns the binary container and its text forms
+func textEncodings(t *testing.T, container []byte) map[string][]byte {
+	t.Helper()
+	armored, err := ArmorData(container, map[string]string{"Filename": "photo.png", "Cipher": "AES-256-GCM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapped bytes.Buffer
+	bw := NewBase64LineWriter(&wrapped)
+	if _, err := bw.Write(container); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"binary":         container,
+		"armored":        armored,
+		"armored, CRLF":  bytes.ReplaceAll(armored, []byte("\n"), []byte("\r\n")),
+		"armored, blank": append([]byte("\n  \n"), armored...),
+		"base64":         []byte(base64.StdEncoding.EncodeToString(container)),
+		"wrapped base64": wrapped.Bytes(),
+	}
+}
+
+func TestCRC24(t *testing.T) {
+	// The check value of CRC-24/OPENPGP
+	if got := crc24(crc24Init, []byte("123456789")); got != 0x21cf02 {
+		t.Errorf("crc24 = %06x, want 21cf02", got)
+	}
+}
+
+func TestArmorRoundTrip(t *testing.T) {
+	password := []byte("armor password")
+	for _, size := range []int{0, 1, 47, 48, 49, DefaultSegmentSize + 3} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		container, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, encoded := range textEncodings(t, container) {
+			var decrypted bytes.Buffer
+			if _, err := DecryptStreamWithOptions(&decrypted, bytes.NewReader(encoded), DecryptOptions{Password: password}); err != nil {
+				t.Fatalf("%s, %d bytes: %v", name, size, err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Errorf("%s, %d bytes: decrypted data differs", name, size)
+			}
+		}
+	}
+}
+
+func TestDetectTextEncoding(t *testing.T) {
+	container, err := EncryptDataWithOptions([]byte("detected"), []byte("password"), EncryptOptions{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, encoded := range textEncodings(t, container) {
+		t.Run(name, func(t *testing.T) {
+			br, headers, err := detectTextEncoding(bufio.NewReader(bytes.NewReader(encoded)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := io.ReadAll(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, container) {
+				t.Error("decoded data differs from the container")
+			}
+			isArmor := strings.HasPrefix(name, "armored")
+			if isArmor && headers["Filename"] != "photo.png" {
+				t.Errorf("headers %v", headers)
+			}
+			if !isArmor && headers != nil {
+				t.Errorf("headers %v for %s input", headers, name)
+			}
+		})
+	}
+
+	// Data in none of the formats passes through unchanged
+	legacy := []byte("legacy data without a header")
+	br, _, err := detectTextEncoding(bufio.NewReader(bytes.NewReader(legacy)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(br); !bytes.Equal(got, legacy) {
+		t.Errorf("legacy data changed to %q", got)
+	}
+}
+
+func TestArmorRewrapped(t *testing.T) {
+	container := make([]byte, 500)
+	rand.Read(container)
+	armored, err := ArmorData(container, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrap the body at 76 columns and drop the blank line, as mail clients do
+	lines := strings.Split(strings.TrimSpace(string(armored)), "\n")
+	var body string
+	var checksum string
+	for _, line := range lines[1 : len(lines)-1] {
+		if strings.HasPrefix(line, "=") {
+			checksum = line
+		} else {
+			body += line
+		}
+	}
+	var rewrapped strings.Builder
+	rewrapped.WriteString(armorBegin + "\n")
+	for len(body) > 76 {
+		rewrapped.WriteString(body[:76] + "\n")
+		body = body[76:]
+	}
+	rewrapped.WriteString(body + "\n" + checksum + "\n" + armorEnd + "\n")
+
+	ar, err := newArmorReader(bufio.NewReader(strings.NewReader(rewrapped.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(ar); err != nil || !bytes.Equal(got, container) {
+		t.Errorf("rewrapped armor decoded to different data (%v)", err)
+	}
+}
+
+func TestArmorRejectsDamagedText(t *testing.T) {
+	container := make([]byte, 200)
+	rand.Read(container)
+	armored, err := ArmorData(container, map[string]string{"Filename": "photo.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(armored)
+	lines := strings.Split(text, "\n")
+	bodyStart := strings.Index(text, "\n\n") + 2
+	checksumLine := lines[len(lines)-3]
+
+	// Swap one base64 character for another so the text still decodes
+	changed := []byte(text)
+	if changed[bodyStart+10] == 'A' {
+		changed[bodyStart+10] = 'B'
+	} else {
+		changed[bodyStart+10] = 'A'
+	}
+
+	otherCRC := "=" + base64.StdEncoding.EncodeToString([]byte{1, 2, 3})
+	tests := []struct {
+		name string
+		text string
+		want error
+	}{
+		{"changed body", string(changed), ErrArmorChecksum},
+		{"changed checksum", strings.Replace(text, checksumLine, otherCRC, 1), ErrArmorChecksum},
+		{"missing checksum", strings.Replace(text, checksumLine+"\n", "", 1), ErrMalformedArmor},
+		{"invalid checksum", strings.Replace(text, checksumLine, "=!!!!", 1), ErrMalformedArmor},
+		{"missing END line", strings.Replace(text, armorEnd, "", 1), ErrMalformedArmor},
+		{"cut in the body", text[:bodyStart+30], ErrMalformedArmor},
+		{"truncated base64", strings.Replace(text, lines[len(lines)-4]+"\n", lines[len(lines)-4][:len(lines[len(lines)-4])-1]+"\n", 1), ErrMalformedArmor},
+		{"invalid base64", strings.Replace(text, lines[3], strings.Repeat("*", len(lines[3])), 1), ErrMalformedArmor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.ReadAll(mustArmorReader(t, tt.text))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := newArmorReader(bufio.NewReader(strings.NewReader("-----BEGIN SOMETHING ELSE-----\n"))); !errors.Is(err, ErrMalformedArmor) {
+		t.Errorf("foreign armor returned %v, want ErrMalformedArmor", err)
+	}
+
+	// A damaged armored container fails decryption with the checksum error
+	_, err = DecryptStreamWithOptions(io.Discard, bytes.NewReader(changed), DecryptOptions{Password: []byte("password")})
+	if !errors.Is(err, ErrArmorChecksum) {
+		t.Errorf("decrypting damaged armor returned %v, want ErrArmorChecksum", err)
+	}
+}
+
+// mustArmorReader parses the armor BEGIN line and headers of text
+func mustArmorReader(t *testing.T, text string) *armorReader {
+	t.Helper()
+	ar, err := newArmorReader(bufio.NewReader(strings.NewReader(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ar
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// Box blurs
+//
+// A box blur averages the pixels of a square around each pixel. It is
+// separable, so it is computed as a sum along the rows followed by a sum of
+// those sums along the columns, and each sum is a running sum: moving the
+// window by one pixel adds the pixel that enters it and subtracts the one
+// that leaves. The cost per pixel is then the same for any radius. Sums are
+// kept as integers of the 16-bit premultiplied channels, so they are exact
+// and subtracting never drifts. Pixels beyond the edges repeat the edge
+// pixels, as for the other blurs.
+//
+// Blurring with a box several times tends to a Gaussian blur (the central
+// limit theorem), which ApplyIteratedBoxBlur uses to approximate a Gaussian
+// of any radius at the cost of three box blurs, following "Fast Almost-
+// Gaussian Filtering" by Peter Kovesi for the sizes of the boxes.
+
+const (
+	// MaxBlurRadius bounds the radius of the blurs, keeping the sums of a row
+	// of a box within 32 bits
+	MaxBlurRadius = 1<<15 - 1
+
+	// iteratedBoxPasses is the number of box blurs that approximate a
+	// Gaussian blur
+	iteratedBoxPasses = 3
+)
+
+// ErrInvalidRadius is returned for a blur radius that is negative or too large
+var ErrInvalidRadius = errors.New("invalid blur radius")
+
+// ApplyIteratedBoxBlur approximates a Gaussian blur of standard deviation
+// sigma with three box blurs, at a cost that does not depend on sigma
+func ApplyIteratedBoxBlur(ctx context.Context, img image.Image, sigma float64) (image.Image, error) {
+	if !(sigma >= 0) || sigma > MaxBlurRadius {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRadius, sigma)
+	}
+	src, err := rgba64Pixels(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	radii := boxRadiiForGaussian(sigma, iteratedBoxPasses)
+
+	// Every pass but the last keeps 16 bits of the average
+	for _, radius := range radii[:len(radii)-1] {
+		next := image.NewRGBA64(image.Rect(0, 0, src.Rect.Dx(), src.Rect.Dy()))
+		area := boxArea(radius)
+		err := boxBlur(ctx, src, radius, func(x, y int, sums *[4]uint64) {
+			p := next.Pix[y*next.Stride+x*8:]
+			for c, sum := range sums {
+				v := (sum + area/2) / area
+				p[c*2], p[c*2+1] = uint8(v>>8), uint8(v)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		src = next
+	}
+
+	blurred := image.NewRGBA(img.Bounds())
+	div := 0xffff * boxArea(radii[len(radii)-1])
+	err = boxBlur(ctx, src, radii[len(radii)-1], func(x, y int, sums *[4]uint64) {
+		p := blurred.Pix[y*blurred.Stride+x*4:]
+		for c, sum := range sums {
+			p[c] = uint8((sum*0xff + div/2) / div)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blurred, nil
+}
+
+// boxRadiiForGaussian returns the radii of n box blurs that, applied one
+// after the other, come closest to a Gaussian blur of standard deviation
+// sigma. The boxes differ in width by at most two pixels.
+func boxRadiiForGaussian(sigma float64, n int) []int {
+	// The ideal width of n equal boxes, and the odd widths either side of it
+	ideal := math.Sqrt(12*sigma*sigma/float64(n) + 1)
+	lower := int(math.Floor(ideal))
+	if lower%2 == 0 {
+		lower--
+	}
+	upper := lower + 2
+
+	// How many boxes of the lower width keep the variance closest to sigma²
+	wl := float64(lower)
+	m := int(math.Round((12*sigma*sigma - float64(n)*wl*wl - 4*float64(n)*wl - 3*float64(n)) / (-4*wl - 4)))
+
+	radii := make([]int, n)
+	for i := range radii {
+		if i < m {
+			radii[i] = (lower - 1) / 2
+		} else {
+			radii[i] = (upper - 1) / 2
+		}
+	}
+	return radii
+}
+
+// boxArea returns the number of pixels in a box of the given radius
+func boxArea(radius int) uint64 {
+	side := uint64(2*radius + 1)
+	return side * side
+}
+
+// boxBlur sums every channel of src over the box of the given radius around
+// each pixel and hands the sums, for the pixel at (x, y) of src counted from
+// its top left corner, to store. The image is processed in bands of rows.
+// Each band keeps a running sum down every column, and slides it by summing
+// the row that enters the box and the row that leaves it along the row as it
+// goes, so the scratch memory is a few rows per band whatever the image size.
+func boxBlur(ctx context.Context, src *image.RGBA64, radius int, store func(x, y int, sums *[4]uint64)) error {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	if width == 0 || height == 0 {
+		return ctx.Err()
+	}
+
+	// sumRow writes the running sums along row y into sums
+	sumRow := func(y int, sums []uint32) {
+		row := src.Pix[y*src.Stride:]
+		var acc [4]uint32
+		clampedWindow(-radius, radius, width, func(i, count int) {
+			for c := range acc {
+				acc[c] += channel16(row, i*8+c*2) * uint32(count)
+			}
+		})
+		for x := 0; x < width; x++ {
+			copy(sums[x*4:x*4+4], acc[:])
+
+			// Slide the window one pixel to the right
+			in, out := clampIndex(x+radius+1, width)*8, clampIndex(x-radius, width)*8
+			for c := range acc {
+				acc[c] += channel16(row, in+c*2) - channel16(row, out+c*2)
+			}
+		}
+	}
+
+	// A band starts from the rows around its first row, which lie within the
+	// halo of the band
+	return parallelBands(ctx, height, radius, func(lo, hi int) {
+		in, out := make([]uint32, width*4), make([]uint32, width*4)
+		acc := make([]uint64, width*4)
+		clampedWindow(lo-radius, lo+radius, height, func(y, count int) {
+			sumRow(y, in)
+			for i, sum := range in {
+				acc[i] += uint64(sum) * uint64(count)
+			}
+		})
+
+		var sums [4]uint64
+		for y := lo; y < hi; y++ {
+			for x := 0; x < width; x++ {
+				copy(sums[:], acc[x*4:x*4+4])
+				store(x, y, &sums)
+			}
+			if y+1 == hi {
+				break
+			}
+
+			// Slide the window one row down
+			sumRow(clampIndex(y+radius+1, height), in)
+			sumRow(clampIndex(y-radius, height), out)
+			for i := range acc {
+				acc[i] += uint64(in[i]) - uint64(out[i])
+			}
+		}
+	})
+}
+
+// clampedWindow calls add for every index of [0, n) that the window of
+// indexes from first to last covers once its indexes are limited to [0, n),
+// with the number of window indexes that land on it. The edges take up any
+// part of the window beyond them, so this costs at most n calls however wide
+// the window is.
+func clampedWindow(first, last, n int, add func(i, count int)) {
+	if n == 1 {
+		add(0, last-first+1)
+		return
+	}
+	if count := min(last, 0) - first + 1; count > 0 {
+		add(0, count)
+	}
+	for i := max(first, 1); i <= min(last, n-2); i++ {
+		add(i, 1)
+	}
+	if count := last - max(first, n-1) + 1; count > 0 {
+		add(n-1, count)
+	}
+}
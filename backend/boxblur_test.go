@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func TestBoxRadiiForGaussian(t *testing.T) {
+	// Worked by hand from Kovesi's formulas: the ideal width
+	// sqrt(12σ²/n + 1) rounded down to an odd wl, and
+	// m = round((12σ² - n·wl² - 4n·wl - 3n) / (-4wl - 4)) boxes of width wl
+	// followed by n - m boxes of width wl + 2
+	tests := []struct {
+		sigma float64
+		n     int
+		want  []int
+	}{
+		{0, 3, []int{0, 0, 0}},       // ideal 1, m = 3
+		{1, 3, []int{0, 0, 1}},       // ideal 2.24, wl 1, m = round(1.5) = 2
+		{2, 3, []int{1, 1, 2}},       // ideal 4.12, wl 3, m = round(1.5) = 2
+		{3.5, 3, []int{3, 3, 3}},     // ideal 7.07, wl 7, m = round(2.91) = 3
+		{8, 3, []int{7, 7, 8}},       // ideal 16.03, wl 15, m = round(1.5) = 2
+		{20, 3, []int{19, 19, 20}},   // ideal 40.01, wl 39, m = round(1.5) = 2
+		{6, 5, []int{4, 4, 4, 4, 5}}, // ideal 9.35, wl 9, m = round(4.2) = 4
+	}
+	for _, tt := range tests {
+		if got := boxRadiiForGaussian(tt.sigma, tt.n); !slices.Equal(got, tt.want) {
+			t.Errorf("boxRadiiForGaussian(%v, %d) = %v, want %v", tt.sigma, tt.n, got, tt.want)
+		}
+	}
+
+	// The variance of the boxes, the sum of (w² - 1) / 12, stays within one
+	// step of a box width of σ²
+	for sigma := 0.5; sigma <= 60; sigma += 0.25 {
+		radii := boxRadiiForGaussian(sigma, iteratedBoxPasses)
+		variance := 0.0
+		for i, r := range radii {
+			w := float64(2*r + 1)
+			variance += (w*w - 1) / 12
+			if i > 0 && (r < radii[i-1] || r > radii[0]+1) {
+				t.Fatalf("σ %v: radii %v are not within one of each other", sigma, radii)
+			}
+		}
+		w := float64(2*radii[0] + 1)
+		if step := ((w+2)*(w+2) - w*w) / 12; math.Abs(variance-sigma*sigma) > step {
+			t.Errorf("σ %v: radii %v have variance %.2f, want %.2f", sigma, radii, variance, sigma*sigma)
+		}
+	}
+}
+
+// blurTestImage returns an opaque image with sharp edges, a gradient and noise
+func blurTestImage() *image.NRGBA {
+	rng := rand.New(rand.NewSource(3))
+	img := image.NewNRGBA(image.Rect(0, 0, 97, 71))
+	for y := 0; y < 71; y++ {
+		for x := 0; x < 97; x++ {
+			c := color.NRGBA{uint8(x * 255 / 96), uint8(y * 255 / 70), uint8(rng.Intn(256)), 255}
+			if (x/12+y/12)%2 == 0 {
+				c.R, c.G = 255-c.R, 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// maxChannelDifference returns the largest difference between a channel of a
+// and the same channel of b, over the pixels at least margin from the edges
+func maxChannelDifference(t *testing.T, a, b image.Image, margin int) int {
+	t.Helper()
+	pa, ra := pixels(t, a)
+	pb, rb := pixels(t, b)
+	if ra != rb {
+		t.Fatalf("bounds %v and %v", ra, rb)
+	}
+	diff := 0
+	for y := margin; y < ra.Dy()-margin; y++ {
+		for x := margin; x < ra.Dx()-margin; x++ {
+			for c := 0; c < 4; c++ {
+				i := (y*ra.Dx()+x)*4 + c
+				diff = max(diff, int(pa[i])-int(pb[i]), int(pb[i])-int(pa[i]))
+			}
+		}
+	}
+	return diff
+}
+
+// iteratedBoxBlurReference blurs an opaque img with boxes of the given radii
+// one after the other in floating point, repeating the edge pixels of every
+// intermediate image
+func iteratedBoxBlurReference(img *image.NRGBA, radii []int) *image.RGBA {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	values := make([]float64, len(img.Pix))
+	for i, v := range img.Pix {
+		values[i] = float64(v)
+	}
+	// boxPass averages along x when step is 4 and along y otherwise
+	boxPass := func(radius, n, step, lines, lineStep int) {
+		next := make([]float64, len(values))
+		for line := 0; line < lines; line++ {
+			for i := 0; i < n; i++ {
+				for c := 0; c < 4; c++ {
+					sum := 0.0
+					for k := i - radius; k <= i+radius; k++ {
+						sum += values[line*lineStep+clampIndex(k, n)*step+c]
+					}
+					next[line*lineStep+i*step+c] = sum / float64(2*radius+1)
+				}
+			}
+		}
+		values = next
+	}
+	for _, radius := range radii {
+		boxPass(radius, width, 4, height, width*4)
+		boxPass(radius, height, width*4, width, 4)
+	}
+	blurred := image.NewRGBA(img.Rect)
+	for i, v := range values {
+		blurred.Pix[i] = uint8(math.Round(v))
+	}
+	return blurred
+}
+
+func TestIteratedBoxBlurApproximatesGaussian(t *testing.T) {
+	img := blurTestImage()
+	for _, sigma := range []float64{2, 3.3, 5, 8} {
+		t.Run(fmt.Sprint(sigma), func(t *testing.T) {
+			ctx := context.Background()
+			approx, err := ApplyIteratedBoxBlur(ctx, img, sigma)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exact, err := ApplyGaussianBlur(ctx, img, sigma, GaussianBlurOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Away from the edges, which every box pass repeats again, the
+			// boxes follow the Gaussian kernel closely
+			if diff := maxChannelDifference(t, approx, exact, int(3*sigma)); diff > 8 {
+				t.Errorf("channels differ by up to %d levels from the Gaussian kernel", diff)
+			}
+			reference := iteratedBoxBlurReference(img, boxRadiiForGaussian(sigma, iteratedBoxPasses))
+			if diff := maxChannelDifference(t, approx, reference, 0); diff > 1 {
+				t.Errorf("channels differ by up to %d levels from the box blurs in floating point", diff)
+			}
+
+			// The default blur hands large radii to the approximation
+			viaOptions, err := ApplyGaussianBlur(ctx, img, sigma, GaussianBlurOptions{BoxRadius: DefaultGaussianBoxRadius})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := exact
+			if sigma >= DefaultGaussianBoxRadius {
+				want = approx
+			}
+			if diff := maxChannelDifference(t, viaOptions, want, 0); diff != 0 {
+				t.Errorf("BoxRadius %v: differs from the expected blur by %d levels", float64(DefaultGaussianBoxRadius), diff)
+			}
+		})
+	}
+}
+
+func TestIteratedBoxBlurEdges(t *testing.T) {
+	ctx := context.Background()
+
+	// Edges repeat the edge pixels, so a solid image keeps its colour up to
+	// the border however wide the boxes are
+	solid := image.NewNRGBA(image.Rect(3, 4, 23, 14))
+	for i := 0; i < len(solid.Pix); i += 4 {
+		copy(solid.Pix[i:], []uint8{40, 90, 200, 255})
+	}
+	for _, sigma := range []float64{0, 1, 8, 40} {
+		got, err := ApplyIteratedBoxBlur(ctx, solid, sigma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bounds() != solid.Bounds() {
+			t.Fatalf("bounds %v, want %v", got.Bounds(), solid.Bounds())
+		}
+		blurred := got.(*image.RGBA)
+		for y := blurred.Rect.Min.Y; y < blurred.Rect.Max.Y; y++ {
+			for x := blurred.Rect.Min.X; x < blurred.Rect.Max.X; x++ {
+				if c := blurred.RGBAAt(x, y); c != (color.RGBA{40, 90, 200, 255}) {
+					t.Fatalf("σ %v: pixel %d,%d is %v", sigma, x, y, c)
+				}
+			}
+		}
+	}
+
+	// A black column next to a white one: each pixel leans towards its own
+	// side, and the two halves mirror each other
+	step := image.NewGray(image.Rect(0, 0, 2, 3))
+	step.SetGray(1, 0, color.Gray{255})
+	step.SetGray(1, 1, color.Gray{255})
+	step.SetGray(1, 2, color.Gray{255})
+	got, err := ApplyIteratedBoxBlur(ctx, step, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 3; y++ {
+		left, right := got.(*image.RGBA).RGBAAt(0, y), got.(*image.RGBA).RGBAAt(1, y)
+		if left.R >= right.R || int(left.R)+int(right.R) != 255 {
+			t.Errorf("row %d: %d and %d", y, left.R, right.R)
+		}
+	}
+
+	if _, err := ApplyIteratedBoxBlur(ctx, image.NewRGBA(image.Rect(0, 0, 0, 5)), 4); err != nil {
+		t.Errorf("empty image: %v", err)
+	}
+	for _, sigma := range []float64{-1, math.NaN(), MaxBlurRadius + 1} {
+		if _, err := ApplyIteratedBoxBlur(ctx, solid, sigma); !errors.Is(err, ErrInvalidRadius) {
+			t.Errorf("σ %v returned %v, want ErrInvalidRadius", sigma, err)
+		}
+	}
+}
+
+func TestIteratedBoxBlurCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got, err := ApplyIteratedBoxBlur(ctx, blurTestImage(), 8); !errors.Is(err, context.Canceled) || got != nil {
+		t.Errorf("returned %T, %v, want context.Canceled", got, err)
+	}
+	if _, err := ApplyGaussianBlur(ctx, blurTestImage(), 8, GaussianBlurOptions{BoxRadius: DefaultGaussianBoxRadius}); !errors.Is(err, context.Canceled) {
+		t.Errorf("approximated Gaussian blur returned %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression before encryption
+//
+// Ciphertext does not compress, so images in uncompressed formats (BMP, TIFF,
+// raw bitmaps) can only be made smaller before they are sealed. A compressed
+// version 3 container has a compression header field (0x0a) holding the codec
+// byte, and its payload holds the compressed image; padding, if any, is
+// applied to the compressed data (see padding.go).
+//
+// Codecs:
+//
+//	1 flate  DEFLATE (RFC 1951) from the standard library
+//	2 zstd   Zstandard (RFC 8878)
+//
+// The field is critical, so older readers refuse compressed containers
+// instead of returning compressed bytes as the image.
+//
+// Decompression is bounded: once more than decompressionAllowance bytes have
+// been produced, the output may not exceed MaxDecompressionRatio times the
+// compressed input read so far, which stops small crafted payloads from
+// expanding into gigabytes.
+
+// CompressionCodec identifies the compression applied before encryption
+type CompressionCodec byte
+
+const (
+	// CompressionNone leaves the image uncompressed
+	CompressionNone CompressionCodec = 0
+
+	// CompressionFlate compresses with DEFLATE
+	CompressionFlate CompressionCodec = 1
+
+	// CompressionZstd compresses with Zstandard
+	CompressionZstd CompressionCodec = 2
+
+	// DefaultMaxDecompressionRatio bounds how much larger decompressed data
+	// may be than its compressed form
+	DefaultMaxDecompressionRatio = 1024
+
+	// decompressionAllowance is how much output is allowed before the ratio
+	// is enforced, so that small, highly compressible images decode (64 MiB)
+	decompressionAllowance = 64 * 1024 * 1024
+
+	// maxZstdWindow bounds the window, and so the memory, a zstd frame may ask for
+	maxZstdWindow = 8 * 1024 * 1024
+)
+
+// ErrDecompressionLimit is returned when compressed data expands beyond the
+// allowed ratio
+var ErrDecompressionLimit = errors.New("decompressed data exceeds the allowed compression ratio")
+
+// String returns the name of the codec as accepted by ParseCompressionCodec
+func (c CompressionCodec) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("compression(%d)", byte(c))
+	}
+}
+
+// ParseCompressionCodec converts a codec name into a CompressionCodec. An
+// empty name selects no compression.
+func ParseCompressionCodec(name string) (CompressionCodec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return CompressionNone, nil
+	case "flate", "deflate":
+		return CompressionFlate, nil
+	case "zstd", "zstandard":
+		return CompressionZstd, nil
+	default:
+		return 0, fmt.Errorf("unsupported compression %q", name)
+	}
+}
+
+// negotiateCompression picks the codec for an upload from a client's
+// comma-separated list of codecs in order of preference: the first one this
+// server supports wins, and unknown names are skipped so clients can list
+// codecs of newer servers first. "auto" selects zstd unless head, the start
+// of the upload, shows a format that is already compressed.
+func negotiateCompression(preferences string, head []byte) (CompressionCodec, error) {
+	if strings.TrimSpace(preferences) == "" {
+		return CompressionNone, nil
+	}
+	for _, name := range strings.Split(preferences, ",") {
+		if strings.EqualFold(strings.TrimSpace(name), "auto") {
+			if isCompressedFormat(head) {
+				return CompressionNone, nil
+			}
+			return CompressionZstd, nil
+		}
+		if codec, err := ParseCompressionCodec(name); err == nil {
+			return codec, nil
+		}
+	}
+	return 0, fmt.Errorf("none of the compression codecs %q is supported (use flate, zstd, auto or none)", preferences)
+}
+
+// isCompressedFormat reports whether data starts like a file format that is
+// already compressed, which would gain nothing from another pass
+func isCompressedFormat(head []byte) bool {
+	contentType := http.DetectContentType(head)
+	switch {
+	case contentType == "image/jpeg", contentType == "image/gif", contentType == "image/webp",
+		contentType == "application/zip", contentType == "application/x-gzip",
+		strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"):
+		return true
+	}
+	return isContainer(head) || isAge(head) || isOpenSSL(head)
+}
+
+// compressedSource returns a reader over src compressed with codec. The
+// compressor runs in its own goroutine; stop must be called once the reader
+// is no longer needed, and returns when the goroutine has stopped reading src.
+func compressedSource(src io.Reader, codec CompressionCodec) (compressed io.Reader, stop func(), err error) {
+	pr, pw := io.Pipe()
+
+	var compressor io.WriteCloser
+	switch codec {
+	case CompressionFlate:
+		compressor, err = flate.NewWriter(pw, flate.DefaultCompression)
+	case CompressionZstd:
+		compressor, err = zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(maxZstdWindow))
+	default:
+		err = fmt.Errorf("unsupported compression %s", codec)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(compressor, src)
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, func() {
+		pr.Close()
+		<-done
+	}, nil
+}
+
+// decompressReader decompresses what it reads from src, enforcing the ratio
+// limit. Close releases the decoder.
+type decompressReader struct {
+	src      *countingReader
+	input    *bufio.Reader
+	r        io.Reader
+	closer   func()
+	maxRatio int64
+	out      int64
+}
+
+// newDecompressReader returns a reader that decompresses src with codec. A
+// maxRatio of zero selects DefaultMaxDecompressionRatio.
+func newDecompressReader(src io.Reader, codec CompressionCodec, maxRatio int) (*decompressReader, error) {
+	if maxRatio <= 0 {
+		maxRatio = DefaultMaxDecompressionRatio
+	}
+	d := &decompressReader{src: &countingReader{r: src}, maxRatio: int64(maxRatio)}
+
+	// Both decoders would otherwise wrap the input in a buffered reader of
+	// their own; doing it here keeps the count of compressed bytes close
+	d.input = bufio.NewReader(d.src)
+	switch codec {
+	case CompressionFlate:
+		fr := flate.NewReader(d.input)
+		d.r, d.closer = fr, func() { fr.Close() }
+	case CompressionZstd:
+		zr, err := zstd.NewReader(d.input, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, err
+		}
+		d.r, d.closer = zr, zr.Close
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression %s", ErrMalformedHeader, codec)
+	}
+	return d, nil
+}
+
+// Read returns decompressed data, failing once it outgrows the ratio limit
+func (d *decompressReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.out += int64(n)
+	if d.out > decompressionAllowance && d.out/d.maxRatio > d.src.n {
+		return 0, fmt.Errorf("%w (%d bytes from %d, limit %d:1)", ErrDecompressionLimit, d.out, d.src.n, d.maxRatio)
+	}
+	switch err {
+	case io.ErrUnexpectedEOF:
+		err = fmt.Errorf("%w: compressed data ends early", ErrStreamTruncated)
+	case io.EOF:
+		// The payload has to be read to its end, where the final segment
+		// is authenticated, and must hold nothing after the compressed data
+		if trailing, copyErr := io.Copy(io.Discard, d.input); copyErr != nil {
+			err = copyErr
+		} else if trailing > 0 {
+			err = fmt.Errorf("%w: %d bytes after the compressed data", ErrMalformedHeader, trailing)
+		}
+	}
+	return n, err
+}
+
+// Close releases the decoder
+func (d *decompressReader) Close() {
+	d.closer()
+}
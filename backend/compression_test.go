@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressBytes compresses data with codec the way the encrypter does
+func compressBytes(t *testing.T, codec CompressionCodec, src io.Reader) []byte {
+	t.Helper()
+	compressed, stop, err := compressedSource(src, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	data, err := io.ReadAll(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// decompressBytes decompresses data and returns the output and how many bytes were produced
+func decompressBytes(data []byte, codec CompressionCodec, maxRatio int) (int64, error) {
+	d, err := newDecompressReader(bytes.NewReader(data), codec, maxRatio)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+	return io.Copy(io.Discard, d)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	// Half random, half repetitive, like an uncompressed bitmap with a flat background
+	plaintext := make([]byte, 4*DefaultSegmentSize+123)
+	rand.Read(plaintext[:len(plaintext)/2])
+	password := []byte("compression password")
+
+	for _, codec := range []CompressionCodec{CompressionFlate, CompressionZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			compressed := compressBytes(t, codec, bytes.NewReader(plaintext))
+			if len(compressed) >= len(plaintext) {
+				t.Errorf("compressed %d bytes into %d", len(plaintext), len(compressed))
+			}
+			d, err := newDecompressReader(bytes.NewReader(compressed), codec, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(d)
+			d.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Error("decompression changed the data")
+			}
+
+			uncompressed, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF})
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF, Compression: codec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encrypted) >= len(uncompressed) {
+				t.Errorf("compressed container is %d bytes, uncompressed %d", len(encrypted), len(uncompressed))
+			}
+			decrypted, header, err := DecryptDataWithOptions(encrypted, DecryptOptions{Password: password})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Compression != codec {
+				t.Errorf("header records %s", header.Compression)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Error("decrypted data differs from the original")
+			}
+		})
+	}
+}
+
+func TestDecompressionBomb(t *testing.T) {
+	const size = 2 * decompressionAllowance
+	tests := []struct {
+		codec    CompressionCodec
+		maxRatio int
+	}{
+		// Zstandard shrinks zeros far beyond the default ratio, DEFLATE
+		// only to about 1:1000, so it is checked against a lower limit
+		{CompressionZstd, 0},
+		{CompressionFlate, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec.String(), func(t *testing.T) {
+			bomb := compressBytes(t, tt.codec, io.LimitReader(zeroReader{}, size))
+			produced, err := decompressBytes(bomb, tt.codec, tt.maxRatio)
+			if !errors.Is(err, ErrDecompressionLimit) {
+				t.Fatalf("got %v after %d bytes, want ErrDecompressionLimit", err, produced)
+			}
+			if produced > decompressionAllowance+1<<20 {
+				t.Errorf("%d bytes produced before stopping", produced)
+			}
+
+			// Below the allowance the ratio is not enforced
+			small := compressBytes(t, tt.codec, io.LimitReader(zeroReader{}, 1<<20))
+			if n, err := decompressBytes(small, tt.codec, tt.maxRatio); err != nil || n != 1<<20 {
+				t.Errorf("small image: %d bytes, %v", n, err)
+			}
+		})
+	}
+
+	t.Run("container", func(t *testing.T) {
+		password := []byte("bomb password")
+		var encrypted bytes.Buffer
+		if err := EncryptStream(&encrypted, io.LimitReader(zeroReader{}, size), password, EncryptOptions{KDF: testKDF, Compression: CompressionZstd}); err != nil {
+			t.Fatal(err)
+		}
+		out := &countingWriter{w: io.Discard}
+		_, err := DecryptStreamWithOptions(out, &encrypted, DecryptOptions{Password: password})
+		if !errors.Is(err, ErrDecompressionLimit) {
+			t.Fatalf("got %v, want ErrDecompressionLimit", err)
+		}
+		if out.n > decompressionAllowance+1<<20 {
+			t.Errorf("%d bytes written before stopping", out.n)
+		}
+	})
+}
+
+func TestDecompressionRejectsDamagedData(t *testing.T) {
+	plaintext := make([]byte, 256*1024)
+	rand.Read(plaintext)
+	for _, codec := range []CompressionCodec{CompressionFlate, CompressionZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			compressed := compressBytes(t, codec, bytes.NewReader(plaintext))
+			if _, err := decompressBytes(compressed[:len(compressed)/2], codec, 0); err == nil {
+				t.Error("truncated data decompressed")
+			}
+			// zstd reads trailing data as another frame, flate leaves it to the reader
+			if _, err := decompressBytes(append(bytes.Clone(compressed), "trailing"...), codec, 0); err == nil {
+				t.Error("data after the compressed stream was accepted")
+			}
+		})
+	}
+	if _, err := newDecompressReader(bytes.NewReader(nil), CompressionCodec(9), 0); !errors.Is(err, ErrMalformedHeader) {
+		t.Errorf("unknown codec returned %v, want ErrMalformedHeader", err)
+	}
+}
+
+func TestZstdWindowLimit(t *testing.T) {
+	// A frame asking for a larger window than the decoder allows is refused
+	// before the window is allocated
+	var frame bytes.Buffer
+	w, err := zstd.NewWriter(&frame, zstd.WithWindowSize(4*maxZstdWindow), zstd.WithEncoderConcurrency(1), zstd.WithSingleSegment(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 6*maxZstdWindow)
+	rand.Read(data[:maxZstdWindow])
+	copy(data[5*maxZstdWindow:], data[:maxZstdWindow])
+	w.Write(data)
+	w.Close()
+	if _, err := decompressBytes(frame.Bytes(), CompressionZstd, 0); err == nil {
+		t.Error("frame with an oversized window decompressed")
+	}
+}
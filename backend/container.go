@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encrypted container format
+//
+// Everything EncryptData produces starts with a self-describing header. All
+// integers are big-endian.
+//
+//	magic      4 bytes   "SIMG"
+//	version    1 byte    container format version (currently 3)
+//	headerLen  4 bytes   length of the header fields that follow
+//	fields     headerLen bytes, each encoded as type(1) | length(2) | value
+//	payload    the rest of the data
+//
+// Version 1 payloads are a single AEAD ciphertext sealed with the nonce field.
+// Version 2 and 3 payloads are a sequence of independently sealed segments
+// (see stream.go), and the nonce field holds the per-file nonce prefix.
+// Version 3 containers always use envelope encryption (see envelope.go).
+//
+// Header field types:
+//
+//	0x01 cipher suite   1 byte suite identifier (see CipherSuite)
+//	0x02 KDF            algorithm(1) | time(4) | memory(4) | parallelism(1) | saltLen(1) | salt
+//	0x03 nonce          AEAD nonce (version 1) or nonce prefix (version 2)
+//	0x04 metadata       opaque application metadata, authenticated but not encrypted
+//	0x05 segment size   4 byte plaintext segment size (version 2, required)
+//	0x06 recipients     sequence of stanzas, each type(1) | length(2) | body
+//	0x07 header MAC     HMAC-SHA256 of the header without this field (version 3, required)
+//	0x08 signer         Ed25519 public key of the sender (version 3, see signing.go)
+//	0x09 padding        policy(1) | bucket size(8); the payload is padded (version 3, see padding.go)
+//	0x0a compression    codec(1); the payload is compressed (version 3, see compression.go)
+//	0x0b policy         policy ID(16) | not before(8) | not after(8) | max decrypts(4) (version 3, see policy.go)
+//	0x80 image metadata sealed record of filename, type, size and history (version 3, see metadata.go)
+//
+// Version 1 and 2 containers carry either a KDF field (the payload key is
+// derived from a password) or a recipients field (the payload key is a random
+// file key wrapped for each recipient, see recipients.go). Version 3
+// containers carry a recipients field and a header MAC, and no KDF field.
+//
+// Recipient stanza types:
+//
+//	0x01 X25519         ephemeral public key(32) | wrapped file key(48)
+//	0x02 password       KDF parameters (as in field 0x02) | wrapped file key(48)
+//	0x03 X25519         recipient fingerprint(8) | ephemeral public key(32) | wrapped file key(48)
+//	0x04 key provider   provider name and key ID, each length(1) | value, then the wrapped file key
+//	0x05 key shares     threshold(1) | count(1) | set ID(8) | share commitments (see shamir.go)
+//
+// Field types below 0x80 are critical: a reader that does not understand one
+// must refuse the container. Types 0x80 and above may be skipped.
+//
+// In versions 1 and 2 the complete header, from the magic up to the last
+// field, is passed to the AEAD as additional data, so any change to it makes
+// decryption fail. Version 3 leaves the recipients and header MAC fields out of
+// the additional data so that recipients can be changed without re-encrypting
+// the payload; the header MAC protects them instead.
+
+const (
+	// ContainerVersion is the container format version written by this server
+	ContainerVersion = byte(3)
+
+	// containerVersionSingleShot is the original version with a single AEAD payload
+	containerVersionSingleShot = byte(1)
+
+	// containerVersionStream is the streaming version that authenticates the full header
+	containerVersionStream = byte(2)
+
+	// containerPrefixSize is the size of magic, version and header length
+	containerPrefixSize = 4 + 1 + 4
+
+	// maxHeaderSize bounds the header length accepted from untrusted data
+	maxHeaderSize = 1 << 20
+
+	// maxPasswordStanzas bounds the password stanzas of a header, since
+	// decrypting runs the KDF of each one until a password matches
+	maxPasswordStanzas = 4
+
+	fieldCipherSuite = byte(0x01)
+	fieldKDF         = byte(0x02)
+	fieldNonce       = byte(0x03)
+	fieldMetadata    = byte(0x04)
+	fieldSegmentSize = byte(0x05)
+	fieldRecipients  = byte(0x06)
+	fieldHeaderMAC   = byte(0x07)
+	fieldSigner      = byte(0x08)
+	fieldPadding     = byte(0x09)
+	fieldCompression = byte(0x0a)
+	fieldPolicy      = byte(0x0b)
+
+	fieldImageMetadata = byte(0x80)
+
+	stanzaX25519       = byte(0x01)
+	stanzaPassword     = byte(0x02)
+	stanzaX25519Hinted = byte(0x03)
+	stanzaKeyProvider  = byte(0x04)
+	stanzaKeyShares    = byte(0x05)
+
+	// fieldOptionalMin is the first field type readers may ignore
+	fieldOptionalMin = byte(0x80)
+)
+
+// containerMagic identifies data produced by EncryptData
+var containerMagic = []byte("SIMG")
+
+// CipherSuite identifies the AEAD used for the payload
+type CipherSuite byte
+
+const (
+	// SuiteAES256GCM is AES-256 in GCM mode with a 96-bit nonce
+	SuiteAES256GCM CipherSuite = 1
+
+	// SuiteChaCha20Poly1305 is ChaCha20-Poly1305 (RFC 8439) with a 96-bit nonce
+	SuiteChaCha20Poly1305 CipherSuite = 2
+
+	// SuiteXChaCha20Poly1305 is XChaCha20-Poly1305 with a 192-bit nonce. It is
+	// fast without AES hardware support and its nonce is large enough to be
+	// chosen at random for any number of messages.
+	SuiteXChaCha20Poly1305 CipherSuite = 3
+)
+
+var (
+	// ErrUnsupportedVersion is returned for containers written by a newer format version
+	ErrUnsupportedVersion = errors.New("unsupported container version")
+
+	// ErrUnsupportedCipherSuite is returned for containers using an unknown cipher suite
+	ErrUnsupportedCipherSuite = errors.New("unsupported cipher suite")
+
+	// ErrMalformedHeader is returned when the container header cannot be parsed
+	ErrMalformedHeader = errors.New("malformed container header")
+)
+
+// String returns a readable name for the cipher suite
+func (s CipherSuite) String() string {
+	switch s {
+	case SuiteAES256GCM:
+		return "AES-256-GCM"
+	case SuiteChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case SuiteXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	default:
+		return fmt.Sprintf("suite(%d)", byte(s))
+	}
+}
+
+// ParseCipherSuite converts a user-supplied cipher name into a CipherSuite.
+// An empty name selects AES-256-GCM.
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "aes", "aes-256-gcm", "aes256gcm":
+		return SuiteAES256GCM, nil
+	case "chacha20", "chacha20-poly1305", "chacha20poly1305":
+		return SuiteChaCha20Poly1305, nil
+	case "xchacha20", "xchacha20-poly1305", "xchacha20poly1305":
+		return SuiteXChaCha20Poly1305, nil
+	default:
+		return 0, fmt.Errorf("%w %q", ErrUnsupportedCipherSuite, name)
+	}
+}
+
+// RecipientStanza holds the file key wrapped for one recipient or password
+type RecipientStanza struct {
+	Type byte
+	Body []byte
+}
+
+// ContainerHeader is the parsed form of an encrypted container header
+type ContainerHeader struct {
+	Version     byte
+	Suite       CipherSuite
+	KDF         KDFParams
+	Recipients  []RecipientStanza
+	Nonce       []byte
+	SegmentSize uint32
+	Metadata    []byte
+	Signer      ed25519.PublicKey
+	MAC         []byte
+
+	// SealedMetadata is the encrypted image metadata record. ImageMetadata
+	// holds its contents once the container has been decrypted.
+	SealedMetadata []byte
+	ImageMetadata  *ImageMetadata
+
+	// Padding is the size-hiding padding applied to the plaintext, with
+	// PaddingBucket the bucket size of PaddingBucket
+	Padding       PaddingPolicy
+	PaddingBucket int64
+
+	// Compression is the codec the image was compressed with
+	Compression CompressionCodec
+
+	// Policy limits when and how often the server decrypts the image
+	Policy *DecryptPolicy
+}
+
+// isContainer reports whether data starts with the container magic
+func isContainer(data []byte) bool {
+	return bytes.HasPrefix(data, containerMagic)
+}
+
+// Marshal encodes the header. The result is both the prefix of the container
+// and the additional data authenticated by the AEAD.
+func (h *ContainerHeader) Marshal() ([]byte, error) {
+	var fields bytes.Buffer
+
+	if err := writeField(&fields, fieldCipherSuite, []byte{byte(h.Suite)}); err != nil {
+		return nil, err
+	}
+	if len(h.Recipients) > 0 {
+		var stanzas bytes.Buffer
+		for _, stanza := range h.Recipients {
+			if err := writeField(&stanzas, stanza.Type, stanza.Body); err != nil {
+				return nil, err
+			}
+		}
+		if err := writeField(&fields, fieldRecipients, stanzas.Bytes()); err != nil {
+			return nil, fmt.Errorf("too many recipients: %v", err)
+		}
+	} else if h.Version != ContainerVersion {
+		if err := writeField(&fields, fieldKDF, marshalKDFParams(h.KDF)); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeField(&fields, fieldNonce, h.Nonce); err != nil {
+		return nil, err
+	}
+	if h.SegmentSize != 0 {
+		var sizeBuf [4]byte
+		binary.BigEndian.PutUint32(sizeBuf[:], h.SegmentSize)
+		if err := writeField(&fields, fieldSegmentSize, sizeBuf[:]); err != nil {
+			return nil, err
+		}
+	}
+	if len(h.Metadata) > 0 {
+		if err := writeField(&fields, fieldMetadata, h.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	if len(h.Signer) > 0 {
+		if err := writeField(&fields, fieldSigner, h.Signer); err != nil {
+			return nil, err
+		}
+	}
+	if h.Padding != PaddingNone {
+		if err := writeField(&fields, fieldPadding, marshalPaddingField(h.Padding, h.PaddingBucket)); err != nil {
+			return nil, err
+		}
+	}
+	if h.Compression != CompressionNone {
+		if err := writeField(&fields, fieldCompression, []byte{byte(h.Compression)}); err != nil {
+			return nil, err
+		}
+	}
+	if h.Policy != nil {
+		if err := writeField(&fields, fieldPolicy, marshalPolicyField(h.Policy)); err != nil {
+			return nil, err
+		}
+	}
+	if len(h.SealedMetadata) > 0 {
+		if err := writeField(&fields, fieldImageMetadata, h.SealedMetadata); err != nil {
+			return nil, fmt.Errorf("image metadata too large: %v", err)
+		}
+	}
+	if len(h.MAC) > 0 {
+		if err := writeField(&fields, fieldHeaderMAC, h.MAC); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, containerPrefixSize, containerPrefixSize+fields.Len())
+	copy(out, containerMagic)
+	out[4] = h.Version
+	binary.BigEndian.PutUint32(out[5:9], uint32(fields.Len()))
+	return append(out, fields.Bytes()...), nil
+}
+
+// writeField appends one type | length | value field to buf
+func writeField(buf *bytes.Buffer, fieldType byte, value []byte) error {
+	if len(value) > 0xffff {
+		return fmt.Errorf("header field %#x too large (%d bytes)", fieldType, len(value))
+	}
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(value)))
+	buf.WriteByte(fieldType)
+	buf.Write(lenBuf[:])
+	buf.Write(value)
+	return nil
+}
+
+// ParseContainerHeader parses the header at the start of data and returns it
+// together with the number of header bytes, which is where the payload begins
+func ParseContainerHeader(data []byte) (*ContainerHeader, int, error) {
+	if !isContainer(data) {
+		return nil, 0, fmt.Errorf("%w: missing magic bytes", ErrMalformedHeader)
+	}
+	if len(data) < containerPrefixSize {
+		return nil, 0, fmt.Errorf("%w: truncated prefix", ErrMalformedHeader)
+	}
+
+	h := &ContainerHeader{Version: data[4]}
+	if h.Version < containerVersionSingleShot || h.Version > ContainerVersion {
+		return nil, 0, fmt.Errorf("%w %d (this server supports versions %d to %d)",
+			ErrUnsupportedVersion, h.Version, containerVersionSingleShot, ContainerVersion)
+	}
+
+	headerLen := binary.BigEndian.Uint32(data[5:9])
+	if headerLen > maxHeaderSize || uint64(len(data)) < uint64(containerPrefixSize)+uint64(headerLen) {
+		return nil, 0, fmt.Errorf("%w: header length %d exceeds data", ErrMalformedHeader, headerLen)
+	}
+	end := containerPrefixSize + int(headerLen)
+
+	seen := make(map[byte]bool)
+	for pos := containerPrefixSize; pos < end; {
+		if end-pos < 3 {
+			return nil, 0, fmt.Errorf("%w: truncated field", ErrMalformedHeader)
+		}
+		fieldType := data[pos]
+		fieldLen := int(binary.BigEndian.Uint16(data[pos+1 : pos+3]))
+		pos += 3
+		if end-pos < fieldLen {
+			return nil, 0, fmt.Errorf("%w: field %#x overruns header", ErrMalformedHeader, fieldType)
+		}
+		value := data[pos : pos+fieldLen]
+		pos += fieldLen
+
+		if seen[fieldType] {
+			return nil, 0, fmt.Errorf("%w: duplicate field %#x", ErrMalformedHeader, fieldType)
+		}
+		seen[fieldType] = true
+
+		switch fieldType {
+		case fieldCipherSuite:
+			if len(value) != 1 {
+				return nil, 0, fmt.Errorf("%w: bad cipher suite field", ErrMalformedHeader)
+			}
+			h.Suite = CipherSuite(value[0])
+		case fieldKDF:
+			params, n, err := unmarshalKDFParams(value)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: %v", ErrMalformedHeader, err)
+			}
+			if n != len(value) {
+				return nil, 0, fmt.Errorf("%w: trailing bytes in KDF field", ErrMalformedHeader)
+			}
+			h.KDF = params
+		case fieldNonce:
+			h.Nonce = append([]byte(nil), value...)
+		case fieldMetadata:
+			h.Metadata = append([]byte(nil), value...)
+		case fieldRecipients:
+			stanzas, err := parseStanzas(value)
+			if err != nil {
+				return nil, 0, err
+			}
+			h.Recipients = stanzas
+		case fieldHeaderMAC:
+			if len(value) != sha256.Size {
+				return nil, 0, fmt.Errorf("%w: bad header MAC field", ErrMalformedHeader)
+			}
+			h.MAC = append([]byte(nil), value...)
+		case fieldSigner:
+			if len(value) != ed25519.PublicKeySize {
+				return nil, 0, fmt.Errorf("%w: bad signer field", ErrMalformedHeader)
+			}
+			h.Signer = ed25519.PublicKey(append([]byte(nil), value...))
+		case fieldPadding:
+			if len(value) != paddingFieldSize || value[0] == byte(PaddingNone) {
+				return nil, 0, fmt.Errorf("%w: bad padding field", ErrMalformedHeader)
+			}
+			h.Padding = PaddingPolicy(value[0])
+			h.PaddingBucket = int64(binary.BigEndian.Uint64(value[1:]))
+		case fieldCompression:
+			if len(value) != 1 || value[0] == byte(CompressionNone) {
+				return nil, 0, fmt.Errorf("%w: bad compression field", ErrMalformedHeader)
+			}
+			h.Compression = CompressionCodec(value[0])
+		case fieldPolicy:
+			policy, err := unmarshalPolicyField(value)
+			if err != nil {
+				return nil, 0, err
+			}
+			h.Policy = policy
+		case fieldImageMetadata:
+			h.SealedMetadata = append([]byte(nil), value...)
+		case fieldSegmentSize:
+			if len(value) != 4 {
+				return nil, 0, fmt.Errorf("%w: bad segment size field", ErrMalformedHeader)
+			}
+			h.SegmentSize = binary.BigEndian.Uint32(value)
+			if h.SegmentSize == 0 || h.SegmentSize > maxSegmentSize {
+				return nil, 0, fmt.Errorf("%w: segment size %d out of range", ErrMalformedHeader, h.SegmentSize)
+			}
+		default:
+			if fieldType < fieldOptionalMin {
+				return nil, 0, fmt.Errorf("%w: unknown critical field %#x", ErrMalformedHeader, fieldType)
+			}
+		}
+	}
+
+	for _, required := range []byte{fieldCipherSuite, fieldNonce} {
+		if !seen[required] {
+			return nil, 0, fmt.Errorf("%w: missing field %#x", ErrMalformedHeader, required)
+		}
+	}
+	if h.Version == ContainerVersion {
+		if seen[fieldKDF] || !seen[fieldRecipients] || !seen[fieldHeaderMAC] {
+			return nil, 0, fmt.Errorf("%w: version %d requires recipients and a header MAC and no KDF",
+				ErrMalformedHeader, h.Version)
+		}
+	} else {
+		if seen[fieldKDF] == seen[fieldRecipients] {
+			return nil, 0, fmt.Errorf("%w: exactly one of KDF or recipients is required", ErrMalformedHeader)
+		}
+		if seen[fieldHeaderMAC] || seen[fieldSigner] || seen[fieldPadding] || seen[fieldCompression] || seen[fieldPolicy] {
+			return nil, 0, fmt.Errorf("%w: header MAC, signer, padding, compression and policy are not allowed in version %d",
+				ErrMalformedHeader, h.Version)
+		}
+	}
+	if h.Version != containerVersionSingleShot && !seen[fieldSegmentSize] {
+		return nil, 0, fmt.Errorf("%w: missing segment size", ErrMalformedHeader)
+	}
+
+	return h, end, nil
+}
+
+// filterHeaderFields returns a copy of a parsed header with the given field
+// types removed and the header length adjusted. The remaining fields keep their
+// original bytes and order, including optional fields this server ignores.
+func filterHeaderFields(headerBytes []byte, exclude ...byte) []byte {
+	out := make([]byte, containerPrefixSize, len(headerBytes))
+	copy(out, headerBytes[:containerPrefixSize])
+
+	for pos := containerPrefixSize; pos+3 <= len(headerBytes); {
+		fieldType := headerBytes[pos]
+		next := pos + 3 + int(binary.BigEndian.Uint16(headerBytes[pos+1:pos+3]))
+		if !bytes.Contains(exclude, []byte{fieldType}) {
+			out = append(out, headerBytes[pos:next]...)
+		}
+		pos = next
+	}
+
+	setHeaderLen(out)
+	return out
+}
+
+// setHeaderLen updates the header length of a raw header to match its fields
+func setHeaderLen(headerBytes []byte) {
+	binary.BigEndian.PutUint32(headerBytes[5:9], uint32(len(headerBytes)-containerPrefixSize))
+}
+
+// parseStanzas decodes the value of a recipients field
+func parseStanzas(value []byte) ([]RecipientStanza, error) {
+	var stanzas []RecipientStanza
+	passwords := 0
+	for pos := 0; pos < len(value); {
+		if len(value)-pos < 3 {
+			return nil, fmt.Errorf("%w: truncated recipient stanza", ErrMalformedHeader)
+		}
+		stanzaType := value[pos]
+		stanzaLen := int(binary.BigEndian.Uint16(value[pos+1 : pos+3]))
+		pos += 3
+		if len(value)-pos < stanzaLen {
+			return nil, fmt.Errorf("%w: recipient stanza overruns field", ErrMalformedHeader)
+		}
+		if stanzaType == stanzaPassword {
+			if passwords++; passwords > maxPasswordStanzas {
+				return nil, fmt.Errorf("%w: more than %d password stanzas", ErrMalformedHeader, maxPasswordStanzas)
+			}
+		}
+		stanzas = append(stanzas, RecipientStanza{
+			Type: stanzaType,
+			Body: append([]byte(nil), value[pos:pos+stanzaLen]...),
+		})
+		pos += stanzaLen
+	}
+	if len(stanzas) == 0 {
+		return nil, fmt.Errorf("%w: empty recipients field", ErrMalformedHeader)
+	}
+	return stanzas, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Headerless ciphertexts of legacyPlaintext under legacyPassword, made with
+// AES-256-GCM outside this code base
+var (
+	legacyPassword  = []byte("legacy password")
+	legacyPlaintext = []byte("image bytes from an old release")
+
+	// nonce || ciphertext, keyed with the SHA-256 of the password
+	legacyUnsalted = "6669786564206e6f6e63652141c6110e348272980d86be3df79ee73e83bb0794fbe272e8ff31dc27b86444e2519f80aae6fb81f0d42f4bcf7eca4c"
+
+	// kdfParams || nonce || ciphertext with PBKDF2-SHA256 at 10000 iterations
+	// and the salt "salt for legacy!", the parameters being the additional data
+	legacySalted = "030000271000000000001073616c7420666f72206c6567616379216f74686572206e6f6e6365211efb9d523043c30d1796420477442f663df0f41692788a7b2a559a40379e3a5a0605e4b4988a509dfb9e28b1c79395"
+)
+
+func TestDeriveLegacyKey(t *testing.T) {
+	want := "c72d01a2fd0dd72b3eb2ff6bf0724fe722e5777438ee9d84d93d6c5a14aa7bf0"
+	if got := hex.EncodeToString(deriveLegacyKey(legacyPassword)); got != want {
+		t.Errorf("deriveLegacyKey = %s, want %s", got, want)
+	}
+}
+
+func TestDecryptLegacyFixtures(t *testing.T) {
+	for name, fixture := range map[string]string{"unsalted": legacyUnsalted, "salted": legacySalted} {
+		t.Run(name, func(t *testing.T) {
+			data, err := hex.DecodeString(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := decryptLegacy(data, legacyPassword); err != nil || !bytes.Equal(got, legacyPlaintext) {
+				t.Errorf("decryptLegacy returned %q, %v", got, err)
+			}
+			if got, err := DecryptData(data, legacyPassword); err != nil || !bytes.Equal(got, legacyPlaintext) {
+				t.Errorf("DecryptData returned %q, %v", got, err)
+			}
+			if _, err := decryptLegacy(data, []byte("wrong password")); !errors.Is(err, ErrAuthenticationFailed) {
+				t.Errorf("wrong password returned %v, want ErrAuthenticationFailed", err)
+			}
+			data[len(data)-1] ^= 1
+			if _, err := decryptLegacy(data, legacyPassword); !errors.Is(err, ErrAuthenticationFailed) {
+				t.Errorf("changed ciphertext returned %v, want ErrAuthenticationFailed", err)
+			}
+		})
+	}
+}
+
+// testField encodes one header field
+func testField(fieldType byte, value []byte) []byte {
+	var buf bytes.Buffer
+	if err := writeField(&buf, fieldType, value); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// testContainer assembles magic, version, header length and fields
+func testContainer(version byte, fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	out := append([]byte("SIMG"), version, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[5:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestParseContainerHeader(t *testing.T) {
+	suite := testField(fieldCipherSuite, []byte{byte(SuiteAES256GCM)})
+	params := marshalKDFParams(KDFParams{Algorithm: KDFPBKDF2SHA256, Time: 10000, Salt: []byte("0123456789abcdef")})
+	kdf := testField(fieldKDF, params)
+	nonce := testField(fieldNonce, []byte("twelve bytes"))
+
+	data := testContainer(1, suite, kdf, nonce, testField(fieldMetadata, []byte("metadata")), testField(0x90, []byte("optional")))
+	header, end, err := ParseContainerHeader(append(data, "payload"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != len(data) || header.Version != 1 || header.Suite != SuiteAES256GCM || header.KDF.Time != 10000 ||
+		string(header.Nonce) != "twelve bytes" || string(header.Metadata) != "metadata" {
+		t.Errorf("parsed %+v ending at %d", header, end)
+	}
+
+	for _, version := range []byte{0, ContainerVersion + 1, 0xff} {
+		if _, _, err := ParseContainerHeader(testContainer(version, suite, kdf, nonce)); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("version %d returned %v, want ErrUnsupportedVersion", version, err)
+		}
+	}
+
+	tooLong := testContainer(1, suite, kdf, nonce)
+	binary.BigEndian.PutUint32(tooLong[5:], uint32(len(tooLong)))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no magic", append([]byte("SIMX"), data[4:]...)},
+		{"truncated prefix", data[:7]},
+		{"truncated header", data[:len(data)-1]},
+		{"header length beyond the data", tooLong},
+		{"truncated field", testContainer(1, suite, kdf, nonce, []byte{0x04, 0})},
+		{"field overruns header", testContainer(1, suite, kdf, nonce, []byte{0x04, 0, 9, 'x'})},
+		{"duplicate field", testContainer(1, suite, kdf, nonce, nonce)},
+		{"bad cipher suite field", testContainer(1, testField(fieldCipherSuite, []byte{1, 1}), kdf, nonce)},
+		{"trailing KDF bytes", testContainer(1, suite, testField(fieldKDF, append(bytes.Clone(params), 0)), nonce)},
+		{"missing nonce", testContainer(1, suite, kdf)},
+		{"unknown critical field", testContainer(1, suite, kdf, nonce, testField(0x7f, []byte("must understand")))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseContainerHeader(tt.data); !errors.Is(err, ErrMalformedHeader) {
+				t.Errorf("got %v, want ErrMalformedHeader", err)
+			}
+		})
+	}
+
+	// Decryption refuses a container with a field it does not understand
+	unknown := testContainer(1, suite, kdf, nonce, testField(0x7f, nil))
+	if _, err := DecryptData(append(unknown, make([]byte, 32)...), []byte("password")); !errors.Is(err, ErrMalformedHeader) ||
+		!strings.Contains(err.Error(), "critical") {
+		t.Errorf("unknown critical field returned %v", err)
+	}
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
 	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 const (
@@ -17,184 +19,300 @@ const (
 	AESKeySize = 32
 )
 
-// deriveKey derives a 32-byte key from a password for AES-256
-func deriveKey(password string) []byte {
-	// Use SHA-256 to derive a 32-byte key from the password
-	hasher := sha256.New()
-	hasher.Write([]byte(password))
-	key := hasher.Sum(nil)
-	fmt.Printf("Debug - Key derivation: password length=%d, derived key prefix=%x...\n",
-		len(password), key[:4]) // Log first 4 bytes of derived key for debugging
-	return key
+// ErrAuthenticationFailed is returned when a ciphertext does not authenticate,
+// which usually means the key is wrong
+var ErrAuthenticationFailed = errors.New("cipher: message authentication failed - incorrect key or corrupted data")
+
+// EncryptOptions controls how EncryptDataWithOptions encrypts data
+type EncryptOptions struct {
+	// Cipher selects the AEAD for the payload. Zero selects AES-256-GCM.
+	Cipher CipherSuite
+
+	// KDF selects the key derivation function and its cost parameters.
+	// A zero value selects Argon2id with the default costs and a random salt.
+	KDF KDFParams
+
+	// Recipients are X25519 public keys the image is encrypted to. The data
+	// key is wrapped for each of them and, if one is given, for the password.
+	Recipients []*ecdh.PublicKey
+
+	// KeyIDs are "provider:keyID" references to server-side keys that also
+	// wrap the data key (see keyprovider.go)
+	KeyIDs []string
+
+	// Metadata is stored in the container header. It is authenticated but
+	// not encrypted.
+	Metadata []byte
+
+	// ImageMetadata describes the original image. It is encrypted into the
+	// container header (see metadata.go).
+	ImageMetadata *ImageMetadata
+
+	// Compression compresses the image before it is encrypted (see
+	// compression.go)
+	Compression CompressionCodec
+
+	// Padding hides the image size by padding the plaintext (see padding.go).
+	// PaddingBucket is the bucket size for PaddingBucket; zero selects
+	// DefaultPaddingBucket.
+	Padding       PaddingPolicy
+	PaddingBucket int64
+
+	// Policy limits when and how often the server decrypts the image (see
+	// policy.go)
+	Policy *DecryptPolicy
+
+	// SigningKey, if set, signs the container as its sender (see signing.go)
+	SigningKey ed25519.PrivateKey
 }
 
-// EncryptData encrypts data using AES-256 in GCM mode
-func EncryptData(data []byte, password string) ([]byte, error) {
-	// Derive 32-byte key for AES-256
-	key := deriveKey(password)
+// DecryptOptions supplies the credentials used to decrypt a container
+type DecryptOptions struct {
+	// Password unlocks password stanzas, password-based containers and legacy data
+	Password []byte
 
-	// Create a new AES cipher block using the derived key
-	block, err := aes.NewCipher(key)
-	if err != nil {
+	// Identities are X25519 private keys tried against the recipient stanzas
+	Identities []*ecdh.PrivateKey
+
+	// KeyIDs are the server-side keys the caller wants to decrypt with
+	KeyIDs []string
+
+	// Shares are printed key shares, of which a quorum recovers a split key
+	Shares []string
+
+	// OpenSSL describes how salted "openssl enc" data was encrypted, which
+	// the data itself does not record (see openssl.go)
+	OpenSSL OpenSSLParams
+
+	// MaxDecompressionRatio bounds how far compressed images may expand.
+	// Zero selects DefaultMaxDecompressionRatio.
+	MaxDecompressionRatio int
+
+	// CountDecrypt counts this decryption against the decrypt limit of the
+	// image. Decrypt endpoints set it; rekeying and other internal reads
+	// only check that the limit has not been reached.
+	CountDecrypt bool
+
+	// TrustedSigners are the sender keys whose signatures are trusted
+	TrustedSigners []ed25519.PublicKey
+
+	// RequireSignature rejects images that are not signed, or, if
+	// TrustedSigners is set, not signed by one of them
+	RequireSignature bool
+
+	// dataKey is the DEK of a version 3 container that the caller has
+	// already unwrapped, used instead of the stanzas so that the KDF does
+	// not run twice. The caller owns and wipes it.
+	dataKey []byte
+}
+
+// EncryptData encrypts data using AES-256 in GCM mode under a random data
+// key, which is wrapped with a key derived from the password by Argon2id
+func EncryptData(data, password []byte) ([]byte, error) {
+	return EncryptDataWithOptions(data, password, EncryptOptions{})
+}
+
+// EncryptDataWithOptions encrypts data with the selected cipher suite and
+// returns it wrapped in the container format described in container.go
+func EncryptDataWithOptions(data, password []byte, opts EncryptOptions) ([]byte, error) {
+	var out bytes.Buffer
+	if err := EncryptStream(&out, bytes.NewReader(data), password, opts); err != nil {
 		return nil, err
 	}
+	return out.Bytes(), nil
+}
 
-	// GCM is a mode of operation for symmetric key cryptographic block ciphers
-	// It provides authenticated encryption
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+// payloadKey recovers the payload key of a version 1 or 2 container, which
+// is either derived from the password or wrapped for X25519 recipients
+func payloadKey(header *ContainerHeader, opts DecryptOptions) ([]byte, error) {
+	if len(header.Recipients) == 0 {
+		return deriveKey(opts.Password, header.KDF)
 	}
 
-	// Create a nonce (number used once)
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
-	if err != nil {
-		return nil, err
+	if len(opts.Identities) == 0 {
+		return nil, errors.New("this image is encrypted to public-key recipients; a private key is required")
 	}
 
-	// Encrypt and authenticate data
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	for _, stanza := range header.Recipients {
+		// Skip stanza types this server does not know, they may be meant for others
+		if stanza.Type != stanzaX25519 {
+			continue
+		}
+		for _, identity := range opts.Identities {
+			fileKey, err := unwrapFileKeyX25519(stanza.Body, identity)
+			if err == nil {
+				return fileKey, nil
+			}
+			if errors.Is(err, ErrMalformedHeader) {
+				return nil, err
+			}
+		}
+	}
+	return nil, ErrNoMatchingIdentity
 }
 
-// DecryptData decrypts data using AES-256 in GCM mode
-func DecryptData(encryptedData []byte, password string) ([]byte, error) {
-	// Check if we have data to decrypt
-	if len(encryptedData) == 0 {
-		return nil, errors.New("no data to decrypt")
+// resolveKDFParams fills in default costs and a random salt for any part of
+// params the caller left unset
+func resolveKDFParams(params KDFParams) (KDFParams, error) {
+	if params.Algorithm == 0 {
+		params.Algorithm = KDFArgon2id
+	}
+	if params.Time != 0 && len(params.Salt) != 0 {
+		return params, nil
+	}
+
+	defaults, err := DefaultKDFParams(params.Algorithm)
+	if err != nil {
+		return KDFParams{}, err
+	}
+	if params.Time == 0 {
+		params.Time, params.Memory, params.Parallelism = defaults.Time, defaults.Memory, defaults.Parallelism
 	}
+	if len(params.Salt) == 0 {
+		params.Salt = defaults.Salt
+	}
+	return params, nil
+}
 
-	// Add debug logging
-	fmt.Printf("DecryptData: Decrypting %d bytes with password of length %d\n",
-		len(encryptedData), len(password))
+// newAEAD creates the AEAD for a cipher suite
+func newAEAD(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case SuiteAES256GCM:
+		// Create a new AES cipher block using the derived key
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("cipher creation failed: %w", err)
+		}
 
-	// Derive 32-byte key for AES-256
-	key := deriveKey(password)
+		// GCM is a mode of operation for symmetric key cryptographic block ciphers
+		// It provides authenticated encryption
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("GCM mode initialization failed: %w", err)
+		}
+		return gcm, nil
+	case SuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedCipherSuite, byte(suite))
+	}
+}
+
+// DecryptData decrypts data produced by EncryptData, using the cipher suite
+// recorded in its header. Headerless data written by older releases is still
+// accepted.
+func DecryptData(encryptedData, password []byte) ([]byte, error) {
+	plaintext, _, err := DecryptDataWithHeader(encryptedData, password)
+	return plaintext, err
+}
 
-	// Create a new AES cipher block using the derived key
-	block, err := aes.NewCipher(key)
+// DecryptDataWithHeader decrypts data like DecryptData and also returns the
+// parsed container header. The header is nil for legacy headerless data.
+func DecryptDataWithHeader(encryptedData, password []byte) ([]byte, *ContainerHeader, error) {
+	return DecryptDataWithOptions(encryptedData, DecryptOptions{Password: password})
+}
+
+// DecryptDataWithOptions decrypts data with a password or private keys and
+// returns the plaintext together with the parsed container header. Nothing is
+// returned unless the whole payload and its signature check out.
+func DecryptDataWithOptions(encryptedData []byte, opts DecryptOptions) ([]byte, *ContainerHeader, error) {
+	var out bytes.Buffer
+	header, err := DecryptStreamWithOptions(&out, bytes.NewReader(encryptedData), opts)
 	if err != nil {
-		return nil, fmt.Errorf("cipher creation failed: %w", err)
+		// Wipe whatever was decrypted before the failure
+		wipe(out.Bytes())
+		return nil, nil, err
+	}
+	return out.Bytes(), header, nil
+}
+
+// decryptLegacy decrypts the headerless formats written before the container
+// format existed: kdfParams || nonce || ciphertext, and the original
+// nonce || ciphertext keyed with an unsalted SHA-256 of the password
+func decryptLegacy(encryptedData, password []byte) ([]byte, error) {
+	if params, headerLen, err := unmarshalKDFParams(encryptedData); err == nil {
+		if key, err := deriveKey(password, params); err == nil {
+			plaintext, err := decryptGCM(key, encryptedData[headerLen:], encryptedData[:headerLen])
+			wipe(key)
+			if err == nil {
+				return plaintext, nil
+			}
+		}
+		// The leading bytes of a legacy nonce can happen to look like KDF parameters
 	}
 
-	// GCM is a mode of operation for symmetric key cryptographic block ciphers
-	gcm, err := cipher.NewGCM(block)
+	key := deriveLegacyKey(password)
+	defer wipe(key)
+	return decryptGCM(key, encryptedData, nil)
+}
+
+// decryptGCM opens nonce || ciphertext with AES-256-GCM
+func decryptGCM(key, data, additionalData []byte) ([]byte, error) {
+	gcm, err := newAEAD(SuiteAES256GCM, key)
 	if err != nil {
-		return nil, fmt.Errorf("GCM mode initialization failed: %w", err)
+		return nil, err
 	}
 
 	// Extract the nonce from the encrypted data
 	nonceSize := gcm.NonceSize()
-	if len(encryptedData) < nonceSize {
+	if len(data) < nonceSize {
 		return nil, errors.New("encrypted data too short (missing nonce)")
 	}
 
-	nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
-	fmt.Printf("DecryptData: Using nonce of size %d, first bytes: %x\n",
-		nonceSize, nonce[:4])
-
-	// Try to detect base64-encoded data
-	if isLikelyBase64(string(encryptedData)) {
-		fmt.Println("DecryptData: Warning - input data appears to be base64 encoded. " +
-			"This may cause decryption to fail.")
-	}
+	return openAEAD(gcm, data[:nonceSize], data[nonceSize:], additionalData)
+}
 
+// openAEAD decrypts and verifies ciphertext, translating authentication
+// failures into a readable error
+func openAEAD(aead cipher.AEAD, nonce, ciphertext, additionalData []byte) ([]byte, error) {
 	// Decrypt and verify data
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		if strings.Contains(err.Error(), "message authentication failed") {
-			return nil, errors.New("decryption failed: cipher: message authentication failed - incorrect key or corrupted data")
+			return nil, fmt.Errorf("decryption failed: %w", ErrAuthenticationFailed)
 		}
 		return nil, fmt.Errorf("decryption failed: %w", err)
 	}
-
-	fmt.Printf("DecryptData: Successfully decrypted %d bytes\n", len(plaintext))
 	return plaintext, nil
 }
 
-// isLikelyBase64 checks if a string is likely base64 encoded
-func isLikelyBase64(s string) bool {
-	// Quick check: base64 strings should be mostly alphanumeric plus + and /
-	// And possibly have = padding at the end
-	if len(s) == 0 {
-		return false
-	}
-
-	// Count characters that are valid in base64
-	validChars := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/="
-	validCount := 0
-
-	for _, c := range s {
-		if strings.Contains(validChars, string(c)) {
-			validCount++
-		}
+// EncryptToBase64 encrypts data with a password using EncryptData and returns
+// the result as a base64 string. EncryptToArmor adds line wrapping, headers and
+// a checksum for text that is sent by email or chat.
+func EncryptToBase64(data, password []byte) (string, error) {
+	ciphertext, err := EncryptData(data, password)
+	if err != nil {
+		return "", err
 	}
 
-	// If more than 90% of characters are valid base64 chars, it's likely base64
-	return float64(validCount)/float64(len(s)) > 0.90
+	// Encode to base64
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-// EncryptToBase64 encrypts data using AES-GCM and returns it as a base64 string
-func EncryptToBase64(data []byte, key string) (string, error) {
-	// Create cipher block
-	block, err := aes.NewCipher([]byte(key))
+// EncryptToArmor encrypts data with a password using EncryptData and returns
+// the result as ASCII armored text (see armor.go)
+func EncryptToArmor(data, password []byte, headers map[string]string) (string, error) {
+	ciphertext, err := EncryptData(data, password)
 	if err != nil {
 		return "", err
 	}
 
-	// Create GCM mode
-	gcm, err := cipher.NewGCM(block)
+	armored, err := ArmorData(ciphertext, headers)
 	if err != nil {
 		return "", err
 	}
-
-	// Create nonce
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
-	}
-
-	// Encrypt data
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-
-	// Encode to base64
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return string(armored), nil
 }
 
-// DecryptFromBase64 decrypts a base64 encoded string using AES-256-GCM
-func DecryptFromBase64(encryptedBase64 string, key string) ([]byte, error) {
+// DecryptFromBase64 decrypts a base64 encoded string produced by EncryptToBase64
+func DecryptFromBase64(encryptedBase64 string, password []byte) ([]byte, error) {
 	// Decode the base64 string
 	ciphertext, err := base64.StdEncoding.DecodeString(encryptedBase64)
 	if err != nil {
 		return nil, fmt.Errorf("base64 decode failed: %w", err)
 	}
 
-	// Create cipher block
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return nil, fmt.Errorf("cipher creation failed: %w", err)
-	}
-
-	// Create GCM mode
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("GCM creation failed: %w", err)
-	}
-
-	// Get the nonce size
-	nonceSize := gcm.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
-
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-
-	// Decrypt and verify data
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("decryption failed: %w", err)
-	}
-
-	return plaintext, nil
+	return DecryptData(ciphertext, password)
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+var cipherSuites = []CipherSuite{SuiteAES256GCM, SuiteChaCha20Poly1305, SuiteXChaCha20Poly1305}
+
+func TestParseCipherSuite(t *testing.T) {
+	tests := []struct {
+		name string
+		want CipherSuite
+	}{
+		{"", SuiteAES256GCM},
+		{"AES-256-GCM", SuiteAES256GCM},
+		{"chacha20-poly1305", SuiteChaCha20Poly1305},
+		{" XChaCha20 ", SuiteXChaCha20Poly1305},
+	}
+	for _, tt := range tests {
+		if got, err := ParseCipherSuite(tt.name); err != nil || got != tt.want {
+			t.Errorf("ParseCipherSuite(%q) = %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+	for _, suite := range cipherSuites {
+		if got, err := ParseCipherSuite(suite.String()); err != nil || got != suite {
+			t.Errorf("%s does not parse back (%v)", suite, err)
+		}
+	}
+	if _, err := ParseCipherSuite("aes-128-cbc"); !errors.Is(err, ErrUnsupportedCipherSuite) {
+		t.Errorf("got %v, want ErrUnsupportedCipherSuite", err)
+	}
+}
+
+// suiteField returns the index of the cipher suite field value in a container header
+func suiteField(t *testing.T, container []byte, suite CipherSuite) int {
+	t.Helper()
+	i := bytes.Index(container, []byte{fieldCipherSuite, 0, 1, byte(suite)})
+	if i < 0 {
+		t.Fatalf("no %s field in the header", suite)
+	}
+	return i + 3
+}
+
+func TestCipherSuiteRoundTrip(t *testing.T) {
+	password := []byte("suite password")
+	plaintext := make([]byte, 2*DefaultSegmentSize+17)
+	rand.Read(plaintext)
+
+	for _, suite := range cipherSuites {
+		t.Run(suite.String(), func(t *testing.T) {
+			encrypted, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF, Cipher: suite})
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, end, err := ParseContainerHeader(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Suite != suite {
+				t.Errorf("header records %s", header.Suite)
+			}
+			// The stream nonce prefix leaves room for the segment counter
+			aead, err := newAEAD(suite, make([]byte, FileKeySize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(header.Nonce) != aead.NonceSize()-streamNonceSuffixSize {
+				t.Errorf("nonce prefix of %d bytes", len(header.Nonce))
+			}
+
+			// The suite is picked from the header, nothing has to be passed
+			decrypted, _, err := DecryptDataWithOptions(encrypted, DecryptOptions{Password: password})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Error("decrypted data differs from the original")
+			}
+
+			tampered := bytes.Clone(encrypted)
+			tampered[end+100] ^= 1
+			if _, _, err := DecryptDataWithOptions(tampered, DecryptOptions{Password: password}); !errors.Is(err, ErrAuthenticationFailed) {
+				t.Errorf("tampered payload returned %v, want ErrAuthenticationFailed", err)
+			}
+		})
+	}
+}
+
+func TestCipherSuiteSwapRejected(t *testing.T) {
+	password := []byte("suite password")
+	encrypted, err := EncryptDataWithOptions([]byte("image"), password, EncryptOptions{KDF: testKDF, Cipher: SuiteChaCha20Poly1305})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := suiteField(t, encrypted, SuiteChaCha20Poly1305)
+
+	// Another suite with the same nonce size fails the header MAC
+	swapped := bytes.Clone(encrypted)
+	swapped[i] = byte(SuiteAES256GCM)
+	if _, _, err := DecryptDataWithOptions(swapped, DecryptOptions{Password: password}); err == nil {
+		t.Error("container decrypted with a swapped cipher suite")
+	}
+
+	unknown := bytes.Clone(encrypted)
+	unknown[i] = 0x7f
+	if _, _, err := DecryptDataWithOptions(unknown, DecryptOptions{Password: password}); err == nil {
+		t.Error("container decrypted with an unknown cipher suite")
+	}
+	if _, err := newAEAD(CipherSuite(0x7f), make([]byte, FileKeySize)); !errors.Is(err, ErrUnsupportedCipherSuite) {
+		t.Errorf("newAEAD returned %v, want ErrUnsupportedCipherSuite", err)
+	}
+}
+
+func TestEncryptCipherFormField(t *testing.T) {
+	password := "form password"
+	plaintext := testPNG(t)
+	fields := map[string]string{"key": password, "kdf": "scrypt", "kdfTime": "10", "kdfMemory": "8", "kdfParallelism": "1"}
+
+	fields["cipher"] = "xchacha20-poly1305"
+	rec := postForm(t, handleEncrypt, "image.png", plaintext, fields)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("encrypt: status %d: %s", rec.Code, rec.Body)
+	}
+	header, _, err := ParseContainerHeader(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Suite != SuiteXChaCha20Poly1305 {
+		t.Errorf("header records %s", header.Suite)
+	}
+	rec = postForm(t, handleDecrypt, "image.png.enc", rec.Body.Bytes(), map[string]string{"key": password})
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), plaintext) {
+		t.Errorf("decrypt: status %d", rec.Code)
+	}
+
+	fields["cipher"] = "rot13"
+	if rec := postForm(t, handleEncrypt, "image.png", plaintext, fields); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown cipher: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Envelope encryption (container version 3)
+//
+// Every image is encrypted once under a random data-encryption key (DEK). The
+// DEK is then wrapped separately for each recipient, by password or public
+// key, and the wrapped copies are stored as stanzas in the recipients field.
+//
+// Two keys are derived from the DEK with HKDF-SHA256: the payload key used
+// for the segments, and a header MAC key. The segments authenticate the header
+// with the recipients and MAC fields left out, and the MAC field holds an
+// HMAC-SHA256 over the whole header except the MAC field itself. Recipients
+// can therefore be added or removed by anyone who can unwrap the DEK, by
+// rewriting the stanzas and the MAC, without touching the payload.
+
+const (
+	// payloadKeyInfo and headerMACInfo are the HKDF info strings for the keys derived from the DEK
+	payloadKeyInfo = "simg/payload/v1"
+	headerMACInfo  = "simg/header-mac/v1"
+
+	// fingerprintSize is the length of the recipient hint in X25519 stanzas
+	fingerprintSize = 8
+)
+
+// ErrHeaderAuthentication is returned when the header MAC does not verify
+var ErrHeaderAuthentication = errors.New("container header authentication failed")
+
+// envelopeKeys derives the payload key and header MAC key from a DEK
+func envelopeKeys(dek []byte) (payloadKey, macKey []byte, err error) {
+	payloadKey, err = hkdf.Key(sha256.New, dek, nil, payloadKeyInfo, FileKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err = hkdf.Key(sha256.New, dek, nil, headerMACInfo, sha256.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payloadKey, macKey, nil
+}
+
+// wrapDataKey wraps the DEK for the password (if any) and every recipient
+func wrapDataKey(dek, password []byte, opts EncryptOptions) ([]RecipientStanza, error) {
+	var stanzas []RecipientStanza
+
+	if len(password) > 0 {
+		params, err := resolveKDFParams(opts.KDF)
+		if err != nil {
+			return nil, err
+		}
+		stanza, err := wrapDataKeyPassword(dek, password, params)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	for _, recipient := range opts.Recipients {
+		stanza, err := wrapDataKeyX25519(dek, recipient)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	for _, ref := range opts.KeyIDs {
+		stanza, err := wrapDataKeyProvider(dek, ref)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	if len(stanzas) == 0 {
+		return nil, errors.New("a password, a key ID or at least one recipient is required")
+	}
+	return stanzas, nil
+}
+
+// wrapDataKeyPassword wraps the DEK under a key derived from a password.
+// The stanza body is the encoded KDF parameters followed by the wrapped DEK.
+func wrapDataKeyPassword(dek, password []byte, params KDFParams) (RecipientStanza, error) {
+	wrappingKey, err := deriveKey(password, params)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+	defer wipe(wrappingKey)
+
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	// The salt is random, so each wrapping key is only ever used once
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	body := aead.Seal(marshalKDFParams(params), nonce, dek, nil)
+	return RecipientStanza{Type: stanzaPassword, Body: body}, nil
+}
+
+// unwrapDataKeyPassword recovers the DEK from a password stanza
+func unwrapDataKeyPassword(body, password []byte) ([]byte, error) {
+	params, n, err := unmarshalKDFParams(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedHeader, err)
+	}
+	if len(body)-n != FileKeySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("%w: bad password stanza length", ErrMalformedHeader)
+	}
+
+	wrappingKey, err := deriveKey(password, params)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(wrappingKey)
+
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Open(nil, nonce, body[n:], nil)
+}
+
+// wrapDataKeyX25519 wraps the DEK for a public key. The stanza body is the
+// recipient fingerprint followed by an X25519 stanza (see recipients.go); the
+// fingerprint lets recipients be found and removed without their private key.
+func wrapDataKeyX25519(dek []byte, recipient *ecdh.PublicKey) (RecipientStanza, error) {
+	wrapped, err := wrapFileKeyX25519(dek, recipient)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	body := append(recipientFingerprint(recipient), wrapped...)
+	return RecipientStanza{Type: stanzaX25519Hinted, Body: body}, nil
+}
+
+// recipientFingerprint returns the hint stored in X25519 stanzas
+func recipientFingerprint(pub *ecdh.PublicKey) []byte {
+	sum := sha256.Sum256(pub.Bytes())
+	return sum[:fingerprintSize]
+}
+
+// unwrapDataKey tries the credentials in opts against every stanza and
+// returns the first DEK that unwraps, together with the index of its stanza
+func unwrapDataKey(stanzas []RecipientStanza, opts DecryptOptions) ([]byte, int, error) {
+	// Errors from key providers are kept, since "no match" would hide an
+	// unreachable or misconfigured provider
+	var providerErr error
+
+	for i, stanza := range stanzas {
+		var dek []byte
+		var err error
+
+		switch stanza.Type {
+		case stanzaPassword:
+			if len(opts.Password) == 0 {
+				continue
+			}
+			dek, err = unwrapDataKeyPassword(stanza.Body, opts.Password)
+		case stanzaX25519, stanzaX25519Hinted:
+			body := stanza.Body
+			if stanza.Type == stanzaX25519Hinted {
+				if len(body) < fingerprintSize {
+					return nil, 0, fmt.Errorf("%w: bad X25519 stanza length", ErrMalformedHeader)
+				}
+				body = body[fingerprintSize:]
+			}
+			for _, identity := range opts.Identities {
+				if stanza.Type == stanzaX25519Hinted &&
+					!bytes.Equal(stanza.Body[:fingerprintSize], recipientFingerprint(identity.PublicKey())) {
+					continue
+				}
+				if dek, err = unwrapFileKeyX25519(body, identity); err == nil {
+					break
+				}
+			}
+		case stanzaKeyProvider:
+			var ref string
+			var wrapped []byte
+			if ref, wrapped, err = parseKeyProviderStanza(stanza.Body); err != nil {
+				return nil, 0, err
+			}
+			if !slices.Contains(opts.KeyIDs, ref) {
+				continue
+			}
+			if dek, err = unwrapDataKeyProvider(ref, wrapped); err != nil {
+				providerErr = fmt.Errorf("key %s: %v", ref, err)
+			}
+		case stanzaKeyShares:
+			if len(opts.Shares) == 0 {
+				continue
+			}
+			// Bad shares are reported as such rather than as a missing key
+			if dek, err = unwrapDataKeyShares(stanza.Body, opts.Shares); errors.Is(err, ErrInvalidShare) {
+				return nil, 0, err
+			}
+		default:
+			// Skip stanza types this server does not know, they may be meant for others
+			continue
+		}
+
+		if errors.Is(err, ErrMalformedHeader) {
+			return nil, 0, err
+		}
+		if err == nil && dek != nil {
+			return dek, i, nil
+		}
+	}
+
+	if providerErr != nil {
+		return nil, 0, fmt.Errorf("%w (%v)", ErrNoMatchingIdentity, providerErr)
+	}
+	return nil, 0, ErrNoMatchingIdentity
+}
+
+// sealHeader marshals a version 3 header with its MAC
+func sealHeader(header *ContainerHeader, macKey []byte) ([]byte, error) {
+	header.MAC = nil
+	unsealed, err := header.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	header.MAC = headerMAC(unsealed, macKey)
+	return header.Marshal()
+}
+
+// resealHeader replaces the recipients and MAC fields of a raw version 3
+// header. All other fields keep their exact bytes, including optional fields
+// this server does not understand, so the payload still authenticates.
+func resealHeader(headerBytes []byte, stanzas []RecipientStanza, macKey []byte) ([]byte, error) {
+	out := bytes.NewBuffer(filterHeaderFields(headerBytes, fieldRecipients, fieldHeaderMAC))
+
+	var encoded bytes.Buffer
+	for _, stanza := range stanzas {
+		if err := writeField(&encoded, stanza.Type, stanza.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeField(out, fieldRecipients, encoded.Bytes()); err != nil {
+		return nil, fmt.Errorf("too many recipients: %v", err)
+	}
+	setHeaderLen(out.Bytes())
+
+	if err := writeField(out, fieldHeaderMAC, headerMAC(out.Bytes(), macKey)); err != nil {
+		return nil, err
+	}
+	setHeaderLen(out.Bytes())
+	return out.Bytes(), nil
+}
+
+// headerMAC computes the MAC of a header that has no MAC field
+func headerMAC(headerWithoutMAC, macKey []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(headerWithoutMAC)
+	return mac.Sum(nil)
+}
+
+// verifyHeaderMAC checks the MAC of a version 3 header
+func verifyHeaderMAC(header *ContainerHeader, headerBytes, macKey []byte) error {
+	expected := headerMAC(filterHeaderFields(headerBytes, fieldHeaderMAC), macKey)
+	if !hmac.Equal(expected, header.MAC) {
+		return ErrHeaderAuthentication
+	}
+	return nil
+}
+
+// payloadAD returns the additional data authenticated by every segment of a
+// version 3 container: the header without the recipients and MAC fields
+func payloadAD(headerBytes []byte) []byte {
+	return filterHeaderFields(headerBytes, fieldRecipients, fieldHeaderMAC)
+}
+
+// openEnvelope unwraps the DEK of a version 3 container, verifies the header
+// MAC and returns the payload key, which the caller wipes, and the segment
+// additional data. The image
+// metadata record, if any, is decrypted into header.ImageMetadata.
+func openEnvelope(header *ContainerHeader, headerBytes []byte, opts DecryptOptions) ([]byte, []byte, error) {
+	if opts.dataKey != nil {
+		return openEnvelopeWithDEK(header, headerBytes, opts.dataKey)
+	}
+	dek, _, err := unwrapDataKey(header.Recipients, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(dek)
+	return openEnvelopeWithDEK(header, headerBytes, dek)
+}
+
+// openEnvelopeWithDEK is openEnvelope for a DEK that has been unwrapped
+// already. The DEK is left to the caller to wipe.
+func openEnvelopeWithDEK(header *ContainerHeader, headerBytes []byte, dek []byte) ([]byte, []byte, error) {
+	payloadKey, macKey, err := envelopeKeys(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(macKey)
+	if err := verifyHeaderMAC(header, headerBytes, macKey); err != nil {
+		wipe(payloadKey)
+		return nil, nil, err
+	}
+	if len(header.SealedMetadata) > 0 {
+		if header.ImageMetadata, err = openImageMetadata(dek, header.Suite, header.SealedMetadata); err != nil {
+			wipe(payloadKey)
+			return nil, nil, err
+		}
+	}
+
+	return payloadKey, payloadAD(headerBytes), nil
+}
+
+// RewrapOptions describes how the recipients of a container change
+type RewrapOptions struct {
+	// AddPassword adds a password stanza using the KDF settings in KDF
+	AddPassword []byte
+	KDF         KDFParams
+
+	// AddRecipients adds an X25519 stanza for each public key
+	AddRecipients []*ecdh.PublicKey
+
+	// RemovePassword removes every password stanza this password unlocks
+	RemovePassword []byte
+
+	// RemoveRecipients removes the X25519 stanzas of these public keys
+	RemoveRecipients []*ecdh.PublicKey
+
+	// AddKeyIDs and RemoveKeyIDs add and remove key provider stanzas
+	AddKeyIDs    []string
+	RemoveKeyIDs []string
+}
+
+// RewrapStream copies a version 3 container from src to dst with a new set of
+// recipients. The DEK is unwrapped with unlock and the payload is copied
+// unchanged, so no plaintext is produced and the image is not re-encrypted.
+// A removed recipient that already knows the data key can still decrypt copies
+// it obtained before; only re-encrypting under a new data key revokes that.
+func RewrapStream(dst io.Writer, src io.Reader, unlock DecryptOptions, opts RewrapOptions) (*ContainerHeader, error) {
+	return rewrapStream(dst, bufio.NewReader(src), unlock, func(dek []byte, stanzas []RecipientStanza) ([]RecipientStanza, error) {
+		stanzas, err := removeStanzas(stanzas, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(opts.AddPassword) > 0 || len(opts.AddRecipients) > 0 || len(opts.AddKeyIDs) > 0 {
+			added, err := wrapDataKey(dek, opts.AddPassword,
+				EncryptOptions{KDF: opts.KDF, Recipients: opts.AddRecipients, KeyIDs: opts.AddKeyIDs})
+			if err != nil {
+				return nil, err
+			}
+			stanzas = append(stanzas, added...)
+		}
+		return stanzas, nil
+	})
+}
+
+// rewrapStream unwraps the DEK of the version 3 container read from src, lets
+// edit compute the new stanzas, and writes the resealed header followed by the
+// unchanged payload to dst
+func rewrapStream(dst io.Writer, src *bufio.Reader, unlock DecryptOptions,
+	edit func(dek []byte, stanzas []RecipientStanza) ([]RecipientStanza, error)) (*ContainerHeader, error) {
+	src, _, err := detectTextEncoding(src)
+	if err != nil {
+		return nil, err
+	}
+	header, headerBytes, err := readContainerHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != ContainerVersion {
+		return nil, fmt.Errorf("only version %d containers can be rewrapped, this one is version %d",
+			ContainerVersion, header.Version)
+	}
+
+	dek, _, err := unwrapDataKey(header.Recipients, unlock)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(dek)
+	payloadKey, macKey, err := envelopeKeys(dek)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(payloadKey, macKey)
+	if err := verifyHeaderMAC(header, headerBytes, macKey); err != nil {
+		return nil, err
+	}
+
+	stanzas, err := edit(dek, header.Recipients)
+	if err != nil {
+		return nil, err
+	}
+	if len(stanzas) == 0 {
+		return nil, errors.New("rewrapping would leave the image without any recipient")
+	}
+
+	newHeaderBytes, err := resealHeader(headerBytes, stanzas, macKey)
+	if err != nil {
+		return nil, err
+	}
+	if header, _, err = ParseContainerHeader(newHeaderBytes); err != nil {
+		return nil, err
+	}
+
+	if _, err := dst.Write(newHeaderBytes); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// RewrapData is the in-memory form of RewrapStream
+func RewrapData(encryptedData []byte, unlock DecryptOptions, opts RewrapOptions) ([]byte, error) {
+	var out bytes.Buffer
+	if _, err := RewrapStream(&out, bytes.NewReader(encryptedData), unlock, opts); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// removeStanzas returns the stanzas that are not selected for removal
+func removeStanzas(stanzas []RecipientStanza, opts RewrapOptions) ([]RecipientStanza, error) {
+	removeFingerprints := make(map[string]bool)
+	for _, pub := range opts.RemoveRecipients {
+		removeFingerprints[string(recipientFingerprint(pub))] = true
+	}
+
+	var kept []RecipientStanza
+	for _, stanza := range stanzas {
+		switch {
+		case stanza.Type == stanzaPassword && len(opts.RemovePassword) > 0:
+			if dek, err := unwrapDataKeyPassword(stanza.Body, opts.RemovePassword); err == nil {
+				wipe(dek)
+				continue
+			}
+		case stanza.Type == stanzaX25519Hinted && len(stanza.Body) >= fingerprintSize:
+			if removeFingerprints[string(stanza.Body[:fingerprintSize])] {
+				continue
+			}
+		case stanza.Type == stanzaKeyProvider:
+			if ref, _, err := parseKeyProviderStanza(stanza.Body); err == nil && slices.Contains(opts.RemoveKeyIDs, ref) {
+				continue
+			}
+		}
+		kept = append(kept, stanza)
+	}
+
+	removing := len(opts.RemovePassword) > 0 || len(opts.RemoveRecipients) > 0 || len(opts.RemoveKeyIDs) > 0
+	if removed := len(stanzas) - len(kept); removed == 0 && removing {
+		return nil, errors.New("none of the recipients to remove were found")
+	}
+	return kept, nil
+}
+
+// describeRecipients summarises a list of stanzas for logs
+func describeRecipients(stanzas []RecipientStanza) string {
+	passwords, publicKeys, keyIDs, other := 0, 0, 0, 0
+	split := ""
+	for _, stanza := range stanzas {
+		switch stanza.Type {
+		case stanzaPassword:
+			passwords++
+		case stanzaX25519, stanzaX25519Hinted:
+			publicKeys++
+		case stanzaKeyProvider:
+			keyIDs++
+		case stanzaKeyShares:
+			if len(stanza.Body) >= 2 {
+				split = fmt.Sprintf(", split %d-of-%d", stanza.Body[0], stanza.Body[1])
+			}
+		default:
+			other++
+		}
+	}
+
+	summary := fmt.Sprintf("%d password(s), %d public key(s), %d key ID(s)", passwords, publicKeys, keyIDs) + split
+	if other > 0 {
+		summary += fmt.Sprintf(", %d unknown", other)
+	}
+	return summary
+}
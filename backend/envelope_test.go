@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvelopeMultipleRecipients(t *testing.T) {
+	t.Setenv("SIMG_KEY_REVIEWERS", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x17}, SecretKeySize)))
+	useKeyProvider(t, EnvKeyProvider{Prefix: envKeyPrefix})
+
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	password := []byte("shared password")
+	plaintext := make([]byte, DefaultSegmentSize+99)
+	rand.Read(plaintext)
+
+	encrypted, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{
+		KDF:        testKDF,
+		Recipients: []*ecdh.PublicKey{alice.PublicKey(), bob.PublicKey()},
+		KeyIDs:     []string{"env:reviewers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, end, err := ParseContainerHeader(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Recipients) != 4 {
+		t.Fatalf("header has %s, want 4 stanzas", describeRecipients(header.Recipients))
+	}
+
+	// The image is encrypted once, whatever the number of recipients
+	single, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, singleEnd, err := ParseContainerHeader(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted)-end != len(single)-singleEnd {
+		t.Errorf("payload of %d bytes for four recipients, %d for one", len(encrypted)-end, len(single)-singleEnd)
+	}
+
+	for name, unlock := range map[string]DecryptOptions{
+		"password": {Password: password},
+		"alice":    {Identities: []*ecdh.PrivateKey{alice}},
+		"bob":      {Identities: []*ecdh.PrivateKey{bob}},
+		"key ID":   {KeyIDs: []string{"env:reviewers"}},
+	} {
+		got, _, err := DecryptDataWithOptions(encrypted, unlock)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(got, plaintext) {
+			t.Errorf("%s: decrypted data differs", name)
+		}
+	}
+}
+
+func TestEnvelopeRejectsModifiedStanzas(t *testing.T) {
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	encrypted, err := EncryptDataWithOptions([]byte("image"), nil, EncryptOptions{Recipients: []*ecdh.PublicKey{alice.PublicKey(), bob.PublicKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := ParseContainerHeader(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing Bob's stanza breaks the header MAC for Alice as well
+	bobStanza := header.Recipients[1].Body
+	i := bytes.Index(encrypted, bobStanza)
+	if i < 0 {
+		t.Fatal("stanza not found in the container")
+	}
+	tampered := bytes.Clone(encrypted)
+	tampered[i+len(bobStanza)-1] ^= 1
+	if _, _, err := DecryptDataWithOptions(tampered, DecryptOptions{Identities: []*ecdh.PrivateKey{alice}}); !errors.Is(err, ErrHeaderAuthentication) {
+		t.Errorf("modified stanza of another recipient returned %v, want ErrHeaderAuthentication", err)
+	}
+	if _, _, err := DecryptDataWithOptions(tampered, DecryptOptions{Identities: []*ecdh.PrivateKey{bob}}); err == nil {
+		t.Error("modified stanza still unwrapped")
+	}
+}
+
+func TestRewrapKeepsPayload(t *testing.T) {
+	alice, bob, carol := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	password := []byte("first password")
+	plaintext := make([]byte, 3*DefaultSegmentSize)
+	rand.Read(plaintext)
+	encrypted, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF, Recipients: []*ecdh.PublicKey{alice.PublicKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := RewrapData(encrypted, DecryptOptions{Identities: []*ecdh.PrivateKey{alice}}, RewrapOptions{
+		AddRecipients:    []*ecdh.PublicKey{bob.PublicKey(), carol.PublicKey()},
+		RemoveRecipients: []*ecdh.PublicKey{alice.PublicKey()},
+		RemovePassword:   password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the header changes, the image is not re-encrypted
+	_, end, err := ParseContainerHeader(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, newEnd, err := ParseContainerHeader(rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rewrapped[newEnd:], encrypted[end:]) {
+		t.Error("rewrapping changed the payload")
+	}
+	if len(header.Recipients) != 2 {
+		t.Errorf("rewrapped header has %s, want 2 recipients", describeRecipients(header.Recipients))
+	}
+
+	for name, identity := range map[string]*ecdh.PrivateKey{"bob": bob, "carol": carol} {
+		got, _, err := DecryptDataWithOptions(rewrapped, DecryptOptions{Identities: []*ecdh.PrivateKey{identity}})
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%s cannot decrypt the rewrapped image (%v)", name, err)
+		}
+	}
+	if _, _, err := DecryptDataWithOptions(rewrapped, DecryptOptions{Identities: []*ecdh.PrivateKey{alice}}); err == nil {
+		t.Error("a removed recipient still decrypts")
+	}
+	if _, _, err := DecryptDataWithOptions(rewrapped, DecryptOptions{Password: password}); err == nil {
+		t.Error("a removed password still decrypts")
+	}
+
+	// Rewrapping needs a credential, and refuses to leave no recipient
+	if _, err := RewrapData(rewrapped, DecryptOptions{Identities: []*ecdh.PrivateKey{alice}}, RewrapOptions{AddPassword: password, KDF: testKDF}); err == nil {
+		t.Error("a removed recipient rewrapped the image")
+	}
+	if _, err := RewrapData(rewrapped, DecryptOptions{Identities: []*ecdh.PrivateKey{bob}},
+		RewrapOptions{RemoveRecipients: []*ecdh.PublicKey{bob.PublicKey(), carol.PublicKey()}}); err == nil {
+		t.Error("rewrapping removed every recipient")
+	}
+	if _, err := RewrapData(rewrapped, DecryptOptions{Identities: []*ecdh.PrivateKey{bob}},
+		RewrapOptions{RemoveRecipients: []*ecdh.PublicKey{alice.PublicKey()}}); err == nil {
+		t.Error("removing a recipient that is not there succeeded")
+	}
+}
+
+func TestMultiRecipientImageOverTCP(t *testing.T) {
+	addr := startTestTCPServer(t)
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	plaintext := []byte("an image stored for two reviewers")
+	encrypted, err := EncryptDataWithOptions(plaintext, nil, EncryptOptions{Recipients: []*ecdh.PublicKey{alice.PublicKey(), bob.PublicKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SendImageViaTCP("review", encrypted, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	var retrieved bytes.Buffer
+	if _, err := RequestImageStreamViaTCP(addr, "review", &retrieved); err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range []*ecdh.PrivateKey{alice, bob} {
+		got, _, err := DecryptDataWithOptions(retrieved.Bytes(), DecryptOptions{Identities: []*ecdh.PrivateKey{identity}})
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("stored image does not decrypt for a recipient (%v)", err)
+		}
+	}
+
+	// The image went to the configured store directory
+	if stored, exists := lookupStoredImage("review"); !exists || filepath.Dir(stored.Path) != tcpServerConfig.StoreDir {
+		t.Errorf("image stored at %q, want it in %s", stored.Path, tcpServerConfig.StoreDir)
+	}
+}
@@ -2,4 +2,11 @@ module image-processing
 
 go 1.24.0
 
-require github.com/gorilla/mux v1.8.1
+require (
+	c2sp.org/CCTV/age v0.0.0-20260829155415-4448f2097b2d
+	github.com/gorilla/mux v1.8.1
+	github.com/klauspost/compress v1.19.2
+	golang.org/x/crypto v0.46.0
+)
+
+require golang.org/x/sys v0.39.0 // indirect
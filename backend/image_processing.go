@@ -1,219 +1,451 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"math"
+	"sync"
 )
 
-// FlipVertical flips an image upside-down
-func FlipVertical(img image.Image) image.Image {
-	bounds := img.Bounds()
-	width, height := bounds.Dx(), bounds.Dy()
-	flipped := image.NewRGBA(bounds)
+// Pixel buffers
+//
+// The operations below convert their input once into an *image.RGBA (or, for
+// the blurs, an *image.RGBA64) and then work on its Pix slice directly, instead
+// of calling At, Set and RGBA for every pixel they touch. *image.RGBA64 holds
+// the 16-bit premultiplied values color.RGBA returns, so the blurs give the
+// same result whatever pixel format the image was decoded into. Inputs that
+// already have the right type are used without a copy. Every pass runs on
+// the band engine in parallel.go and stops when its context ends.
+
+// rgbaPixels returns img as an *image.RGBA. Pix[0] of the result is the top
+// left pixel of img, wherever its bounds start.
+func rgbaPixels(ctx context.Context, img image.Image) (*image.RGBA, error) {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba, nil
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	return rgba, convertPixels(ctx, rgba, img)
+}
 
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			flipped.Set(x, height-y-1, img.At(x, y))
-		}
+// rgba64Pixels returns img as an *image.RGBA64, like rgbaPixels
+func rgba64Pixels(ctx context.Context, img image.Image) (*image.RGBA64, error) {
+	if rgba64, ok := img.(*image.RGBA64); ok {
+		return rgba64, nil
 	}
-	return flipped
+	rgba64 := image.NewRGBA64(img.Bounds())
+	return rgba64, convertPixels(ctx, rgba64, img)
 }
 
-// RotateArbitrary rotates an image by the specified angle (in degrees)
-func RotateArbitrary(img image.Image, angle float64) image.Image {
+// convertPixels draws img onto dst, which has the same bounds, band by band
+func convertPixels(ctx context.Context, dst draw.Image, img image.Image) error {
 	bounds := img.Bounds()
-	width, height := bounds.Dx(), bounds.Dy()
-	centerX, centerY := float64(width)/2, float64(height)/2
+	return parallelBands(ctx, bounds.Dy(), 0, func(lo, hi int) {
+		band := image.Rect(bounds.Min.X, bounds.Min.Y+lo, bounds.Max.X, bounds.Min.Y+hi)
+		draw.Draw(dst, band, img, band.Min, draw.Src)
+	})
+}
 
-	// Convert angle to radians
-	angleRad := angle * math.Pi / 180
+// channel16 reads the big-endian 16-bit channel value at i of an RGBA64 Pix slice
+func channel16(pix []uint8, i int) uint32 {
+	return uint32(pix[i])<<8 | uint32(pix[i+1])
+}
 
-	// Calculate new image dimensions to fit the rotated image
-	cosAngle, sinAngle := math.Abs(math.Cos(angleRad)), math.Abs(math.Sin(angleRad))
-	newWidth := int(math.Ceil(float64(width)*cosAngle + float64(height)*sinAngle))
-	newHeight := int(math.Ceil(float64(width)*sinAngle + float64(height)*cosAngle))
+// unitChannels maps every 16-bit channel value v to float64(v) / 0xffff, which
+// the blurs would otherwise compute once per kernel tap
+var unitChannels = sync.OnceValue(func() *[1 << 16]float64 {
+	var table [1 << 16]float64
+	for v := range table {
+		table[v] = float64(v) / 0xffff
+	}
+	return &table
+})
 
-	// Create new image with adjusted dimensions
-	rotated := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+// clampIndex limits i to [0, n)
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
 
-	// Fill with transparent color
-	draw.Draw(rotated, rotated.Bounds(), image.Transparent, image.Point{}, draw.Src)
+// axisCenter returns the position of the centre of an axis of n pixels,
+// which rotations turn around
+func axisCenter(n int) float64 {
+	return float64(n-1) / 2
+}
 
-	// Calculate new center
-	newCenterX, newCenterY := float64(newWidth)/2, float64(newHeight)/2
+// rotatedSize returns the size of the canvas that holds an image of width by
+// height pixels rotated by angleRad, ignoring rounding errors that would add
+// a column or row
+func rotatedSize(width, height int, angleRad float64) (int, int) {
+	cosAngle, sinAngle := math.Abs(math.Cos(angleRad)), math.Abs(math.Sin(angleRad))
+	newWidth := int(math.Ceil(float64(width)*cosAngle + float64(height)*sinAngle - 1e-9))
+	newHeight := int(math.Ceil(float64(width)*sinAngle + float64(height)*cosAngle - 1e-9))
+	return newWidth, newHeight
+}
 
-	// Perform rotation
-	for y := 0; y < newHeight; y++ {
-		for x := 0; x < newWidth; x++ {
-			// Translate to origin
-			xt := float64(x) - newCenterX
-			yt := float64(y) - newCenterY
-
-			// Rotate
-			cosA, sinA := math.Cos(-angleRad), math.Sin(-angleRad)
-			xr := xt*cosA - yt*sinA
-			yr := xt*sinA + yt*cosA
-
-			// Translate back and adjust for original center
-			xOriginal := int(math.Round(xr + centerX))
-			yOriginal := int(math.Round(yr + centerY))
-
-			// Check if the point is in the original image
-			if xOriginal >= 0 && xOriginal < width && yOriginal >= 0 && yOriginal < height {
-				rotated.Set(x, y, img.At(xOriginal, yOriginal))
-			}
-		}
-	}
+// RotateOptions selects how RotateArbitrary and RotateShear sample and frame
+// the image.
+// The zero value samples the nearest pixel, leaves the uncovered corners
+// transparent and expands the canvas to fit the whole rotated image.
+type RotateOptions struct {
+	// Kernel computes pixels that fall between source pixels
+	Kernel ResamplingKernel
 
-	return rotated
+	// Background fills the parts of the canvas the image does not cover
+	Background BackgroundFill
+
+	// BackgroundColor is the colour used with BackgroundSolid
+	BackgroundColor color.Color
+
+	// Crop keeps the size of the original image instead of expanding the
+	// canvas, cutting off the corners that rotate out of it
+	Crop bool
 }
 
-// RotateShear rotates an image using three shear matrices
-func RotateShear(img image.Image, angle float64) image.Image {
+// RotateArbitrary rotates an image by the specified angle (in degrees)
+// around the centre of its pixel grid, so that turns by multiples of 90°
+// move every pixel exactly
+func RotateArbitrary(ctx context.Context, img image.Image, angle float64, opts RotateOptions) (image.Image, error) {
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
+	centerX, centerY := axisCenter(width), axisCenter(height)
 
 	// Convert angle to radians
 	angleRad := angle * math.Pi / 180
 
-	// Calculate shear factors
-	tanHalfAngle := math.Tan(angleRad / 2)
+	// Calculate new image dimensions to fit the rotated image
+	newWidth, newHeight := width, height
+	if !opts.Crop {
+		newWidth, newHeight = rotatedSize(width, height, angleRad)
+	}
 
-	// Calculate new dimensions to fit the rotated image
-	cosAngle, sinAngle := math.Abs(math.Cos(angleRad)), math.Abs(math.Sin(angleRad))
-	newWidth := int(math.Ceil(float64(width)*cosAngle + float64(height)*sinAngle))
-	newHeight := int(math.Ceil(float64(width)*sinAngle + float64(height)*cosAngle))
-
-	// Create intermediate and result images
-	intermediate1 := image.NewRGBA(image.Rect(0, 0, width, newHeight))
-	intermediate2 := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
-	result := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
-
-	// Fill with background color
-	draw.Draw(intermediate1, intermediate1.Bounds(), image.Transparent, image.Point{}, draw.Src)
-	draw.Draw(intermediate2, intermediate2.Bounds(), image.Transparent, image.Point{}, draw.Src)
-	draw.Draw(result, result.Bounds(), image.Transparent, image.Point{}, draw.Src)
-
-	// Calculate offsets for centered rotation
-	offsetX := (newWidth - width) / 2
-	offsetY := (newHeight - height) / 2
-
-	// Step 1: Horizontal shear
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			newX := int(float64(x)-float64(y-height/2)*tanHalfAngle) + offsetX
-			newY := y + offsetY
-			if newX >= 0 && newX < newWidth && newY >= 0 && newY < newHeight {
-				intermediate1.Set(newX, newY, img.At(x, y))
-			}
-		}
+	// Create new image with adjusted dimensions; it starts out transparent
+	rotated := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+
+	// Calculate new center
+	newCenterX, newCenterY := axisCenter(newWidth), axisCenter(newHeight)
+	cosA, sinA := math.Cos(-angleRad), math.Sin(-angleRad)
+
+	// sourcePosition maps a pixel of the rotated image into the original
+	sourcePosition := func(x, y int) (float64, float64) {
+		// Translate to origin
+		xt := float64(x) - newCenterX
+		yt := float64(y) - newCenterY
+
+		// Rotate
+		xr := xt*cosA - yt*sinA
+		yr := xt*sinA + yt*cosA
+
+		// Translate back and adjust for original center
+		return xr + centerX, yr + centerY
 	}
 
-	// Step 2: Vertical shear
-	for y := 0; y < newHeight; y++ {
-		for x := 0; x < newWidth; x++ {
-			newX := x
-			newY := int(float64(y) + float64(x-newWidth/2)*sinAngle)
-			if newX >= 0 && newX < newWidth && newY >= 0 && newY < newHeight {
-				intermediate2.Set(newX, newY, intermediate1.At(x, y))
+	var process func(lo, hi int)
+	if opts.Kernel == KernelNearest {
+		src, err := rgbaPixels(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		var background []uint8
+		if opts.Background == BackgroundSolid && opts.BackgroundColor != nil {
+			c := color.RGBAModel.Convert(opts.BackgroundColor).(color.RGBA)
+			background = []uint8{c.R, c.G, c.B, c.A}
+		}
+		process = func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				row := rotated.Pix[y*rotated.Stride:]
+				for x := 0; x < newWidth; x++ {
+					xr, yr := sourcePosition(x, y)
+					xOriginal := int(math.Round(xr))
+					yOriginal := int(math.Round(yr))
+
+					// Check if the point is in the original image
+					inside := xOriginal >= 0 && xOriginal < width && yOriginal >= 0 && yOriginal < height
+					if !inside && opts.Background == BackgroundEdge {
+						xOriginal, yOriginal = clampIndex(xOriginal, width), clampIndex(yOriginal, height)
+						inside = true
+					}
+					if inside {
+						i := yOriginal*src.Stride + xOriginal*4
+						copy(row[x*4:x*4+4], src.Pix[i:i+4])
+					} else if background != nil {
+						copy(row[x*4:x*4+4], background)
+					}
+				}
 			}
 		}
-	}
-
-	// Step 3: Horizontal shear again
-	for y := 0; y < newHeight; y++ {
-		for x := 0; x < newWidth; x++ {
-			newX := int(float64(x) - float64(y-newHeight/2)*tanHalfAngle)
-			newY := y
-			if newX >= 0 && newX < newWidth && newY >= 0 && newY < newHeight {
-				result.Set(newX, newY, intermediate2.At(x, y))
+	} else {
+		src, err := rgba64Pixels(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		sampler := newResampler(src, opts.Kernel, opts.Background, opts.BackgroundColor)
+		process = func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				row := rotated.Pix[y*rotated.Stride:]
+				for x := 0; x < newWidth; x++ {
+					xr, yr := sourcePosition(x, y)
+					sampler.sample(xr, yr, row[x*4:x*4+4])
+				}
 			}
 		}
 	}
 
-	return result
+	// Perform rotation
+	if err := parallelBands(ctx, newHeight, 0, process); err != nil {
+		return nil, err
+	}
+	return rotated, nil
 }
 
-// ConvertToGrayscale converts an image to grayscale
-func ConvertToGrayscale(img image.Image) image.Image {
+// RotateShear rotates an image by the specified angle (in degrees) with
+// three shears, as described by Alan Paeth in "A Fast Algorithm for General
+// Raster Rotation": a rotation by θ is a horizontal shear by -tan(θ/2), a
+// vertical shear by sin(θ) and the first horizontal shear again. The shears
+// lose accuracy as θ approaches 180°, so the angle is split into exact
+// quarter turns and a remainder between -45° and 45°, which is sheared.
+// Each shear resamples one row or column at a time with opts.Kernel:
+// KernelNearest moves whole pixels, the other kernels move them by fractions
+// of a pixel. Intermediate images hold 16-bit channels. The canvas and the
+// background are chosen by opts as for RotateArbitrary.
+func RotateShear(ctx context.Context, img image.Image, angle float64, opts RotateOptions) (image.Image, error) {
+	src, err := rgba64Pixels(ctx, img)
+	if err != nil {
+		return nil, err
+	}
 	bounds := img.Bounds()
-	grayImg := image.NewGray(bounds)
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return image.NewRGBA(image.Rect(0, 0, width, height)), nil
+	}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			grayImg.Set(x, y, img.At(x, y))
+	// Split the angle into quarter turns and a remainder in [-45°, 45°]
+	quarterTurns := math.Round(angle / 90)
+	remainder := (angle - quarterTurns*90) * math.Pi / 180
+	if turns := normalizeTurns(quarterTurns); turns != 0 {
+		turned, err := RotateQuarterTurns(ctx, src, turns)
+		if err != nil {
+			return nil, err
 		}
+		src = turned.(*image.RGBA64)
 	}
+	turnedWidth, turnedHeight := src.Rect.Dx(), src.Rect.Dy()
 
-	return grayImg
-}
-
-// ApplyBoxBlur applies a box blur to an image
-func ApplyBoxBlur(img image.Image, radius int) image.Image {
-	bounds := img.Bounds()
-	blurred := image.NewRGBA(bounds)
+	// Calculate new dimensions to fit the rotated image
+	newWidth, newHeight := width, height
+	if !opts.Crop {
+		newWidth, newHeight = rotatedSize(turnedWidth, turnedHeight, remainder)
+	}
 
-	// Create kernel size based on radius
-	kernelSize := 2*radius + 1
-	kernelArea := float64(kernelSize * kernelSize)
+	// Shear factors
+	alpha := -math.Tan(remainder / 2)
+	beta := math.Sin(remainder)
+
+	// The first shear widens the image. Its canvas keeps the parity of the
+	// width, so that without a remainder pixels move by whole positions, and
+	// leaves room for the kernel beyond the sheared image.
+	pad := int(math.Ceil(opts.Kernel.support())) + 1
+	shearedWidth := turnedWidth + 2*(int(math.Ceil(math.Abs(alpha)*float64(turnedHeight)/2))+pad)
+
+	background := backgroundChannels(opts.Background, opts.BackgroundColor)
+
+	// Step 1: Horizontal shear of every row around the centre
+	intermediate1 := image.NewRGBA64(image.Rect(0, 0, shearedWidth, turnedHeight))
+	err = shearLines(ctx, intermediate1, src, false, func(y int) float64 {
+		return axisCenter(turnedWidth) - axisCenter(shearedWidth) - alpha*(float64(y)-axisCenter(turnedHeight))
+	}, opts.Kernel, opts.Background, background)
+	if err != nil {
+		return nil, err
+	}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			var r, g, b, a float64
+	// Step 2: Vertical shear of every column onto the rows of the result
+	intermediate2 := image.NewRGBA64(image.Rect(0, 0, shearedWidth, newHeight))
+	err = shearLines(ctx, intermediate2, intermediate1, true, func(x int) float64 {
+		return axisCenter(turnedHeight) - axisCenter(newHeight) - beta*(float64(x)-axisCenter(shearedWidth))
+	}, opts.Kernel, opts.Background, background)
+	if err != nil {
+		return nil, err
+	}
 
-			// Apply kernel
-			for ky := -radius; ky <= radius; ky++ {
-				for kx := -radius; kx <= radius; kx++ {
-					sampleX, sampleY := x+kx, y+ky
+	// Step 3: Horizontal shear again, onto the columns of the result
+	result := image.NewRGBA64(image.Rect(0, 0, newWidth, newHeight))
+	err = shearLines(ctx, result, intermediate2, false, func(y int) float64 {
+		return axisCenter(shearedWidth) - axisCenter(newWidth) - alpha*(float64(y)-axisCenter(newHeight))
+	}, opts.Kernel, opts.Background, background)
+	if err != nil {
+		return nil, err
+	}
+	return rgbaPixels(ctx, result)
+}
 
-					// Check bounds
-					if sampleX < bounds.Min.X {
-						sampleX = bounds.Min.X
-					} else if sampleX >= bounds.Max.X {
-						sampleX = bounds.Max.X - 1
+// shearLines resamples every line of src into the same line of dst. Lines are
+// rows, or columns if vertical is set, and dst has as many as src. Pixel i of
+// line l of dst is taken from position i+shift(l) of line l of src, so every
+// pixel of a line moves by the same amount and the kernel weights are computed
+// once per line.
+func shearLines(ctx context.Context, dst, src *image.RGBA64, vertical bool, shift func(l int) float64,
+	kernel ResamplingKernel, fill BackgroundFill, background [4]float64) error {
+	lines, length, srcLength := dst.Rect.Dy(), dst.Rect.Dx(), src.Rect.Dx()
+	linePitch, pixelPitch, srcLinePitch, srcPixelPitch := dst.Stride, 8, src.Stride, 8
+	if vertical {
+		lines, length, srcLength = dst.Rect.Dx(), dst.Rect.Dy(), src.Rect.Dy()
+		linePitch, pixelPitch, srcLinePitch, srcPixelPitch = 8, dst.Stride, 8, src.Stride
+	}
+	unit := unitChannels()
+
+	return parallelBands(ctx, lines, 0, func(lo, hi int) {
+		var weights [maxKernelTaps]float64
+		for l := lo; l < hi; l++ {
+			first, taps := kernel.taps(shift(l), &weights)
+			srcLine := src.Pix[l*srcLinePitch:]
+			out := dst.Pix[l*linePitch:]
+			for i := 0; i < length; i++ {
+				var acc [4]float64
+				for t := 0; t < taps; t++ {
+					s := first + i + t
+					if s < 0 || s >= srcLength {
+						if fill != BackgroundEdge {
+							for c := range acc {
+								acc[c] += background[c] * weights[t]
+							}
+							continue
+						}
+						s = clampIndex(s, srcLength)
 					}
+					p := s * srcPixelPitch
+					acc[0] += unit[channel16(srcLine, p)] * weights[t]
+					acc[1] += unit[channel16(srcLine, p+2)] * weights[t]
+					acc[2] += unit[channel16(srcLine, p+4)] * weights[t]
+					acc[3] += unit[channel16(srcLine, p+6)] * weights[t]
+				}
+				store16(out[i*pixelPitch:], &acc)
+			}
+		}
+	})
+}
 
-					if sampleY < bounds.Min.Y {
-						sampleY = bounds.Min.Y
-					} else if sampleY >= bounds.Max.Y {
-						sampleY = bounds.Max.Y - 1
-					}
+// ConvertToGrayscale converts an image to grayscale
+func ConvertToGrayscale(ctx context.Context, img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	grayImg := image.NewGray(bounds)
 
-					// Get pixel color
-					pixelColor := img.At(sampleX, sampleY)
-					rVal, gVal, bVal, aVal := pixelColor.RGBA()
+	// luma is color.GrayModel applied to 16-bit premultiplied values
+	luma := func(r, g, b uint32) uint8 {
+		return uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
+	}
 
-					// Accumulate values (normalize from uint32 to float64)
-					r += float64(rVal) / 0xffff
-					g += float64(gVal) / 0xffff
-					b += float64(bVal) / 0xffff
-					a += float64(aVal) / 0xffff
+	var process func(lo, hi int)
+	switch src := img.(type) {
+	case *image.Gray:
+		process = func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				copy(grayImg.Pix[y*grayImg.Stride:], src.Pix[y*src.Stride:y*src.Stride+width])
+			}
+		}
+	case *image.RGBA:
+		process = func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				row := src.Pix[y*src.Stride:]
+				out := grayImg.Pix[y*grayImg.Stride:]
+				for x := 0; x < width; x++ {
+					p := row[x*4 : x*4+4]
+					out[x] = luma(uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101)
+				}
+			}
+		}
+	case *image.NRGBA:
+		process = func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				row := src.Pix[y*src.Stride:]
+				out := grayImg.Pix[y*grayImg.Stride:]
+				for x := 0; x < width; x++ {
+					p := row[x*4 : x*4+4]
+					a := uint32(p[3])
+					out[x] = luma(uint32(p[0])*0x101*a/0xff, uint32(p[1])*0x101*a/0xff, uint32(p[2])*0x101*a/0xff)
+				}
+			}
+		}
+	default:
+		rgba64, err := rgba64Pixels(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		process = func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				row := rgba64.Pix[y*rgba64.Stride:]
+				out := grayImg.Pix[y*grayImg.Stride:]
+				for x := 0; x < width; x++ {
+					out[x] = luma(channel16(row, x*8), channel16(row, x*8+2), channel16(row, x*8+4))
 				}
 			}
+		}
+	}
+
+	if err := parallelBands(ctx, height, 0, process); err != nil {
+		return nil, err
+	}
+	return grayImg, nil
+}
 
-			// Calculate average
-			r /= kernelArea
-			g /= kernelArea
-			b /= kernelArea
-			a /= kernelArea
-
-			// Set pixel
-			blurred.Set(x, y, color.RGBA{
-				R: uint8(r * 255),
-				G: uint8(g * 255),
-				B: uint8(b * 255),
-				A: uint8(a * 255),
-			})
+// ApplyBoxBlur applies a box blur to an image, averaging the square of
+// 2*radius+1 pixels around each pixel with running sums (see boxblur.go)
+func ApplyBoxBlur(ctx context.Context, img image.Image, radius int) (image.Image, error) {
+	if radius < 0 || radius > MaxBlurRadius {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidRadius, radius)
+	}
+	src, err := rgba64Pixels(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	blurred := image.NewRGBA(img.Bounds())
+
+	// The average of 16-bit values, scaled to 8 bits and rounded down
+	div := 0xffff * boxArea(radius)
+	err = boxBlur(ctx, src, radius, func(x, y int, sums *[4]uint64) {
+		p := blurred.Pix[y*blurred.Stride+x*4:]
+		for c, sum := range sums {
+			p[c] = uint8(sum * 0xff / div)
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
+	return blurred, nil
+}
 
-	return blurred
+// GaussianBlurOptions selects how ApplyGaussianBlur computes the blur
+type GaussianBlurOptions struct {
+	// BoxRadius, if positive, is the radius from which the blur is
+	// approximated by ApplyIteratedBoxBlur, whose cost does not grow with
+	// the radius as the cost of the Gaussian kernel does
+	BoxRadius float64
 }
 
-// ApplyGaussianBlur applies a Gaussian blur to an image
-func ApplyGaussianBlur(img image.Image, radius float64) image.Image {
+// DefaultGaussianBoxRadius is a BoxRadius above which the approximation is
+// hard to tell from the Gaussian kernel, which by then has 49 taps
+const DefaultGaussianBoxRadius = 8
+
+// ApplyGaussianBlur applies a Gaussian blur of standard deviation radius to
+// an image
+func ApplyGaussianBlur(ctx context.Context, img image.Image, radius float64, opts GaussianBlurOptions) (image.Image, error) {
+	if !(radius > 0) || radius > MaxBlurRadius {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRadius, radius)
+	}
+	if opts.BoxRadius > 0 && radius >= opts.BoxRadius {
+		return ApplyIteratedBoxBlur(ctx, img, radius)
+	}
+	src, err := rgba64Pixels(ctx, img)
+	if err != nil {
+		return nil, err
+	}
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 	blurred := image.NewRGBA(bounds)
@@ -239,129 +471,124 @@ func ApplyGaussianBlur(img image.Image, radius float64) image.Image {
 
 	// Create temporary image for horizontal pass
 	tempImg := image.NewRGBA(bounds)
+	unit := unitChannels()
 
 	// Horizontal pass
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			var r, g, b, a float64
-
-			for kx := 0; kx < kernelSize; kx++ {
-				sampleX := x + (kx - kernelRadius)
-
-				// Handle edge cases
-				if sampleX < 0 {
-					sampleX = 0
-				} else if sampleX >= width {
-					sampleX = width - 1
+	err = parallelBands(ctx, height, 0, func(lo, hi int) {
+		for y := lo; y < hi; y++ {
+			row := src.Pix[y*src.Stride:]
+			out := tempImg.Pix[y*tempImg.Stride:]
+			for x := 0; x < width; x++ {
+				var r, g, b, a float64
+
+				for kx := 0; kx < kernelSize; kx++ {
+					// Handle edge cases
+					i := clampIndex(x+(kx-kernelRadius), width) * 8
+
+					weight := kernel[kx]
+					r += unit[channel16(row, i)] * weight
+					g += unit[channel16(row, i+2)] * weight
+					b += unit[channel16(row, i+4)] * weight
+					a += unit[channel16(row, i+6)] * weight
 				}
 
-				pixelColor := img.At(sampleX, y)
-				rVal, gVal, bVal, aVal := pixelColor.RGBA()
-
-				weight := kernel[kx]
-				r += float64(rVal) / 0xffff * weight
-				g += float64(gVal) / 0xffff * weight
-				b += float64(bVal) / 0xffff * weight
-				a += float64(aVal) / 0xffff * weight
+				p := out[x*4 : x*4+4]
+				p[0], p[1], p[2], p[3] = uint8(r*255), uint8(g*255), uint8(b*255), uint8(a*255)
 			}
-
-			tempImg.Set(x, y, color.RGBA{
-				R: uint8(r * 255),
-				G: uint8(g * 255),
-				B: uint8(b * 255),
-				A: uint8(a * 255),
-			})
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Vertical pass
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			var r, g, b, a float64
-
-			for ky := 0; ky < kernelSize; ky++ {
-				sampleY := y + (ky - kernelRadius)
-
-				// Handle edge cases
-				if sampleY < 0 {
-					sampleY = 0
-				} else if sampleY >= height {
-					sampleY = height - 1
+	// Vertical pass, which reads the rows of the horizontal pass above and
+	// below each band
+	err = parallelBands(ctx, height, kernelRadius, func(lo, hi int) {
+		for y := lo; y < hi; y++ {
+			out := blurred.Pix[y*blurred.Stride:]
+			for x := 0; x < width; x++ {
+				var r, g, b, a float64
+
+				for ky := 0; ky < kernelSize; ky++ {
+					// Handle edge cases
+					sampleY := clampIndex(y+(ky-kernelRadius), height)
+					p := tempImg.Pix[sampleY*tempImg.Stride+x*4:]
+
+					weight := kernel[ky]
+					r += unit[uint32(p[0])*0x101] * weight
+					g += unit[uint32(p[1])*0x101] * weight
+					b += unit[uint32(p[2])*0x101] * weight
+					a += unit[uint32(p[3])*0x101] * weight
 				}
 
-				pixelColor := tempImg.At(x, sampleY)
-				rVal, gVal, bVal, aVal := pixelColor.RGBA()
-
-				weight := kernel[ky]
-				r += float64(rVal) / 0xffff * weight
-				g += float64(gVal) / 0xffff * weight
-				b += float64(bVal) / 0xffff * weight
-				a += float64(aVal) / 0xffff * weight
+				p := out[x*4 : x*4+4]
+				p[0], p[1], p[2], p[3] = uint8(r*255), uint8(g*255), uint8(b*255), uint8(a*255)
 			}
-
-			blurred.Set(x, y, color.RGBA{
-				R: uint8(r * 255),
-				G: uint8(g * 255),
-				B: uint8(b * 255),
-				A: uint8(a * 255),
-			})
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return blurred
+	return blurred, nil
 }
 
 // ApplySobelEdgeDetection applies Sobel edge detection to an image
-func ApplySobelEdgeDetection(img image.Image) image.Image {
+func ApplySobelEdgeDetection(ctx context.Context, img image.Image) (image.Image, error) {
 	// First convert to grayscale for edge detection
-	grayImg := ConvertToGrayscale(img)
+	gray, err := ConvertToGrayscale(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	grayImg := gray.(*image.Gray)
 	bounds := grayImg.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 	edges := image.NewRGBA(bounds)
 
 	// Sobel operators
-	sobelX := [][]int{
+	sobelX := [3][3]float64{
 		{-1, 0, 1},
 		{-2, 0, 2},
 		{-1, 0, 1},
 	}
 
-	sobelY := [][]int{
+	sobelY := [3][3]float64{
 		{-1, -2, -1},
 		{0, 0, 0},
 		{1, 2, 1},
 	}
 
-	for y := 1; y < height-1; y++ {
-		for x := 1; x < width-1; x++ {
-			// Apply Sobel operator
-			var gx, gy float64
-
-			for i := -1; i <= 1; i++ {
-				for j := -1; j <= 1; j++ {
-					pixel := grayImg.At(x+j, y+i)
-					grayValue := color.GrayModel.Convert(pixel).(color.Gray).Y
-
-					gx += float64(grayValue) * float64(sobelX[i+1][j+1])
-					gy += float64(grayValue) * float64(sobelY[i+1][j+1])
+	// Bands cover the interior rows and read one row beyond either end
+	err = parallelBands(ctx, height-2, 1, func(lo, hi int) {
+		for y := lo + 1; y < hi+1; y++ {
+			out := edges.Pix[y*edges.Stride:]
+			for x := 1; x < width-1; x++ {
+				// Apply Sobel operator
+				var gx, gy float64
+
+				for i := -1; i <= 1; i++ {
+					row := grayImg.Pix[(y+i)*grayImg.Stride:]
+					for j := -1; j <= 1; j++ {
+						grayValue := float64(row[x+j])
+
+						gx += grayValue * sobelX[i+1][j+1]
+						gy += grayValue * sobelY[i+1][j+1]
+					}
 				}
-			}
 
-			// Calculate gradient magnitude
-			magnitude := math.Sqrt(gx*gx + gy*gy)
+				// Calculate gradient magnitude
+				magnitude := math.Sqrt(gx*gx + gy*gy)
 
-			// Normalize and threshold
-			normalizedMagnitude := math.Min(255, magnitude)
+				// Normalize and threshold
+				normalizedMagnitude := uint8(math.Min(255, magnitude))
 
-			// Set edge pixel
-			edges.Set(x, y, color.RGBA{
-				R: uint8(normalizedMagnitude),
-				G: uint8(normalizedMagnitude),
-				B: uint8(normalizedMagnitude),
-				A: 255,
-			})
+				// Set edge pixel
+				p := out[x*4 : x*4+4]
+				p[0], p[1], p[2], p[3] = normalizedMagnitude, normalizedMagnitude, normalizedMagnitude, 255
+			}
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return edges
+	return edges, nil
 }
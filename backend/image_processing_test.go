@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The operations in image_processing.go work on Pix slices directly. The
+// functions below compute the same results the straightforward way, with At
+// and Set, as the operations did before; the golden tests check that both
+// agree to the byte for every pixel format an image can be decoded into.
+
+// grayscaleAtSet converts img to grayscale with color.GrayModel
+func grayscaleAtSet(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+	return gray
+}
+
+// boxBlurAtSet averages the 16-bit channels over the box around each pixel,
+// repeating the edge pixels, and scales the average to 8 bits rounding down
+func boxBlurAtSet(img image.Image, radius int) *image.RGBA {
+	bounds := img.Bounds()
+	blurred := image.NewRGBA(bounds)
+	div := 0xffff * boxArea(radius)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var sums [4]uint64
+			for ky := -radius; ky <= radius; ky++ {
+				for kx := -radius; kx <= radius; kx++ {
+					sampleX := bounds.Min.X + clampIndex(x+kx-bounds.Min.X, bounds.Dx())
+					sampleY := bounds.Min.Y + clampIndex(y+ky-bounds.Min.Y, bounds.Dy())
+					r, g, b, a := img.At(sampleX, sampleY).RGBA()
+					sums[0] += uint64(r)
+					sums[1] += uint64(g)
+					sums[2] += uint64(b)
+					sums[3] += uint64(a)
+				}
+			}
+			blurred.Set(x, y, color.RGBA{
+				R: uint8(sums[0] * 0xff / div),
+				G: uint8(sums[1] * 0xff / div),
+				B: uint8(sums[2] * 0xff / div),
+				A: uint8(sums[3] * 0xff / div),
+			})
+		}
+	}
+	return blurred
+}
+
+// gaussianBlurAtSet is the Gaussian blur as it was written with At and Set:
+// a horizontal and a vertical pass of the kernel, each truncating to 8 bits.
+// Only the offsets of images whose bounds do not start at the origin are
+// added.
+func gaussianBlurAtSet(img image.Image, radius float64) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	blurred := image.NewRGBA(bounds)
+
+	// Create kernel size based on radius (typically 3σ rule)
+	kernelSize := int(math.Ceil(radius*3))*2 + 1
+	kernelRadius := kernelSize / 2
+
+	// Generate 1D Gaussian kernel
+	kernel := make([]float64, kernelSize)
+	kernelSum := 0.0
+
+	for i := 0; i < kernelSize; i++ {
+		x := float64(i - kernelRadius)
+		kernel[i] = math.Exp(-(x * x) / (2 * radius * radius))
+		kernelSum += kernel[i]
+	}
+
+	// Normalize kernel
+	for i := 0; i < kernelSize; i++ {
+		kernel[i] /= kernelSum
+	}
+
+	// Create temporary image for horizontal pass
+	tempImg := image.NewRGBA(bounds)
+
+	// Horizontal pass
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float64
+
+			for kx := 0; kx < kernelSize; kx++ {
+				sampleX := x + (kx - kernelRadius)
+
+				// Handle edge cases
+				if sampleX < 0 {
+					sampleX = 0
+				} else if sampleX >= width {
+					sampleX = width - 1
+				}
+
+				pixelColor := img.At(bounds.Min.X+sampleX, bounds.Min.Y+y)
+				rVal, gVal, bVal, aVal := pixelColor.RGBA()
+
+				weight := kernel[kx]
+				r += float64(rVal) / 0xffff * weight
+				g += float64(gVal) / 0xffff * weight
+				b += float64(bVal) / 0xffff * weight
+				a += float64(aVal) / 0xffff * weight
+			}
+
+			tempImg.Set(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA{
+				R: uint8(r * 255),
+				G: uint8(g * 255),
+				B: uint8(b * 255),
+				A: uint8(a * 255),
+			})
+		}
+	}
+
+	// Vertical pass
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float64
+
+			for ky := 0; ky < kernelSize; ky++ {
+				sampleY := y + (ky - kernelRadius)
+
+				// Handle edge cases
+				if sampleY < 0 {
+					sampleY = 0
+				} else if sampleY >= height {
+					sampleY = height - 1
+				}
+
+				pixelColor := tempImg.At(bounds.Min.X+x, bounds.Min.Y+sampleY)
+				rVal, gVal, bVal, aVal := pixelColor.RGBA()
+
+				weight := kernel[ky]
+				r += float64(rVal) / 0xffff * weight
+				g += float64(gVal) / 0xffff * weight
+				b += float64(bVal) / 0xffff * weight
+				a += float64(aVal) / 0xffff * weight
+			}
+
+			blurred.Set(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA{
+				R: uint8(r * 255),
+				G: uint8(g * 255),
+				B: uint8(b * 255),
+				A: uint8(a * 255),
+			})
+		}
+	}
+
+	return blurred
+}
+
+// flipVerticalAtSet flips img upside-down into an RGBA image
+func flipVerticalAtSet(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	flipped := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			flipped.Set(x, height-y-1, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return flipped
+}
+
+// rotateAtSet rotates img around the centre of its pixel grid, taking the
+// nearest source pixel and leaving the uncovered corners transparent
+func rotateAtSet(img image.Image, angle float64, crop bool) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	angleRad := angle * math.Pi / 180
+
+	newWidth, newHeight := width, height
+	if !crop {
+		newWidth, newHeight = rotatedSize(width, height, angleRad)
+	}
+	rotated := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+
+	cosA, sinA := math.Cos(-angleRad), math.Sin(-angleRad)
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			xt := float64(x) - axisCenter(newWidth)
+			yt := float64(y) - axisCenter(newHeight)
+			xOriginal := int(math.Round(xt*cosA - yt*sinA + axisCenter(width)))
+			yOriginal := int(math.Round(xt*sinA + yt*cosA + axisCenter(height)))
+			if xOriginal >= 0 && xOriginal < width && yOriginal >= 0 && yOriginal < height {
+				rotated.Set(x, y, img.At(bounds.Min.X+xOriginal, bounds.Min.Y+yOriginal))
+			}
+		}
+	}
+	return rotated
+}
+
+// sobelAtSet computes the gradient magnitude of the grayscale image, leaving
+// the border pixels transparent
+func sobelAtSet(img image.Image) *image.RGBA {
+	gray := grayscaleAtSet(img)
+	bounds := gray.Bounds()
+	edges := image.NewRGBA(bounds)
+	sobelX := [3][3]float64{{-1, 0, 1}, {-2, 0, 2}, {-1, 0, 1}}
+	sobelY := [3][3]float64{{-1, -2, -1}, {0, 0, 0}, {1, 2, 1}}
+
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+		for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
+			var gx, gy float64
+			for i := -1; i <= 1; i++ {
+				for j := -1; j <= 1; j++ {
+					v := float64(gray.GrayAt(x+j, y+i).Y)
+					gx += v * sobelX[i+1][j+1]
+					gy += v * sobelY[i+1][j+1]
+				}
+			}
+			m := uint8(math.Min(255, math.Sqrt(gx*gx+gy*gy)))
+			edges.Set(x, y, color.RGBA{m, m, m, 255})
+		}
+	}
+	return edges
+}
+
+// goldenImage is a named test input
+type goldenImage struct {
+	name string
+	img  image.Image
+}
+
+// goldenImages returns random images in every pixel format the decoders
+// produce, with odd sizes so that the bands of the band engine are uneven
+func goldenImages(t testing.TB) []goldenImage {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	rect := image.Rect(0, 0, 37, 23)
+
+	nrgba := image.NewNRGBA(rect)
+	rgba := image.NewRGBA(rect)
+	rgba64 := image.NewRGBA64(rect)
+	nrgba64 := image.NewNRGBA64(rect)
+	gray := image.NewGray(rect)
+	gray16 := image.NewGray16(rect)
+	paletted := image.NewPaletted(rect, color.Palette{
+		color.Black, color.White, color.RGBA{200, 10, 30, 255}, color.NRGBA{1, 2, 3, 100},
+	})
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))}
+			c64 := color.NRGBA64{uint16(rng.Intn(1 << 16)), uint16(rng.Intn(1 << 16)), uint16(rng.Intn(1 << 16)), uint16(rng.Intn(1 << 16))}
+			nrgba.Set(x, y, c)
+			rgba.Set(x, y, c)
+			rgba64.Set(x, y, c64)
+			nrgba64.Set(x, y, c64)
+			gray.Set(x, y, c)
+			gray16.Set(x, y, c64)
+			paletted.SetColorIndex(x, y, uint8(rng.Intn(len(paletted.Palette))))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, nrgba, nil); err != nil {
+		t.Fatal(err)
+	}
+	ycbcr, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []goldenImage{
+		{"RGBA", rgba},
+		{"NRGBA", nrgba},
+		{"RGBA64", rgba64},
+		{"NRGBA64", nrgba64},
+		{"Gray", gray},
+		{"Gray16", gray16},
+		{"Paletted", paletted},
+		{"YCbCr", ycbcr},
+		{"SubImage", rgba.SubImage(image.Rect(5, 3, 25, 21))},
+		{"Line", nrgba.SubImage(image.Rect(0, 4, 37, 5))},
+	}
+}
+
+// pixels returns the Pix slice and bounds of an image the operations return
+func pixels(t *testing.T, img image.Image) ([]uint8, image.Rectangle) {
+	t.Helper()
+	switch img := img.(type) {
+	case *image.RGBA:
+		return img.Pix, img.Rect
+	case *image.Gray:
+		return img.Pix, img.Rect
+	}
+	t.Fatalf("unexpected result type %T", img)
+	return nil, image.Rectangle{}
+}
+
+// assertSameImage fails unless got and want have the same bounds and bytes
+func assertSameImage(t *testing.T, got image.Image, err error, want image.Image) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotPix, gotRect := pixels(t, got)
+	wantPix, wantRect := pixels(t, want)
+	if gotRect != wantRect {
+		t.Fatalf("bounds %v, want %v", gotRect, wantRect)
+	}
+	if i := firstDifference(gotPix, wantPix); i >= 0 {
+		t.Fatalf("byte %d is %d, want %d", i, gotPix[i], wantPix[i])
+	}
+}
+
+// firstDifference returns the index of the first byte where a and b differ,
+// or -1
+func firstDifference(a, b []uint8) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return min(len(a), len(b))
+	}
+	return -1
+}
+
+func TestGoldenGrayscale(t *testing.T) {
+	for _, input := range goldenImages(t) {
+		t.Run(input.name, func(t *testing.T) {
+			got, err := ConvertToGrayscale(context.Background(), input.img)
+			assertSameImage(t, got, err, grayscaleAtSet(input.img))
+		})
+	}
+}
+
+func TestGoldenSobelEdgeDetection(t *testing.T) {
+	for _, input := range goldenImages(t) {
+		t.Run(input.name, func(t *testing.T) {
+			got, err := ApplySobelEdgeDetection(context.Background(), input.img)
+			assertSameImage(t, got, err, sobelAtSet(input.img))
+		})
+	}
+}
+
+func TestGoldenBoxBlur(t *testing.T) {
+	for _, input := range goldenImages(t) {
+		for _, radius := range []int{0, 1, 3, 40} {
+			t.Run(fmt.Sprintf("%s/%d", input.name, radius), func(t *testing.T) {
+				got, err := ApplyBoxBlur(context.Background(), input.img, radius)
+				assertSameImage(t, got, err, boxBlurAtSet(input.img, radius))
+			})
+		}
+	}
+}
+
+func TestGoldenGaussianBlur(t *testing.T) {
+	for _, input := range goldenImages(t) {
+		for _, radius := range []float64{0.5, 1, 2, 3.3} {
+			t.Run(fmt.Sprintf("%s/%v", input.name, radius), func(t *testing.T) {
+				got, err := ApplyGaussianBlur(context.Background(), input.img, radius, GaussianBlurOptions{})
+				assertSameImage(t, got, err, gaussianBlurAtSet(input.img, radius))
+			})
+		}
+	}
+}
+
+func TestGoldenRotate(t *testing.T) {
+	for _, input := range goldenImages(t) {
+		for _, angle := range []float64{0, 30, -45, 90, 137.5, 180, -271} {
+			for _, crop := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/%v/crop=%v", input.name, angle, crop), func(t *testing.T) {
+					got, err := RotateArbitrary(context.Background(), input.img, angle, RotateOptions{Crop: crop})
+					assertSameImage(t, got, err, rotateAtSet(input.img, angle, crop))
+				})
+			}
+		}
+	}
+}
+
+// FlipVertical keeps the type of the image (see transform.go), so its
+// result is compared by colour rather than byte for byte
+func TestGoldenFlipVertical(t *testing.T) {
+	for _, input := range goldenImages(t) {
+		t.Run(input.name, func(t *testing.T) {
+			got, err := FlipVertical(context.Background(), input.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := flipVerticalAtSet(input.img)
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("bounds %v, want %v", got.Bounds(), want.Bounds())
+			}
+			for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+				for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+					if c := color.RGBAModel.Convert(got.At(x, y)); c != want.At(x, y) {
+						t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, c, want.At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
+
+// benchmarkImage returns a random photo-sized NRGBA image, the format PNG
+// files decode into
+func benchmarkImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 1024, 768))
+	rand.New(rand.NewSource(2)).Read(img.Pix)
+	return img
+}
+
+// benchmarkPaths compares the At/Set version of an operation with the one
+// working on Pix slices
+func benchmarkPaths(b *testing.B, atSet func(image.Image), pix func(image.Image) error) {
+	img := benchmarkImage()
+	b.Run("AtSet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			atSet(img)
+		}
+	})
+	b.Run("Pix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := pix(img); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkConvertToGrayscale(b *testing.B) {
+	benchmarkPaths(b, func(img image.Image) { grayscaleAtSet(img) }, func(img image.Image) error {
+		_, err := ConvertToGrayscale(context.Background(), img)
+		return err
+	})
+}
+
+func BenchmarkApplySobelEdgeDetection(b *testing.B) {
+	benchmarkPaths(b, func(img image.Image) { sobelAtSet(img) }, func(img image.Image) error {
+		_, err := ApplySobelEdgeDetection(context.Background(), img)
+		return err
+	})
+}
+
+func BenchmarkApplyBoxBlur(b *testing.B) {
+	benchmarkPaths(b, func(img image.Image) { boxBlurAtSet(img, 3) }, func(img image.Image) error {
+		_, err := ApplyBoxBlur(context.Background(), img, 3)
+		return err
+	})
+}
+
+func BenchmarkApplyGaussianBlur(b *testing.B) {
+	benchmarkPaths(b, func(img image.Image) { gaussianBlurAtSet(img, 2) }, func(img image.Image) error {
+		_, err := ApplyGaussianBlur(context.Background(), img, 2, GaussianBlurOptions{})
+		return err
+	})
+}
+
+func BenchmarkFlipVertical(b *testing.B) {
+	benchmarkPaths(b, func(img image.Image) { flipVerticalAtSet(img) }, func(img image.Image) error {
+		_, err := FlipVertical(context.Background(), img)
+		return err
+	})
+}
+
+func BenchmarkRotateArbitrary(b *testing.B) {
+	benchmarkPaths(b, func(img image.Image) { rotateAtSet(img, 30, false) }, func(img image.Image) error {
+		_, err := RotateArbitrary(context.Background(), img, 30, RotateOptions{})
+		return err
+	})
+}
+
+// smoothImage returns an opaque image of slowly varying colours, which every
+// interpolating kernel reconstructs well
+func smoothImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(127 + 120*math.Sin(6*fx+2*fy)),
+				G: uint8(127 + 120*math.Cos(5*fy-3*fx)),
+				B: uint8(127 + 120*math.Sin(4*(fx+fy))),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// opaquePSNR returns the peak signal-to-noise ratio in dB of the colour
+// channels of the pixels that are opaque in both images, and how many there
+// are. Corners the rotated image does not cover are left out, since the two
+// rotations blend them with the transparent background differently.
+func opaquePSNR(a, b *image.RGBA) (float64, int) {
+	var squaredError float64
+	n := 0
+	for y := 0; y < a.Rect.Dy(); y++ {
+		for x := 0; x < a.Rect.Dx(); x++ {
+			pa := a.Pix[y*a.Stride+x*4:]
+			pb := b.Pix[y*b.Stride+x*4:]
+			if pa[3] != 0xff || pb[3] != 0xff {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				d := float64(pa[c]) - float64(pb[c])
+				squaredError += d * d
+			}
+			n++
+		}
+	}
+	if squaredError == 0 {
+		return math.Inf(1), n
+	}
+	return 10 * math.Log10(255*255*float64(3*n)/squaredError), n
+}
+
+func TestRotateShearMatchesRotateArbitrary(t *testing.T) {
+	sizes := []image.Point{{120, 80}, {81, 121}, {64, 64}}
+	angles := []float64{-179.5, -135, -90, -30, -0.5, 0, 17.5, 45, 95, 137.5, 179, 180, 180.5, 270, 350}
+	kernels := []ResamplingKernel{KernelBilinear, KernelBicubic, KernelLanczos3}
+
+	for _, size := range sizes {
+		img := smoothImage(size.X, size.Y)
+		for _, angle := range angles {
+			for _, kernel := range kernels {
+				t.Run(fmt.Sprintf("%dx%d/%v/%v", size.X, size.Y, angle, kernel), func(t *testing.T) {
+					opts := RotateOptions{Kernel: kernel, Crop: true}
+					sheared, err := RotateShear(context.Background(), img, angle, opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					rotated, err := RotateArbitrary(context.Background(), img, angle, opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					a, b := sheared.(*image.RGBA), rotated.(*image.RGBA)
+					if a.Rect != b.Rect {
+						t.Fatalf("bounds %v, want %v", a.Rect, b.Rect)
+					}
+					psnr, n := opaquePSNR(a, b)
+					if n < size.X*size.Y/4 {
+						t.Fatalf("only %d opaque pixels to compare", n)
+					}
+					if psnr < 40 {
+						t.Errorf("PSNR %.1f dB, want at least 40 dB", psnr)
+					}
+				})
+			}
+
+			// Without Crop both expand the canvas the same way
+			sheared, err := RotateShear(context.Background(), img, angle, RotateOptions{Kernel: KernelBilinear})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rotated, err := RotateArbitrary(context.Background(), img, angle, RotateOptions{Kernel: KernelBilinear})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sheared.Bounds() != rotated.Bounds() {
+				t.Errorf("%dx%d rotated by %v: bounds %v, want %v", size.X, size.Y, angle, sheared.Bounds(), rotated.Bounds())
+			}
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDFAlgorithm identifies the password-based key derivation function
+type KDFAlgorithm byte
+
+const (
+	// KDFArgon2id derives keys with Argon2id (the default)
+	KDFArgon2id KDFAlgorithm = 1
+
+	// KDFScrypt derives keys with scrypt
+	KDFScrypt KDFAlgorithm = 2
+
+	// KDFPBKDF2SHA256 derives keys with PBKDF2-HMAC-SHA256
+	KDFPBKDF2SHA256 KDFAlgorithm = 3
+
+	// KDFSaltSize is the size of the random salt generated for each file
+	KDFSaltSize = 16
+
+	// kdfParamsFixedSize is the encoded size of KDFParams without the salt
+	kdfParamsFixedSize = 1 + 4 + 4 + 1 + 1
+)
+
+// Limits applied to KDF parameters read from ciphertexts, so that a crafted
+// header cannot make the server burn unbounded CPU or memory. Each parameter
+// is bounded on its own, and the memory of one derivation and its memory
+// multiplied by its passes are bounded as a whole, since the individual
+// maximums combined would still ask for many gigabytes.
+const (
+	minSaltSize = 8
+	maxSaltSize = 64
+
+	// maxKDFMemory bounds the memory of one derivation in bytes: Memory KiB
+	// for Argon2id, 128·r·N for scrypt
+	maxKDFMemory = 256 << 20
+
+	// maxKDFWork bounds the memory of one derivation times its passes
+	// (Argon2id time, scrypt p), in bytes
+	maxKDFWork = 1 << 30
+
+	maxArgon2Time    = 16
+	maxArgon2Memory  = maxKDFMemory / 1024 // KiB
+	maxArgon2Threads = 64
+
+	minScryptLogN = 10
+	maxScryptLogN = 22
+	maxScryptR    = 32
+	maxScryptP    = 16
+
+	minPBKDF2Iterations = 10000
+	maxPBKDF2Iterations = 10000000
+)
+
+// KDFParams holds the algorithm, salt and cost parameters used to turn a
+// password into a 256-bit key. The cost fields are interpreted per algorithm:
+//
+//	Argon2id: Time = passes, Memory = memory in KiB, Parallelism = lanes
+//	scrypt:   Time = log2(N), Memory = r, Parallelism = p
+//	PBKDF2:   Time = iterations (Memory and Parallelism are unused)
+type KDFParams struct {
+	Algorithm   KDFAlgorithm
+	Time        uint32
+	Memory      uint32
+	Parallelism uint8
+	Salt        []byte
+}
+
+// String returns the name of the algorithm as accepted by ParseKDFAlgorithm
+func (a KDFAlgorithm) String() string {
+	switch a {
+	case KDFArgon2id:
+		return "argon2id"
+	case KDFScrypt:
+		return "scrypt"
+	case KDFPBKDF2SHA256:
+		return "pbkdf2"
+	default:
+		return fmt.Sprintf("kdf(%d)", byte(a))
+	}
+}
+
+// ParseKDFAlgorithm converts a user-supplied name into a KDFAlgorithm.
+// An empty name selects Argon2id.
+func ParseKDFAlgorithm(name string) (KDFAlgorithm, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "argon2id", "argon2":
+		return KDFArgon2id, nil
+	case "scrypt":
+		return KDFScrypt, nil
+	case "pbkdf2", "pbkdf2-sha256":
+		return KDFPBKDF2SHA256, nil
+	default:
+		return 0, fmt.Errorf("unsupported key derivation function %q", name)
+	}
+}
+
+// DefaultKDFParams returns the recommended cost parameters for the algorithm
+// together with a fresh random salt
+func DefaultKDFParams(alg KDFAlgorithm) (KDFParams, error) {
+	params := KDFParams{Algorithm: alg}
+
+	switch alg {
+	case KDFArgon2id:
+		// RFC 9106 second recommended option, with a few extra passes
+		params.Time = 3
+		params.Memory = 64 * 1024
+		params.Parallelism = 4
+	case KDFScrypt:
+		params.Time = 15 // N = 32768
+		params.Memory = 8
+		params.Parallelism = 1
+	case KDFPBKDF2SHA256:
+		params.Time = 600000 // OWASP recommendation for PBKDF2-HMAC-SHA256
+	default:
+		return KDFParams{}, fmt.Errorf("unsupported key derivation function %d", alg)
+	}
+
+	params.Salt = make([]byte, KDFSaltSize)
+	if _, err := io.ReadFull(rand.Reader, params.Salt); err != nil {
+		return KDFParams{}, err
+	}
+
+	return params, nil
+}
+
+// validate checks that the parameters are within the supported limits
+func (p KDFParams) validate() error {
+	if len(p.Salt) < minSaltSize || len(p.Salt) > maxSaltSize {
+		return fmt.Errorf("invalid KDF salt length %d", len(p.Salt))
+	}
+
+	switch p.Algorithm {
+	case KDFArgon2id:
+		if p.Time < 1 || p.Time > maxArgon2Time {
+			return fmt.Errorf("argon2id time cost %d out of range", p.Time)
+		}
+		if p.Memory < 8*uint32(p.Parallelism) || p.Memory > maxArgon2Memory {
+			return fmt.Errorf("argon2id memory cost %d KiB out of range", p.Memory)
+		}
+		if p.Parallelism < 1 || p.Parallelism > maxArgon2Threads {
+			return fmt.Errorf("argon2id parallelism %d out of range", p.Parallelism)
+		}
+		if uint64(p.Memory)*1024*uint64(p.Time) > maxKDFWork {
+			return fmt.Errorf("argon2id cost of %d KiB times %d passes is too high", p.Memory, p.Time)
+		}
+	case KDFScrypt:
+		if p.Time < minScryptLogN || p.Time > maxScryptLogN {
+			return fmt.Errorf("scrypt log2(N) %d out of range", p.Time)
+		}
+		if p.Memory < 1 || p.Memory > maxScryptR {
+			return fmt.Errorf("scrypt r %d out of range", p.Memory)
+		}
+		if p.Parallelism < 1 || p.Parallelism > maxScryptP {
+			return fmt.Errorf("scrypt p %d out of range", p.Parallelism)
+		}
+		if err := checkScryptCost(int(p.Time), int(p.Memory), int(p.Parallelism)); err != nil {
+			return err
+		}
+	case KDFPBKDF2SHA256:
+		if p.Time < minPBKDF2Iterations || p.Time > maxPBKDF2Iterations {
+			return fmt.Errorf("pbkdf2 iteration count %d out of range", p.Time)
+		}
+	default:
+		return fmt.Errorf("unsupported key derivation function %d", p.Algorithm)
+	}
+
+	return nil
+}
+
+// checkScryptCost returns an error if scrypt with N = 2^logN, r and p would
+// need more than maxKDFMemory, or more than maxKDFWork over its p passes
+func checkScryptCost(logN, r, p int) error {
+	memory := uint64(128*r) << logN
+	if memory > maxKDFMemory || memory*uint64(p) > maxKDFWork {
+		return fmt.Errorf("scrypt cost of log2(N) %d, r %d and p %d is too high", logN, r, p)
+	}
+	return nil
+}
+
+// deriveKey derives a 32-byte payload key from a password using the given
+// KDF parameters. The caller wipes the key (see secret.go).
+func deriveKey(password []byte, params KDFParams) ([]byte, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	switch params.Algorithm {
+	case KDFArgon2id:
+		return argon2.IDKey(password, params.Salt, params.Time, params.Memory,
+			params.Parallelism, AESKeySize), nil
+	case KDFScrypt:
+		return scrypt.Key(password, params.Salt, 1<<params.Time, int(params.Memory),
+			int(params.Parallelism), AESKeySize)
+	case KDFPBKDF2SHA256:
+		return pbkdf2.Key(password, params.Salt, int(params.Time), AESKeySize, sha256.New), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key derivation function %d", params.Algorithm)
+}
+
+// deriveLegacyKey derives a key the way releases before the salted KDF did:
+// a single unsalted SHA-256 of the password. It is only used to decrypt old data.
+func deriveLegacyKey(password []byte) []byte {
+	key := sha256.Sum256(password)
+	return key[:]
+}
+
+// marshalKDFParams encodes the parameters as
+// algorithm(1) | time(4) | memory(4) | parallelism(1) | saltLen(1) | salt
+func marshalKDFParams(p KDFParams) []byte {
+	buf := make([]byte, kdfParamsFixedSize, kdfParamsFixedSize+len(p.Salt))
+	buf[0] = byte(p.Algorithm)
+	binary.BigEndian.PutUint32(buf[1:5], p.Time)
+	binary.BigEndian.PutUint32(buf[5:9], p.Memory)
+	buf[9] = p.Parallelism
+	buf[10] = byte(len(p.Salt))
+	return append(buf, p.Salt...)
+}
+
+// unmarshalKDFParams decodes parameters written by marshalKDFParams and
+// returns them together with the number of bytes consumed
+func unmarshalKDFParams(data []byte) (KDFParams, int, error) {
+	if len(data) < kdfParamsFixedSize {
+		return KDFParams{}, 0, errors.New("KDF parameters truncated")
+	}
+
+	saltLen := int(data[10])
+	if len(data) < kdfParamsFixedSize+saltLen {
+		return KDFParams{}, 0, errors.New("KDF salt truncated")
+	}
+
+	params := KDFParams{
+		Algorithm:   KDFAlgorithm(data[0]),
+		Time:        binary.BigEndian.Uint32(data[1:5]),
+		Memory:      binary.BigEndian.Uint32(data[5:9]),
+		Parallelism: data[9],
+		Salt:        append([]byte(nil), data[kdfParamsFixedSize:kdfParamsFixedSize+saltLen]...),
+	}
+	if err := params.validate(); err != nil {
+		return KDFParams{}, 0, err
+	}
+
+	return params, kdfParamsFixedSize + saltLen, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestKDFParamsCost(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, KDFSaltSize)
+	tests := []struct {
+		name   string
+		params KDFParams
+		ok     bool
+	}{
+		{"argon2id default", KDFParams{Algorithm: KDFArgon2id, Time: 3, Memory: 64 * 1024, Parallelism: 4}, true},
+		{"argon2id at the memory limit", KDFParams{Algorithm: KDFArgon2id, Time: 4, Memory: maxArgon2Memory, Parallelism: 4}, true},
+		{"argon2id too many passes at the memory limit", KDFParams{Algorithm: KDFArgon2id, Time: 5, Memory: maxArgon2Memory, Parallelism: 4}, false},
+		{"argon2id 1 GiB", KDFParams{Algorithm: KDFArgon2id, Time: 1, Memory: 1024 * 1024, Parallelism: 4}, false},
+		{"argon2id 1 GiB 16 passes", KDFParams{Algorithm: KDFArgon2id, Time: maxArgon2Time, Memory: 1024 * 1024, Parallelism: 4}, false},
+		{"scrypt default", KDFParams{Algorithm: KDFScrypt, Time: 15, Memory: 8, Parallelism: 1}, true},
+		{"scrypt age default", KDFParams{Algorithm: KDFScrypt, Time: 18, Memory: 8, Parallelism: 1}, true},
+		{"scrypt 512 MiB", KDFParams{Algorithm: KDFScrypt, Time: 19, Memory: 8, Parallelism: 1}, false},
+		{"scrypt 16 GiB", KDFParams{Algorithm: KDFScrypt, Time: maxScryptLogN, Memory: maxScryptR, Parallelism: 1}, false},
+		{"scrypt too many passes", KDFParams{Algorithm: KDFScrypt, Time: 17, Memory: 8, Parallelism: maxScryptP}, false},
+		{"scrypt passes within the limit", KDFParams{Algorithm: KDFScrypt, Time: 17, Memory: 8, Parallelism: 8}, true},
+		{"pbkdf2 default", KDFParams{Algorithm: KDFPBKDF2SHA256, Time: 600000}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Salt = salt
+			err := tt.params.validate()
+			if tt.ok && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+// allocatedDuring returns how many bytes f allocates
+func allocatedDuring(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestOversizedKDFRejectedBeforeDerivation(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, KDFSaltSize)
+	oversized := []KDFParams{
+		{Algorithm: KDFScrypt, Time: maxScryptLogN, Memory: maxScryptR, Parallelism: 1, Salt: salt},
+		{Algorithm: KDFArgon2id, Time: maxArgon2Time, Memory: 1024 * 1024, Parallelism: 4, Salt: salt},
+	}
+	for _, params := range oversized {
+		t.Run(params.Algorithm.String(), func(t *testing.T) {
+			// A password stanza as an attacker would put it in a header
+			body := append(marshalKDFParams(params), make([]byte, FileKeySize+chacha20poly1305.Overhead)...)
+			stanzas := []RecipientStanza{{Type: stanzaPassword, Body: body}}
+
+			var err error
+			allocated := allocatedDuring(func() {
+				_, _, err = unwrapDataKey(stanzas, DecryptOptions{Password: []byte("password")})
+			})
+			if !errors.Is(err, ErrMalformedHeader) {
+				t.Errorf("unwrapDataKey returned %v, want ErrMalformedHeader", err)
+			}
+			// Deriving would have allocated hundreds of megabytes at least
+			if allocated > 1<<20 {
+				t.Errorf("rejecting the stanza allocated %d bytes", allocated)
+			}
+
+			if _, err := deriveKey([]byte("password"), params); err == nil {
+				t.Error("deriveKey accepted the parameters")
+			}
+		})
+	}
+
+	t.Run("age", func(t *testing.T) {
+		stanza := ageStanza{
+			Type: "scrypt",
+			Args: []string{ageBase64.EncodeToString(make([]byte, ageScryptSalt)), "22"},
+			Body: make([]byte, ageFileKeySize+chacha20poly1305.Overhead),
+		}
+		var err error
+		allocated := allocatedDuring(func() {
+			_, err = unwrapAgeScrypt(stanza, []byte("password"))
+		})
+		if !errors.Is(err, ErrMalformedAge) {
+			t.Errorf("unwrapAgeScrypt returned %v, want ErrMalformedAge", err)
+		}
+		if allocated > 1<<20 {
+			t.Errorf("rejecting the stanza allocated %d bytes", allocated)
+		}
+	})
+}
+
+func TestPasswordStanzaLimit(t *testing.T) {
+	params, err := DefaultKDFParams(KDFScrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Time = minScryptLogN
+	stanza := append(marshalKDFParams(params), make([]byte, FileKeySize+chacha20poly1305.Overhead)...)
+
+	encode := func(n int) []byte {
+		var field bytes.Buffer
+		for i := 0; i < n; i++ {
+			if err := writeField(&field, stanzaPassword, stanza); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return field.Bytes()
+	}
+
+	if stanzas, err := parseStanzas(encode(maxPasswordStanzas)); err != nil || len(stanzas) != maxPasswordStanzas {
+		t.Fatalf("parsing %d password stanzas returned %d stanzas, %v", maxPasswordStanzas, len(stanzas), err)
+	}
+	if _, err := parseStanzas(encode(maxPasswordStanzas + 1)); !errors.Is(err, ErrMalformedHeader) {
+		t.Fatalf("parsing %d password stanzas returned %v, want ErrMalformedHeader", maxPasswordStanzas+1, err)
+	}
+}
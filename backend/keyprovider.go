@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Key providers
+//
+// A key provider holds keys on the server's side and wraps data keys with
+// them, so that clients can refer to a key by ID instead of sending secret
+// material. Key references have the form "provider:keyID", for example
+// "keyring:photos", "env:TEAM" or "vault:images"; a reference without a
+// provider name uses the local keyring.
+//
+// A data key wrapped by a provider is stored in a stanza of type 0x04:
+//
+//	providerLen(1) | provider | keyIDLen(1) | keyID | wrapped key
+//
+// so the header records which key was used. Naming a key ID is not enough
+// to decrypt with it over the HTTP API: the request must also carry the key
+// access token from SIMG_KEY_ACCESS_TOKEN, and if SIMG_KEY_ACCESS_ALLOW lists
+// key references, only those may be used. Managing the keyring over HTTP
+// needs the same token. Without a token, both are disabled.
+
+const (
+	// defaultKeyProvider is used for key references without a provider name
+	defaultKeyProvider = "keyring"
+
+	// SecretKeySize is the size of the keys held by the keyring and env providers
+	SecretKeySize = 32
+)
+
+var (
+	// ErrUnknownKey is returned when a provider has no key with the requested ID
+	ErrUnknownKey = errors.New("unknown key ID")
+
+	// ErrUnknownKeyProvider is returned for key references to a provider that
+	// is not configured
+	ErrUnknownKeyProvider = errors.New("key provider is not configured")
+
+	// ErrKeyAccessDenied is returned when a request may not decrypt with the
+	// server-held keys it names
+	ErrKeyAccessDenied = errors.New("use of server-held keys is not allowed")
+
+	// ErrKeyAccessTokenRequired is returned when a request that uses or
+	// manages server-held keys carries no key access token
+	ErrKeyAccessTokenRequired = fmt.Errorf("%w: a key access token is required", ErrKeyAccessDenied)
+)
+
+// KeyProvider wraps and unwraps data keys with keys it identifies by ID
+type KeyProvider interface {
+	// Name is the provider part of key references, e.g. "keyring"
+	Name() string
+
+	// WrapKey encrypts a data key with the key keyID
+	WrapKey(keyID string, dek []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key wrapped by WrapKey
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+var (
+	// Registered key providers, by name
+	keyProviders      = make(map[string]KeyProvider)
+	keyProvidersMutex sync.RWMutex
+)
+
+// RegisterKeyProvider makes a provider available to key references
+func RegisterKeyProvider(provider KeyProvider) {
+	keyProvidersMutex.Lock()
+	defer keyProvidersMutex.Unlock()
+	keyProviders[provider.Name()] = provider
+}
+
+// lookupKeyProvider returns the registered provider with the given name
+func lookupKeyProvider(name string) (KeyProvider, error) {
+	keyProvidersMutex.RLock()
+	defer keyProvidersMutex.RUnlock()
+	provider, exists := keyProviders[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKeyProvider, name)
+	}
+	return provider, nil
+}
+
+// RegisteredKeyProviders returns the names of the configured providers
+func RegisteredKeyProviders() []string {
+	keyProvidersMutex.RLock()
+	defer keyProvidersMutex.RUnlock()
+	names := make([]string, 0, len(keyProviders))
+	for name := range keyProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseKeyRef splits a "provider:keyID" reference. The provider defaults to
+// the local keyring.
+func ParseKeyRef(ref string) (provider, keyID string, err error) {
+	ref = strings.TrimSpace(ref)
+	provider, keyID, found := strings.Cut(ref, ":")
+	if !found {
+		provider, keyID = defaultKeyProvider, ref
+	}
+	if provider == "" || keyID == "" || len(provider) > 0xff || len(keyID) > 0xff {
+		return "", "", fmt.Errorf("invalid key ID %q", ref)
+	}
+	return provider, keyID, nil
+}
+
+// ParseKeyRefs normalises a list of key references, where each entry may hold
+// several comma separated references
+func ParseKeyRefs(values []string) ([]string, error) {
+	var refs []string
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			provider, keyID, err := ParseKeyRef(entry)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, provider+":"+keyID)
+		}
+	}
+	return refs, nil
+}
+
+// KeyAccessPolicy decides which requests may decrypt with server-held keys
+type KeyAccessPolicy struct {
+	// Token must be presented by requests that decrypt with key IDs. An
+	// empty token disables decrypting with key IDs over the HTTP API.
+	Token string
+
+	// Allowed lists the key references requests may use; if it is empty,
+	// every configured key may be used
+	Allowed []string
+}
+
+// keyAccess is the key access policy of this server
+var keyAccess KeyAccessPolicy
+
+// authorize checks that a request presenting token may decrypt with refs
+func (p KeyAccessPolicy) authorize(token string, refs []string) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	if err := p.authorizeToken(token); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if !p.allows(ref) {
+			return fmt.Errorf("%w: key %s", ErrKeyAccessDenied, ref)
+		}
+	}
+	return nil
+}
+
+// authorizeToken checks the token of a request that uses or manages
+// server-held keys
+func (p KeyAccessPolicy) authorizeToken(token string) error {
+	if p.Token == "" {
+		return fmt.Errorf("%w: server-held keys are disabled on this server", ErrKeyAccessDenied)
+	}
+	if token == "" {
+		return ErrKeyAccessTokenRequired
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) != 1 {
+		return fmt.Errorf("%w: invalid key access token", ErrKeyAccessDenied)
+	}
+	return nil
+}
+
+// allows reports whether requests may use the key ref
+func (p KeyAccessPolicy) allows(ref string) bool {
+	return len(p.Allowed) == 0 || slices.Contains(p.Allowed, ref)
+}
+
+// wrapDataKeyProvider wraps the DEK with the key named by ref
+func wrapDataKeyProvider(dek []byte, ref string) (RecipientStanza, error) {
+	providerName, keyID, err := ParseKeyRef(ref)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+	provider, err := lookupKeyProvider(providerName)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	wrapped, err := provider.WrapKey(keyID, dek)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("key %s:%s: %w", providerName, keyID, err)
+	}
+
+	body := make([]byte, 0, 2+len(providerName)+len(keyID)+len(wrapped))
+	body = append(body, byte(len(providerName)))
+	body = append(body, providerName...)
+	body = append(body, byte(len(keyID)))
+	body = append(body, keyID...)
+	body = append(body, wrapped...)
+	return RecipientStanza{Type: stanzaKeyProvider, Body: body}, nil
+}
+
+// parseKeyProviderStanza splits a key provider stanza into its reference and wrapped key
+func parseKeyProviderStanza(body []byte) (ref string, wrapped []byte, err error) {
+	if len(body) < 1 || len(body) < 1+int(body[0])+1 {
+		return "", nil, fmt.Errorf("%w: truncated key provider stanza", ErrMalformedHeader)
+	}
+	provider := string(body[1 : 1+body[0]])
+	rest := body[1+len(provider):]
+	if len(rest) < 1+int(rest[0]) {
+		return "", nil, fmt.Errorf("%w: truncated key provider stanza", ErrMalformedHeader)
+	}
+	keyID := string(rest[1 : 1+rest[0]])
+	return provider + ":" + keyID, rest[1+len(keyID):], nil
+}
+
+// unwrapDataKeyProvider recovers the DEK from a key provider stanza
+func unwrapDataKeyProvider(ref string, wrapped []byte) ([]byte, error) {
+	providerName, keyID, err := ParseKeyRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := lookupKeyProvider(providerName)
+	if err != nil {
+		return nil, err
+	}
+	return provider.UnwrapKey(keyID, wrapped)
+}
+
+// wrapWithSecretKey seals a data key with a locally held key as
+// nonce(24) | XChaCha20-Poly1305 ciphertext, bound to the key ID
+func wrapWithSecretKey(key []byte, keyID string, dek []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same key wraps many data keys, so every wrap gets a random nonce
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dek)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dek, []byte(keyID)), nil
+}
+
+// unwrapWithSecretKey opens a data key sealed by wrapWithSecretKey
+func unwrapWithSecretKey(key []byte, keyID string, wrapped []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: wrapped key too short", ErrMalformedHeader)
+	}
+	nonce := wrapped[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+// EnvKeyProvider reads keys from environment variables: key ID "team" is the
+// base64 encoded 32-byte key in SIMG_KEY_TEAM
+type EnvKeyProvider struct {
+	Prefix string
+}
+
+// envKeyPrefix is the default prefix of the environment variables holding keys
+const envKeyPrefix = "SIMG_KEY_"
+
+// Name returns "env"
+func (p EnvKeyProvider) Name() string {
+	return "env"
+}
+
+// key reads and decodes the variable for keyID
+func (p EnvKeyProvider) key(keyID string) ([]byte, error) {
+	name := p.Prefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(keyID))
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != SecretKeySize {
+		return nil, fmt.Errorf("%s must hold a base64 encoded %d-byte key", name, SecretKeySize)
+	}
+	return key, nil
+}
+
+// WrapKey wraps a data key with the key in the environment
+func (p EnvKeyProvider) WrapKey(keyID string, dek []byte) ([]byte, error) {
+	key, err := p.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return wrapWithSecretKey(key, keyID, dek)
+}
+
+// UnwrapKey unwraps a data key with the key in the environment
+func (p EnvKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, err := p.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return unwrapWithSecretKey(key, keyID, wrapped)
+}
+
+// Environment variables used to configure the key providers
+const (
+	envKeyringPath       = "SIMG_KEYRING"
+	envKeyringPassphrase = "SIMG_KEYRING_PASSPHRASE"
+	envVaultAddr         = "VAULT_ADDR"
+	envVaultToken        = "VAULT_TOKEN"
+	envVaultMount        = "VAULT_TRANSIT_MOUNT"
+	envKeyAccessToken    = "SIMG_KEY_ACCESS_TOKEN"
+	envKeyAccessAllow    = "SIMG_KEY_ACCESS_ALLOW"
+)
+
+// ConfigureKeyProviders registers the key providers configured in the
+// environment and reads the key access policy. The env provider is always
+// available; the keyring needs SIMG_KEYRING_PASSPHRASE and Vault needs
+// VAULT_ADDR and VAULT_TOKEN.
+func ConfigureKeyProviders() {
+	RegisterKeyProvider(EnvKeyProvider{Prefix: envKeyPrefix})
+
+	keyAccess = KeyAccessPolicy{Token: os.Getenv(envKeyAccessToken)}
+	if allow := os.Getenv(envKeyAccessAllow); allow != "" {
+		refs, err := ParseKeyRefs([]string{allow})
+		if err != nil {
+			log.Printf("Ignoring %s: %v", envKeyAccessAllow, err)
+			refs = nil
+		}
+		if len(refs) == 0 {
+			// An unreadable allow-list must not widen access to every key
+			keyAccess.Token = ""
+		}
+		keyAccess.Allowed = refs
+	}
+	if keyAccess.Token == "" {
+		log.Printf("%s is not set, decrypting with key IDs and managing the keyring over HTTP are disabled", envKeyAccessToken)
+	}
+
+	if passphrase := secretBytes(os.Getenv(envKeyringPassphrase)); len(passphrase) > 0 {
+		path := os.Getenv(envKeyringPath)
+		if path == "" {
+			path = KeyringPath
+		}
+		keyring, err := OpenKeyring(path, passphrase)
+		wipe(passphrase)
+		if err != nil {
+			log.Printf("Keyring %s not available: %v", path, err)
+		} else {
+			RegisterKeyProvider(keyring)
+		}
+	}
+
+	if addr := os.Getenv(envVaultAddr); addr != "" {
+		RegisterKeyProvider(NewVaultTransitProvider(addr, os.Getenv(envVaultToken), os.Getenv(envVaultMount)))
+	}
+
+	log.Printf("Key providers: %s", strings.Join(RegisteredKeyProviders(), ", "))
+}
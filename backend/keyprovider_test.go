@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEnvKeyProvider(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, SecretKeySize)
+	t.Setenv("SIMG_KEY_TEAM_PHOTOS", " "+base64.StdEncoding.EncodeToString(key)+"\n")
+	t.Setenv("SIMG_KEY_SHORT", base64.StdEncoding.EncodeToString(key[:16]))
+	t.Setenv("SIMG_KEY_NOT_BASE64", "not base64!")
+
+	provider := EnvKeyProvider{Prefix: envKeyPrefix}
+	dek, err := newFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "team-photos" and "team.photos" both name SIMG_KEY_TEAM_PHOTOS, but a
+	// wrapped key is bound to the key ID it was wrapped for
+	wrapped, err := provider.WrapKey("team-photos", dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := provider.UnwrapKey("team-photos", wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Error("unwrapped key differs from the data key")
+	}
+	if _, err := provider.UnwrapKey("team.photos", wrapped); err == nil {
+		t.Error("a key wrapped for one key ID unwrapped with another")
+	}
+
+	if _, err := provider.WrapKey("missing", dek); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v, want ErrUnknownKey", err)
+	}
+	for _, id := range []string{"short", "not-base64"} {
+		if _, err := provider.WrapKey(id, dek); err == nil || !strings.Contains(err.Error(), "must hold a base64 encoded") {
+			t.Errorf("%s: got error %v, want an invalid key", id, err)
+		}
+	}
+
+	tampered := bytes.Clone(wrapped)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := provider.UnwrapKey("team-photos", tampered); err == nil {
+		t.Error("a tampered wrapped key unwrapped")
+	}
+	if _, err := provider.UnwrapKey("team-photos", wrapped[:10]); !errors.Is(err, ErrMalformedHeader) {
+		t.Errorf("got error %v, want ErrMalformedHeader", err)
+	}
+}
+
+func TestEnvKeyProviderContainer(t *testing.T) {
+	t.Setenv("SIMG_KEY_TEAM", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, SecretKeySize)))
+	useKeyProvider(t, EnvKeyProvider{Prefix: envKeyPrefix})
+
+	plaintext := []byte("an image wrapped by an environment key")
+	ciphertext, err := EncryptDataWithOptions(plaintext, nil, EncryptOptions{KeyIDs: []string{"env:team"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{KeyIDs: []string{"env:team"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("decrypted data differs from the original")
+	}
+
+	// Once the variable changes the image no longer opens
+	t.Setenv("SIMG_KEY_TEAM", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x43}, SecretKeySize)))
+	if _, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{KeyIDs: []string{"env:team"}}); err == nil {
+		t.Error("the image opened with a different key")
+	}
+}
+
+func TestParseKeyRefs(t *testing.T) {
+	refs, err := ParseKeyRefs([]string{"photos, env:team", "", "vault:images"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"keyring:photos", "env:team", "vault:images"}
+	if strings.Join(refs, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", refs, want)
+	}
+	for _, bad := range []string{":photos", "env:", strings.Repeat("x", 256)} {
+		if _, err := ParseKeyRefs([]string{bad}); err == nil {
+			t.Errorf("%q parsed as a key reference", bad)
+		}
+	}
+}
+
+func TestKeyAccessPolicy(t *testing.T) {
+	refs := []string{"env:team"}
+	tests := []struct {
+		name   string
+		policy KeyAccessPolicy
+		token  string
+		refs   []string
+		ok     bool
+	}{
+		{"no key IDs", KeyAccessPolicy{}, "", nil, true},
+		{"disabled", KeyAccessPolicy{}, "", refs, false},
+		{"disabled with a token", KeyAccessPolicy{}, "secret", refs, false},
+		{"missing token", KeyAccessPolicy{Token: "secret"}, "", refs, false},
+		{"wrong token", KeyAccessPolicy{Token: "secret"}, "guess", refs, false},
+		{"right token", KeyAccessPolicy{Token: "secret"}, "secret", refs, true},
+		{"allowed key", KeyAccessPolicy{Token: "secret", Allowed: []string{"env:team", "vault:images"}}, "secret", refs, true},
+		{"key not allowed", KeyAccessPolicy{Token: "secret", Allowed: []string{"vault:images"}}, "secret", refs, false},
+		{"one of two keys not allowed", KeyAccessPolicy{Token: "secret", Allowed: []string{"env:team"}}, "secret", []string{"env:team", "env:other"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.authorize(tt.token, tt.refs)
+			if tt.ok && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrKeyAccessDenied) {
+				t.Errorf("got %v, want ErrKeyAccessDenied", err)
+			}
+		})
+	}
+}
+
+func TestDecryptWithKeyIDNeedsAccessToken(t *testing.T) {
+	t.Setenv("SIMG_KEY_TEAM", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, SecretKeySize)))
+	useKeyProvider(t, EnvKeyProvider{Prefix: envKeyPrefix})
+	previous := keyAccess
+	t.Cleanup(func() { keyAccess = previous })
+
+	plaintext := testPNG(t)
+	ciphertext, err := EncryptDataWithOptions(plaintext, nil, EncryptOptions{KeyIDs: []string{"env:team"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyAccess = KeyAccessPolicy{}
+	if rec := postForm(t, handleServerDecrypt, "image.enc", ciphertext, map[string]string{"keyId": "env:team"}); rec.Code != http.StatusForbidden {
+		t.Errorf("without a configured token: status %d, want 403", rec.Code)
+	}
+
+	keyAccess = KeyAccessPolicy{Token: "access token"}
+	if rec := postForm(t, handleServerDecrypt, "image.enc", ciphertext, map[string]string{"keyId": "env:team"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want 401", rec.Code)
+	}
+	if rec := postForm(t, handleServerDecrypt, "image.enc", ciphertext, map[string]string{"keyId": "env:team", "keyToken": "guess"}); rec.Code != http.StatusForbidden {
+		t.Errorf("with the wrong token: status %d, want 403", rec.Code)
+	}
+	rec := postForm(t, handleServerDecrypt, "image.enc", ciphertext, map[string]string{"keyId": "env:team", "keyToken": "access token"})
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), plaintext) {
+		t.Errorf("with the token: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	// The TCP retrieval endpoint checks the token before fetching anything
+	rec = postJSON(t, handleRequestDecrypt, RequestDecryptRequest{ServerAddr: "127.0.0.1:1", ImageID: "photo", KeyIDs: []string{"env:team"}})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("request decrypt without a token: status %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// KeyringPath is the default location of the local keyring file
+const KeyringPath = "./assets/keys/keyring.simg"
+
+// Keyring is a KeyProvider backed by a local file. The file is a JSON map of
+// key IDs to base64 keys, encrypted as a container with the keyring passphrase.
+type Keyring struct {
+	path       string
+	passphrase []byte
+
+	mu   sync.RWMutex
+	keys map[string][]byte
+}
+
+// OpenKeyring loads the keyring at path, or starts an empty one if the file
+// does not exist yet. The keyring keeps its own copy of the passphrase, so
+// the caller may wipe passphrase as soon as OpenKeyring returns.
+func OpenKeyring(path string, passphrase []byte) (*Keyring, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("a keyring passphrase is required")
+	}
+
+	k := &Keyring{path: path, passphrase: bytes.Clone(passphrase), keys: make(map[string][]byte)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		k.Close()
+		return nil, err
+	}
+
+	plaintext, err := DecryptData(data, passphrase)
+	if err != nil {
+		k.Close()
+		return nil, fmt.Errorf("failed to unlock keyring: %w", err)
+	}
+	defer wipe(plaintext)
+
+	var encoded map[string]string
+	if err := json.Unmarshal(plaintext, &encoded); err != nil {
+		k.Close()
+		return nil, fmt.Errorf("invalid keyring: %v", err)
+	}
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != SecretKeySize {
+			k.Close()
+			return nil, fmt.Errorf("invalid keyring entry %q", id)
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+// Close wipes the passphrase and the keys held in memory. The keyring cannot
+// be used afterwards.
+func (k *Keyring) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	wipe(k.passphrase)
+	k.passphrase = nil
+	for id, key := range k.keys {
+		wipe(key)
+		delete(k.keys, id)
+	}
+}
+
+// Name returns "keyring"
+func (k *Keyring) Name() string {
+	return defaultKeyProvider
+}
+
+// GenerateKey adds a new random key under keyID and saves the keyring
+func (k *Keyring) GenerateKey(keyID string) error {
+	if _, _, err := ParseKeyRef(keyID); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, exists := k.keys[keyID]; exists {
+		return fmt.Errorf("key %q already exists", keyID)
+	}
+
+	key := make([]byte, SecretKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	k.keys[keyID] = key
+
+	if err := k.save(); err != nil {
+		delete(k.keys, keyID)
+		return err
+	}
+	return nil
+}
+
+// KeyIDs returns the IDs of the keys in the keyring
+func (k *Keyring) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// save encrypts the keyring and replaces the file. The caller holds k.mu.
+func (k *Keyring) save() error {
+	encoded := make(map[string]string, len(k.keys))
+	for id, key := range k.keys {
+		encoded[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	plaintext, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	defer wipe(plaintext)
+
+	data, err := EncryptData(plaintext, k.passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return fmt.Errorf("failed to create keyring directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), "keyring-*")
+	if err != nil {
+		return fmt.Errorf("failed to write keyring: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write keyring: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write keyring: %v", err)
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
+
+// key returns the key stored under keyID
+func (k *Keyring) key(keyID string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, exists := k.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	return key, nil
+}
+
+// WrapKey wraps a data key with a keyring key
+func (k *Keyring) WrapKey(keyID string, dek []byte) ([]byte, error) {
+	key, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return wrapWithSecretKey(key, keyID, dek)
+}
+
+// UnwrapKey unwraps a data key with a keyring key
+func (k *Keyring) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapWithSecretKey(key, keyID, wrapped)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestKeyringRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "keyring.simg")
+	passphrase := []byte("keyring passphrase")
+
+	keyring, err := OpenKeyring(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The keyring keeps its own copy, so the caller may wipe its passphrase
+	wipe(passphrase)
+	passphrase = []byte("keyring passphrase")
+
+	if len(keyring.KeyIDs()) != 0 {
+		t.Fatalf("new keyring has keys %v", keyring.KeyIDs())
+	}
+	for _, id := range []string{"photos", "scans"} {
+		if err := keyring.GenerateKey(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keyring.GenerateKey("photos"); err == nil {
+		t.Error("a key ID was generated twice")
+	}
+
+	dek, err := newFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := keyring.WrapKey("photos", dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenKeyring(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := reopened.KeyIDs(); !slices.Equal(ids, []string{"photos", "scans"}) {
+		t.Errorf("reopened keyring has keys %v", ids)
+	}
+	unwrapped, err := reopened.UnwrapKey("photos", wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Error("unwrapped key differs from the data key")
+	}
+
+	// A wrapped key is bound to its key ID
+	if _, err := reopened.UnwrapKey("scans", wrapped); err == nil {
+		t.Error("a key wrapped for one key ID unwrapped with another")
+	}
+	if _, err := reopened.WrapKey("missing", dek); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v, want ErrUnknownKey", err)
+	}
+
+	reopened.Close()
+	if _, err := reopened.UnwrapKey("photos", wrapped); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("closed keyring still unwraps keys: %v", err)
+	}
+}
+
+func TestKeyringWrongPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.simg")
+	keyring, err := OpenKeyring(path, []byte("right passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.GenerateKey("photos"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenKeyring(path, []byte("wrong passphrase")); !isWrongKey(err) {
+		t.Errorf("got error %v, want a wrong key", err)
+	}
+	if _, err := OpenKeyring(path, nil); err == nil {
+		t.Error("a keyring opened without a passphrase")
+	}
+
+	// A corrupted file is refused rather than treated as an empty keyring
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenKeyring(path, []byte("right passphrase")); err == nil {
+		t.Error("a corrupted keyring opened")
+	}
+}
+
+func TestKeyringContainer(t *testing.T) {
+	keyring, err := OpenKeyring(filepath.Join(t.TempDir(), "keyring.simg"), []byte("keyring passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.GenerateKey("photos"); err != nil {
+		t.Fatal(err)
+	}
+	useKeyProvider(t, keyring)
+
+	plaintext := []byte("an image wrapped by the keyring")
+	ciphertext, err := EncryptDataWithOptions(plaintext, nil, EncryptOptions{KeyIDs: []string{"photos"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{KeyIDs: []string{"keyring:photos"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("decrypted data differs from the original")
+	}
+}
+
+func TestKeyringEndpointNeedsAccessToken(t *testing.T) {
+	keyring, err := OpenKeyring(filepath.Join(t.TempDir(), "keyring.simg"), []byte("keyring passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.GenerateKey("photos"); err != nil {
+		t.Fatal(err)
+	}
+	useKeyProvider(t, keyring)
+	previous := keyAccess
+	t.Cleanup(func() { keyAccess = previous })
+	keyAccess = KeyAccessPolicy{Token: "access token"}
+
+	list := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/keyring", nil)
+		if token != "" {
+			r.Header.Set("X-Key-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		handleKeyring(rec, r)
+		return rec
+	}
+	create := func(body map[string]string) *httptest.ResponseRecorder {
+		return postJSON(t, handleKeyring, body)
+	}
+
+	tests := []struct {
+		name string
+		rec  *httptest.ResponseRecorder
+		code int
+	}{
+		{"GET without a token", list(""), http.StatusUnauthorized},
+		{"GET with the wrong token", list("guess"), http.StatusForbidden},
+		{"POST without a token", create(map[string]string{"keyId": "stolen"}), http.StatusUnauthorized},
+		{"POST with the wrong token", create(map[string]string{"keyId": "stolen", "keyToken": "guess"}), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if tt.rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, tt.rec.Code, tt.code)
+		}
+		if strings.Contains(tt.rec.Body.String(), "photos") {
+			t.Errorf("%s: response lists the keyring: %s", tt.name, tt.rec.Body)
+		}
+	}
+	if slices.Contains(keyring.KeyIDs(), "stolen") {
+		t.Error("an unauthenticated request created a key")
+	}
+
+	// Without a configured token, keyring management is disabled
+	keyAccess = KeyAccessPolicy{}
+	if rec := list("access token"); rec.Code != http.StatusForbidden {
+		t.Errorf("GET on a server without a token: status %d, want 403", rec.Code)
+	}
+
+	keyAccess = KeyAccessPolicy{Token: "access token", Allowed: []string{"keyring:photos", "keyring:scans"}}
+	if rec := create(map[string]string{"keyId": "scans", "keyToken": "access token"}); rec.Code != http.StatusOK {
+		t.Fatalf("POST with the token: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := create(map[string]string{"keyId": "other", "keyToken": "access token"}); rec.Code != http.StatusForbidden {
+		t.Errorf("POST of a key outside the allow-list: status %d, want 403", rec.Code)
+	}
+	if err := keyring.GenerateKey("hidden"); err != nil {
+		t.Fatal(err)
+	}
+	rec := list("access token")
+	var listed struct {
+		KeyIDs []string `json:"keyIds"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET with the token: status %d: %s", rec.Code, rec.Body)
+	}
+	if !slices.Equal(listed.KeyIDs, []string{"keyring:photos", "keyring:scans"}) {
+		t.Errorf("listed %v, want the allowed keys", listed.KeyIDs)
+	}
+}
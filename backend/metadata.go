@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Image metadata
+//
+// A version 3 container can carry a record describing the original image:
+// its filename, MIME type, dimensions, the processing applied before it was
+// encrypted, and timestamps. The record is JSON, sealed into the optional
+// header field 0x80 as
+//
+//	nonce | AEAD(record)
+//
+// with the payload cipher suite, under a key derived from the DEK with HKDF
+// ("simg/image-metadata/v1"). Only holders of a key can read it, and as part
+// of the header it is covered by the header MAC and the segment additional
+// data. Rewrapping keeps it unchanged and rekeying carries it over.
+//
+// Readers that predate the field skip it, since it is optional.
+
+const (
+	// imageMetadataInfo is the HKDF info string for the metadata key
+	imageMetadataInfo = "simg/image-metadata/v1"
+
+	// maxImageHistory bounds the processing steps kept in the record
+	maxImageHistory = 64
+
+	// maxImageMetadataText bounds the filename, MIME type and each history entry
+	maxImageMetadataText = 255
+)
+
+// ImageMetadata describes the original image of an encrypted container
+type ImageMetadata struct {
+	Filename string `json:"filename,omitempty"`
+	MIMEType string `json:"mimeType,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+
+	// History lists the processing steps applied before encryption, oldest first
+	History []string `json:"history,omitempty"`
+
+	// Created is when the original image was created or last modified, if
+	// the client knows; Encrypted is when the container was written
+	Created   time.Time `json:"created,omitzero"`
+	Encrypted time.Time `json:"encrypted,omitzero"`
+}
+
+// sanitize trims the record to what is safe to store and to echo back in
+// response headers
+func (m *ImageMetadata) sanitize() {
+	m.Filename = cleanMetadataText(filepath.Base(strings.ReplaceAll(m.Filename, `\`, "/")))
+	if m.Filename == "." || m.Filename == "/" {
+		m.Filename = ""
+	}
+	if mediaType, _, err := mime.ParseMediaType(m.MIMEType); err == nil && len(mediaType) <= maxImageMetadataText {
+		m.MIMEType = mediaType
+	} else {
+		m.MIMEType = ""
+	}
+	if m.Width < 0 || m.Height < 0 {
+		m.Width, m.Height = 0, 0
+	}
+	if len(m.History) > maxImageHistory {
+		m.History = m.History[len(m.History)-maxImageHistory:]
+	}
+	for i, step := range m.History {
+		m.History[i] = cleanMetadataText(step)
+	}
+}
+
+// cleanMetadataText drops control characters and caps the length
+func cleanMetadataText(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, ""))
+	for len(s) > maxImageMetadataText {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return strings.TrimSpace(s)
+}
+
+// imageMetadataKey derives the key that seals the metadata record
+func imageMetadataKey(dek []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, dek, nil, imageMetadataInfo, FileKeySize)
+}
+
+// sealImageMetadata encrypts the metadata record for the header
+func sealImageMetadata(dek []byte, suite CipherSuite, meta *ImageMetadata) ([]byte, error) {
+	record := *meta
+	record.History = append([]string(nil), meta.History...)
+	record.sanitize()
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := imageMetadataKey(dek)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openImageMetadata decrypts the metadata record of a header
+func openImageMetadata(dek []byte, suite CipherSuite, sealed []byte) (*ImageMetadata, error) {
+	key, err := imageMetadataKey(dek)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: image metadata too short", ErrMalformedHeader)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("image metadata: %w", ErrAuthenticationFailed)
+	}
+
+	meta := &ImageMetadata{}
+	if err := json.Unmarshal(plaintext, meta); err != nil {
+		return nil, fmt.Errorf("%w: image metadata: %v", ErrMalformedHeader, err)
+	}
+	meta.sanitize()
+	return meta, nil
+}
+
+// DescribeImage builds the metadata record of an image about to be
+// encrypted. The MIME type is sniffed when contentType is empty or generic,
+// and the dimensions are read from the image header for formats the server
+// can decode. src is rewound afterwards.
+func DescribeImage(src io.ReadSeeker, filename, contentType string) (*ImageMetadata, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if contentType == "" || strings.HasPrefix(contentType, "application/octet-stream") {
+		contentType = http.DetectContentType(head[:n])
+	}
+
+	meta := &ImageMetadata{Filename: filename, MIMEType: contentType}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if config, _, err := image.DecodeConfig(src); err == nil {
+		meta.Width, meta.Height = config.Width, config.Height
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	meta.sanitize()
+	return meta, nil
+}
+
+// ContentDisposition returns an attachment Content-Disposition with the
+// original filename, or "" if the record has none
+func (m *ImageMetadata) ContentDisposition() string {
+	if m.Filename == "" {
+		return ""
+	}
+	return attachmentDisposition(m.Filename)
+}
+
+// attachmentDisposition returns an attachment Content-Disposition for name.
+// The filename is quoted, or RFC 2231 encoded outside ASCII, so that it
+// cannot add parameters or break the header.
+func attachmentDisposition(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+// HeaderValue returns the record as JSON that is safe to use as an HTTP header
+// value: characters outside ASCII are written as \u escapes
+func (m *ImageMetadata) HeaderValue() string {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	var b bytes.Buffer
+	for _, r := range string(encoded) {
+		if r < 0x80 {
+			b.WriteRune(r)
+			continue
+		}
+		for _, unit := range utf16.Encode([]rune{r}) {
+			fmt.Fprintf(&b, `\u%04x`, unit)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// OpenSSL enc format
+//
+// Partners that use "openssl enc" send files in its salted format:
+//
+//	"Salted__" | salt(8) | AES ciphertext
+//
+// The key and IV are derived from the password and salt, either with PBKDF2
+// ("-pbkdf2", "-iter") or with the legacy EVP_BytesToKey. CBC ciphertext is
+// PKCS #7 padded, CTR ciphertext is not. Nothing in the file records the
+// cipher, key derivation or digest, so the reader has to know them; the
+// defaults match "openssl enc -aes-256-cbc -pbkdf2".
+//
+// The format is not authenticated: a wrong password usually shows up as bad
+// CBC padding, but tampered data and any CTR ciphertext decrypt to garbage
+// without an error. It is only offered for exchange with OpenSSL users. With
+// "-a", OpenSSL writes the same data as base64 in 64 column lines, which is
+// recognised by its "U2FsdGVkX1" prefix.
+
+const (
+	// opensslMagic starts every salted OpenSSL file
+	opensslMagic = "Salted__"
+
+	// opensslSaltSize is the size of the salt following the magic
+	opensslSaltSize = 8
+
+	// opensslDefaultIterations is the PBKDF2 iteration count of "openssl enc -pbkdf2"
+	opensslDefaultIterations = 10000
+
+	// opensslBufferSize is how much data is processed at a time, a multiple of the AES block size
+	opensslBufferSize = 64 * 1024
+
+	// base64OpenSSLMagic is the base64 encoding of the magic, as written by "openssl enc -a"
+	base64OpenSSLMagic = "U2FsdGVkX1"
+)
+
+// ErrBadPadding is returned when CBC padding of OpenSSL data is invalid,
+// which almost always means the password or parameters are wrong
+var ErrBadPadding = errors.New("bad decrypt - incorrect password, wrong OpenSSL parameters or corrupted data")
+
+// OpenSSLParams selects how OpenSSL data is encrypted, named after the
+// options of "openssl enc". Empty fields take the defaults of
+// "openssl enc -aes-256-cbc -pbkdf2".
+type OpenSSLParams struct {
+	// Cipher is aes-128-cbc, aes-192-cbc, aes-256-cbc or the -ctr variants
+	Cipher string
+
+	// KDF is "pbkdf2" or "evp" for the legacy EVP_BytesToKey
+	KDF string
+
+	// Digest is the hash used by the KDF: "sha256", or "md5" as used by
+	// EVP_BytesToKey in OpenSSL before 1.1.0. EVP_BytesToKey defaults to MD5.
+	Digest string
+
+	// Iterations is the PBKDF2 iteration count ("-iter")
+	Iterations int
+}
+
+// resolve validates the parameters and fills in the defaults
+func (p OpenSSLParams) resolve() (OpenSSLParams, error) {
+	p.Cipher = strings.ToLower(strings.TrimSpace(p.Cipher))
+	p.KDF = strings.ToLower(strings.TrimSpace(p.KDF))
+	p.Digest = strings.ToLower(strings.TrimSpace(p.Digest))
+
+	if p.Cipher == "" {
+		p.Cipher = "aes-256-cbc"
+	}
+	if _, _, err := p.mode(); err != nil {
+		return OpenSSLParams{}, err
+	}
+
+	switch p.KDF {
+	case "", "pbkdf2":
+		p.KDF = "pbkdf2"
+		if p.Iterations == 0 {
+			p.Iterations = opensslDefaultIterations
+		}
+		if p.Iterations < 1 || p.Iterations > maxPBKDF2Iterations {
+			return OpenSSLParams{}, fmt.Errorf("OpenSSL PBKDF2 iterations must be between 1 and %d", maxPBKDF2Iterations)
+		}
+		if p.Digest == "" {
+			p.Digest = "sha256"
+		}
+	case "evp", "evp_bytestokey":
+		p.KDF = "evp"
+		p.Iterations = 0
+		if p.Digest == "" {
+			p.Digest = "md5"
+		}
+	default:
+		return OpenSSLParams{}, fmt.Errorf("unsupported OpenSSL key derivation %q", p.KDF)
+	}
+
+	if _, err := p.hash(); err != nil {
+		return OpenSSLParams{}, err
+	}
+	return p, nil
+}
+
+// mode returns the AES key size and whether the cipher runs in CTR mode
+func (p OpenSSLParams) mode() (int, bool, error) {
+	switch p.Cipher {
+	case "aes-128-cbc":
+		return 16, false, nil
+	case "aes-192-cbc":
+		return 24, false, nil
+	case "aes-256-cbc":
+		return 32, false, nil
+	case "aes-128-ctr":
+		return 16, true, nil
+	case "aes-192-ctr":
+		return 24, true, nil
+	case "aes-256-ctr":
+		return 32, true, nil
+	default:
+		return 0, false, fmt.Errorf("unsupported OpenSSL cipher %q", p.Cipher)
+	}
+}
+
+// hash returns the digest used for key derivation
+func (p OpenSSLParams) hash() (func() hash.Hash, error) {
+	switch p.Digest {
+	case "sha256":
+		return sha256.New, nil
+	case "md5":
+		return md5.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported OpenSSL digest %q", p.Digest)
+	}
+}
+
+// deriveKeyIV derives the AES key and IV from the password and salt. Both
+// share one buffer, which the caller wipes.
+func (p OpenSSLParams) deriveKeyIV(password, salt []byte) ([]byte, []byte, error) {
+	keySize, _, err := p.mode()
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := p.hash()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var material []byte
+	if p.KDF == "pbkdf2" {
+		material = pbkdf2.Key(password, salt, p.Iterations, keySize+aes.BlockSize, h)
+	} else {
+		material = evpBytesToKey(h, password, salt, keySize+aes.BlockSize)
+	}
+	return material[:keySize], material[keySize:], nil
+}
+
+// evpBytesToKey is OpenSSL's EVP_BytesToKey with a count of 1:
+// D_i = H(D_(i-1) || password || salt), concatenated until size bytes
+func evpBytesToKey(h func() hash.Hash, password, salt []byte, size int) []byte {
+	material := make([]byte, 0, size+h().Size())
+	var block []byte
+	for len(material) < size {
+		d := h()
+		d.Write(block)
+		d.Write(password)
+		d.Write(salt)
+		block = d.Sum(block[:0])
+		material = append(material, block...)
+	}
+	wipe(block)
+	return material[:size]
+}
+
+// isOpenSSL reports whether data starts with the salted OpenSSL magic
+func isOpenSSL(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(opensslMagic))
+}
+
+// EncryptOpenSSLStream reads plaintext from src and writes it to dst in the
+// salted "openssl enc" format. The output is NOT authenticated; use it only
+// for recipients that can do nothing but "openssl enc -d".
+func EncryptOpenSSLStream(dst io.Writer, src io.Reader, password []byte, params OpenSSLParams) error {
+	if len(password) == 0 {
+		return errors.New("a password is required for OpenSSL output")
+	}
+	params, err := params.resolve()
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, opensslSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	key, iv, err := params.deriveKeyIV(password, salt)
+	if err != nil {
+		return err
+	}
+	defer wipe(key, iv)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(dst, opensslMagic); err != nil {
+		return err
+	}
+	if _, err := dst.Write(salt); err != nil {
+		return err
+	}
+
+	if _, ctr, _ := params.mode(); ctr {
+		_, err := io.Copy(cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: dst}, src)
+		return err
+	}
+
+	cbc := cipher.NewCBCEncrypter(block, iv)
+	buf := make([]byte, opensslBufferSize)
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		last := readErr != nil
+
+		chunk := buf[:n]
+		if last {
+			// PKCS #7: pad with 1 to 16 bytes, each holding the pad length
+			pad := aes.BlockSize - n%aes.BlockSize
+			chunk = append(chunk, bytes.Repeat([]byte{byte(pad)}, pad)...)
+		}
+		cbc.CryptBlocks(chunk, chunk)
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptOpenSSL reads salted OpenSSL data from src and writes the plaintext
+// to dst
+func decryptOpenSSL(dst io.Writer, src *bufio.Reader, password []byte, params OpenSSLParams) error {
+	if len(password) == 0 {
+		return errors.New("a password is required for OpenSSL data")
+	}
+	params, err := params.resolve()
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, len(opensslMagic)+opensslSaltSize)
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		return fmt.Errorf("%w: missing OpenSSL salt", ErrStreamTruncated)
+	}
+	key, iv, err := params.deriveKeyIV(password, prefix[len(opensslMagic):])
+	if err != nil {
+		return err
+	}
+	defer wipe(key, iv)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	if _, ctr, _ := params.mode(); ctr {
+		_, err := io.Copy(dst, cipher.StreamReader{S: cipher.NewCTR(block, iv), R: src})
+		return err
+	}
+
+	// The last block holds the padding, so it is kept back until EOF
+	cbc := cipher.NewCBCDecrypter(block, iv)
+	buf := make([]byte, opensslBufferSize)
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		if n%aes.BlockSize != 0 {
+			return fmt.Errorf("%w: OpenSSL data is not a whole number of blocks", ErrStreamTruncated)
+		}
+		chunk := buf[:n]
+		cbc.CryptBlocks(chunk, chunk)
+
+		last := readErr != nil
+		if !last {
+			if _, err := src.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		if last {
+			if n == 0 {
+				return fmt.Errorf("%w: no OpenSSL data after the salt", ErrStreamTruncated)
+			}
+			if chunk, err = removePKCS7Padding(chunk); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// removePKCS7Padding strips the padding of the final CBC chunk without
+// branching on the padding bytes
+func removePKCS7Padding(chunk []byte) ([]byte, error) {
+	lastBlock := chunk[len(chunk)-aes.BlockSize:]
+	pad := int(lastBlock[aes.BlockSize-1])
+	good := subtle.ConstantTimeLessOrEq(1, pad) & subtle.ConstantTimeLessOrEq(pad, aes.BlockSize)
+	for i := 0; i < aes.BlockSize; i++ {
+		inPad := subtle.ConstantTimeLessOrEq(aes.BlockSize-pad, i)
+		matches := subtle.ConstantTimeByteEq(lastBlock[i], byte(pad))
+		good &= subtle.ConstantTimeSelect(inPad, matches, 1)
+	}
+	if good != 1 {
+		return nil, ErrBadPadding
+	}
+	return chunk[:len(chunk)-pad], nil
+}
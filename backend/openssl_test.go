@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// opensslPassword and opensslPlaintext were used to create the fixtures with
+// "openssl enc <args> -a -A -pass pass:..." (OpenSSL 3.0)
+const (
+	opensslPassword  = "interop password"
+	opensslPlaintext = "OpenSSL interop fixture spanning three blocks"
+)
+
+var opensslFixtures = []struct {
+	args      string
+	params    OpenSSLParams
+	plaintext string
+	data      string
+}{
+	{"-aes-256-cbc -pbkdf2", OpenSSLParams{}, opensslPlaintext,
+		"U2FsdGVkX1+MCI0EywuOXUKYu6eF2ljuJuO0IPjZdpfwShXbHXLKezMsSHRNMfkyKEZ4ofSpt2pqUUp6xzUBjQ=="},
+	{"-aes-128-cbc -pbkdf2 -iter 1000", OpenSSLParams{Cipher: "aes-128-cbc", Iterations: 1000}, opensslPlaintext,
+		"U2FsdGVkX1+US7EaoCwggx9GSuPR/WlJJoZ34A5fgJrY/dVMG+ZFylzGwvef5mW1FRwuHirWoEtpGpG+3Jq13g=="},
+	{"-aes-256-cbc -md md5", OpenSSLParams{KDF: "evp"}, opensslPlaintext,
+		"U2FsdGVkX1+9N0EcYt/OOPRUSG3T58LVil76Hf3zkrjQ9Xncm8MiJM8YIH0rdymO3t8PDb8iCMcitNDsoOuqvQ=="},
+	{"-aes-256-cbc -md sha256", OpenSSLParams{KDF: "evp", Digest: "sha256"}, opensslPlaintext,
+		"U2FsdGVkX1/rSI+U6BQJzOHc0ztHmBflbYmm4VnBeJTg62ZjnMU8HYqK/TKB1XY9w31uqGfictZC7cZmUmVNzQ=="},
+	{"-aes-256-ctr -pbkdf2", OpenSSLParams{Cipher: "aes-256-ctr"}, opensslPlaintext,
+		"U2FsdGVkX19cTqvi4QuzLCACJEc6THlGR/bAk306cU9dtgJwgLbZEE0zPX5fXahKjp8D4HARqKKnU4KA+Q=="},
+	{"-aes-192-ctr -md md5", OpenSSLParams{Cipher: "aes-192-ctr", KDF: "evp"}, opensslPlaintext,
+		"U2FsdGVkX18g0enEwMk12LjakCznYgN/H+vT0PXeyR3ch9DBv8yhKSpEbPJdX2qY/yXewA+tmmVI+ssm7w=="},
+	{"-aes-256-cbc -pbkdf2, empty input", OpenSSLParams{}, "",
+		"U2FsdGVkX1956vNApDxCbtZU6wsO90jWt9d6isYsij8="},
+	{"-aes-256-cbc -pbkdf2, one block", OpenSSLParams{}, "0123456789abcdef",
+		"U2FsdGVkX18JZKEuEyxVy7lmC57OTy/oOTPMNf3rWsZW/wDjDTZAL6HAdPNHmE1M"},
+}
+
+// decryptOpenSSLBytes decrypts salted OpenSSL data held in memory
+func decryptOpenSSLBytes(data []byte, password string, params OpenSSLParams) ([]byte, error) {
+	var out bytes.Buffer
+	err := decryptOpenSSL(&out, bufio.NewReader(bytes.NewReader(data)), []byte(password), params)
+	return out.Bytes(), err
+}
+
+func TestOpenSSLFixtures(t *testing.T) {
+	for _, fixture := range opensslFixtures {
+		t.Run(fixture.args, func(t *testing.T) {
+			data, err := base64.StdEncoding.DecodeString(fixture.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decryptOpenSSLBytes(data, opensslPassword, fixture.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != fixture.plaintext {
+				t.Errorf("decrypted %q, want %q", got, fixture.plaintext)
+			}
+
+			// The base64 text of "openssl enc -a" is recognised as it is
+			var out bytes.Buffer
+			if _, err := DecryptStreamWithOptions(&out, strings.NewReader(fixture.data), DecryptOptions{Password: []byte(opensslPassword), OpenSSL: fixture.params}); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != fixture.plaintext {
+				t.Errorf("base64 input decrypted to %q", out.String())
+			}
+		})
+	}
+}
+
+func TestOpenSSLRejectsBadData(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(opensslFixtures[0].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := base64.StdEncoding.DecodeString(opensslFixtures[2].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flipping a bit of the last but one block changes the padding byte
+	badPadding := bytes.Clone(data)
+	badPadding[len(badPadding)-17] ^= 0x40
+
+	tests := []struct {
+		name     string
+		data     []byte
+		password string
+		params   OpenSSLParams
+		want     error
+	}{
+		{"wrong password", data, "wrong password", OpenSSLParams{}, ErrBadPadding},
+		{"wrong legacy password", legacy, "wrong password", OpenSSLParams{KDF: "evp"}, ErrBadPadding},
+		{"wrong key derivation", data, opensslPassword, OpenSSLParams{KDF: "evp"}, ErrBadPadding},
+		{"bad padding", badPadding, opensslPassword, OpenSSLParams{}, ErrBadPadding},
+		{"partial block", data[:len(data)-1], opensslPassword, OpenSSLParams{}, ErrStreamTruncated},
+		{"salt only", data[:len(opensslMagic)+opensslSaltSize], opensslPassword, OpenSSLParams{}, ErrStreamTruncated},
+		{"short salt", data[:len(opensslMagic)+3], opensslPassword, OpenSSLParams{}, ErrStreamTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptOpenSSLBytes(tt.data, tt.password, tt.params)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if bytes.Contains(got, []byte(opensslPlaintext[:16])) {
+				t.Error("plaintext was written")
+			}
+		})
+	}
+
+	for _, params := range []OpenSSLParams{{Cipher: "aes-256-gcm"}, {KDF: "bcrypt"}, {Digest: "sha1"}, {Iterations: -1}} {
+		if _, err := decryptOpenSSLBytes(data, opensslPassword, params); err == nil {
+			t.Errorf("%+v accepted", params)
+		}
+	}
+	if _, err := decryptOpenSSLBytes(data, "", OpenSSLParams{}); err == nil {
+		t.Error("decrypted without a password")
+	}
+
+	// CTR has no padding, so a wrong password cannot be detected; it must
+	// still not panic and not return the plaintext
+	ctr, err := base64.StdEncoding.DecodeString(opensslFixtures[4].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := decryptOpenSSLBytes(ctr, "wrong password", opensslFixtures[4].params); string(got) == opensslPlaintext {
+		t.Error("a wrong password decrypted CTR data")
+	}
+}
+
+func TestOpenSSLRoundTrip(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("round trip "), opensslBufferSize/5)
+	for _, params := range []OpenSSLParams{{}, {Cipher: "aes-128-ctr"}, {KDF: "evp"}, {Cipher: "aes-192-cbc", KDF: "evp", Digest: "sha256"}} {
+		var encrypted bytes.Buffer
+		if err := EncryptOpenSSLStream(&encrypted, bytes.NewReader(plaintext), []byte(opensslPassword), params); err != nil {
+			t.Fatal(err)
+		}
+		got, err := decryptOpenSSLBytes(encrypted.Bytes(), opensslPassword, params)
+		if err != nil {
+			t.Fatalf("%+v: %v", params, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("%+v: round trip changed the data", params)
+		}
+	}
+}
+
+func TestOpenSSLCommandDecryptsOutput(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not installed")
+	}
+	tests := []struct {
+		args   []string
+		params OpenSSLParams
+	}{
+		{[]string{"-aes-256-cbc", "-pbkdf2"}, OpenSSLParams{}},
+		{[]string{"-aes-256-cbc", "-md", "md5"}, OpenSSLParams{KDF: "evp"}},
+		{[]string{"-aes-256-ctr", "-pbkdf2", "-iter", "2000"}, OpenSSLParams{Cipher: "aes-256-ctr", Iterations: 2000}},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			var encrypted bytes.Buffer
+			if err := EncryptOpenSSLStream(&encrypted, strings.NewReader(opensslPlaintext), []byte(opensslPassword), tt.params); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("openssl", append(append([]string{"enc", "-d"}, tt.args...), "-pass", "pass:"+opensslPassword)...)
+			cmd.Stdin = &encrypted
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("openssl enc -d: %v", err)
+			}
+			if string(got) != opensslPlaintext {
+				t.Errorf("openssl decrypted %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// Size-hiding padding
+//
+// Without padding the container length gives away the image size to anyone
+// watching the transfer. A padded version 3 container has a padding header
+// field (0x09):
+//
+//	policy(1) | bucket size(8)
+//
+// and its plaintext, before segmentation, is
+//
+//	data length(8) | data | zero bytes
+//
+// with the zero bytes bringing the whole to the size chosen by the policy.
+// The length and the padding are encrypted and authenticated like the data;
+// the reader passes on the first data length bytes and checks that the rest
+// is zero. The policy is recorded for information only.
+//
+// Policies:
+//
+//	bucket  round up to a multiple of the bucket size (DefaultPaddingBucket)
+//	pow2    round up to a power of two, up to 100% overhead
+//	padme   PADMÉ, which leaks O(log log n) bits of the size for at most 12% overhead
+
+// PaddingPolicy selects how the plaintext is padded
+type PaddingPolicy byte
+
+const (
+	// PaddingNone leaves the plaintext as it is
+	PaddingNone PaddingPolicy = 0
+
+	// PaddingBucket pads to a multiple of a fixed bucket size
+	PaddingBucket PaddingPolicy = 1
+
+	// PaddingPowerOfTwo pads to the next power of two
+	PaddingPowerOfTwo PaddingPolicy = 2
+
+	// PaddingPADME pads with the PADMÉ scheme
+	PaddingPADME PaddingPolicy = 3
+
+	// DefaultPaddingBucket is the bucket size used when none is given (256 KiB)
+	DefaultPaddingBucket = 256 * 1024
+
+	// maxPaddingBucket bounds the bucket size (64 MiB)
+	maxPaddingBucket = 64 * 1024 * 1024
+
+	// paddingLengthSize is the size of the data length that starts padded plaintext
+	paddingLengthSize = 8
+
+	// paddingFieldSize is the size of the padding header field
+	paddingFieldSize = 1 + 8
+)
+
+// ErrMalformedPadding is returned when the length prefix or the padding of a
+// padded payload is invalid
+var ErrMalformedPadding = errors.New("malformed payload padding")
+
+// String returns the name of the policy as accepted by ParsePaddingPolicy
+func (p PaddingPolicy) String() string {
+	switch p {
+	case PaddingNone:
+		return "none"
+	case PaddingBucket:
+		return "bucket"
+	case PaddingPowerOfTwo:
+		return "pow2"
+	case PaddingPADME:
+		return "padme"
+	default:
+		return fmt.Sprintf("padding(%d)", byte(p))
+	}
+}
+
+// ParsePaddingPolicy converts a user-supplied name into a PaddingPolicy. An
+// empty name selects no padding.
+func ParsePaddingPolicy(name string) (PaddingPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return PaddingNone, nil
+	case "bucket", "buckets":
+		return PaddingBucket, nil
+	case "pow2", "power-of-two", "poweroftwo":
+		return PaddingPowerOfTwo, nil
+	case "padme", "padmé":
+		return PaddingPADME, nil
+	default:
+		return 0, fmt.Errorf("unsupported padding policy %q", name)
+	}
+}
+
+// resolvePadding validates a padding policy and bucket size given by a client
+// and fills in the default bucket size. The bucket size is only used by
+// PaddingBucket.
+func resolvePadding(name string, bucket int64) (PaddingPolicy, int64, error) {
+	policy, err := ParsePaddingPolicy(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if policy != PaddingBucket {
+		return policy, 0, nil
+	}
+	if bucket == 0 {
+		bucket = DefaultPaddingBucket
+	}
+	if _, err := paddedSize(policy, bucket, 0); err != nil {
+		return 0, 0, err
+	}
+	return policy, bucket, nil
+}
+
+// paddedSize returns the size n bytes are padded to
+func paddedSize(policy PaddingPolicy, bucket, n int64) (int64, error) {
+	var size int64
+	switch policy {
+	case PaddingNone:
+		return n, nil
+	case PaddingBucket:
+		if bucket <= 0 || bucket > maxPaddingBucket {
+			return 0, fmt.Errorf("padding bucket size must be between 1 and %d bytes", maxPaddingBucket)
+		}
+		size = (n + bucket - 1) / bucket * bucket
+	case PaddingPowerOfTwo:
+		if n <= 1 {
+			return 1, nil
+		}
+		size = int64(1) << bits.Len64(uint64(n-1))
+	case PaddingPADME:
+		size = padme(n)
+	default:
+		return 0, fmt.Errorf("unsupported padding policy %d", policy)
+	}
+	if size < n {
+		return 0, errors.New("image too large to pad")
+	}
+	return size, nil
+}
+
+// padme rounds n up so that only the top log2(log2(n))+1 bits of the size
+// are significant (Nikitin et al., "Reducing Metadata Leakage from Encrypted
+// Files and Communication with PURBs", 2019)
+func padme(n int64) int64 {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len64(uint64(n)) - 1  // floor(log2 n)
+	s := bits.Len64(uint64(e))      // floor(log2 e) + 1
+	mask := int64(1)<<uint(e-s) - 1 // low bits that are zeroed
+	return (n + mask) &^ mask
+}
+
+// marshalPaddingField encodes the padding header field
+func marshalPaddingField(policy PaddingPolicy, bucket int64) []byte {
+	value := make([]byte, paddingFieldSize)
+	value[0] = byte(policy)
+	binary.BigEndian.PutUint64(value[1:], uint64(bucket))
+	return value
+}
+
+// paddedSource returns a reader over the padded plaintext of src: its length,
+// the data and the zero padding. The data length must be known up front, so
+// a source that cannot seek is first spooled to a temporary file; the
+// returned cleanup function removes it. check reports whether src delivered
+// exactly the expected number of bytes, once the reader has been drained.
+func paddedSource(src io.Reader, policy PaddingPolicy, bucket int64) (padded io.Reader, check func() error, cleanup func(), err error) {
+	cleanup = func() {}
+	seeker, ok := src.(io.ReadSeeker)
+	if !ok {
+		spool, err := os.CreateTemp("", "padding-*")
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		cleanup = func() { removeTempFile(spool) }
+		if _, err := io.Copy(spool, src); err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		seeker = spool
+	}
+
+	dataSize, err := remainingSize(seeker)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	total, err := paddedSize(policy, bucket, paddingLengthSize+dataSize)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	prefix := make([]byte, paddingLengthSize)
+	binary.BigEndian.PutUint64(prefix, uint64(dataSize))
+	data := &countingReader{r: io.LimitReader(seeker, dataSize)}
+	padding := io.LimitReader(zeroReader{}, total-paddingLengthSize-dataSize)
+
+	check = func() error {
+		if data.n != dataSize {
+			return fmt.Errorf("image changed size while it was encrypted (%d of %d bytes)", data.n, dataSize)
+		}
+		return nil
+	}
+	return io.MultiReader(bytes.NewReader(prefix), data, padding), check, cleanup, nil
+}
+
+// remainingSize returns the number of bytes between the current position of
+// s and its end, leaving the position unchanged
+func remainingSize(s io.Seeker) (int64, error) {
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - start, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from r and counts the bytes
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// zeroReader returns an endless stream of zero bytes
+type zeroReader struct{}
+
+// Read fills p with zeros
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// unpadReader strips the length prefix and padding of padded plaintext
+type unpadReader struct {
+	src       io.Reader
+	started   bool
+	remaining int64 // data bytes still to return
+}
+
+// newUnpadReader returns a reader over the data in the padded plaintext read
+// from src. It returns io.EOF only once src has been read to its end and the
+// padding has been checked.
+func newUnpadReader(src io.Reader) *unpadReader {
+	return &unpadReader{src: src}
+}
+
+// Read returns data bytes, checking the padding once they have all been read
+func (u *unpadReader) Read(p []byte) (int, error) {
+	if !u.started {
+		prefix := make([]byte, paddingLengthSize)
+		if _, err := io.ReadFull(u.src, prefix); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, fmt.Errorf("%w: missing data length", ErrMalformedPadding)
+			}
+			return 0, err
+		}
+		length := binary.BigEndian.Uint64(prefix)
+		if length > 1<<62 {
+			return 0, fmt.Errorf("%w: bad data length", ErrMalformedPadding)
+		}
+		u.started, u.remaining = true, int64(length)
+	}
+
+	if u.remaining == 0 {
+		return 0, u.checkPadding()
+	}
+	if int64(len(p)) > u.remaining {
+		p = p[:u.remaining]
+	}
+	n, err := u.src.Read(p)
+	u.remaining -= int64(n)
+	if err == io.EOF && u.remaining > 0 {
+		return n, fmt.Errorf("%w: data shorter than its length prefix", ErrMalformedPadding)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// checkPadding reads the rest of src and returns io.EOF if it is all zero
+func (u *unpadReader) checkPadding() error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := u.src.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return fmt.Errorf("%w: non-zero padding", ErrMalformedPadding)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPaddedSize(t *testing.T) {
+	const bucket = DefaultPaddingBucket
+	tests := []struct {
+		name   string
+		policy PaddingPolicy
+		bucket int64
+		n      int64
+		want   int64
+	}{
+		{"none", PaddingNone, 0, 12345, 12345},
+		{"bucket empty", PaddingBucket, bucket, 0, 0},
+		{"bucket one byte", PaddingBucket, bucket, 1, bucket},
+		{"bucket one byte short", PaddingBucket, bucket, bucket - 1, bucket},
+		{"bucket exact", PaddingBucket, bucket, bucket, bucket},
+		{"bucket one byte over", PaddingBucket, bucket, bucket + 1, 2 * bucket},
+		{"bucket several", PaddingBucket, bucket, 5*bucket + 7, 6 * bucket},
+		{"bucket of 1000", PaddingBucket, 1000, 1001, 2000},
+		{"bucket of one byte", PaddingBucket, 1, 777, 777},
+		{"pow2 empty", PaddingPowerOfTwo, 0, 0, 1},
+		{"pow2 one byte", PaddingPowerOfTwo, 0, 1, 1},
+		{"pow2 three", PaddingPowerOfTwo, 0, 3, 4},
+		{"pow2 exact", PaddingPowerOfTwo, 0, 1 << 20, 1 << 20},
+		{"pow2 one byte over", PaddingPowerOfTwo, 0, 1<<20 + 1, 1 << 21},
+		{"pow2 one byte short", PaddingPowerOfTwo, 0, 1<<20 - 1, 1 << 20},
+		{"padme empty", PaddingPADME, 0, 0, 0},
+		{"padme one byte", PaddingPADME, 0, 1, 1},
+		{"padme small sizes are exact", PaddingPADME, 0, 7, 7},
+		{"padme 9", PaddingPADME, 0, 9, 10},
+		{"padme 100", PaddingPADME, 0, 100, 104},
+		{"padme 1000", PaddingPADME, 0, 1000, 1024},
+		{"padme 1025", PaddingPADME, 0, 1025, 1088},
+		{"padme 1000000", PaddingPADME, 0, 1000000, 1015808},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := paddedSize(tt.policy, tt.bucket, tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("paddedSize(%d) = %d, want %d", tt.n, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := paddedSize(PaddingBucket, maxPaddingBucket+1, 1); err == nil {
+		t.Error("oversized bucket accepted")
+	}
+	if _, err := paddedSize(PaddingBucket, 0, 1); err == nil {
+		t.Error("empty bucket accepted")
+	}
+	if _, err := paddedSize(PaddingPolicy(9), 0, 1); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestPADMEOverhead(t *testing.T) {
+	// PADMÉ adds at most about 12% and keeps O(log log n) significant bits
+	for n := int64(2); n < 1<<40; n = n*3/2 + 1 {
+		padded := padme(n)
+		if padded < n || float64(padded-n) > 0.12*float64(n) {
+			t.Fatalf("padme(%d) = %d", n, padded)
+		}
+		if padme(padded) != padded {
+			t.Fatalf("padme(%d) = %d is not a fixed point", n, padded)
+		}
+	}
+}
+
+func TestResolvePadding(t *testing.T) {
+	if policy, bucket, err := resolvePadding("bucket", 0); err != nil || policy != PaddingBucket || bucket != DefaultPaddingBucket {
+		t.Errorf("got %s %d %v, want the default bucket", policy, bucket, err)
+	}
+	if _, bucket, err := resolvePadding("padme", 4096); err != nil || bucket != 0 {
+		t.Errorf("padme kept bucket %d (%v)", bucket, err)
+	}
+	for _, bad := range []struct {
+		name   string
+		bucket int64
+	}{{"bucket", maxPaddingBucket + 1}, {"bucket", -1}, {"random", 0}} {
+		if _, _, err := resolvePadding(bad.name, bad.bucket); err == nil {
+			t.Errorf("%s with bucket %d accepted", bad.name, bad.bucket)
+		}
+	}
+}
+
+// padBytes pads data and returns the padded plaintext
+func padBytes(t *testing.T, data []byte, policy PaddingPolicy, bucket int64) []byte {
+	t.Helper()
+	padded, check, cleanup, err := paddedSource(bytes.NewReader(data), policy, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	out, err := io.ReadAll(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestPaddingRoundTrip(t *testing.T) {
+	const bucket = 4096
+	for _, policy := range []PaddingPolicy{PaddingBucket, PaddingPowerOfTwo, PaddingPADME} {
+		// Sizes around the bucket edges, counting the length prefix
+		for _, size := range []int{0, 1, bucket - paddingLengthSize - 1, bucket - paddingLengthSize, bucket - paddingLengthSize + 1, 3*bucket + 5} {
+			data := make([]byte, size)
+			rand.Read(data)
+
+			padded := padBytes(t, data, policy, bucket)
+			want, err := paddedSize(policy, bucket, int64(paddingLengthSize+size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(padded)) != want {
+				t.Errorf("%s, %d bytes: padded to %d, want %d", policy, size, len(padded), want)
+			}
+
+			got, err := io.ReadAll(newUnpadReader(bytes.NewReader(padded)))
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", policy, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s, %d bytes: unpadded %d bytes that differ", policy, size, len(got))
+			}
+		}
+	}
+
+	// A source that cannot seek is spooled first
+	data := []byte("streamed data")
+	padded, check, cleanup, err := paddedSource(io.MultiReader(bytes.NewReader(data)), PaddingBucket, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if out, _ := io.ReadAll(padded); len(out) != bucket || check() != nil {
+		t.Errorf("spooled source padded to %d bytes", len(out))
+	}
+}
+
+func TestUnpadRejectsMalformedPadding(t *testing.T) {
+	padded := padBytes(t, []byte("some image data"), PaddingBucket, 64)
+
+	nonZero := bytes.Clone(padded)
+	nonZero[len(nonZero)-1] = 1
+
+	tooLong := bytes.Clone(padded)
+	binary.BigEndian.PutUint64(tooLong, uint64(len(padded)))
+
+	huge := bytes.Clone(padded)
+	binary.BigEndian.PutUint64(huge, 1<<63)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"non-zero padding", nonZero},
+		{"length beyond the data", tooLong},
+		{"huge length", huge},
+		{"missing length", padded[:paddingLengthSize-1]},
+		{"empty", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := io.ReadAll(newUnpadReader(bytes.NewReader(tt.data))); !errors.Is(err, ErrMalformedPadding) {
+				t.Errorf("got %v, want ErrMalformedPadding", err)
+			}
+		})
+	}
+}
+
+func TestPaddedContainerSizes(t *testing.T) {
+	password := []byte("padding password")
+	const bucket = 4096
+	encrypt := func(size int) []byte {
+		data := make([]byte, size)
+		rand.Read(data)
+		encrypted, err := EncryptDataWithOptions(data, password, EncryptOptions{KDF: testKDF, Padding: PaddingBucket, PaddingBucket: bucket})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, header, err := DecryptDataWithOptions(encrypted, DecryptOptions{Password: password})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("%d bytes: decrypted data differs", size)
+		}
+		if header.Padding != PaddingBucket || header.PaddingBucket != bucket {
+			t.Errorf("header records %s %d", header.Padding, header.PaddingBucket)
+		}
+		return encrypted
+	}
+
+	// Every size in a bucket gives the same container size
+	a, b := encrypt(1), encrypt(bucket-paddingLengthSize)
+	if len(a) != len(b) {
+		t.Errorf("containers of one bucket are %d and %d bytes", len(a), len(b))
+	}
+	if c := encrypt(bucket - paddingLengthSize + 1); len(c) != len(a)+bucket {
+		t.Errorf("one byte over the bucket gives %d bytes, want %d", len(c), len(a)+bucket)
+	}
+}
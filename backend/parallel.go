@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Parallel execution
+//
+// Image operations split their output into horizontal bands (or, for passes
+// that move pixels along columns, vertical ones) and process them on a pool
+// of runtime.GOMAXPROCS(0) workers. A band reads the source rows it covers
+// plus a halo above and below, as far as the kernel of the operation reaches,
+// straight from the shared source buffer. Bands are kept several halos tall
+// so that rows read by two bands stay a small part of the work. Workers check
+// the context before every band, so an operation whose request has been
+// abandoned stops after the bands already running and returns the context's
+// error.
+
+const (
+	// minBandSize is the smallest band handed to a worker
+	minBandSize = 16
+
+	// bandsPerWorker splits the work finer than one band per worker, so that
+	// a slow band does not hold up the others
+	bandsPerWorker = 4
+
+	// bandHaloFactor is how many halos tall a band is at least
+	bandHaloFactor = 4
+)
+
+// parallelBands splits [0, n) into bands and calls process for each of them
+// on a bounded pool of workers. halo is how far beyond its band the
+// operation reads. It returns ctx.Err() if the context ends before every band
+// has been processed; a panic in process is raised again in the caller.
+func parallelBands(ctx context.Context, n, halo int, process func(lo, hi int)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	size := max((n+workers*bandsPerWorker-1)/(workers*bandsPerWorker), minBandSize, bandHaloFactor*halo)
+	bands := (n + size - 1) / size
+	if workers > bands {
+		workers = bands
+	}
+
+	var next, done atomic.Int64
+	var stop atomic.Bool
+	var panicOnce sync.Once
+	var panicked any
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panicOnce.Do(func() { panicked = r })
+					stop.Store(true)
+				}
+			}()
+			for !stop.Load() && ctx.Err() == nil {
+				band := int(next.Add(1) - 1)
+				if band >= bands {
+					return
+				}
+				lo := band * size
+				process(lo, min(lo+size, n))
+				done.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if panicked != nil {
+		panic(panicked)
+	}
+	if int(done.Load()) < bands {
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// useGOMAXPROCS sets the number of workers for the rest of the test
+func useGOMAXPROCS(t *testing.T, n int) {
+	t.Helper()
+	previous := runtime.GOMAXPROCS(n)
+	t.Cleanup(func() { runtime.GOMAXPROCS(previous) })
+}
+
+func TestParallelBandsCoverEveryRow(t *testing.T) {
+	for _, procs := range []int{1, 3, 8} {
+		for _, n := range []int{1, 15, 16, 17, 100, 1000, 4099} {
+			for _, halo := range []int{0, 1, 7, 50} {
+				t.Run(fmt.Sprintf("procs=%d/n=%d/halo=%d", procs, n, halo), func(t *testing.T) {
+					useGOMAXPROCS(t, procs)
+					seen := make([]atomic.Int32, n)
+					var mu sync.Mutex
+					var bands [][2]int
+					err := parallelBands(context.Background(), n, halo, func(lo, hi int) {
+						for i := lo; i < hi; i++ {
+							seen[i].Add(1)
+						}
+						mu.Lock()
+						bands = append(bands, [2]int{lo, hi})
+						mu.Unlock()
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					for i := range seen {
+						if got := seen[i].Load(); got != 1 {
+							t.Fatalf("row %d processed %d times", i, got)
+						}
+					}
+					// Every band but the last is at least minBandSize and
+					// bandHaloFactor halos tall
+					for _, band := range bands {
+						if band[1] != n && band[1]-band[0] < max(minBandSize, bandHaloFactor*halo) {
+							t.Errorf("band %v is too small", band)
+						}
+					}
+				})
+			}
+		}
+	}
+
+	if err := parallelBands(context.Background(), 0, 1, func(lo, hi int) { t.Error("called for no rows") }); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParallelBandsCancellation(t *testing.T) {
+	useGOMAXPROCS(t, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := parallelBands(ctx, 100, 0, func(lo, hi int) { t.Error("band processed after cancellation") })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled context returned %v", err)
+	}
+
+	// Cancelling while bands run stops the workers at the next band
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var processed atomic.Int32
+	err = parallelBands(ctx, 100*minBandSize, 0, func(lo, hi int) {
+		processed.Add(1)
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled operation returned %v", err)
+	}
+	if got := processed.Load(); got > 2 {
+		t.Errorf("%d bands processed after cancellation with 2 workers", got)
+	}
+}
+
+func TestParallelBandsPanic(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "band failed" {
+			t.Errorf("recovered %v", r)
+		}
+	}()
+	parallelBands(context.Background(), 1000, 0, func(lo, hi int) {
+		if lo > 0 {
+			panic("band failed")
+		}
+	})
+	t.Error("panic in a band was not raised again")
+}
+
+// TestParallelOperationsMatchGolden checks that band boundaries and halos do
+// not change the result, on an image tall enough for many bands
+func TestParallelOperationsMatchGolden(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	img := image.NewNRGBA(image.Rect(0, 0, 61, 203))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Intn(256))
+	}
+	for y := 0; y < 203; y += 9 {
+		img.SetNRGBA(0, y, color.NRGBA{255, 255, 255, 255})
+	}
+
+	for _, procs := range []int{1, 5} {
+		t.Run(fmt.Sprintf("procs=%d", procs), func(t *testing.T) {
+			useGOMAXPROCS(t, procs)
+			ctx := context.Background()
+
+			got, err := ConvertToGrayscale(ctx, img)
+			assertSameImage(t, got, err, grayscaleAtSet(img))
+			got, err = ApplySobelEdgeDetection(ctx, img)
+			assertSameImage(t, got, err, sobelAtSet(img))
+			got, err = ApplyBoxBlur(ctx, img, 9)
+			assertSameImage(t, got, err, boxBlurAtSet(img, 9))
+			got, err = ApplyGaussianBlur(ctx, img, 4, GaussianBlurOptions{})
+			assertSameImage(t, got, err, gaussianBlurAtSet(img, 4))
+			got, err = RotateArbitrary(ctx, img, 33, RotateOptions{})
+			assertSameImage(t, got, err, rotateAtSet(img, 33, false))
+		})
+	}
+}
+
+func TestOperationsStopWhenCancelled(t *testing.T) {
+	img := smoothImage(64, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	operations := map[string]func() (image.Image, error){
+		"grayscale":     func() (image.Image, error) { return ConvertToGrayscale(ctx, img) },
+		"sobel":         func() (image.Image, error) { return ApplySobelEdgeDetection(ctx, img) },
+		"box blur":      func() (image.Image, error) { return ApplyBoxBlur(ctx, img, 3) },
+		"gaussian blur": func() (image.Image, error) { return ApplyGaussianBlur(ctx, img, 2, GaussianBlurOptions{}) },
+		"rotate":        func() (image.Image, error) { return RotateArbitrary(ctx, img, 30, RotateOptions{}) },
+		"flip":          func() (image.Image, error) { return FlipVertical(ctx, img) },
+	}
+	for name, op := range operations {
+		if got, err := op(); !errors.Is(err, context.Canceled) || got != nil {
+			t.Errorf("%s returned %T, %v, want context.Canceled", name, got, err)
+		}
+	}
+}
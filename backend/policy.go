@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Decrypt policy
+//
+// A version 3 container can carry a policy field (0x0b) that limits when and
+// how often this server decrypts it:
+//
+//	policy ID(16) | not before(8) | not after(8) | max decrypts(4)
+//
+// Times are Unix seconds and a zero leaves the bound out. The field is part
+// of the authenticated header, so changing it makes the header MAC fail, and
+// it is critical, so servers that predate it refuse the container instead of
+// ignoring the deadline. The policy ID names the image in the decrypt count
+// store; rewrapping and re-encrypting keep it, so rekeying does not reset
+// the count.
+//
+// The store only changes once a header MAC has been verified, and it keeps
+// the latest not-after time seen for each policy ID itself. A count is
+// dropped when that recorded time has passed, never because of what a stored
+// header claims: anyone can build a valid container around another image's
+// policy ID, so a header cannot be trusted to end someone else's count.
+//
+// The policy binds this server only. Anyone holding both the container and a
+// key can still decrypt it with other software.
+
+const (
+	// DecryptCountsPath is where the number of decryptions per policy ID is kept
+	DecryptCountsPath = "./assets/decrypt_counts.json"
+
+	// ExpiredImagePurgeInterval is how often expired images are removed from the store
+	ExpiredImagePurgeInterval = 5 * time.Minute
+
+	// policyIDSize is the size of the random policy ID
+	policyIDSize = 16
+
+	// policyFieldSize is the size of the policy header field
+	policyFieldSize = policyIDSize + 8 + 8 + 4
+)
+
+var (
+	// ErrImageExpired is returned for images past their not-after time or
+	// decrypt count
+	ErrImageExpired = errors.New("encrypted image has expired")
+
+	// ErrImageNotYetValid is returned for images before their not-before time
+	ErrImageNotYetValid = errors.New("encrypted image cannot be decrypted yet")
+)
+
+// DecryptPolicy limits when and how often the server decrypts an image
+type DecryptPolicy struct {
+	// ID identifies the image in the decrypt count store. EncryptStream
+	// fills it in if it is empty.
+	ID []byte `json:"-"`
+
+	NotBefore   time.Time `json:"notBefore,omitzero"`
+	NotAfter    time.Time `json:"notAfter,omitzero"`
+	MaxDecrypts uint32    `json:"maxDecrypts,omitempty"`
+}
+
+// NewDecryptPolicy builds a policy from client values. notBefore and
+// notAfter are timestamps (RFC 3339 or milliseconds since the epoch),
+// expiresIn a duration such as "24h" that sets notAfter relative to now, and
+// maxDecrypts the number of decryptions allowed. It returns nil if no limit
+// is given.
+func NewDecryptPolicy(notBefore, notAfter, expiresIn string, maxDecrypts uint32) (*DecryptPolicy, error) {
+	if notBefore == "" && notAfter == "" && expiresIn == "" && maxDecrypts == 0 {
+		return nil, nil
+	}
+
+	policy := &DecryptPolicy{MaxDecrypts: maxDecrypts}
+	var err error
+	if notBefore != "" {
+		if policy.NotBefore, err = parseTimestamp(notBefore); err != nil {
+			return nil, fmt.Errorf("invalid notBefore: %v", err)
+		}
+	}
+	switch {
+	case notAfter != "" && expiresIn != "":
+		return nil, errors.New("give either notAfter or expiresIn, not both")
+	case notAfter != "":
+		if policy.NotAfter, err = parseTimestamp(notAfter); err != nil {
+			return nil, fmt.Errorf("invalid notAfter: %v", err)
+		}
+	case expiresIn != "":
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid expiresIn %q", expiresIn)
+		}
+		policy.NotAfter = time.Now().Add(d)
+	}
+
+	// The header stores whole seconds
+	policy.NotBefore = truncateToSecond(policy.NotBefore)
+	policy.NotAfter = truncateToSecond(policy.NotAfter)
+	if !policy.NotAfter.IsZero() {
+		if !policy.NotAfter.After(time.Now()) {
+			return nil, errors.New("notAfter is in the past")
+		}
+		if !policy.NotBefore.IsZero() && !policy.NotAfter.After(policy.NotBefore) {
+			return nil, errors.New("notAfter must be later than notBefore")
+		}
+	}
+	return policy, nil
+}
+
+// parseTimestamp parses an RFC 3339 timestamp or milliseconds since the epoch
+func parseTimestamp(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC 3339 nor milliseconds since the epoch", v)
+	}
+	return t.UTC(), nil
+}
+
+// truncateToSecond drops the sub-second part of t, keeping the zero time zero
+func truncateToSecond(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return time.Unix(t.Unix(), 0).UTC()
+}
+
+// marshalPolicyField encodes the policy header field
+func marshalPolicyField(p *DecryptPolicy) []byte {
+	value := make([]byte, policyFieldSize)
+	copy(value, p.ID)
+	if !p.NotBefore.IsZero() {
+		binary.BigEndian.PutUint64(value[policyIDSize:], uint64(p.NotBefore.Unix()))
+	}
+	if !p.NotAfter.IsZero() {
+		binary.BigEndian.PutUint64(value[policyIDSize+8:], uint64(p.NotAfter.Unix()))
+	}
+	binary.BigEndian.PutUint32(value[policyIDSize+16:], p.MaxDecrypts)
+	return value
+}
+
+// unmarshalPolicyField decodes the policy header field
+func unmarshalPolicyField(value []byte) (*DecryptPolicy, error) {
+	if len(value) != policyFieldSize {
+		return nil, fmt.Errorf("%w: bad policy field", ErrMalformedHeader)
+	}
+	p := &DecryptPolicy{
+		ID:          append([]byte(nil), value[:policyIDSize]...),
+		MaxDecrypts: binary.BigEndian.Uint32(value[policyIDSize+16:]),
+	}
+	if s := int64(binary.BigEndian.Uint64(value[policyIDSize:])); s != 0 {
+		p.NotBefore = time.Unix(s, 0).UTC()
+	}
+	if s := int64(binary.BigEndian.Uint64(value[policyIDSize+8:])); s != 0 {
+		p.NotAfter = time.Unix(s, 0).UTC()
+	}
+	return p, nil
+}
+
+// withID returns a copy of the policy with a random ID if it has none
+func (p *DecryptPolicy) withID() (*DecryptPolicy, error) {
+	policy := *p
+	if len(policy.ID) == 0 {
+		policy.ID = make([]byte, policyIDSize)
+		if _, err := io.ReadFull(rand.Reader, policy.ID); err != nil {
+			return nil, err
+		}
+	} else if len(policy.ID) != policyIDSize {
+		return nil, fmt.Errorf("policy ID must be %d bytes", policyIDSize)
+	}
+	return &policy, nil
+}
+
+// key returns the policy ID as used in the decrypt count store
+func (p *DecryptPolicy) key() string {
+	return hex.EncodeToString(p.ID)
+}
+
+// checkTime returns an error if now is outside the policy's time window
+func (p *DecryptPolicy) checkTime(now time.Time) error {
+	if !p.NotBefore.IsZero() && now.Before(p.NotBefore) {
+		return fmt.Errorf("%w (not before %s)", ErrImageNotYetValid, p.NotBefore.Format(time.RFC3339))
+	}
+	if !p.NotAfter.IsZero() && !now.Before(p.NotAfter) {
+		return fmt.Errorf("%w (not after %s)", ErrImageExpired, p.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// expired reports whether the image can never be decrypted again: it is past
+// its not-after time or has used up its decrypt count
+func (p *DecryptPolicy) expired(now time.Time) bool {
+	if errors.Is(p.checkTime(now), ErrImageExpired) {
+		return true
+	}
+	if p.MaxDecrypts == 0 {
+		return false
+	}
+	used, err := decryptCounts.used(p.key())
+	return err == nil && used >= p.MaxDecrypts
+}
+
+// enforcePolicy checks the policy of a container about to be decrypted. If
+// count is set one decryption is reserved against the decrypt limit, so that
+// concurrent decryptions cannot exceed it, and the returned refund gives it
+// back; the caller refunds it unless the whole image decrypts. Otherwise an
+// exhausted limit is only checked. refund is never nil.
+func enforcePolicy(p *DecryptPolicy, count bool) (refund func(), err error) {
+	refund = func() {}
+	if p == nil {
+		return refund, nil
+	}
+	if err := p.checkTime(time.Now()); err != nil {
+		return refund, err
+	}
+	if p.MaxDecrypts == 0 {
+		return refund, nil
+	}
+	if count {
+		id := p.key()
+		if err := decryptCounts.take(id, p.MaxDecrypts, p.NotAfter); err != nil {
+			return refund, err
+		}
+		return func() {
+			if err := decryptCounts.refund(id); err != nil {
+				log.Printf("Failed to refund decrypt count of policy %s: %v", id, err)
+			}
+		}, nil
+	}
+	used, err := decryptCounts.used(p.key())
+	if err != nil {
+		return refund, err
+	}
+	if used >= p.MaxDecrypts {
+		return refund, fmt.Errorf("%w (decrypted %d of %d times)", ErrImageExpired, used, p.MaxDecrypts)
+	}
+	return refund, nil
+}
+
+// decryptCountStore records how often each policy ID has been decrypted. It
+// is saved to a JSON file after every change so that restarts do not reset
+// the counts.
+type decryptCountStore struct {
+	path string
+
+	mu     sync.Mutex
+	counts map[string]decryptCount
+}
+
+// decryptCount is the entry of one policy ID in the decrypt count store
+type decryptCount struct {
+	Used uint32 `json:"used"`
+
+	// NotAfter is the latest not-after time, in Unix seconds, of the
+	// verified headers counted under this ID. Zero means at least one of
+	// them had none, so the count is kept for good.
+	NotAfter int64 `json:"notAfter,omitempty"`
+}
+
+// decryptCounts is the decrypt count store of this server
+var decryptCounts = &decryptCountStore{path: DecryptCountsPath}
+
+// load reads the store file on first use. The caller holds s.mu.
+func (s *decryptCountStore) load() error {
+	if s.counts != nil {
+		return nil
+	}
+	counts := make(map[string]decryptCount)
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read decrypt counts: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &counts); err != nil {
+			// Older servers stored the bare counts, which are kept for good
+			var used map[string]uint32
+			if json.Unmarshal(data, &used) != nil {
+				return fmt.Errorf("invalid decrypt counts file: %v", err)
+			}
+			counts = make(map[string]decryptCount, len(used))
+			for id, n := range used {
+				counts[id] = decryptCount{Used: n}
+			}
+		}
+	}
+	s.counts = counts
+	return nil
+}
+
+// save replaces the store file. The caller holds s.mu.
+func (s *decryptCountStore) save() error {
+	data, err := json.Marshal(s.counts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create decrypt counts directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "decrypt-counts-*")
+	if err != nil {
+		return fmt.Errorf("failed to write decrypt counts: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write decrypt counts: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write decrypt counts: %v", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// used returns how often the image with the given policy ID was decrypted
+func (s *decryptCountStore) used(id string) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	return s.counts[id].Used, nil
+}
+
+// take counts one decryption, failing if max decryptions have already been
+// made. notAfter is the not-after time of the verified header; the entry
+// keeps the latest one seen so that a short-lived container cannot make the
+// count of a longer-lived one with the same ID expire early.
+func (s *decryptCountStore) take(id string, max uint32, notAfter time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	entry, exists := s.counts[id]
+	if entry.Used >= max {
+		return fmt.Errorf("%w (decrypted %d of %d times)", ErrImageExpired, entry.Used, max)
+	}
+
+	updated := entry
+	updated.Used++
+	switch {
+	case notAfter.IsZero():
+		updated.NotAfter = 0
+	case !exists || (entry.NotAfter != 0 && notAfter.Unix() > entry.NotAfter):
+		updated.NotAfter = notAfter.Unix()
+	}
+	s.counts[id] = updated
+	if err := s.save(); err != nil {
+		if exists {
+			s.counts[id] = entry
+		} else {
+			delete(s.counts, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// refund gives back a decryption counted by take that did not complete
+func (s *decryptCountStore) refund(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	entry := s.counts[id]
+	if entry.Used == 0 {
+		return nil
+	}
+	updated := entry
+	updated.Used--
+	s.counts[id] = updated
+	if err := s.save(); err != nil {
+		s.counts[id] = entry
+		return err
+	}
+	return nil
+}
+
+// forgetExpired drops the counts whose recorded not-after time has passed,
+// since no genuine container under their ID can be decrypted any more, and
+// returns how many were dropped
+func (s *decryptCountStore) forgetExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	var expired []string
+	for id, entry := range s.counts {
+		if entry.NotAfter != 0 && now.Unix() >= entry.NotAfter {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	previous := make(map[string]decryptCount, len(expired))
+	for _, id := range expired {
+		previous[id] = s.counts[id]
+		delete(s.counts, id)
+	}
+	if err := s.save(); err != nil {
+		for id, entry := range previous {
+			s.counts[id] = entry
+		}
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// storedImagePolicy returns the policy in the header of a stored image, or
+// nil if it has none or is not a container
+func storedImagePolicy(img storedImage) (*DecryptPolicy, error) {
+	f, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prefix := make([]byte, len(containerMagic))
+	if _, err := io.ReadFull(f, prefix); err != nil || !isContainer(prefix) {
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header, _, err := readContainerHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	return header.Policy, nil
+}
+
+// removeStoredImage deletes an image from the store and its file from disk
+func removeStoredImage(imageID string, img storedImage) {
+	encryptedImageStoreMutex.Lock()
+	if current, exists := encryptedImageStore[imageID]; exists && current.Path == img.Path {
+		delete(encryptedImageStore, imageID)
+	}
+	encryptedImageStoreMutex.Unlock()
+
+	for _, path := range []string{img.Path, storedImageIDPath(img.Path)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove expired image '%s': %v", imageID, err)
+		}
+	}
+}
+
+// checkStoredImagePolicy checks the decrypt policy of a stored image before
+// it is handed out, and removes the image from the store if it has expired.
+// Images whose header cannot be read are served as before. The header is not
+// authenticated here, so it only decides about this stored copy and never
+// changes the decrypt count store.
+func checkStoredImagePolicy(imageID string, img storedImage) error {
+	policy, err := storedImagePolicy(img)
+	if err != nil {
+		log.Printf("Failed to read the policy of image '%s': %v", imageID, err)
+		return nil
+	}
+	if policy == nil {
+		return nil
+	}
+
+	_, err = enforcePolicy(policy, false)
+	if errors.Is(err, ErrImageExpired) {
+		removeStoredImage(imageID, img)
+		log.Printf("Removed expired image '%s' from the store", imageID)
+	}
+	return err
+}
+
+// PurgeExpiredImages removes the stored images whose policy has expired and
+// returns how many were removed. It also drops the decrypt counts that have
+// passed their recorded not-after time.
+func PurgeExpiredImages() int {
+	encryptedImageStoreMutex.RLock()
+	images := make(map[string]storedImage, len(encryptedImageStore))
+	for id, img := range encryptedImageStore {
+		images[id] = img
+	}
+	encryptedImageStoreMutex.RUnlock()
+
+	now := time.Now()
+	purged := 0
+	for id, img := range images {
+		policy, err := storedImagePolicy(img)
+		if err != nil || policy == nil || !policy.expired(now) {
+			continue
+		}
+		removeStoredImage(id, img)
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Purged %d expired images from the store", purged)
+	}
+
+	// Copies held elsewhere stay subject to the count until the not-after
+	// time recorded from their verified headers, after which it no longer
+	// matters
+	if forgotten, err := decryptCounts.forgetExpired(now); err != nil {
+		log.Printf("Failed to drop expired decrypt counts: %v", err)
+	} else if forgotten > 0 {
+		log.Printf("Dropped %d expired decrypt counts", forgotten)
+	}
+	return purged
+}
+
+// purgeExpiredImagesEvery runs PurgeExpiredImages at every interval
+func purgeExpiredImagesEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		PurgeExpiredImages()
+	}
+}
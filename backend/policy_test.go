@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useDecryptCounts points the decrypt count store at a temporary file for
+// the duration of the test
+func useDecryptCounts(t *testing.T) {
+	t.Helper()
+	previous := decryptCounts
+	decryptCounts = &decryptCountStore{path: filepath.Join(t.TempDir(), "decrypt_counts.json")}
+	t.Cleanup(func() { decryptCounts = previous })
+}
+
+// encryptWithPolicy encrypts plaintext under password with the given policy
+func encryptWithPolicy(t *testing.T, plaintext, password []byte, policy *DecryptPolicy) []byte {
+	t.Helper()
+	ciphertext, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF, Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func TestDecryptLimit(t *testing.T) {
+	useDecryptCounts(t)
+	plaintext := []byte("limited image")
+	password := []byte("correct horse")
+	ciphertext := encryptWithPolicy(t, plaintext, password, &DecryptPolicy{MaxDecrypts: 2})
+
+	for i := 0; i < 2; i++ {
+		got, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{Password: password, CountDecrypt: true})
+		if err != nil {
+			t.Fatalf("decryption %d: %v", i+1, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("decryption %d returned the wrong plaintext", i+1)
+		}
+	}
+	if _, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{Password: password, CountDecrypt: true}); !errors.Is(err, ErrImageExpired) {
+		t.Fatalf("third decryption returned %v, want ErrImageExpired", err)
+	}
+
+	// A failed decryption does not use up the limit
+	useDecryptCounts(t)
+	if _, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{Password: []byte("wrong"), CountDecrypt: true}); err == nil {
+		t.Fatal("decrypted with the wrong password")
+	}
+	if _, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{Password: password}); err != nil {
+		t.Fatalf("uncounted decryption failed: %v", err)
+	}
+	if used, _ := decryptCounts.used(hexPolicyID(t, ciphertext, password)); used != 0 {
+		t.Errorf("failed and uncounted decryptions used %d decryptions", used)
+	}
+}
+
+// hexPolicyID returns the count store key of a container's policy
+func hexPolicyID(t *testing.T, ciphertext, password []byte) string {
+	t.Helper()
+	_, header, err := DecryptDataWithOptions(ciphertext, DecryptOptions{Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header.Policy.key()
+}
+
+func TestForgedPolicyCannotResetDecryptCount(t *testing.T) {
+	useDecryptCounts(t)
+	previousStore := encryptedImageStore
+	encryptedImageStore = make(map[string]storedImage)
+	t.Cleanup(func() { encryptedImageStore = previousStore })
+
+	victimPassword := []byte("victim password")
+	victim := &DecryptPolicy{ID: bytes.Repeat([]byte{0x42}, policyIDSize), NotAfter: time.Now().Add(time.Hour), MaxDecrypts: 1}
+	victimImage := encryptWithPolicy(t, []byte("victim image"), victimPassword, victim)
+	if _, _, err := DecryptDataWithOptions(victimImage, DecryptOptions{Password: victimPassword, CountDecrypt: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An attacker builds a valid container under their own password that
+	// claims the victim's policy ID and a not-after time in the past, and
+	// uploads it to the store
+	forged := &DecryptPolicy{ID: victim.ID, NotAfter: time.Now().Add(-time.Hour), MaxDecrypts: 1}
+	forgedImage := encryptWithPolicy(t, []byte("forged image"), []byte("attacker password"), forged)
+	path := filepath.Join(t.TempDir(), "forged.enc")
+	if err := os.WriteFile(path, forgedImage, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stored := storedImage{Path: path, Size: int64(len(forgedImage))}
+	encryptedImageStore["forged"] = stored
+
+	if _, _, err := DecryptDataWithOptions(forgedImage, DecryptOptions{Password: []byte("attacker password"), CountDecrypt: true}); !errors.Is(err, ErrImageExpired) {
+		t.Fatalf("expired forged image returned %v, want ErrImageExpired", err)
+	}
+	if err := checkStoredImagePolicy("forged", stored); !errors.Is(err, ErrImageExpired) {
+		t.Fatalf("checkStoredImagePolicy returned %v, want ErrImageExpired", err)
+	}
+
+	// Upload it again for the purge, which removed it the first time
+	if err := os.WriteFile(path, forgedImage, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(storedImageIDPath(path), []byte("forged"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	encryptedImageStore["forged"] = stored
+	if purged := PurgeExpiredImages(); purged != 1 {
+		t.Errorf("purged %d images, want 1", purged)
+	}
+	for _, file := range []string{path, storedImageIDPath(path)} {
+		if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind by the purge (%v)", filepath.Base(file), err)
+		}
+	}
+
+	if used, err := decryptCounts.used(victim.key()); err != nil || used != 1 {
+		t.Fatalf("victim's decrypt count is %d (%v) after the forged image expired, want 1", used, err)
+	}
+	if _, _, err := DecryptDataWithOptions(victimImage, DecryptOptions{Password: victimPassword, CountDecrypt: true}); !errors.Is(err, ErrImageExpired) {
+		t.Fatalf("victim image decrypted beyond its limit: %v", err)
+	}
+}
+
+func TestDecryptCountsExpireByRecordedNotAfter(t *testing.T) {
+	useDecryptCounts(t)
+	now := time.Now()
+
+	if err := decryptCounts.take("long", 5, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// A short-lived container with the same ID does not shorten the count
+	if err := decryptCounts.take("long", 5, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptCounts.take("forever", 5, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptCounts.take("short", 5, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	forgotten, err := decryptCounts.forgetExpired(now.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forgotten != 1 {
+		t.Errorf("forgot %d counts, want 1", forgotten)
+	}
+	for id, want := range map[string]uint32{"long": 2, "forever": 1, "short": 0} {
+		if used, _ := decryptCounts.used(id); used != want {
+			t.Errorf("count of %q is %d, want %d", id, used, want)
+		}
+	}
+
+	// The counts survive a restart
+	reloaded := &decryptCountStore{path: decryptCounts.path}
+	if used, err := reloaded.used("long"); err != nil || used != 2 {
+		t.Errorf("reloaded count is %d (%v), want 2", used, err)
+	}
+}
+
+func TestDecryptCountsReadOldFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decrypt_counts.json")
+	if err := os.WriteFile(path, []byte(`{"abcd":3}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := &decryptCountStore{path: path}
+	if used, err := store.used("abcd"); err != nil || used != 3 {
+		t.Fatalf("count is %d (%v), want 3", used, err)
+	}
+	if forgotten, err := store.forgetExpired(time.Now().Add(24 * time.Hour)); err != nil || forgotten != 0 {
+		t.Errorf("forgot %d counts (%v) without a recorded not-after time", forgotten, err)
+	}
+}
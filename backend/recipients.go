@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Public-key recipients
+//
+// When an image is encrypted to recipients, the payload key is a random file
+// key and the header carries one stanza per recipient with the file key
+// wrapped for that recipient:
+//
+//	ephemeral public key (32 bytes) | wrapped file key (32 bytes + 16 byte tag)
+//
+// The wrapping key is HKDF-SHA256 over the X25519 shared secret between a
+// fresh ephemeral key and the recipient's key, salted with both public keys.
+// Each wrapping key is used exactly once, so the file key is sealed with
+// ChaCha20-Poly1305 under an all-zero nonce.
+//
+// Version 3 containers store the same stanza prefixed with a fingerprint of
+// the recipient's key, and may also wrap the file key for a password (see
+// envelope.go).
+
+const (
+	// FileKeySize is the size of the random payload key used with recipients
+	FileKeySize = 32
+
+	// x25519StanzaSize is the encoded size of an X25519 recipient stanza
+	x25519StanzaSize = 32 + FileKeySize + chacha20poly1305.Overhead
+
+	// x25519StanzaInfo is the HKDF info string for X25519 stanzas
+	x25519StanzaInfo = "simg/x25519/v1"
+
+	// PEM block types used to export keys
+	pemPublicKeyType  = "PUBLIC KEY"
+	pemPrivateKeyType = "PRIVATE KEY"
+)
+
+// ErrNoMatchingIdentity is returned when neither the supplied password nor any
+// of the supplied private keys can unwrap the file key of a container
+var ErrNoMatchingIdentity = errors.New("no key or identity matches any recipient of this image")
+
+// GenerateX25519Key generates a new recipient keypair
+func GenerateX25519Key() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// MarshalPublicKeyPEM exports a recipient (X25519) or signer (Ed25519) public
+// key as a PKIX "PUBLIC KEY" PEM block
+func MarshalPublicKeyPEM(pub any) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: pemPublicKeyType, Bytes: der})), nil
+}
+
+// MarshalPrivateKeyPEM exports an X25519 or Ed25519 private key as a PKCS #8
+// "PRIVATE KEY" PEM block
+func MarshalPrivateKeyPEM(priv any) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: pemPrivateKeyType, Bytes: der})), nil
+}
+
+// ParsePublicKey parses an X25519 public key given as a PKIX PEM block, as
+// the base64 encoding of the raw 32-byte key or as an "age1..." recipient
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		if block.Type != pemPublicKeyType {
+			return nil, fmt.Errorf("expected a %s PEM block, got %s", pemPublicKeyType, block.Type)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %v", err)
+		}
+		pub, ok := key.(*ecdh.PublicKey)
+		if !ok || pub.Curve() != ecdh.X25519() {
+			return nil, errors.New("public key is not an X25519 key")
+		}
+		return pub, nil
+	}
+
+	if isAgeRecipient(s) {
+		return parseAgeRecipient(s)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("public key is neither PEM, base64 nor an age recipient")
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	return pub, nil
+}
+
+// ParsePrivateKey parses an X25519 private key given as a PKCS #8 PEM block,
+// as the base64 encoding of the raw 32-byte key or as an age identity
+func ParsePrivateKey(s string) (*ecdh.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		if block.Type != pemPrivateKeyType {
+			return nil, fmt.Errorf("expected a %s PEM block, got %s", pemPrivateKeyType, block.Type)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %v", err)
+		}
+		priv, ok := key.(*ecdh.PrivateKey)
+		if !ok || priv.Curve() != ecdh.X25519() {
+			return nil, errors.New("private key is not an X25519 key")
+		}
+		return priv, nil
+	}
+
+	if strings.Contains(strings.ToUpper(s), ageIdentityHRP+"1") {
+		return parseAgeIdentity(s)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("private key is neither PEM, base64 nor an age identity")
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	return priv, nil
+}
+
+// ParsePublicKeys parses a list of public keys, where each entry may itself
+// hold several keys separated by commas or concatenated PEM blocks
+func ParsePublicKeys(values []string) ([]*ecdh.PublicKey, error) {
+	var keys []*ecdh.PublicKey
+	for _, value := range values {
+		for _, entry := range splitKeyList(value) {
+			pub, err := ParsePublicKey(entry)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, pub)
+		}
+	}
+	return keys, nil
+}
+
+// splitKeyList splits a value into individual PEM blocks or comma/newline
+// separated base64 keys
+func splitKeyList(value string) []string {
+	var entries []string
+	rest := []byte(strings.TrimSpace(value))
+
+	for len(rest) > 0 {
+		block, remaining := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		entries = append(entries, string(pem.EncodeToMemory(block)))
+		rest = []byte(strings.TrimSpace(string(remaining)))
+	}
+
+	for _, field := range strings.FieldsFunc(string(rest), func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}) {
+		entries = append(entries, field)
+	}
+	return entries
+}
+
+// KeyFingerprint returns a short identifier for a public key
+func KeyFingerprint(pub *ecdh.PublicKey) string {
+	return fingerprint(pub.Bytes())
+}
+
+// fingerprint returns the hex encoding of the first 8 bytes of SHA-256(raw)
+func fingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8])
+}
+
+// newFileKey returns a random payload key
+func newFileKey() ([]byte, error) {
+	fileKey := make([]byte, FileKeySize)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, err
+	}
+	return fileKey, nil
+}
+
+// x25519WrappingKey derives the key that wraps the file key for one stanza
+func x25519WrappingKey(sharedSecret, ephemeralPub, recipientPub []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeralPub)+len(recipientPub))
+	salt = append(salt, ephemeralPub...)
+	salt = append(salt, recipientPub...)
+	return hkdf.Key(sha256.New, sharedSecret, salt, x25519StanzaInfo, chacha20poly1305.KeySize)
+}
+
+// wrapFileKeyX25519 wraps the file key for one recipient and returns the stanza body
+func wrapFileKeyX25519(fileKey []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %v", err)
+	}
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	wrappingKey, err := x25519WrappingKey(sharedSecret, ephemeralPub, recipient.Bytes())
+	wipe(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(wrappingKey)
+
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(ephemeralPub, nonce, fileKey, nil), nil
+}
+
+// unwrapFileKeyX25519 recovers the file key from a stanza body. It fails if
+// the stanza was not created for identity.
+func unwrapFileKeyX25519(body []byte, identity *ecdh.PrivateKey) ([]byte, error) {
+	if len(body) != x25519StanzaSize {
+		return nil, fmt.Errorf("%w: bad X25519 stanza length %d", ErrMalformedHeader, len(body))
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(body[:32])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad ephemeral key", ErrMalformedHeader)
+	}
+
+	sharedSecret, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %v", err)
+	}
+
+	wrappingKey, err := x25519WrappingKey(sharedSecret, body[:32], identity.PublicKey().Bytes())
+	wipe(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(wrappingKey)
+
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Open(nil, nonce, body[32:], nil)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestIdentity generates an X25519 keypair
+func newTestIdentity(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	priv, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestParseX25519Keys(t *testing.T) {
+	priv := newTestIdentity(t)
+	pub := priv.PublicKey()
+	pubPEM, err := MarshalPublicKeyPEM(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPEM, err := MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, encoded := range map[string]string{
+		"PEM":           pubPEM,
+		"base64":        base64.StdEncoding.EncodeToString(pub.Bytes()),
+		"age recipient": AgeRecipient(pub),
+	} {
+		got, err := ParsePublicKey("\n" + encoded + "\n")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !got.Equal(pub) {
+			t.Errorf("%s: parsed a different public key", name)
+		}
+	}
+	for name, encoded := range map[string]string{
+		"PEM":          privPEM,
+		"base64":       base64.StdEncoding.EncodeToString(priv.Bytes()),
+		"age identity": AgeIdentity(priv),
+	} {
+		got, err := ParsePrivateKey(encoded)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !got.Equal(priv) {
+			t.Errorf("%s: parsed a different private key", name)
+		}
+	}
+
+	keys, err := ParsePublicKeys([]string{pubPEM + pubPEM, AgeRecipient(pub) + ", " + base64.StdEncoding.EncodeToString(pub.Bytes())})
+	if err != nil || len(keys) != 4 {
+		t.Errorf("parsed %d keys from a list of 4 (%v)", len(keys), err)
+	}
+
+	for _, bad := range []string{"", "not a key", base64.StdEncoding.EncodeToString(make([]byte, 31)), privPEM} {
+		if _, err := ParsePublicKey(bad); err == nil {
+			t.Errorf("%q parsed as a public key", bad)
+		}
+	}
+	if _, err := ParsePrivateKey(pubPEM); err == nil {
+		t.Error("a public key parsed as a private key")
+	}
+}
+
+func TestWrapFileKeyX25519(t *testing.T) {
+	priv, other := newTestIdentity(t), newTestIdentity(t)
+	fileKey, err := newFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := wrapFileKeyX25519(fileKey, priv.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != x25519StanzaSize {
+		t.Fatalf("stanza of %d bytes, want %d", len(body), x25519StanzaSize)
+	}
+
+	got, err := unwrapFileKeyX25519(body, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileKey) {
+		t.Error("unwrapped a different file key")
+	}
+
+	// Each wrap uses a fresh ephemeral key
+	again, err := wrapFileKeyX25519(fileKey, priv.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again[:32], body[:32]) {
+		t.Error("two stanzas share an ephemeral key")
+	}
+
+	if _, err := unwrapFileKeyX25519(body, other); err == nil {
+		t.Error("another identity unwrapped the file key")
+	}
+	for _, i := range []int{0, 40, len(body) - 1} {
+		tampered := bytes.Clone(body)
+		tampered[i] ^= 1
+		if _, err := unwrapFileKeyX25519(tampered, priv); err == nil {
+			t.Errorf("stanza with byte %d changed unwrapped", i)
+		}
+	}
+	if _, err := unwrapFileKeyX25519(body[:len(body)-1], priv); !errors.Is(err, ErrMalformedHeader) {
+		t.Errorf("short stanza returned %v, want ErrMalformedHeader", err)
+	}
+}
+
+func TestRecipientEncryption(t *testing.T) {
+	alice, bob, eve := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	plaintext := []byte("an image for two recipients")
+	encrypted, err := EncryptDataWithOptions(plaintext, nil, EncryptOptions{Recipients: []*ecdh.PublicKey{alice.PublicKey(), bob.PublicKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, identity := range map[string]*ecdh.PrivateKey{"alice": alice, "bob": bob} {
+		got, _, err := DecryptDataWithOptions(encrypted, DecryptOptions{Identities: []*ecdh.PrivateKey{eve, identity}})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("%s: decrypted data differs", name)
+		}
+	}
+
+	if _, _, err := DecryptDataWithOptions(encrypted, DecryptOptions{Identities: []*ecdh.PrivateKey{eve}}); !errors.Is(err, ErrNoMatchingIdentity) {
+		t.Errorf("another identity returned %v, want ErrNoMatchingIdentity", err)
+	}
+	if _, _, err := DecryptDataWithOptions(encrypted, DecryptOptions{Password: []byte("guess")}); err == nil {
+		t.Error("a password opened an image encrypted to recipients")
+	}
+}
+
+func TestRecipientEndpoints(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleGenerateKey(rec, httptest.NewRequest(http.MethodPost, "/api/keys/generate", nil))
+	var generated KeyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &generated); err != nil || !generated.Success || generated.Type != keyTypeX25519 {
+		t.Fatalf("generate: %d %s (%v)", rec.Code, rec.Body, err)
+	}
+
+	// Importing the exported public key gives the same fingerprint
+	rec = postJSON(t, handleImportKey, map[string]string{"key": generated.PublicKey})
+	var imported KeyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &imported); err != nil || imported.Fingerprint != generated.Fingerprint || imported.PrivateKey != "" {
+		t.Errorf("import: %s (%v)", rec.Body, err)
+	}
+	if rec := postJSON(t, handleImportKey, map[string]string{"key": "not a key"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("importing garbage: status %d, want 400", rec.Code)
+	}
+
+	plaintext := testPNG(t)
+	rec = postForm(t, handleEncrypt, "image.png", plaintext, map[string]string{"recipients": generated.AgeRecipient})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("encrypt: status %d: %s", rec.Code, rec.Body)
+	}
+	encrypted := rec.Body.Bytes()
+
+	rec = postForm(t, handleDecrypt, "image.png.enc", encrypted, map[string]string{"identity": generated.PrivateKey})
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), plaintext) {
+		t.Errorf("decrypt with the identity: status %d", rec.Code)
+	}
+
+	other := newTestIdentity(t)
+	otherPEM, err := MarshalPrivateKeyPEM(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = postForm(t, handleDecrypt, "image.png.enc", encrypted, map[string]string{"identity": otherPEM})
+	if rec.Code == http.StatusOK || bytes.Equal(rec.Body.Bytes(), plaintext) {
+		t.Errorf("decrypt with another identity: status %d", rec.Code)
+	}
+	if rec := postForm(t, handleEncrypt, "image.png", plaintext, map[string]string{"recipients": "age1notakey"}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Invalid recipients") {
+		t.Errorf("invalid recipient: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTransmitEndpointStatuses(t *testing.T) {
+	addr := startTestTCPServer(t)
+	alice := newTestIdentity(t)
+	aliceKey, err := MarshalPublicKeyPEM(alice.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := base64.StdEncoding.EncodeToString(testPNG(t))
+
+	tests := []struct {
+		name string
+		body map[string]any
+		code int
+	}{
+		{"no credentials", map[string]any{"encryptedData": image, "serverAddr": addr, "imageID": "photo"}, http.StatusBadRequest},
+		{"no image ID", map[string]any{"encryptedData": image, "serverAddr": addr, "recipients": []string{aliceKey}}, http.StatusBadRequest},
+		{"unknown key ID", map[string]any{"encryptedData": image, "serverAddr": addr, "imageID": "photo", "keyIds": []string{"env:missing"}}, http.StatusBadRequest},
+		{"unknown key provider", map[string]any{"encryptedData": image, "serverAddr": addr, "imageID": "photo", "keyIds": []string{"nowhere:key"}}, http.StatusBadRequest},
+		{"recipient", map[string]any{"encryptedData": image, "serverAddr": addr, "imageID": "photo", "recipients": []string{aliceKey}}, http.StatusOK},
+	}
+	useKeyProvider(t, EnvKeyProvider{Prefix: envKeyPrefix})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := postJSON(t, handleTransmit, tt.body); rec.Code != tt.code {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+		})
+	}
+	if _, exists := lookupStoredImage("photo"); !exists {
+		t.Error("the image was not transmitted")
+	}
+
+	// Uploads map unknown key IDs the same way
+	rec := postForm(t, handleTransmit, "image.png", testPNG(t), map[string]string{"serverAddr": addr, "imageID": "upload", "keyId": "env:missing"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("upload with an unknown key ID: status %d, want 400: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Key rotation
+//
+// Rekeying makes an encrypted image openable only with a new set of
+// credentials. Version 3 containers are rewrapped: the data key is unwrapped
+// with the old credentials and wrapped again for the new ones, and the payload
+// is copied unchanged. Older formats, or any image when re-encryption is
+// requested, are decrypted and encrypted again under a fresh data key, which
+// is the only way to lock out someone who already learned the old data key.
+
+// RekeyOptions holds the new credentials of a rekeyed image
+type RekeyOptions struct {
+	// Password, Recipients and KeyIDs replace every existing password,
+	// recipient and key ID
+	Password   []byte
+	Recipients []*ecdh.PublicKey
+	KeyIDs     []string
+
+	// KDF selects the key derivation for Password, as in EncryptOptions
+	KDF KDFParams
+
+	// Reencrypt forces a full re-encryption under a new data key even when
+	// the image could be rewrapped
+	Reencrypt bool
+
+	// Cipher and SigningKey only apply when the image is re-encrypted. A zero
+	// Cipher keeps the original suite. Re-encrypted images are only signed if
+	// SigningKey is set, since the old signature cannot carry over.
+	Cipher     CipherSuite
+	SigningKey ed25519.PrivateKey
+}
+
+// Rekey results reported per image
+const (
+	RekeyRewrapped   = "rewrapped"
+	RekeyReencrypted = "reencrypted"
+	RekeySkipped     = "skipped"
+	RekeyFailed      = "failed"
+)
+
+// RekeyStream copies the encrypted image in src to dst so that only the new
+// credentials in opts can open it, and returns whether it was rewrapped or
+// re-encrypted. dst must be discarded if an error is returned.
+func RekeyStream(dst io.Writer, src io.Reader, unlock DecryptOptions, opts RekeyOptions) (string, error) {
+	if len(opts.Password) == 0 && len(opts.Recipients) == 0 && len(opts.KeyIDs) == 0 {
+		return "", errors.New("a new key, key ID or at least one new recipient is required")
+	}
+
+	br, _, err := detectTextEncoding(bufio.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+
+	var header *ContainerHeader
+	var headerBytes []byte
+	ciphertext := io.Reader(br)
+
+	if prefix, err := br.Peek(containerPrefixSize); err == nil && isContainer(prefix) {
+		if prefix[4] == ContainerVersion && !opts.Reencrypt {
+			_, err := rewrapStream(dst, br, unlock, func(dek []byte, _ []RecipientStanza) ([]RecipientStanza, error) {
+				return wrapDataKey(dek, opts.Password,
+					EncryptOptions{KDF: opts.KDF, Recipients: opts.Recipients, KeyIDs: opts.KeyIDs})
+			})
+			if err != nil {
+				return "", err
+			}
+			return RekeyRewrapped, nil
+		}
+
+		// Read the header up front to carry the suite and metadata over,
+		// then hand it back to the decrypter together with the payload
+		if header, headerBytes, err = readContainerHeader(br); err != nil {
+			return "", err
+		}
+		ciphertext = io.MultiReader(bytes.NewReader(headerBytes), br)
+	}
+
+	encryptOpts := EncryptOptions{
+		Cipher:     opts.Cipher,
+		KDF:        opts.KDF,
+		Recipients: opts.Recipients,
+		KeyIDs:     opts.KeyIDs,
+		SigningKey: opts.SigningKey,
+	}
+	if header != nil {
+		encryptOpts.Metadata = header.Metadata
+		encryptOpts.Padding = header.Padding
+		encryptOpts.PaddingBucket = header.PaddingBucket
+		encryptOpts.Compression = header.Compression
+		encryptOpts.Policy = header.Policy
+		if encryptOpts.Cipher == 0 {
+			encryptOpts.Cipher = header.Suite
+		}
+
+		// The new header is written before the old payload is decrypted, so
+		// the sealed image metadata has to be opened up front. The DEK is
+		// handed on to the decrypter rather than unwrapped a second time.
+		if len(header.SealedMetadata) > 0 && header.Version == ContainerVersion {
+			dek, _, err := unwrapDataKey(header.Recipients, unlock)
+			if err != nil {
+				return "", err
+			}
+			defer wipe(dek)
+			key, _, err := openEnvelopeWithDEK(header, headerBytes, dek)
+			if err != nil {
+				return "", err
+			}
+			wipe(key)
+			encryptOpts.ImageMetadata = header.ImageMetadata
+			unlock.dataKey = dek
+		}
+	}
+
+	// Decrypt and encrypt concurrently through a pipe so that no more than a
+	// segment of plaintext is held in memory. The pipe only reaches EOF once
+	// the decrypter has verified the whole image and its signature; a failure
+	// closes it with the error instead, so EncryptStream fails without
+	// sealing the final segment and the caller discards dst.
+	pr, pw := io.Pipe()
+	decrypted := make(chan error, 1)
+	go func() {
+		_, err := DecryptStreamWithOptions(pw, ciphertext, unlock)
+		pw.CloseWithError(err)
+		decrypted <- err
+	}()
+
+	err = EncryptStream(dst, pr, opts.Password, encryptOpts)
+	pr.CloseWithError(err)
+	if decryptErr := <-decrypted; decryptErr != nil {
+		return "", decryptErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return RekeyReencrypted, nil
+}
+
+// isWrongKey reports whether a rekey error means the old credentials do not
+// open the image, as opposed to the image or the store being broken
+func isWrongKey(err error) bool {
+	return errors.Is(err, ErrNoMatchingIdentity) || errors.Is(err, ErrAuthenticationFailed)
+}
+
+// RekeyProgress reports the progress of a rekey operation after each image
+type RekeyProgress struct {
+	ImageID string `json:"imageID,omitempty"` // the image just processed
+	Result  string `json:"result,omitempty"`  // one of the Rekey* results
+	Error   string `json:"error,omitempty"`
+
+	Done        int  `json:"done"`
+	Total       int  `json:"total"`
+	Rewrapped   int  `json:"rewrapped"`
+	Reencrypted int  `json:"reencrypted"`
+	Skipped     int  `json:"skipped"`
+	Failed      int  `json:"failed"`
+	Finished    bool `json:"finished"`
+}
+
+// RekeyRequest is the wire form of a rekey operation on the image store, as
+// sent in an ImageRekeyRequest message. Keys are PEM or base64 strings.
+type RekeyRequest struct {
+	// Token is the rekey token configured on the TCP server
+	Token string `json:"token,omitempty"`
+
+	// ImageIDs lists the images to rekey; empty means every stored image,
+	// which the server must allow explicitly
+	ImageIDs []string `json:"imageIDs,omitempty"`
+
+	// Key, Identities, KeyIDs and Shares are the old credentials
+	Key        string   `json:"key,omitempty"`
+	Identities []string `json:"identities,omitempty"`
+	KeyIDs     []string `json:"keyIds,omitempty"`
+	Shares     []string `json:"shares,omitempty"`
+
+	// NewKey, NewRecipients and NewKeyIDs are the new credentials
+	NewKey        string   `json:"newKey,omitempty"`
+	NewRecipients []string `json:"newRecipients,omitempty"`
+	NewKeyIDs     []string `json:"newKeyIds,omitempty"`
+
+	Reencrypt  bool   `json:"reencrypt,omitempty"`
+	Cipher     string `json:"cipher,omitempty"`
+	SigningKey string `json:"signingKey,omitempty"`
+}
+
+// options parses the keys of a rekey request. The caller wipes the returned
+// passwords.
+func (req RekeyRequest) options() (DecryptOptions, RekeyOptions, error) {
+	unlock := DecryptOptions{Shares: req.Shares}
+	if err := ValidateKeyShares(req.Shares); err != nil {
+		return DecryptOptions{}, RekeyOptions{}, err
+	}
+	for _, value := range req.Identities {
+		identity, err := ParsePrivateKey(value)
+		if err != nil {
+			return DecryptOptions{}, RekeyOptions{}, fmt.Errorf("invalid identity: %v", err)
+		}
+		unlock.Identities = append(unlock.Identities, identity)
+	}
+	var err error
+	if unlock.KeyIDs, err = ParseKeyRefs(req.KeyIDs); err != nil {
+		return DecryptOptions{}, RekeyOptions{}, err
+	}
+	if req.Key == "" && len(unlock.Identities) == 0 && len(unlock.KeyIDs) == 0 && len(unlock.Shares) == 0 {
+		return DecryptOptions{}, RekeyOptions{}, errors.New("the old key, key ID, identity or key shares are required")
+	}
+
+	opts := RekeyOptions{Reencrypt: req.Reencrypt}
+	if opts.Recipients, err = ParsePublicKeys(req.NewRecipients); err != nil {
+		return DecryptOptions{}, RekeyOptions{}, fmt.Errorf("invalid newRecipients: %v", err)
+	}
+	if opts.KeyIDs, err = ParseKeyRefs(req.NewKeyIDs); err != nil {
+		return DecryptOptions{}, RekeyOptions{}, err
+	}
+	if req.NewKey == "" && len(opts.Recipients) == 0 && len(opts.KeyIDs) == 0 {
+		return DecryptOptions{}, RekeyOptions{}, errors.New("a new key, key ID or at least one new recipient is required")
+	}
+	if req.Cipher != "" {
+		if opts.Cipher, err = ParseCipherSuite(req.Cipher); err != nil {
+			return DecryptOptions{}, RekeyOptions{}, err
+		}
+	}
+	if req.SigningKey != "" {
+		if opts.SigningKey, err = ParseSigningKey(req.SigningKey); err != nil {
+			return DecryptOptions{}, RekeyOptions{}, fmt.Errorf("invalid signingKey: %v", err)
+		}
+	}
+	unlock.Password, opts.Password = secretBytes(req.Key), secretBytes(req.NewKey)
+	return unlock, opts, nil
+}
+
+// rekeyStoreMutex serialises rekey operations on the image store
+var rekeyStoreMutex sync.Mutex
+
+// rekeyStoredImage rekeys one image in the store. The new version is written
+// next to the old one and only replaces it once it is complete, and only if
+// no upload replaced the old one meanwhile.
+func rekeyStoredImage(imageID string, unlock DecryptOptions, opts RekeyOptions) (string, error) {
+	stored, exists := lookupStoredImage(imageID)
+	if !exists {
+		return "", fmt.Errorf("image with ID %s not found", imageID)
+	}
+
+	src, err := os.Open(stored.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open stored image: %v", err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(stored.Path), "rekey-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create store file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	result, err := RekeyStream(tmp, src, unlock, opts)
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write image data: %v", err)
+	}
+	if err := commitStoredImage(imageID, tmp.Name(), stored.Path, size, &stored); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// RekeyStore rekeys the given stored images, or every stored image if
+// imageIDs is empty, and calls progress after each one. In bulk mode images
+// the old credentials do not open are skipped; otherwise they are failures.
+func RekeyStore(imageIDs []string, unlock DecryptOptions, opts RekeyOptions, progress func(RekeyProgress)) RekeyProgress {
+	rekeyStoreMutex.Lock()
+	defer rekeyStoreMutex.Unlock()
+
+	bulk := len(imageIDs) == 0
+	if bulk {
+		encryptedImageStoreMutex.RLock()
+		for id := range encryptedImageStore {
+			imageIDs = append(imageIDs, id)
+		}
+		encryptedImageStoreMutex.RUnlock()
+		sort.Strings(imageIDs)
+	}
+
+	status := RekeyProgress{Total: len(imageIDs)}
+	for _, imageID := range imageIDs {
+		result, err := rekeyStoredImage(imageID, unlock, opts)
+		switch {
+		case err != nil && bulk && isWrongKey(err):
+			result = RekeySkipped
+			status.Skipped++
+		case err != nil:
+			result = RekeyFailed
+			status.Failed++
+			log.Printf("Rekey of image '%s' failed: %v", imageID, err)
+		case result == RekeyRewrapped:
+			status.Rewrapped++
+		default:
+			status.Reencrypted++
+		}
+
+		status.Done++
+		status.ImageID, status.Result, status.Error = imageID, result, ""
+		if err != nil {
+			status.Error = err.Error()
+		}
+		if progress != nil {
+			progress(status)
+		}
+	}
+
+	status.ImageID, status.Result, status.Error = "", "", ""
+	status.Finished = true
+	return status
+}
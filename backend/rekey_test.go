@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRekeyReencryptKeepsImageMetadata(t *testing.T) {
+	plaintext := []byte("image with metadata")
+	oldPassword, newPassword := []byte("old password"), []byte("new password")
+	encrypted, err := EncryptDataWithOptions(plaintext, oldPassword, EncryptOptions{
+		KDF:           testKDF,
+		ImageMetadata: &ImageMetadata{Filename: "holiday.png", MIMEType: "image/png", Width: 8, Height: 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rekeyed bytes.Buffer
+	result, err := RekeyStream(&rekeyed, bytes.NewReader(encrypted), DecryptOptions{Password: oldPassword},
+		RekeyOptions{Password: newPassword, KDF: testKDF, Reencrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != RekeyReencrypted {
+		t.Fatalf("result %q, want %q", result, RekeyReencrypted)
+	}
+
+	got, header, err := DecryptDataWithOptions(rekeyed.Bytes(), DecryptOptions{Password: newPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("re-encrypted image decrypts to different data")
+	}
+	if header.ImageMetadata == nil || header.ImageMetadata.Filename != "holiday.png" || header.ImageMetadata.Width != 8 {
+		t.Errorf("image metadata %+v was not carried over", header.ImageMetadata)
+	}
+	if _, _, err := DecryptDataWithOptions(rekeyed.Bytes(), DecryptOptions{Password: oldPassword}); err == nil {
+		t.Error("the old password still opens the re-encrypted image")
+	}
+
+	// The wrong old password fails before anything is written
+	rekeyed.Reset()
+	_, err = RekeyStream(&rekeyed, bytes.NewReader(encrypted), DecryptOptions{Password: []byte("wrong")},
+		RekeyOptions{Password: newPassword, KDF: testKDF, Reencrypt: true})
+	if !isWrongKey(err) {
+		t.Errorf("wrong password returned %v", err)
+	}
+	if rekeyed.Len() != 0 {
+		t.Errorf("%d bytes written with the wrong password", rekeyed.Len())
+	}
+}
+
+func TestRekeyRewrapsContainer(t *testing.T) {
+	alice := newTestIdentity(t)
+	oldPassword := []byte("old password")
+	plaintext := make([]byte, 2*DefaultSegmentSize+1)
+	rand.Read(plaintext)
+	encrypted, err := EncryptDataWithOptions(plaintext, oldPassword, EncryptOptions{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rekeyed bytes.Buffer
+	result, err := RekeyStream(&rekeyed, bytes.NewReader(encrypted), DecryptOptions{Password: oldPassword},
+		RekeyOptions{Recipients: []*ecdh.PublicKey{alice.PublicKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != RekeyRewrapped {
+		t.Fatalf("result %q, want %q", result, RekeyRewrapped)
+	}
+
+	// Rewrapping leaves the payload as it was
+	_, end, err := ParseContainerHeader(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newEnd, err := ParseContainerHeader(rekeyed.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rekeyed.Bytes()[newEnd:], encrypted[end:]) {
+		t.Error("rewrapping changed the payload")
+	}
+
+	got, _, err := DecryptDataWithOptions(rekeyed.Bytes(), DecryptOptions{Identities: []*ecdh.PrivateKey{alice}})
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("the new recipient cannot decrypt the rekeyed image (%v)", err)
+	}
+	if _, _, err := DecryptDataWithOptions(rekeyed.Bytes(), DecryptOptions{Password: oldPassword}); err == nil {
+		t.Error("the old password still opens the rekeyed image")
+	}
+
+	if _, err := RekeyStream(io.Discard, bytes.NewReader(encrypted), DecryptOptions{Password: oldPassword}, RekeyOptions{}); err == nil {
+		t.Error("rekeyed without new credentials")
+	}
+}
+
+func TestAuthorizeRekey(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TCPServerConfig
+		req    RekeyRequest
+		ok     bool
+	}{
+		{"disabled", TCPServerConfig{}, RekeyRequest{ImageIDs: []string{"a"}}, false},
+		{"no token", TCPServerConfig{RekeyToken: "secret"}, RekeyRequest{ImageIDs: []string{"a"}}, false},
+		{"wrong token", TCPServerConfig{RekeyToken: "secret"}, RekeyRequest{Token: "guess", ImageIDs: []string{"a"}}, false},
+		{"listed images", TCPServerConfig{RekeyToken: "secret"}, RekeyRequest{Token: "secret", ImageIDs: []string{"a"}}, true},
+		{"bulk not allowed", TCPServerConfig{RekeyToken: "secret"}, RekeyRequest{Token: "secret"}, false},
+		{"bulk", TCPServerConfig{RekeyToken: "secret", AllowBulkRekey: true}, RekeyRequest{Token: "secret"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.authorizeRekey(tt.req)
+			if tt.ok && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrRekeyNotAllowed) {
+				t.Errorf("got %v, want ErrRekeyNotAllowed", err)
+			}
+		})
+	}
+}
+
+// useRekeyStore starts a TCP server that accepts rekeys with token
+func useRekeyStore(t *testing.T, token string) string {
+	t.Helper()
+	previous := tcpServerConfig
+	tcpServerConfig = TCPServerConfig{MaxImageSize: DefaultMaxStoredImageSize, RekeyToken: token, AllowBulkRekey: true}
+	t.Cleanup(func() { tcpServerConfig = previous })
+	return startTestTCPServer(t)
+}
+
+func TestRekeyStoreViaTCP(t *testing.T) {
+	addr := useRekeyStore(t, "rekey token")
+	oldPassword, otherPassword := []byte("old password"), []byte("someone else's password")
+	images := map[string][]byte{"first": []byte("first image"), "second": []byte("second image"), "other": []byte("other image")}
+	for id, plaintext := range images {
+		password := oldPassword
+		if id == "other" {
+			password = otherPassword
+		}
+		encrypted, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storeTestImage(t, id, encrypted)
+	}
+
+	// Images the old key does not open are skipped in a bulk rekey
+	var progress []RekeyProgress
+	final, err := RekeyViaTCP(addr, RekeyRequest{Token: "rekey token", Key: string(oldPassword), NewKey: "new password"},
+		func(p RekeyProgress) { progress = append(progress, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 3 || progress[2].Done != 3 {
+		t.Errorf("got %d progress reports: %+v", len(progress), progress)
+	}
+	if !final.Finished || final.Total != 3 || final.Rewrapped != 2 || final.Skipped != 1 || final.Failed != 0 {
+		t.Errorf("final report %+v", final)
+	}
+
+	for id, plaintext := range images {
+		stored, err := RequestImageViaTCP(addr, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		password := []byte("new password")
+		if id == "other" {
+			password = otherPassword
+		}
+		if got, _, err := DecryptDataWithOptions(stored, DecryptOptions{Password: password}); err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%s does not decrypt after the rekey (%v)", id, err)
+		}
+	}
+
+	// A request without the token changes nothing
+	_, err = RekeyViaTCP(addr, RekeyRequest{Token: "guess", Key: "new password", NewKey: "stolen"}, nil)
+	if !errors.Is(err, ErrRekeyNotAllowed) {
+		t.Errorf("wrong token returned %v, want ErrRekeyNotAllowed", err)
+	}
+	stored, err := RequestImageViaTCP(addr, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptDataWithOptions(stored, DecryptOptions{Password: []byte("new password")}); err != nil {
+		t.Errorf("refused rekey changed the image: %v", err)
+	}
+}
+
+func TestRekeyKeepsConcurrentUpload(t *testing.T) {
+	useRekeyStore(t, "rekey token")
+	oldPassword, newPassword := []byte("old password"), []byte("new password")
+	encrypt := func(plaintext, password []byte) []byte {
+		t.Helper()
+		encrypted, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encrypted
+	}
+	upload := func(data []byte) {
+		t.Helper()
+		if err := storeImage("photo", bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A rekey that read the first upload must not replace the second one
+	upload(encrypt([]byte("first upload"), oldPassword))
+	stored, _ := lookupStoredImage("photo")
+	second := encrypt([]byte("second upload"), oldPassword)
+	upload(second)
+	rekeyed := filepath.Join(tcpServerConfig.StoreDir, "rekeyed")
+	if err := os.WriteFile(rekeyed, encrypt([]byte("first upload"), newPassword), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitStoredImage("photo", rekeyed, stored.Path, stored.Size, &stored); !errors.Is(err, ErrStoredImageChanged) {
+		t.Fatalf("commit over a newer upload returned %v, want ErrStoredImageChanged", err)
+	}
+	if data, err := os.ReadFile(stored.Path); err != nil || !bytes.Equal(data, second) {
+		t.Errorf("the newer upload was overwritten (%v)", err)
+	}
+
+	// Rekeying the current version still works
+	if result, err := rekeyStoredImage("photo", DecryptOptions{Password: oldPassword}, RekeyOptions{Password: newPassword, KDF: testKDF}); err != nil || result != RekeyRewrapped {
+		t.Fatalf("rekey returned %q, %v", result, err)
+	}
+	current, _ := lookupStoredImage("photo")
+	data, err := os.ReadFile(current.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := DecryptDataWithOptions(data, DecryptOptions{Password: newPassword}); err != nil || string(got) != "second upload" {
+		t.Errorf("rekeyed image is %q (%v)", got, err)
+	}
+	if current.Generation == stored.Generation {
+		t.Error("the rekeyed image kept the generation of the first upload")
+	}
+}
+
+func TestRekeyEndpoint(t *testing.T) {
+	addr := useRekeyStore(t, "rekey token")
+	encrypted, err := EncryptDataWithOptions([]byte("image"), []byte("old password"), EncryptOptions{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeTestImage(t, "image", encrypted)
+
+	request := map[string]any{"serverAddr": addr, "token": "rekey token", "imageIDs": []string{"image", "missing"},
+		"key": "old password", "newKey": "new password", "reencrypt": true}
+	rec := postJSON(t, handleRekey, request)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var reports []RekeyProgress
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var report RekeyProgress
+		if err := json.Unmarshal([]byte(line), &report); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, report)
+	}
+	if len(reports) != 3 || reports[0].Result != RekeyReencrypted || reports[1].Result != RekeyFailed {
+		t.Errorf("reports %+v", reports)
+	}
+	if final := reports[len(reports)-1]; !final.Finished || final.Reencrypted != 1 || final.Failed != 1 {
+		t.Errorf("final report %+v", final)
+	}
+
+	request["token"] = "guess"
+	if rec := postJSON(t, handleRekey, request); rec.Code != http.StatusForbidden {
+		t.Errorf("wrong token: status %d, want 403", rec.Code)
+	}
+	delete(request, "newKey")
+	if rec := postJSON(t, handleRekey, request); rec.Code != http.StatusBadRequest {
+		t.Errorf("no new key: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// Resampling
+//
+// Operations that move pixels by fractions of a pixel compute each output
+// pixel from the source pixels around the position it maps to, weighted by a
+// resampling kernel:
+//
+//	nearest   the closest source pixel
+//	box       the average of the source pixels an output pixel covers
+//	bilinear  linear interpolation between the 2x2 closest pixels
+//	bicubic   Catmull-Rom cubic over the 4x4 closest pixels
+//	lanczos3  windowed sinc over the 6x6 closest pixels
+//
+// Kernels are applied to premultiplied 16-bit values, so a transparent pixel
+// next to an opaque one does not bleed its hidden colour into the result.
+// Bicubic and Lanczos overshoot near sharp edges; results are clamped to the
+// valid premultiplied range. Positions outside the source are filled as the
+// BackgroundFill says: transparent, a solid colour, or the nearest edge pixel.
+
+// ResamplingKernel selects how pixels between source pixels are computed
+type ResamplingKernel byte
+
+const (
+	// KernelNearest takes the closest source pixel
+	KernelNearest ResamplingKernel = 0
+
+	// KernelBilinear interpolates linearly between neighbouring pixels
+	KernelBilinear ResamplingKernel = 1
+
+	// KernelBicubic interpolates with the Catmull-Rom cubic
+	KernelBicubic ResamplingKernel = 2
+
+	// KernelLanczos3 interpolates with a Lanczos window of three lobes
+	KernelLanczos3 ResamplingKernel = 3
+
+	// KernelBox averages the source pixels an output pixel covers, which is
+	// the closest pixel unless the image is made smaller
+	KernelBox ResamplingKernel = 4
+
+	// maxKernelTaps is the most source pixels a kernel reads along one axis
+	maxKernelTaps = 8
+)
+
+// String returns the name of the kernel as accepted by ParseResamplingKernel
+func (k ResamplingKernel) String() string {
+	switch k {
+	case KernelNearest:
+		return "nearest"
+	case KernelBilinear:
+		return "bilinear"
+	case KernelBicubic:
+		return "bicubic"
+	case KernelLanczos3:
+		return "lanczos3"
+	case KernelBox:
+		return "box"
+	default:
+		return fmt.Sprintf("kernel(%d)", byte(k))
+	}
+}
+
+// ParseResamplingKernel converts a kernel name into a ResamplingKernel. An
+// empty name selects nearest.
+func ParseResamplingKernel(name string) (ResamplingKernel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "nearest":
+		return KernelNearest, nil
+	case "bilinear", "linear":
+		return KernelBilinear, nil
+	case "bicubic", "cubic", "catmull-rom":
+		return KernelBicubic, nil
+	case "lanczos3", "lanczos":
+		return KernelLanczos3, nil
+	case "box", "area":
+		return KernelBox, nil
+	default:
+		return 0, fmt.Errorf("unsupported resampling kernel %q", name)
+	}
+}
+
+// support returns how far from the sample position the kernel reaches
+func (k ResamplingKernel) support() float64 {
+	switch k {
+	case KernelBilinear:
+		return 1
+	case KernelBicubic:
+		return 2
+	case KernelLanczos3:
+		return 3
+	default:
+		return 0.5
+	}
+}
+
+// weight returns the weight of a source pixel at distance x from the sample
+// position
+func (k ResamplingKernel) weight(x float64) float64 {
+	x = math.Abs(x)
+	switch k {
+	case KernelBilinear:
+		if x < 1 {
+			return 1 - x
+		}
+	case KernelBicubic:
+		if x < 1 {
+			return (1.5*x-2.5)*x*x + 1
+		}
+		if x < 2 {
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+	case KernelLanczos3:
+		if x == 0 {
+			return 1
+		}
+		if x < 3 {
+			px := math.Pi * x
+			return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+		}
+	default:
+		if x <= 0.5 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// taps returns the first source index the kernel reads around position p,
+// the number of indexes it reads and their normalised weights
+func (k ResamplingKernel) taps(p float64, weights *[maxKernelTaps]float64) (int, int) {
+	if k == KernelNearest || k == KernelBox {
+		weights[0] = 1
+		return int(math.Floor(p + 0.5)), 1
+	}
+	support := k.support()
+	first := int(math.Floor(p - support + 1))
+	n, sum := 0, 0.0
+	for i := first; n < maxKernelTaps && float64(i) < p+support; i++ {
+		weights[n] = k.weight(p - float64(i))
+		sum += weights[n]
+		n++
+	}
+	if sum != 0 {
+		for i := 0; i < n; i++ {
+			weights[i] /= sum
+		}
+	}
+	return first, n
+}
+
+// BackgroundFill selects what resampling reads outside the source image
+type BackgroundFill byte
+
+const (
+	// BackgroundTransparent fills with transparent pixels
+	BackgroundTransparent BackgroundFill = 0
+
+	// BackgroundSolid fills with a solid colour
+	BackgroundSolid BackgroundFill = 1
+
+	// BackgroundEdge repeats the nearest edge pixel
+	BackgroundEdge BackgroundFill = 2
+)
+
+// String returns the name of the fill as accepted by ParseBackgroundFill
+func (f BackgroundFill) String() string {
+	switch f {
+	case BackgroundTransparent:
+		return "transparent"
+	case BackgroundSolid:
+		return "solid"
+	case BackgroundEdge:
+		return "edge"
+	default:
+		return fmt.Sprintf("background(%d)", byte(f))
+	}
+}
+
+// ParseBackgroundFill converts "transparent", "edge" or a hex colour such as
+// "#ff8000" or "#ff800080" into a BackgroundFill and, for a colour, the
+// colour to fill with. An empty name selects transparent.
+func ParseBackgroundFill(name string) (BackgroundFill, color.Color, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "", "transparent", "none":
+		return BackgroundTransparent, nil, nil
+	case "edge", "extend":
+		return BackgroundEdge, nil, nil
+	}
+	rgba, err := hex.DecodeString(strings.TrimPrefix(name, "#"))
+	if err != nil || (len(rgba) != 3 && len(rgba) != 4) {
+		return 0, nil, fmt.Errorf("unsupported background %q", name)
+	}
+	if len(rgba) == 3 {
+		rgba = append(rgba, 0xff)
+	}
+	return BackgroundSolid, color.NRGBA{R: rgba[0], G: rgba[1], B: rgba[2], A: rgba[3]}, nil
+}
+
+// resampler samples an image at arbitrary positions, where pixel (x, y) of
+// the source sits at position (x, y)
+type resampler struct {
+	src           *image.RGBA64
+	width, height int
+	kernel        ResamplingKernel
+	fill          BackgroundFill
+
+	// background is the premultiplied fill colour, scaled to [0, 1]
+	background [4]float64
+}
+
+// newResampler prepares src for sampling with kernel, filling positions
+// outside it as fill says. background is only used for BackgroundSolid.
+func newResampler(src *image.RGBA64, kernel ResamplingKernel, fill BackgroundFill, background color.Color) *resampler {
+	return &resampler{src: src, width: src.Rect.Dx(), height: src.Rect.Dy(), kernel: kernel, fill: fill,
+		background: backgroundChannels(fill, background)}
+}
+
+// sample writes the pixel at position (x, y) to out as 8-bit premultiplied
+// RGBA
+func (s *resampler) sample(x, y float64, out []uint8) {
+	var wx, wy [maxKernelTaps]float64
+	firstX, nx := s.kernel.taps(x, &wx)
+	firstY, ny := s.kernel.taps(y, &wy)
+	unit := unitChannels()
+
+	var acc [4]float64
+	for j := 0; j < ny; j++ {
+		sy := firstY + j
+		if sy < 0 || sy >= s.height {
+			if s.fill != BackgroundEdge {
+				for c := range acc {
+					acc[c] += s.background[c] * wy[j]
+				}
+				continue
+			}
+			sy = clampIndex(sy, s.height)
+		}
+		row := s.src.Pix[sy*s.src.Stride:]
+		var line [4]float64
+		for i := 0; i < nx; i++ {
+			sx := firstX + i
+			if sx < 0 || sx >= s.width {
+				if s.fill != BackgroundEdge {
+					for c := range line {
+						line[c] += s.background[c] * wx[i]
+					}
+					continue
+				}
+				sx = clampIndex(sx, s.width)
+			}
+			p := sx * 8
+			line[0] += unit[channel16(row, p)] * wx[i]
+			line[1] += unit[channel16(row, p+2)] * wx[i]
+			line[2] += unit[channel16(row, p+4)] * wx[i]
+			line[3] += unit[channel16(row, p+6)] * wx[i]
+		}
+		for c := range acc {
+			acc[c] += line[c] * wy[j]
+		}
+	}
+
+	// Keep the result a valid premultiplied colour after any overshoot
+	a := math.Min(math.Max(acc[3], 0), 1)
+	for c := 0; c < 3; c++ {
+		out[c] = uint8(math.Min(math.Max(acc[c], 0), a)*255 + 0.5)
+	}
+	out[3] = uint8(a*255 + 0.5)
+}
+
+// store16 writes acc, premultiplied channels scaled to [0, 1], to out as a
+// 16-bit RGBA64 pixel, clamped like sample clamps its results
+func store16(out []uint8, acc *[4]float64) {
+	a := math.Min(math.Max(acc[3], 0), 1)
+	for c := 0; c < 4; c++ {
+		v := a
+		if c < 3 {
+			v = math.Min(math.Max(acc[c], 0), a)
+		}
+		v16 := uint16(v*0xffff + 0.5)
+		out[c*2], out[c*2+1] = uint8(v16>>8), uint8(v16)
+	}
+}
+
+// backgroundChannels returns the premultiplied channels of the fill colour,
+// scaled to [0, 1]. They are zero unless fill is BackgroundSolid.
+func backgroundChannels(fill BackgroundFill, background color.Color) [4]float64 {
+	if fill != BackgroundSolid || background == nil {
+		return [4]float64{}
+	}
+	r, g, b, a := background.RGBA()
+	return [4]float64{float64(r) / 0xffff, float64(g) / 0xffff, float64(b) / 0xffff, float64(a) / 0xffff}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+var interpolatingKernels = []ResamplingKernel{KernelBilinear, KernelBicubic, KernelLanczos3}
+
+func TestParseResamplingKernel(t *testing.T) {
+	tests := []struct {
+		name string
+		want ResamplingKernel
+	}{
+		{"", KernelNearest},
+		{"linear", KernelBilinear},
+		{" Catmull-Rom ", KernelBicubic},
+		{"LANCZOS", KernelLanczos3},
+		{"area", KernelBox},
+	}
+	for _, tt := range tests {
+		if got, err := ParseResamplingKernel(tt.name); err != nil || got != tt.want {
+			t.Errorf("ParseResamplingKernel(%q) = %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+	for _, kernel := range append(interpolatingKernels, KernelNearest, KernelBox) {
+		if got, err := ParseResamplingKernel(kernel.String()); err != nil || got != kernel {
+			t.Errorf("%s does not parse back (%v)", kernel, err)
+		}
+	}
+	if _, err := ParseResamplingKernel("sinc"); err == nil {
+		t.Error("unknown kernel parsed")
+	}
+}
+
+func TestParseBackgroundFill(t *testing.T) {
+	tests := []struct {
+		name  string
+		fill  BackgroundFill
+		color color.Color
+	}{
+		{"", BackgroundTransparent, nil},
+		{"none", BackgroundTransparent, nil},
+		{"Extend", BackgroundEdge, nil},
+		{"#ff8000", BackgroundSolid, color.NRGBA{0xff, 0x80, 0x00, 0xff}},
+		{"00ff0080", BackgroundSolid, color.NRGBA{0x00, 0xff, 0x00, 0x80}},
+	}
+	for _, tt := range tests {
+		fill, c, err := ParseBackgroundFill(tt.name)
+		if err != nil || fill != tt.fill || c != tt.color {
+			t.Errorf("ParseBackgroundFill(%q) = %s, %v, %v", tt.name, fill, c, err)
+		}
+	}
+	for _, bad := range []string{"red", "#ff80", "#ff800080ff", "#gg0000"} {
+		if _, _, err := ParseBackgroundFill(bad); err == nil {
+			t.Errorf("%q parsed as a background", bad)
+		}
+	}
+}
+
+func TestKernelTaps(t *testing.T) {
+	for _, kernel := range interpolatingKernels {
+		// Interpolating kernels reproduce the source pixel at its own position
+		for _, x := range []float64{1, 2, 3} {
+			if w := kernel.weight(x); math.Abs(w) > 1e-12 {
+				t.Errorf("%s: weight %v at distance %v", kernel, w, x)
+			}
+		}
+		if w := kernel.weight(0); w != 1 {
+			t.Errorf("%s: weight %v at the sample position", kernel, w)
+		}
+
+		var weights [maxKernelTaps]float64
+		_, n := kernel.taps(10.3, &weights)
+		if n != int(2*kernel.support()) {
+			t.Errorf("%s reads %d pixels, want %d", kernel, n, int(2*kernel.support()))
+		}
+		sum := 0.0
+		for _, w := range weights[:n] {
+			sum += w
+		}
+		if math.Abs(sum-1) > 1e-12 {
+			t.Errorf("%s: weights sum to %v", kernel, sum)
+		}
+	}
+
+	var weights [maxKernelTaps]float64
+	first, n := KernelBilinear.taps(4.25, &weights)
+	if first != 4 || n != 2 || weights[0] != 0.75 || weights[1] != 0.25 {
+		t.Errorf("bilinear taps at 4.25: first %d, weights %v", first, weights[:n])
+	}
+}
+
+// testRGBA64 returns a 1-pixel-high RGBA64 image of the given pixels
+func testRGBA64(pixels ...color.Color) *image.RGBA64 {
+	img := image.NewRGBA64(image.Rect(0, 0, len(pixels), 1))
+	for x, c := range pixels {
+		img.Set(x, 0, c)
+	}
+	return img
+}
+
+func TestResamplerPremultipliedAlpha(t *testing.T) {
+	tests := []struct {
+		name   string
+		pixels []color.Color
+		want   color.RGBA
+	}{
+		{"black to white", []color.Color{color.Black, color.White}, color.RGBA{128, 128, 128, 255}},
+		// The hidden green of the transparent pixel does not bleed in
+		{"red to transparent", []color.Color{color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 0}}, color.RGBA{128, 0, 0, 128}},
+	}
+	for _, tt := range tests {
+		s := newResampler(testRGBA64(tt.pixels...), KernelBilinear, BackgroundEdge, nil)
+		out := make([]uint8, 4)
+		s.sample(0.5, 0, out)
+		if got := (color.RGBA{out[0], out[1], out[2], out[3]}); got != tt.want {
+			t.Errorf("%s: sampled %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRotateKernelsAtRightAngles(t *testing.T) {
+	grid := grayGrid([]uint8{1, 2, 3}, []uint8{4, 5, 6})
+	want := map[float64][][]uint8{0: {{1, 2, 3}, {4, 5, 6}}, 90: transforms[4].want, 180: transforms[5].want, -90: transforms[6].want}
+	for _, kernel := range append(interpolatingKernels, KernelNearest) {
+		for angle, rows := range want {
+			t.Run(fmt.Sprintf("%s/%v", kernel, angle), func(t *testing.T) {
+				got, err := RotateArbitrary(context.Background(), grid, angle, RotateOptions{Kernel: kernel})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Bounds() != image.Rect(0, 0, len(rows[0]), len(rows)) {
+					t.Fatalf("bounds %v", got.Bounds())
+				}
+				for y, row := range rows {
+					for x, v := range row {
+						if c := got.At(x, y).(color.RGBA); c != (color.RGBA{v, v, v, 255}) {
+							t.Fatalf("pixel %d,%d is %v, want gray %d", x, y, c, v)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRotateBackground(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	img := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{255, 0, 0, 255})
+	}
+	tests := []struct {
+		background string
+		corner     color.RGBA
+	}{
+		{"transparent", color.RGBA{}},
+		{"#00ff00", color.RGBA{0, 255, 0, 255}},
+		{"#00ff0080", color.RGBA{0, 128, 0, 128}},
+		{"edge", red},
+	}
+	for _, kernel := range append(interpolatingKernels, KernelNearest) {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/%s", kernel, tt.background), func(t *testing.T) {
+				fill, c, err := ParseBackgroundFill(tt.background)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts := RotateOptions{Kernel: kernel, Background: fill, BackgroundColor: c}
+				got, err := RotateArbitrary(context.Background(), img, 45, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rotated := got.(*image.RGBA)
+				if size := rotated.Rect.Dx(); size != 29 {
+					t.Errorf("canvas %v, want 29 pixels square", rotated.Rect)
+				}
+				if c := rotated.RGBAAt(0, 0); c != tt.corner {
+					t.Errorf("corner %v, want %v", c, tt.corner)
+				}
+				if c := rotated.RGBAAt(14, 14); c != red {
+					t.Errorf("centre %v, want %v", c, red)
+				}
+
+				opts.Crop = true
+				cropped, err := RotateArbitrary(context.Background(), img, 45, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cropped.Bounds() != img.Bounds() {
+					t.Errorf("cropped to %v, want %v", cropped.Bounds(), img.Bounds())
+				}
+				if c := cropped.(*image.RGBA).RGBAAt(0, 0); c != tt.corner {
+					t.Errorf("cropped corner %v, want %v", c, tt.corner)
+				}
+			})
+		}
+	}
+}
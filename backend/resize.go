@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Resizing
+//
+// Resize scales an image in two separable passes, first along the rows and
+// then along the columns, each computing an output pixel from the source
+// pixels under a resampling kernel (see resample.go). When an image is made
+// smaller the kernel is widened by the scale factor, so that every source
+// pixel contributes to the result instead of being skipped, which is what
+// keeps downscaled previews free of aliasing. Pixel centres are mapped onto
+// each other, and pixels beyond the edges repeat the edge pixels.
+//
+// The size of the result is chosen by a ResizeMode:
+//
+//	exact  the given width and height, changing the aspect ratio if needed
+//	fit    the largest size within the given width and height
+//	fill   the given width and height, cropping the centre of the image to
+//	       their aspect ratio
+//	scale  the size of the image multiplied by a factor
+//
+// With exact and fit, a width or height of zero follows the aspect ratio of
+// the image.
+
+// ResizeMode selects how the size of a resized image is chosen
+type ResizeMode byte
+
+const (
+	// ResizeFit keeps the aspect ratio and fits within the width and height
+	ResizeFit ResizeMode = 0
+
+	// ResizeExact scales to the width and height
+	ResizeExact ResizeMode = 1
+
+	// ResizeFill covers the width and height and crops what is left over
+	ResizeFill ResizeMode = 2
+
+	// ResizeScale multiplies the size by a scale factor
+	ResizeScale ResizeMode = 3
+
+	// MaxResizePixels bounds the number of pixels a resized image may have
+	MaxResizePixels = 1 << 26
+
+	// ThumbnailSize is the largest width and height of a thumbnail
+	ThumbnailSize = 256
+)
+
+// ErrInvalidSize is returned for a resize to a size that is empty or too large
+var ErrInvalidSize = errors.New("invalid image size")
+
+// String returns the name of the mode as accepted by ParseResizeMode
+func (m ResizeMode) String() string {
+	switch m {
+	case ResizeFit:
+		return "fit"
+	case ResizeExact:
+		return "exact"
+	case ResizeFill:
+		return "fill"
+	case ResizeScale:
+		return "scale"
+	default:
+		return fmt.Sprintf("resize(%d)", byte(m))
+	}
+}
+
+// ParseResizeMode converts a mode name into a ResizeMode. An empty name
+// selects fit.
+func ParseResizeMode(name string) (ResizeMode, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "fit", "contain":
+		return ResizeFit, nil
+	case "exact", "stretch":
+		return ResizeExact, nil
+	case "fill", "cover", "crop":
+		return ResizeFill, nil
+	case "scale":
+		return ResizeScale, nil
+	default:
+		return 0, fmt.Errorf("unsupported resize mode %q", name)
+	}
+}
+
+// ResizeOptions describes a resize
+type ResizeOptions struct {
+	// Mode chooses the size of the result
+	Mode ResizeMode
+
+	// Width and Height are the size for ResizeFit, ResizeExact and ResizeFill
+	Width, Height int
+
+	// Scale is the factor for ResizeScale
+	Scale float64
+
+	// Kernel is the resampling filter; KernelBox, KernelBilinear,
+	// KernelBicubic (Catmull-Rom) and KernelLanczos3 give smooth results
+	Kernel ResamplingKernel
+}
+
+// Resize scales an image as opts describes
+func Resize(ctx context.Context, img image.Image, opts ResizeOptions) (image.Image, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	newWidth, newHeight, err := resizeDimensions(width, height, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := rgba64Pixels(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Mode == ResizeFill {
+		// Crop the centre of the image to the aspect ratio of the result
+		cropWidth, cropHeight := width, height
+		if width*newHeight > newWidth*height {
+			cropWidth = max(1, int(math.Round(float64(height)*float64(newWidth)/float64(newHeight))))
+		} else {
+			cropHeight = max(1, int(math.Round(float64(width)*float64(newHeight)/float64(newWidth))))
+		}
+		crop := image.Rect(0, 0, cropWidth, cropHeight).Add(src.Rect.Min).
+			Add(image.Pt((width-cropWidth)/2, (height-cropHeight)/2))
+		src = src.SubImage(crop).(*image.RGBA64)
+	}
+
+	// Rows first, then columns
+	columns := image.NewRGBA64(image.Rect(0, 0, newWidth, src.Rect.Dy()))
+	err = resizeLines(ctx, columns, src, false, newResizeWeights(src.Rect.Dx(), newWidth, opts.Kernel))
+	if err != nil {
+		return nil, err
+	}
+	resized := image.NewRGBA64(image.Rect(0, 0, newWidth, newHeight))
+	err = resizeLines(ctx, resized, columns, true, newResizeWeights(src.Rect.Dy(), newHeight, opts.Kernel))
+	if err != nil {
+		return nil, err
+	}
+	return rgbaPixels(ctx, resized)
+}
+
+// Thumbnail returns a preview of an image that fits within size by size
+// pixels. Images that already fit keep their size.
+func Thumbnail(ctx context.Context, img image.Image, size int) (image.Image, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return rgbaPixels(ctx, img)
+	}
+	return Resize(ctx, img, ResizeOptions{Mode: ResizeFit, Width: size, Height: size, Kernel: KernelLanczos3})
+}
+
+// resizeDimensions returns the size of an image of width by height pixels
+// resized as opts describes
+func resizeDimensions(width, height int, opts ResizeOptions) (int, int, error) {
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("%w: the image is empty", ErrInvalidSize)
+	}
+	if opts.Width < 0 || opts.Height < 0 {
+		return 0, 0, fmt.Errorf("%w: %dx%d", ErrInvalidSize, opts.Width, opts.Height)
+	}
+
+	// scaled multiplies n by factor, keeping at least one pixel and staying
+	// within range of an int when the result is far too large
+	scaled := func(n int, factor float64) int {
+		return max(1, int(math.Round(math.Min(float64(n)*factor, MaxResizePixels+1))))
+	}
+	newWidth, newHeight := opts.Width, opts.Height
+	switch opts.Mode {
+	case ResizeScale:
+		if !(opts.Scale > 0) || math.IsInf(opts.Scale, 1) {
+			return 0, 0, fmt.Errorf("%w: scale factor %v", ErrInvalidSize, opts.Scale)
+		}
+		newWidth, newHeight = scaled(width, opts.Scale), scaled(height, opts.Scale)
+	case ResizeFill:
+		if newWidth == 0 || newHeight == 0 {
+			return 0, 0, fmt.Errorf("%w: fill needs a width and a height", ErrInvalidSize)
+		}
+	case ResizeFit, ResizeExact:
+		switch {
+		case newWidth == 0 && newHeight == 0:
+			return 0, 0, fmt.Errorf("%w: a width or a height is required", ErrInvalidSize)
+		case newWidth == 0:
+			newWidth = scaled(width, float64(newHeight)/float64(height))
+		case newHeight == 0:
+			newHeight = scaled(height, float64(newWidth)/float64(width))
+		case opts.Mode == ResizeFit:
+			factor := math.Min(float64(newWidth)/float64(width), float64(newHeight)/float64(height))
+			newWidth, newHeight = min(newWidth, scaled(width, factor)), min(newHeight, scaled(height, factor))
+		}
+	default:
+		return 0, 0, fmt.Errorf("unsupported resize mode %s", opts.Mode)
+	}
+
+	if newWidth > MaxResizePixels || newHeight > MaxResizePixels || newWidth*newHeight > MaxResizePixels {
+		return 0, 0, fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrInvalidSize, newWidth, newHeight, MaxResizePixels)
+	}
+	return newWidth, newHeight, nil
+}
+
+// resizeWeights holds, for every output pixel along one axis, the first
+// source pixel it reads and the weights of the source pixels from there on
+type resizeWeights struct {
+	first   []int
+	weights [][]float64
+}
+
+// newResizeWeights computes the weights that scale srcLength pixels to
+// dstLength pixels with kernel
+func newResizeWeights(srcLength, dstLength int, kernel ResamplingKernel) resizeWeights {
+	ratio := float64(srcLength) / float64(dstLength)
+	widen := math.Max(1, ratio)
+	support := kernel.support() * widen
+
+	w := resizeWeights{first: make([]int, dstLength), weights: make([][]float64, dstLength)}
+	for i := 0; i < dstLength; i++ {
+		// The centre of output pixel i, in source pixel positions
+		center := (float64(i)+0.5)*ratio - 0.5
+
+		if kernel == KernelNearest {
+			w.first[i], w.weights[i] = int(math.Floor(center+0.5)), []float64{1}
+			continue
+		}
+		first := int(math.Ceil(center - support))
+		last := int(math.Floor(center + support))
+		weights := make([]float64, 0, last-first+1)
+		sum := 0.0
+		for j := first; j <= last; j++ {
+			weight := kernel.weight((float64(j) - center) / widen)
+			weights = append(weights, weight)
+			sum += weight
+		}
+		if sum == 0 {
+			w.first[i], w.weights[i] = int(math.Floor(center+0.5)), []float64{1}
+			continue
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		w.first[i], w.weights[i] = first, weights
+	}
+	return w
+}
+
+// resizeLines resamples the rows of src into the rows of dst, which is as
+// tall, or if vertical is set the columns of src into the columns of dst,
+// which is as wide, with the weights of each output pixel along that axis
+func resizeLines(ctx context.Context, dst, src *image.RGBA64, vertical bool, w resizeWeights) error {
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+	unit := unitChannels()
+
+	if !vertical {
+		srcWidth := src.Rect.Dx()
+		return parallelBands(ctx, height, 0, func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				row := src.Pix[y*src.Stride:]
+				out := dst.Pix[y*dst.Stride:]
+				for x := 0; x < width; x++ {
+					var acc [4]float64
+					for t, weight := range w.weights[x] {
+						p := clampIndex(w.first[x]+t, srcWidth) * 8
+						acc[0] += unit[channel16(row, p)] * weight
+						acc[1] += unit[channel16(row, p+2)] * weight
+						acc[2] += unit[channel16(row, p+4)] * weight
+						acc[3] += unit[channel16(row, p+6)] * weight
+					}
+					store16(out[x*8:], &acc)
+				}
+			}
+		})
+	}
+
+	// Columns are resampled a row at a time, adding each source row the
+	// output row reads to a row of sums
+	srcHeight := src.Rect.Dy()
+	return parallelBands(ctx, height, 0, func(lo, hi int) {
+		acc := make([][4]float64, width)
+		for y := lo; y < hi; y++ {
+			clear(acc)
+			for t, weight := range w.weights[y] {
+				row := src.Pix[clampIndex(w.first[y]+t, srcHeight)*src.Stride:]
+				for x := range acc {
+					p := x * 8
+					acc[x][0] += unit[channel16(row, p)] * weight
+					acc[x][1] += unit[channel16(row, p+2)] * weight
+					acc[x][2] += unit[channel16(row, p+4)] * weight
+					acc[x][3] += unit[channel16(row, p+6)] * weight
+				}
+			}
+			out := dst.Pix[y*dst.Stride:]
+			for x := range acc {
+				store16(out[x*8:], &acc[x])
+			}
+		}
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var resizeKernels = []ResamplingKernel{KernelNearest, KernelBox, KernelBilinear, KernelBicubic, KernelLanczos3}
+
+func TestResizeDimensions(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          ResizeOptions
+		width, height int
+	}{
+		{"fit wide", ResizeOptions{Mode: ResizeFit, Width: 100, Height: 100}, 100, 50},
+		{"fit tall box", ResizeOptions{Mode: ResizeFit, Width: 50, Height: 400}, 50, 25},
+		{"fit width only", ResizeOptions{Mode: ResizeFit, Width: 300}, 300, 150},
+		{"fit height only", ResizeOptions{Mode: ResizeFit, Height: 10}, 20, 10},
+		{"exact", ResizeOptions{Mode: ResizeExact, Width: 30, Height: 70}, 30, 70},
+		{"exact width only", ResizeOptions{Mode: ResizeExact, Width: 50}, 50, 25},
+		{"fill", ResizeOptions{Mode: ResizeFill, Width: 64, Height: 64}, 64, 64},
+		{"scale down", ResizeOptions{Mode: ResizeScale, Scale: 0.25}, 50, 25},
+		{"scale up", ResizeOptions{Mode: ResizeScale, Scale: 1.5}, 300, 150},
+		{"scale to nothing", ResizeOptions{Mode: ResizeScale, Scale: 0.0001}, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, err := resizeDimensions(200, 100, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if width != tt.width || height != tt.height {
+				t.Errorf("got %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+
+	for _, opts := range []ResizeOptions{
+		{Mode: ResizeFit},
+		{Mode: ResizeExact, Width: -1, Height: 10},
+		{Mode: ResizeFill, Width: 10},
+		{Mode: ResizeScale},
+		{Mode: ResizeScale, Scale: -2},
+		{Mode: ResizeScale, Scale: 1e12},
+		{Mode: ResizeExact, Width: MaxResizePixels, Height: 2},
+	} {
+		if _, _, err := resizeDimensions(200, 100, opts); !errors.Is(err, ErrInvalidSize) {
+			t.Errorf("%+v returned %v, want ErrInvalidSize", opts, err)
+		}
+	}
+}
+
+func TestResizeKeepsSolidColour(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(5, 5, 45, 35))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{30, 140, 220, 255})
+	}
+	want := color.RGBA{30, 140, 220, 255}
+	for _, kernel := range resizeKernels {
+		for _, opts := range []ResizeOptions{
+			{Mode: ResizeScale, Scale: 0.3, Kernel: kernel},
+			{Mode: ResizeScale, Scale: 2.7, Kernel: kernel},
+			{Mode: ResizeFill, Width: 9, Height: 17, Kernel: kernel},
+		} {
+			t.Run(fmt.Sprintf("%s/%s", kernel, opts.Mode), func(t *testing.T) {
+				got, err := Resize(context.Background(), img, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resized := got.(*image.RGBA)
+				for y := 0; y < resized.Rect.Dy(); y++ {
+					for x := 0; x < resized.Rect.Dx(); x++ {
+						if c := resized.RGBAAt(x, y); c != want {
+							t.Fatalf("pixel %d,%d is %v, want %v", x, y, c, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// grayGrid returns a Gray image with the given rows of pixel values, placed
+// at an offset so that operations have to honour the bounds
+func grayGrid(rows ...[]uint8) *image.Gray {
+	img := image.NewGray(image.Rect(10, 20, 10+len(rows[0]), 20+len(rows)))
+	for y, row := range rows {
+		for x, v := range row {
+			img.SetGray(10+x, 20+y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+func TestResizeOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		src  *image.Gray
+		opts ResizeOptions
+		want [][]uint8
+	}{
+		{"box halves", grayGrid([]uint8{0, 100, 200, 50}), ResizeOptions{Mode: ResizeExact, Width: 2, Height: 1, Kernel: KernelBox},
+			[][]uint8{{50, 125}}},
+		{"box quarters", grayGrid([]uint8{0, 40}, []uint8{80, 120}), ResizeOptions{Mode: ResizeScale, Scale: 0.5, Kernel: KernelBox},
+			[][]uint8{{60}}},
+		{"nearest doubles", grayGrid([]uint8{10, 20}), ResizeOptions{Mode: ResizeScale, Scale: 2, Kernel: KernelNearest},
+			[][]uint8{{10, 10, 20, 20}, {10, 10, 20, 20}}},
+		{"fill crops the centre", grayGrid([]uint8{1, 2, 3, 4}, []uint8{5, 6, 7, 8}), ResizeOptions{Mode: ResizeFill, Width: 2, Height: 2, Kernel: KernelLanczos3},
+			[][]uint8{{2, 3}, {6, 7}}},
+		{"same size", grayGrid([]uint8{1, 2, 3}, []uint8{4, 5, 6}), ResizeOptions{Mode: ResizeExact, Width: 3, Height: 2, Kernel: KernelBicubic},
+			[][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Resize(context.Background(), tt.src, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resized := got.(*image.RGBA)
+			if resized.Rect != image.Rect(0, 0, len(tt.want[0]), len(tt.want)) {
+				t.Fatalf("bounds %v", resized.Rect)
+			}
+			for y, row := range tt.want {
+				for x, v := range row {
+					if c := resized.RGBAAt(x, y); c != (color.RGBA{v, v, v, 255}) {
+						t.Errorf("pixel %d,%d is %v, want gray %d", x, y, c, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		width, height int
+		want          image.Rectangle
+	}{
+		{600, 300, image.Rect(0, 0, 256, 128)},
+		{300, 1000, image.Rect(0, 0, 77, 256)},
+		{256, 256, image.Rect(0, 0, 256, 256)},
+		{40, 30, image.Rect(0, 0, 40, 30)},
+	}
+	for _, tt := range tests {
+		thumbnail, err := Thumbnail(ctx, smoothImage(tt.width, tt.height), ThumbnailSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumbnail.Bounds() != tt.want {
+			t.Errorf("thumbnail of %dx%d is %v, want %v", tt.width, tt.height, thumbnail.Bounds(), tt.want)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := Resize(cancelled, smoothImage(600, 300), ResizeOptions{Width: 100}); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled resize returned %v", err)
+	}
+}
+
+func TestProcessResizeSavesThumbnail(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("uploads", 0700); err != nil {
+		t.Fatal(err)
+	}
+	var upload bytes.Buffer
+	if err := png.Encode(&upload, smoothImage(600, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("uploads", "wide.png"), upload.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	process := func(body map[string]any) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		handleProcess(rec, httptest.NewRequest(http.MethodPost, "/process?filename=wide.png", bytes.NewReader(data)))
+		return rec
+	}
+
+	rec := process(map[string]any{"operation": "resize", "width": 300, "height": 300})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("resize: status %d: %s", rec.Code, rec.Body)
+	}
+	var response struct {
+		Data      string `json:"data"`
+		Thumbnail string `json:"thumbnail"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	decodeSize := func(path string) image.Point {
+		t.Helper()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		config, err := jpeg.DecodeConfig(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return image.Pt(config.Width, config.Height)
+	}
+	if size := decodeSize(filepath.Join("processed", response.Data)); size != image.Pt(300, 150) {
+		t.Errorf("processed image is %v, want 300x150", size)
+	}
+	if size := decodeSize(filepath.Join("processed", response.Thumbnail)); size != image.Pt(256, 128) {
+		t.Errorf("thumbnail is %v, want 256x128", size)
+	}
+
+	// The thumbnail endpoint serves it, and makes one if it is missing
+	if err := os.Remove(filepath.Join("processed", response.Thumbnail)); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handleThumbnail(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail?filename="+response.Data, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("thumbnail: status %d", rec.Code)
+	}
+	if config, err := jpeg.DecodeConfig(rec.Body); err != nil || config.Width != 256 || config.Height != 128 {
+		t.Errorf("served thumbnail is %dx%d (%v)", config.Width, config.Height, err)
+	}
+	rec = httptest.NewRecorder()
+	handleThumbnail(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail?filename=missing.jpg", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing image: status %d, want 404", rec.Code)
+	}
+
+	for _, body := range []map[string]any{
+		{"operation": "resize"},
+		{"operation": "resize", "width": -5, "height": 10},
+		{"operation": "resize", "mode": "fill", "width": 10},
+		{"operation": "resize", "mode": "sideways", "width": 10},
+		{"operation": "resize", "width": 10, "interpolation": "sinc"},
+	} {
+		if rec := process(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", body, rec.Code)
+		}
+	}
+}
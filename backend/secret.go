@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"log"
+	"regexp"
+)
+
+// Secret handling
+//
+// Passwords, data keys and every key derived from them are held in byte
+// slices and wiped as soon as they are no longer needed. Every function that
+// takes a password takes it as a byte slice and leaves it to the caller to
+// wipe. Form values and JSON fields arrive as strings, which cannot be
+// wiped, so the handlers copy a password into a byte slice once, as soon as
+// they read it, and wipe that copy when the request is done. Key schedules
+// held inside cipher and AEAD instances cannot be wiped either and live until
+// the garbage collector reclaims them.
+//
+// Secrets are never logged. As a second line of defence all log output goes
+// through a redacting writer, which replaces the value after names such as
+// key= or password=, and long runs of hex, base64 or decimal bytes, which is
+// what key material looks like once it has been formatted.
+
+// redacted replaces secrets in log output
+const redacted = "[REDACTED]"
+
+// secretPatterns match secrets in log output. The first keeps the name and
+// separator of a named value and redacts the value.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b((?:key|password|passphrase|secret|token|identity|share|dek|kek)s?\s*[=:]\s*)("[^"]*"|[^\s,;]+)`),
+	regexp.MustCompile(`\b[0-9A-Fa-f]{32,}\b`),
+	regexp.MustCompile(`[A-Za-z0-9+/_-]{40,}={0,2}`),
+	regexp.MustCompile(`\[(?:\d{1,3}[ ,]+){15,}\d{1,3}\]`),
+}
+
+// wipe overwrites secrets with zeros
+func wipe(secrets ...[]byte) {
+	for _, secret := range secrets {
+		clear(secret)
+	}
+}
+
+// secretBytes copies a password received as a string into a byte slice that
+// the caller wipes once it is done. An empty password gives a nil slice.
+func secretBytes(password string) []byte {
+	if password == "" {
+		return nil
+	}
+	return []byte(password)
+}
+
+// redactSecrets replaces anything that looks like a secret in a log line
+func redactSecrets(line []byte) []byte {
+	line = secretPatterns[0].ReplaceAll(line, []byte("${1}"+redacted))
+	for _, pattern := range secretPatterns[1:] {
+		line = pattern.ReplaceAllLiteral(line, []byte(redacted))
+	}
+	return line
+}
+
+// redactingWriter redacts secrets from everything written to w. The log
+// package writes each entry in a single call, so entries are never split.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// Write redacts p and writes it to the underlying writer
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write(redactSecrets(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// InstallRedactingLogger sends the output of the standard logger through a
+// redacting writer
+func InstallRedactingLogger() {
+	if _, ok := log.Writer().(redactingWriter); !ok {
+		log.SetOutput(redactingWriter{w: log.Writer()})
+	}
+}
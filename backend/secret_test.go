@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the standard logger through a redacting writer into a
+// buffer for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	InstallRedactingLogger()
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+// secretEncodings returns the forms in which a secret could end up in a log
+func secretEncodings(secret []byte) map[string]string {
+	return map[string]string{
+		"raw":          string(secret),
+		"hex":          hex.EncodeToString(secret),
+		"upper hex":    strings.ToUpper(hex.EncodeToString(secret)),
+		"base64":       base64.StdEncoding.EncodeToString(secret),
+		"raw base64":   base64.RawStdEncoding.EncodeToString(secret),
+		"url base64":   base64.URLEncoding.EncodeToString(secret),
+		"raw url b64":  base64.RawURLEncoding.EncodeToString(secret),
+		"decimal list": fmt.Sprint(secret),
+	}
+}
+
+// assertNotLogged fails if any of the secrets appears in the log
+func assertNotLogged(t *testing.T, logged string, secrets map[string][]byte) {
+	t.Helper()
+	for name, secret := range secrets {
+		for encoding, value := range secretEncodings(secret) {
+			if strings.Contains(logged, value) {
+				t.Errorf("%s found in the log as %s", name, encoding)
+			}
+		}
+	}
+}
+
+func TestRoundTripLogsNoKeyMaterial(t *testing.T) {
+	logged := captureLog(t)
+
+	password := "correct horse battery staple"
+	plaintext := testPNG(t)
+
+	rec := postForm(t, handleEncrypt, "image.png", plaintext, map[string]string{
+		"key":            password,
+		"kdfTime":        "1",
+		"kdfMemory":      "64",
+		"kdfParallelism": "1",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("encrypt: status %d: %s", rec.Code, rec.Body)
+	}
+	ciphertext := rec.Body.Bytes()
+
+	rec = postForm(t, handleDecrypt, "image.png.enc", ciphertext, map[string]string{"key": password})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("decrypt: status %d: %s", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), plaintext) {
+		t.Fatal("decrypted image differs from the original")
+	}
+
+	// Recover every key and nonce the round trip used
+	header, _, err := readContainerHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Recipients) != 1 || header.Recipients[0].Type != stanzaPassword {
+		t.Fatalf("expected a single password stanza, got %s", describeRecipients(header.Recipients))
+	}
+	stanza := header.Recipients[0].Body
+	params, _, err := unmarshalKDFParams(stanza)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappingKey, err := deriveKey([]byte(password), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dek, err := unwrapDataKeyPassword(stanza, []byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadKey, macKey, err := envelopeKeys(dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logged.Len() == 0 {
+		t.Fatal("the round trip logged nothing")
+	}
+	assertNotLogged(t, logged.String(), map[string][]byte{
+		"derived key":   wrappingKey,
+		"DEK":           dek,
+		"payload key":   payloadKey,
+		"MAC key":       macKey,
+		"nonce prefix":  header.Nonce,
+		"segment nonce": streamNonce(header.Nonce, 0, true),
+	})
+}
+
+func TestRedactingLoggerHidesFormattedKeys(t *testing.T) {
+	logged := captureLog(t)
+
+	dek, err := newFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Printf("unwrapped %x", dek)
+	log.Printf("unwrapped %X", dek)
+	log.Printf("unwrapped %s", base64.StdEncoding.EncodeToString(dek))
+	log.Printf("unwrapped %s", base64.RawURLEncoding.EncodeToString(dek))
+	log.Printf("unwrapped %v", dek)
+	log.Printf("password=hunter2, done")
+
+	got := logged.String()
+	if strings.Count(got, redacted) != 6 {
+		t.Errorf("expected 6 redactions, got:\n%s", got)
+	}
+	if strings.Contains(got, "hunter2") {
+		t.Error("password found in the log")
+	}
+	for encoding, value := range secretEncodings(dek) {
+		if encoding != "raw" && strings.Contains(got, value) {
+			t.Errorf("DEK found in the log as %s", encoding)
+		}
+	}
+}
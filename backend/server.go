@@ -1,18 +1,27 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"io"
 	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -21,8 +30,9 @@ const (
 	// HTTPPort is the port for the HTTP server
 	HTTPPort = "8083"
 
-	// MaxUploadSize is the maximum size of uploaded images (10MB)
-	MaxUploadSize = 10 * 1024 * 1024
+	// MaxUploadMemory is how much of an upload is kept in memory (10MB).
+	// Larger uploads are spooled to temporary files, so there is no hard size limit.
+	MaxUploadMemory = 10 * 1024 * 1024
 
 	// UploadPath is the directory for storing uploaded images
 	UploadPath = "./assets/uploads"
@@ -51,15 +61,31 @@ type RequestDecryptRequest struct {
 	ServerAddr string `json:"serverAddr"`
 	ImageID    string `json:"imageID"`
 	Key        string `json:"key"`
+	Identity   string `json:"identity,omitempty"` // X25519 private key, instead of Key
+
+	// KeyIDs are "provider:keyID" references to server-side keys, instead of
+	// Key; KeyToken is the key access token they need (see keyprovider.go)
+	KeyIDs   []string `json:"keyIds,omitempty"`
+	KeyToken string   `json:"keyToken,omitempty"`
+
+	// Shares are printed key shares of an image whose key has been split
+	Shares []string `json:"shares,omitempty"`
+
+	// TrustedSigners are Ed25519 sender keys; RequireSignature rejects images
+	// not signed by one of them (or by anyone, if none are given)
+	TrustedSigners   []string `json:"trustedSigners,omitempty"`
+	RequireSignature bool     `json:"requireSignature,omitempty"`
 }
 
 // RequestDecryptResponse is the response from the request-decrypt endpoint
 // Data contains the decrypted image as base64
 // Message is used on error
 type RequestDecryptResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message,omitempty"`
-	Data    string `json:"data,omitempty"`
+	Success   bool           `json:"success"`
+	Message   string         `json:"message,omitempty"`
+	Data      string         `json:"data,omitempty"`
+	Signature *SignatureInfo `json:"signature,omitempty"`
+	Metadata  *ImageMetadata `json:"metadata,omitempty"`
 }
 
 // StartServer initializes and starts the HTTP server
@@ -69,13 +95,20 @@ func StartServer(port string) {
 	// Add existing routes
 	router.HandleFunc("/api/upload", handleUpload)
 	router.HandleFunc("/api/process", handleProcess)
+	router.HandleFunc("/api/thumbnail", handleThumbnail)
 	router.HandleFunc("/api/encrypt", handleEncrypt)
+	router.HandleFunc("/api/rewrap", handleRewrap)
+	router.HandleFunc("/api/rekey", handleRekey)
+	router.HandleFunc("/api/shares/split", handleSplitKey)
 	router.HandleFunc("/api/decrypt", handleDecrypt)
 	router.HandleFunc("/api/transmit", handleTransmit)
 	router.HandleFunc("/api/request-image", handleRequestImage)
 	router.HandleFunc("/api/request-decrypt", handleRequestDecrypt)
 	router.HandleFunc("/api/server-decrypt", handleServerDecrypt)
 	router.HandleFunc("/api/get-decrypted-image", handleGetDecryptedImage) // New endpoint for reliable image downloads
+	router.HandleFunc("/api/keys/generate", handleGenerateKey)
+	router.HandleFunc("/api/keys/import", handleImportKey)
+	router.HandleFunc("/api/keys/keyring", handleKeyring)
 
 	// Add static file serving
 	fs := http.FileServer(http.Dir("../frontend"))
@@ -206,13 +239,61 @@ func handleProcess(w http.ResponseWriter, r *http.Request) {
 
 	// Get operation from request body
 	var req struct {
-		Operation string `json:"operation"`
+		Operation     string   `json:"operation"`
+		Angle         *float64 `json:"angle,omitempty"`
+		Radius        *float64 `json:"radius,omitempty"`
+		Interpolation string   `json:"interpolation,omitempty"`
+		Background    string   `json:"background,omitempty"`
+		Crop          bool     `json:"crop,omitempty"`
+		Width         int      `json:"width,omitempty"`
+		Height        int      `json:"height,omitempty"`
+		Scale         float64  `json:"scale,omitempty"`
+		Mode          string   `json:"mode,omitempty"`
+		X             int      `json:"x,omitempty"`
+		Y             int      `json:"y,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	// Rotation settings: the kernel, and a background of "transparent",
+	// "edge" or a hex colour
+	rotateOpts := RotateOptions{Crop: req.Crop}
+	var err error
+	if rotateOpts.Kernel, err = ParseResamplingKernel(req.Interpolation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rotateOpts.Background, rotateOpts.BackgroundColor, err = ParseBackgroundFill(req.Background); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	angle := 90.0 // Default 90-degree rotation
+	if req.Angle != nil {
+		angle = *req.Angle
+	}
+
+	// Blur radius, which is the standard deviation for Gaussian blurs
+	radius := 2.0 // Default blur radius
+	if req.Radius != nil {
+		radius = *req.Radius
+	}
+
+	// Resize settings: the mode defaults to scale when only a scale factor
+	// is given, and the filter to Lanczos
+	resizeOpts := ResizeOptions{Width: req.Width, Height: req.Height, Scale: req.Scale, Kernel: rotateOpts.Kernel}
+	if resizeOpts.Mode, err = ParseResizeMode(req.Mode); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" && req.Scale != 0 && req.Width == 0 && req.Height == 0 {
+		resizeOpts.Mode = ResizeScale
+	}
+	if req.Interpolation == "" {
+		resizeOpts.Kernel = KernelLanczos3
+	}
+
 	// Open the uploaded image
 	filepath := "uploads/" + filename
 	file, err := os.Open(filepath)
@@ -231,21 +312,57 @@ func handleProcess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Process the image based on the operation
+	// Process the image based on the operation. The request context stops
+	// the operation if the client goes away.
+	ctx := r.Context()
 	var processedImg image.Image
 	switch req.Operation {
 	case "grayscale":
-		processedImg = ConvertToGrayscale(img)
-	case "flip":
-		processedImg = FlipVertical(img)
+		processedImg, err = ConvertToGrayscale(ctx, img)
+	case "flip", "flip_vertical":
+		processedImg, err = FlipVertical(ctx, img)
+	case "flip_horizontal":
+		processedImg, err = FlipHorizontal(ctx, img)
+	case "transpose":
+		processedImg, err = Transpose(ctx, img)
+	case "transverse":
+		processedImg, err = Transverse(ctx, img)
+	case "crop":
+		var rect image.Rectangle
+		if rect, err = cropRect(img.Bounds().Dx(), img.Bounds().Dy(), req.X, req.Y, req.Width, req.Height); err != nil {
+			break
+		}
+		processedImg, err = Crop(ctx, img, rect)
 	case "rotate":
-		processedImg = RotateArbitrary(img, 90) // Default 90-degree rotation
-	case "blur":
-		processedImg = ApplyGaussianBlur(img, 2.0) // Default blur radius
+		// Right angles move pixels exactly unless the canvas is cropped
+		if turns := angle / 90; turns == math.Trunc(turns) && !req.Crop {
+			processedImg, err = RotateQuarterTurns(ctx, img, normalizeTurns(turns))
+		} else {
+			processedImg, err = RotateArbitrary(ctx, img, angle, rotateOpts)
+		}
+	case "blur", "gaussian_blur":
+		processedImg, err = ApplyGaussianBlur(ctx, img, radius, GaussianBlurOptions{BoxRadius: DefaultGaussianBoxRadius})
+	case "box_blur":
+		processedImg, err = ApplyBoxBlur(ctx, img, int(math.Round(radius)))
+	case "resize":
+		processedImg, err = Resize(ctx, img, resizeOpts)
 	default:
 		http.Error(w, "Invalid operation", http.StatusBadRequest)
 		return
 	}
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Processing of %s abandoned: %v", filename, err)
+			return
+		}
+		if errors.Is(err, ErrInvalidSize) || errors.Is(err, ErrInvalidRadius) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error processing image: %v", err)
+		http.Error(w, "Error processing image", http.StatusInternalServerError)
+		return
+	}
 
 	// Create processed directory if it doesn't exist
 	if err := os.MkdirAll("processed", 0755); err != nil {
@@ -272,22 +389,87 @@ func handleProcess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Return success response
+	// Save a preview next to it; the processed image is usable without one
 	response := map[string]interface{}{
 		"success": true,
 		"message": "Image processed successfully",
 		"data":    processedFilename,
 	}
+	if err := saveThumbnail(ctx, processedImg, "processed/"+thumbnailPrefix+processedFilename); err != nil {
+		log.Printf("Error creating thumbnail of %s: %v", processedFilename, err)
+	} else {
+		response["thumbnail"] = thumbnailPrefix + processedFilename
+	}
+
+	// Return success response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// padKey pads the key to the required length (32 bytes for AES-256)
-func padKey(key string) []byte {
-	// Use SHA-256 for consistent key derivation
-	hasher := sha256.New()
-	hasher.Write([]byte(key))
-	return hasher.Sum(nil)
+// thumbnailPrefix names the preview saved next to each processed image
+const thumbnailPrefix = "thumb_"
+
+// saveThumbnail writes a JPEG preview of img to path
+func saveThumbnail(ctx context.Context, img image.Image, path string) error {
+	thumbnail, err := Thumbnail(ctx, img, ThumbnailSize)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(file, thumbnail, nil); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// handleThumbnail serves the preview of a processed image, given as the
+// "filename" query parameter. Previews missing for images processed before
+// they were introduced are created from the processed image.
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	filename := filepath.Base(r.URL.Query().Get("filename"))
+	if filename == "." || filename == "/" {
+		http.Error(w, "Filename is required", http.StatusBadRequest)
+		return
+	}
+	thumbnailPath := filepath.Join("processed", thumbnailPrefix+filename)
+
+	if _, err := os.Stat(thumbnailPath); errors.Is(err, os.ErrNotExist) {
+		file, err := os.Open(filepath.Join("processed", filename))
+		if err != nil {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		img, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			log.Printf("Error decoding image: %v", err)
+			http.Error(w, "Failed to decode image", http.StatusInternalServerError)
+			return
+		}
+		if err := saveThumbnail(r.Context(), img, thumbnailPath); err != nil {
+			log.Printf("Error creating thumbnail of %s: %v", filename, err)
+			http.Error(w, "Error creating thumbnail", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, thumbnailPath)
 }
 
 // handleDownload handles image download requests
@@ -305,7 +487,8 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 
 	// Get filename and key from query parameters
 	filename := r.URL.Query().Get("data")
-	key := r.URL.Query().Get("key")
+	key := secretBytes(r.URL.Query().Get("key"))
+	defer wipe(key)
 
 	if filename == "" {
 		http.Error(w, "Filename is required", http.StatusBadRequest)
@@ -331,15 +514,12 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// If a key is provided, encrypt the content
-	if key != "" {
-		// Pad the key to the required length
-		paddedKey := padKey(key)
-
+	if len(key) > 0 {
 		// Convert the image data to base64
 		base64Data := base64.StdEncoding.EncodeToString(fileContent)
 
-		// Encrypt the base64 data
-		encryptedData, err := EncryptToBase64([]byte(base64Data), string(paddedKey))
+		// Encrypt the base64 data into armored text
+		encryptedData, err := EncryptToArmor([]byte(base64Data), key, map[string]string{"Filename": filename})
 		if err != nil {
 			log.Printf("Error encrypting file: %v", err)
 			http.Error(w, "Failed to encrypt image", http.StatusInternalServerError)
@@ -351,11 +531,11 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 
 		// Set appropriate headers for encrypted data
 		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("Content-Disposition", "attachment; filename=encrypted_"+filename)
+		w.Header().Set("Content-Disposition", attachmentDisposition("encrypted_"+filename))
 	} else {
 		// Set headers for regular image download
 		w.Header().Set("Content-Type", "image/jpeg")
-		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+		w.Header().Set("Content-Disposition", attachmentDisposition(filename))
 	}
 
 	// Write the content to the response
@@ -366,13 +546,34 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleTransmit handles image transmission requests
+// handleTransmit handles image transmission requests. The image is either sent
+// as base64 in a JSON body, or as a multipart "file" upload (with "key",
+// "serverAddr" and "imageID" fields) which is encrypted and transmitted
+// without being loaded into memory. Both accept an optional "cipher",
+// "recipients" public keys in addition to or in place of the key, and a
+// "signingKey" to sign the image as its sender.
 func handleTransmit(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		handleTransmitUpload(w, r)
+		return
+	}
+
 	var req struct {
-		EncryptedData string `json:"encryptedData"`
-		ServerAddr    string `json:"serverAddr"`
-		ImageID       string `json:"imageID"`
-		Key           string `json:"key"`
+		EncryptedData string   `json:"encryptedData"`
+		ServerAddr    string   `json:"serverAddr"`
+		ImageID       string   `json:"imageID"`
+		Key           string   `json:"key"`
+		Recipients    []string `json:"recipients,omitempty"`
+		KeyIDs        []string `json:"keyIds,omitempty"`
+		Cipher        string   `json:"cipher,omitempty"`
+		SigningKey    string   `json:"signingKey,omitempty"`
+		Padding       string   `json:"padding,omitempty"`
+		PaddingBucket int64    `json:"paddingBucket,omitempty"`
+		Compression   string   `json:"compression,omitempty"`
+		NotBefore     string   `json:"notBefore,omitempty"`
+		NotAfter      string   `json:"notAfter,omitempty"`
+		ExpiresIn     string   `json:"expiresIn,omitempty"`
+		MaxDecrypts   uint32   `json:"maxDecrypts,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -380,6 +581,45 @@ func handleTransmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	suite, err := ParseCipherSuite(req.Cipher)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recipients, err := ParsePublicKeys(req.Recipients)
+	if err != nil {
+		sendError(w, "Invalid recipients: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	keyIDs, err := ParseKeyRefs(req.KeyIDs)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (req.Key == "" && len(recipients) == 0 && len(keyIDs) == 0) || req.ServerAddr == "" || req.ImageID == "" {
+		sendError(w, "Missing key, keyIds or recipients, serverAddr, or imageID", http.StatusBadRequest)
+		return
+	}
+
+	var signingKey ed25519.PrivateKey
+	if req.SigningKey != "" {
+		if signingKey, err = ParseSigningKey(req.SigningKey); err != nil {
+			sendError(w, "Invalid signingKey: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	padding, paddingBucket, err := resolvePadding(req.Padding, req.PaddingBucket)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy, err := NewDecryptPolicy(req.NotBefore, req.NotAfter, req.ExpiresIn, req.MaxDecrypts)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Decode base64 image data into raw bytes
 	rawData, err := base64.StdEncoding.DecodeString(req.EncryptedData)
 	if err != nil {
@@ -387,10 +627,20 @@ func handleTransmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	compression, err := negotiateCompression(req.Compression, rawData[:min(len(rawData), 512)])
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Encrypt the data with provided key
-	encryptedBytes, err := EncryptData(rawData, req.Key)
+	opts := EncryptOptions{Cipher: suite, Recipients: recipients, KeyIDs: keyIDs, SigningKey: signingKey,
+		Padding: padding, PaddingBucket: paddingBucket, Compression: compression, Policy: policy}
+	key := secretBytes(req.Key)
+	defer wipe(key)
+	encryptedBytes, err := EncryptDataWithOptions(rawData, key, opts)
 	if err != nil {
-		sendError(w, "Failed to encrypt data for transmission", http.StatusInternalServerError)
+		sendEncryptError(w, err)
 		return
 	}
 
@@ -407,6 +657,107 @@ func handleTransmit(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleTransmitUpload encrypts a multipart upload into a temporary file and
+// streams it to the TCP server
+func handleTransmitUpload(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(MaxUploadMemory); err != nil {
+		sendError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		sendError(w, "No file received: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	key := secretBytes(r.FormValue("key"))
+	defer wipe(key)
+	serverAddr := r.FormValue("serverAddr")
+	imageID := r.FormValue("imageID")
+	recipients, err := ParsePublicKeys(r.MultipartForm.Value["recipients"])
+	if err != nil {
+		sendError(w, "Invalid recipients: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	keyIDs, err := ParseKeyRefs(r.MultipartForm.Value["keyId"])
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (len(key) == 0 && len(recipients) == 0 && len(keyIDs) == 0) || serverAddr == "" || imageID == "" {
+		sendError(w, "Missing key, keyId or recipients, serverAddr, or imageID", http.StatusBadRequest)
+		return
+	}
+
+	suite, err := ParseCipherSuite(r.FormValue("cipher"))
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signingKey, err := signingKeyFromForm(r)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	padding, paddingBucket, err := paddingFromForm(r)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy, err := policyFromForm(r)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	encryptedFile, err := os.CreateTemp("", "transmit-*")
+	if err != nil {
+		sendError(w, "Failed to create temporary file", http.StatusInternalServerError)
+		return
+	}
+	defer removeTempFile(encryptedFile)
+
+	imageMetadata, err := imageMetadataFromForm(r, file, header)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	compression, err := compressionFromForm(r, file)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Encrypting %s (%d bytes) for transmission as '%s'", header.Filename, header.Size, imageID)
+	opts := EncryptOptions{Cipher: suite, Recipients: recipients, KeyIDs: keyIDs, SigningKey: signingKey,
+		ImageMetadata: imageMetadata, Padding: padding, PaddingBucket: paddingBucket, Compression: compression, Policy: policy}
+	if err := EncryptStream(encryptedFile, file, key, opts); err != nil {
+		sendEncryptError(w, err)
+		return
+	}
+
+	size, err := encryptedFile.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = encryptedFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sendError(w, "Failed to read encrypted data", http.StatusInternalServerError)
+		return
+	}
+
+	if err := SendImageStreamViaTCP(imageID, encryptedFile, size, serverAddr); err != nil {
+		sendError(w, "Failed to transmit image", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, ImageResponse{
+		Success: true,
+		Message: "Image transmitted successfully",
+	})
+}
+
 // handleDecrypt handles decryption of encrypted files
 func handleDecrypt(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for browser compatibility
@@ -420,7 +771,7 @@ func handleDecrypt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse the multipart form
-	err := r.ParseMultipartForm(MaxUploadSize)
+	err := r.ParseMultipartForm(MaxUploadMemory)
 	if err != nil {
 		sendError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
@@ -434,46 +785,43 @@ func handleDecrypt(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	key := r.FormValue("key")
-	if key == "" {
-		sendError(w, "Decryption key is required", http.StatusBadRequest)
+	// Get the password or private key from the form
+	opts, err := decryptOptionsFromForm(r)
+	if err != nil {
+		sendError(w, err.Error(), requestErrorStatus(err))
 		return
 	}
+	defer wipe(opts.Password)
 
 	// Check file extension and provide a warning but continue
-	if !strings.HasSuffix(strings.ToLower(header.Filename), ".enc") {
-		log.Printf("Warning: File %s doesn't have .enc extension", header.Filename)
-	}
-
-	// Read the encrypted file
-	encryptedData, err := io.ReadAll(file)
-	if err != nil {
-		sendError(w, "Failed to read encrypted file: "+err.Error(), http.StatusInternalServerError)
-		return
+	if name := strings.TrimSuffix(strings.ToLower(header.Filename), ".asc"); !strings.HasSuffix(name, ".enc") && !strings.HasSuffix(name, ".age") {
+		log.Printf("Warning: File %s doesn't have .enc or .age extension", header.Filename)
 	}
 
-	log.Printf("Received file: %s, size: %d bytes, key length: %d, attempting to decrypt",
-		header.Filename, len(encryptedData), len(key))
+	log.Printf("Received file: %s, size: %d bytes, attempting to decrypt", header.Filename, header.Size)
 
-	// Try to decrypt the data
-	decryptedData, err := DecryptData(encryptedData, key)
+	// Decrypt the data into a temporary file
+	decryptedFile, containerHeader, err := decryptToTempFile(file, opts)
 	if err != nil {
 		log.Printf("Decryption error: %v", err)
-		sendError(w, "Failed to decrypt data: "+err.Error(), http.StatusInternalServerError)
+		sendError(w, "Failed to decrypt data: "+err.Error(), decryptErrorStatus(err))
 		return
 	}
-
-	log.Printf("Decryption successful, decrypted size: %d bytes", len(decryptedData))
+	defer removeTempFile(decryptedFile)
 
 	// Try to determine the content type
-	contentType := http.DetectContentType(decryptedData)
+	contentType, err := detectFileContentType(decryptedFile)
+	if err != nil {
+		sendError(w, "Failed to read decrypted data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	log.Printf("Detected content type: %s", contentType)
 
 	// Set the appropriate content type and write the decrypted data
+	setSignatureHeaders(w, SignatureStatus(containerHeader, opts.TrustedSigners))
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(decryptedData)))
-	w.WriteHeader(http.StatusOK)
-	w.Write(decryptedData)
+	setImageMetadataHeaders(w, containerHeader)
+	serveTempFile(w, decryptedFile)
 }
 
 // handleEncrypt handles encryption of files
@@ -490,7 +838,7 @@ func handleEncrypt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse multipart form with the defined max size
-	if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+	if err := r.ParseMultipartForm(MaxUploadMemory); err != nil {
 		http.Error(w, fmt.Sprintf("Could not parse form: %v", err), http.StatusBadRequest)
 		return
 	}
@@ -503,191 +851,1020 @@ func handleEncrypt(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Get the encryption key
-	key := r.FormValue("key")
-	if key == "" {
-		http.Error(w, "No encryption key provided", http.StatusBadRequest)
+	// Get the encryption key, the server-side key IDs or the public keys of the recipients
+	key := secretBytes(r.FormValue("key"))
+	defer wipe(key)
+	recipients, err := ParsePublicKeys(r.MultipartForm.Value["recipients"])
+	if err != nil {
+		http.Error(w, "Invalid recipients: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Read the file
-	fileData, err := io.ReadAll(file)
+	keyIDs, err := ParseKeyRefs(r.MultipartForm.Value["keyId"])
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Log the size of data being encrypted for debugging
-	log.Printf("Encrypting file: %s, size: %d bytes", handler.Filename, len(fileData))
-
-	// Encrypt the data using our secure EncryptData function
-	encryptedData, err := EncryptData(fileData, key)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Encryption failed: %v", err), http.StatusInternalServerError)
+	if len(key) == 0 && len(recipients) == 0 && len(keyIDs) == 0 {
+		http.Error(w, "No encryption key, key ID or recipients provided", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Encryption successful. Encrypted size: %d bytes", len(encryptedData))
-
-	// Set headers for file download
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.enc", handler.Filename))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(encryptedData)))
-
-	// Write encrypted data to response
-	if _, err := w.Write(encryptedData); err != nil {
-		log.Printf("Error writing response: %v", err)
+	// Get the optional cipher and key derivation settings
+	suite, err := ParseCipherSuite(r.FormValue("cipher"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-}
-
-// handleRequestImage handles requests to retrieve images from a TCP server
-func handleRequestImage(w http.ResponseWriter, r *http.Request) {
-	// Parse the JSON request
-	var req struct {
-		ServerAddr string `json:"serverAddr"`
-		ImageID    string `json:"imageID"`
+	kdfParams, err := kdfParamsFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		sendError(w, "Invalid request body", http.StatusBadRequest)
+	signingKey, err := signingKeyFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	log.Printf("Requesting image with ID '%s' from server %s", req.ImageID, req.ServerAddr)
-
-	// Request the image from the TCP server
-	encryptedData, err := RequestImageViaTCP(req.ServerAddr, req.ImageID)
+	padding, paddingBucket, err := paddingFromForm(r)
 	if err != nil {
-		log.Printf("Error requesting image from TCP server: %v", err)
-		sendError(w, "Failed to retrieve image: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	log.Printf("Successfully retrieved encrypted image data (%d bytes)", len(encryptedData))
-
-	// Convert binary data to base64 for JSON transmission
-	base64Data := base64.StdEncoding.EncodeToString(encryptedData)
-
-	// Send the encrypted data back to the client
-	response := struct {
-		Success       bool   `json:"success"`
-		Message       string `json:"message"`
-		EncryptedData string `json:"encryptedData"`
-	}{
-		Success:       true,
-		Message:       "Image retrieved successfully",
-		EncryptedData: base64Data,
+	policy, err := policyFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// handleRequestDecrypt retrieves the encrypted image via TCP, decrypts it, and returns base64 data
-func handleRequestDecrypt(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Log the size of data being encrypted for debugging
+	log.Printf("Encrypting file: %s, size: %d bytes, cipher: %s, kdf: %s, recipients: %d, key IDs: %v",
+		handler.Filename, handler.Size, suite, kdfParams.Algorithm, len(recipients), keyIDs)
+
+	opts := EncryptOptions{Cipher: suite, KDF: kdfParams, Recipients: recipients, KeyIDs: keyIDs, SigningKey: signingKey,
+		Padding: padding, PaddingBucket: paddingBucket, Policy: policy}
+	armored, _ := strconv.ParseBool(r.FormValue("armor"))
+	if opts.ImageMetadata, err = imageMetadataFromForm(r, file, handler); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var req RequestDecryptRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		sendError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+	if opts.Compression, err = compressionFromForm(r, file); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if req.ServerAddr == "" || req.ImageID == "" || req.Key == "" {
-		sendError(w, "Missing serverAddr, imageID, or key", http.StatusBadRequest)
+
+	// "format=age" writes an age v1 file instead of a SIMG container, and
+	// "format=openssl" an "openssl enc" file for legacy tools
+	var ageFormat, opensslFormat bool
+	var opensslParams OpenSSLParams
+	switch strings.ToLower(r.FormValue("format")) {
+	case "", "simg":
+	case "age":
+		// age files have no room for the metadata record, padding, compression or a policy
+		if padding != PaddingNone || opts.Compression != CompressionNone || policy != nil {
+			http.Error(w, "The age format does not support padding, compression or decrypt policies", http.StatusBadRequest)
+			return
+		}
+		ageFormat = true
+		opts.ImageMetadata = nil
+		if r.FormValue("cipher") == "" {
+			opts.Cipher = SuiteChaCha20Poly1305
+		}
+	case "openssl":
+		// Legacy export: unauthenticated, password only
+		if len(key) == 0 || len(recipients) > 0 || len(keyIDs) > 0 || signingKey != nil ||
+			padding != PaddingNone || opts.Compression != CompressionNone || policy != nil {
+			http.Error(w, "The openssl format needs a key and supports no recipients, key IDs, signatures, padding, compression or decrypt policies", http.StatusBadRequest)
+			return
+		}
+		if opensslParams, err = openSSLParamsFromForm(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opensslFormat = true
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported format %q", r.FormValue("format")), http.StatusBadRequest)
 		return
 	}
 
-	// Log complete request for debugging
-	log.Printf("Decrypt request: serverAddr=%s, imageID=%s, key length=%d",
-		req.ServerAddr, req.ImageID, len(req.Key))
-
-	// Retrieve encrypted bytes from TCP server
-	encryptedData, err := RequestImageViaTCP(req.ServerAddr, req.ImageID)
+	// Set headers for file download; armored output is text for email or chat
+	extension := ".enc"
+	switch {
+	case ageFormat:
+		extension = ".age"
+	case opensslFormat:
+		extension = ".legacy.enc"
+		w.Header().Set("Access-Control-Expose-Headers", "X-Encryption-Warning")
+		w.Header().Set("X-Encryption-Warning", "legacy OpenSSL enc format ("+opensslParams.Cipher+", "+opensslParams.KDF+"), not authenticated")
+		log.Printf("Warning: writing %s in the legacy, unauthenticated OpenSSL format", handler.Filename)
+	}
+	if armored {
+		w.Header().Set("Content-Disposition", attachmentDisposition(handler.Filename+extension+".asc"))
+		w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+	} else {
+		w.Header().Set("Content-Disposition", attachmentDisposition(handler.Filename+extension))
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	// Encrypt the upload straight into the response, one segment at a time
+	out := &countingWriter{w: w}
+	var dst io.WriteCloser = nopWriteCloser{out}
+	switch {
+	case armored && ageFormat:
+		dst = NewAgeArmorWriter(out)
+	case armored && opensslFormat:
+		dst = NewBase64LineWriter(out)
+	case armored:
+		dst = NewArmorWriter(out, armorHeaders(opts, handler.Filename))
+	}
+	switch {
+	case ageFormat:
+		err = EncryptAgeStream(dst, file, key, opts)
+	case opensslFormat:
+		err = EncryptOpenSSLStream(dst, file, key, opensslParams)
+	default:
+		err = EncryptStream(dst, file, key, opts)
+	}
+	if err == nil {
+		err = dst.Close()
+	}
 	if err != nil {
-		log.Printf("Error retrieving image: %v", err)
-		sendError(w, "Failed to retrieve image: "+err.Error(), http.StatusInternalServerError)
+		if out.n == 0 {
+			http.Error(w, fmt.Sprintf("Encryption failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Error writing response: %v", err)
 		return
 	}
-	log.Printf("Retrieved encrypted data: %d bytes, first 16 bytes: %x", len(encryptedData), encryptedData[:min(16, len(encryptedData))])
 
-	// Prepare various keys to try - the exact same key, padded key, and hashed key
-	var keys []struct {
-		name string
-		key  string
-	} = []struct {
-		name string
-		key  string
-	}{
-		{"original", req.Key},
-		{"padded", string(padKey(req.Key))},
-		{"hashed", fmt.Sprintf("%x", sha256.Sum256([]byte(req.Key)))},
-	}
-
-	var successfulDecryption bool
-	var decryptedData []byte
-	var decryptErr error
-
-	// Try each key with original data and potentially base64-decoded data
-	for _, k := range keys {
-		// Try the key on original data
-		decryptedData, decryptErr = DecryptData(encryptedData, k.key)
-		if decryptErr == nil {
-			log.Printf("Successfully decrypted with %s key", k.name)
-			successfulDecryption = true
-			break
-		}
+	log.Printf("Encryption successful. Encrypted size: %d bytes", out.n)
+}
 
-		log.Printf("Decryption with %s key failed: %v", k.name, decryptErr)
+// handleRewrap changes who can decrypt an encrypted file without re-encrypting
+// the image. The file is unlocked with "key", "keyId" or "identity"; "addKey",
+// "addKeyId" and "addRecipients" add a password, server-side keys or public
+// keys (using the "kdf" settings of /api/encrypt for the password), and
+// "removeKey", "removeKeyId" and "removeRecipients" remove them.
+func handleRewrap(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-		// Try base64 decoding the data first (in case it's double encoded)
-		if decodedData, err := base64.StdEncoding.DecodeString(string(encryptedData)); err == nil {
-			decryptedData, decryptErr = DecryptData(decodedData, k.key)
-			if decryptErr == nil {
-				log.Printf("Successfully decrypted base64-decoded data with %s key", k.name)
-				successfulDecryption = true
-				break
-			}
-		}
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
-	if !successfulDecryption {
-		log.Printf("All decryption attempts failed")
-		sendError(w, "Failed to decrypt data: "+decryptErr.Error(), http.StatusInternalServerError)
+	if err := r.ParseMultipartForm(MaxUploadMemory); err != nil {
+		http.Error(w, fmt.Sprintf("Could not parse form: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	// Now that we have decrypted data, see if it's an image or further encoded
-	contentType := http.DetectContentType(decryptedData)
-	log.Printf("Decrypted data content type: %s", contentType)
-
-	// If it doesn't look like an image, it might be a base64 encoded image
-	if !strings.HasPrefix(contentType, "image/") && len(decryptedData) > 0 {
-		// Try to decode as base64
-		if possibleImageData, err := base64.StdEncoding.DecodeString(string(decryptedData)); err == nil {
-			possibleContentType := http.DetectContentType(possibleImageData)
-			log.Printf("After base64 decoding: content type: %s", possibleContentType)
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving file: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
 
-			if strings.HasPrefix(possibleContentType, "image/") {
-				log.Printf("Found base64-encoded image after decryption")
-				decryptedData = possibleImageData
+	unlock, err := decryptOptionsFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+	defer wipe(unlock.Password)
+
+	opts := RewrapOptions{
+		AddPassword:    secretBytes(r.FormValue("addKey")),
+		RemovePassword: secretBytes(r.FormValue("removeKey")),
+	}
+	defer wipe(opts.AddPassword, opts.RemovePassword)
+	if opts.AddRecipients, err = ParsePublicKeys(r.MultipartForm.Value["addRecipients"]); err != nil {
+		http.Error(w, "Invalid addRecipients: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.RemoveRecipients, err = ParsePublicKeys(r.MultipartForm.Value["removeRecipients"]); err != nil {
+		http.Error(w, "Invalid removeRecipients: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.AddKeyIDs, err = ParseKeyRefs(r.MultipartForm.Value["addKeyId"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.RemoveKeyIDs, err = ParseKeyRefs(r.MultipartForm.Value["removeKeyId"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(opts.AddPassword) > 0 {
+		if opts.KDF, err = kdfParamsFromForm(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Rewrapping file: %s, adding %d recipients, removing %d recipients",
+		handler.Filename, len(opts.AddRecipients), len(opts.RemoveRecipients))
+
+	w.Header().Set("Content-Disposition", attachmentDisposition(handler.Filename))
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	// The header is only written once the data key has been unwrapped, so
+	// errors about the credentials can still be reported
+	out := &countingWriter{w: w}
+	if _, err := RewrapStream(out, file, unlock, opts); err != nil {
+		if out.n == 0 {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrNoMatchingIdentity) {
+				status = http.StatusUnauthorized
 			}
+			http.Error(w, fmt.Sprintf("Rewrap failed: %v", err), status)
+			return
 		}
+		log.Printf("Error writing response: %v", err)
+		return
 	}
 
-	// For safety, ensure we're always returning valid data even if the content type isn't what we expect
-	log.Printf("Final decrypted data size: %d bytes", len(decryptedData))
+	log.Printf("Rewrap successful. Size: %d bytes", out.n)
+}
+
+// SplitKeyResponse is returned by the key splitting endpoint. Data holds the
+// rewrapped file as base64; each share is handed to one custodian.
+type SplitKeyResponse struct {
+	Success   bool     `json:"success"`
+	Threshold int      `json:"threshold"`
+	Count     int      `json:"count"`
+	Shares    []string `json:"shares"`
+	Data      string   `json:"data"`
+}
+
+// handleSplitKey splits the data key of an encrypted file among custodians.
+// The file is unlocked like in /api/rewrap, "threshold" of "shares" key shares
+// are then needed to decrypt it. Other ways to open the file are removed
+// unless "keepExisting" is set. The shares are decrypted with the "share"
+// field of the decrypt endpoints.
+func handleSplitKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(MaxUploadMemory); err != nil {
+		sendError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		sendError(w, "No file received: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	unlock, err := decryptOptionsFromForm(r)
+	if err != nil {
+		sendError(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+	defer wipe(unlock.Password)
+
+	var opts ShareOptions
+	if opts.Threshold, err = strconv.Atoi(r.FormValue("threshold")); err != nil {
+		sendError(w, "Invalid threshold", http.StatusBadRequest)
+		return
+	}
+	if opts.Count, err = strconv.Atoi(r.FormValue("shares")); err != nil {
+		sendError(w, "Invalid shares count", http.StatusBadRequest)
+		return
+	}
+	opts.KeepExisting, _ = strconv.ParseBool(r.FormValue("keepExisting"))
+
+	log.Printf("Splitting key of file: %s into %d-of-%d shares", handler.Filename, opts.Threshold, opts.Count)
+
+	var out bytes.Buffer
+	shares, err := SplitKeyStream(&out, file, unlock, opts)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrNoMatchingIdentity) {
+			status = http.StatusUnauthorized
+		}
+		sendError(w, "Key split failed: "+err.Error(), status)
+		return
+	}
 
-	// Encode to base64 for JSON transmission to frontend
-	b64 := base64.StdEncoding.EncodeToString(decryptedData)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(RequestDecryptResponse{
-		Success: true,
-		Data:    b64,
+	json.NewEncoder(w).Encode(SplitKeyResponse{
+		Success:   true,
+		Threshold: opts.Threshold,
+		Count:     opts.Count,
+		Shares:    shares,
+		Data:      base64.StdEncoding.EncodeToString(out.Bytes()),
 	})
 }
 
+// kdfParamsFromForm reads the optional "kdf", "kdfTime", "kdfMemory" and
+// "kdfParallelism" form fields. Cost fields that are not set keep the
+// defaults of the selected algorithm.
+func kdfParamsFromForm(r *http.Request) (KDFParams, error) {
+	alg, err := ParseKDFAlgorithm(r.FormValue("kdf"))
+	if err != nil {
+		return KDFParams{}, err
+	}
+
+	params, err := DefaultKDFParams(alg)
+	if err != nil {
+		return KDFParams{}, err
+	}
+
+	if v := r.FormValue("kdfTime"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return KDFParams{}, fmt.Errorf("invalid kdfTime: %v", err)
+		}
+		params.Time = uint32(n)
+	}
+	if v := r.FormValue("kdfMemory"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return KDFParams{}, fmt.Errorf("invalid kdfMemory: %v", err)
+		}
+		params.Memory = uint32(n)
+	}
+	if v := r.FormValue("kdfParallelism"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return KDFParams{}, fmt.Errorf("invalid kdfParallelism: %v", err)
+		}
+		params.Parallelism = uint8(n)
+	}
+
+	if err := params.validate(); err != nil {
+		return KDFParams{}, err
+	}
+	return params, nil
+}
+
+// decryptOptionsFromForm reads the decryption credentials from a form: a
+// "key" password, "keyId" server-side keys with the "keyToken" that allows
+// their use, one or more "identity" X25519
+// private keys and/or a quorum of "share" key shares. The
+// signature policy is read from "trustedSigners" (Ed25519 public keys) and
+// "requireSignature". The caller wipes the returned password.
+func decryptOptionsFromForm(r *http.Request) (DecryptOptions, error) {
+	var opts DecryptOptions
+	password := r.FormValue("key")
+
+	identities := formValues(r, "identity")
+	for _, value := range identities {
+		identity, err := ParsePrivateKey(value)
+		if err != nil {
+			return DecryptOptions{}, fmt.Errorf("invalid identity: %v", err)
+		}
+		opts.Identities = append(opts.Identities, identity)
+	}
+
+	keyIDs, err := ParseKeyRefs(formValues(r, "keyId"))
+	if err != nil {
+		return DecryptOptions{}, err
+	}
+	if err := keyAccess.authorize(r.FormValue("keyToken"), keyIDs); err != nil {
+		return DecryptOptions{}, err
+	}
+	opts.KeyIDs = keyIDs
+
+	opts.Shares = formValues(r, "share")
+	if err := ValidateKeyShares(opts.Shares); err != nil {
+		return DecryptOptions{}, err
+	}
+
+	if password == "" && len(opts.Identities) == 0 && len(opts.KeyIDs) == 0 && len(opts.Shares) == 0 {
+		return DecryptOptions{}, errors.New("a decryption key, key ID, identity or key shares are required")
+	}
+
+	if opts.OpenSSL, err = openSSLParamsFromForm(r); err != nil {
+		return DecryptOptions{}, err
+	}
+
+	trustedSigners, err := ParseVerifyingKeys(formValues(r, "trustedSigners"))
+	if err != nil {
+		return DecryptOptions{}, fmt.Errorf("invalid trustedSigners: %v", err)
+	}
+	opts.TrustedSigners = trustedSigners
+	opts.RequireSignature, _ = strconv.ParseBool(r.FormValue("requireSignature"))
+	opts.CountDecrypt = true
+	opts.Password = secretBytes(password)
+	return opts, nil
+}
+
+// openSSLParamsFromForm reads the "openssl enc" settings "opensslCipher",
+// "opensslKdf" ("pbkdf2" or "evp"), "opensslDigest" and "opensslIter", which
+// default to those of "openssl enc -aes-256-cbc -pbkdf2"
+func openSSLParamsFromForm(r *http.Request) (OpenSSLParams, error) {
+	params := OpenSSLParams{
+		Cipher: r.FormValue("opensslCipher"),
+		KDF:    r.FormValue("opensslKdf"),
+		Digest: r.FormValue("opensslDigest"),
+	}
+	if v := r.FormValue("opensslIter"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return OpenSSLParams{}, fmt.Errorf("invalid opensslIter: %v", err)
+		}
+		params.Iterations = n
+	}
+	return params.resolve()
+}
+
+// paddingFromForm reads the optional "padding" policy (none, bucket, pow2 or
+// padme) and "paddingBucket" size in bytes
+func paddingFromForm(r *http.Request) (PaddingPolicy, int64, error) {
+	var bucket int64
+	if v := r.FormValue("paddingBucket"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid paddingBucket: %v", err)
+		}
+		bucket = n
+	}
+	return resolvePadding(r.FormValue("padding"), bucket)
+}
+
+// policyFromForm reads the optional decrypt policy: "notBefore" and
+// "notAfter" timestamps (RFC 3339 or milliseconds since the epoch), or
+// "expiresIn" as a duration such as "24h", and "maxDecrypts"
+func policyFromForm(r *http.Request) (*DecryptPolicy, error) {
+	var maxDecrypts uint32
+	if v := r.FormValue("maxDecrypts"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxDecrypts: %v", err)
+		}
+		maxDecrypts = uint32(n)
+	}
+	return NewDecryptPolicy(r.FormValue("notBefore"), r.FormValue("notAfter"), r.FormValue("expiresIn"), maxDecrypts)
+}
+
+// compressionFromForm negotiates the codec for an upload from the optional
+// "compression" field: flate, zstd, auto or none, or a comma-separated list
+// in order of preference. file is rewound afterwards.
+func compressionFromForm(r *http.Request, file multipart.File) (CompressionCodec, error) {
+	preferences := r.FormValue("compression")
+	if preferences == "" {
+		return CompressionNone, nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return negotiateCompression(preferences, head[:n])
+}
+
+// formValues returns every value of a form field, for multipart and
+// urlencoded forms alike
+func formValues(r *http.Request, name string) []string {
+	if r.MultipartForm != nil {
+		return r.MultipartForm.Value[name]
+	}
+	if v := r.FormValue(name); v != "" {
+		return []string{v}
+	}
+	return nil
+}
+
+// signingKeyFromForm reads the optional "signingKey" Ed25519 private key
+func signingKeyFromForm(r *http.Request) (ed25519.PrivateKey, error) {
+	value := r.FormValue("signingKey")
+	if value == "" {
+		return nil, nil
+	}
+	key, err := ParseSigningKey(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signingKey: %v", err)
+	}
+	return key, nil
+}
+
+// decryptErrorStatus maps a decryption error to an HTTP status. Images that
+// fail the signature policy are refused rather than treated as server errors.
+func decryptErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrBadSignature), errors.Is(err, ErrUnsignedImage), errors.Is(err, ErrUntrustedSigner),
+		errors.Is(err, ErrImageNotYetValid):
+		return http.StatusForbidden
+	case errors.Is(err, ErrImageExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrInvalidShare), errors.Is(err, ErrDecompressionLimit):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// requestErrorStatus maps an error reading the credentials of a request to
+// an HTTP status: a missing key access token is unauthorized, key IDs the
+// request may not use are forbidden, anything else is a bad request
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrKeyAccessTokenRequired):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrKeyAccessDenied):
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// sendEncryptError reports an error encrypting an image for transmission. Key
+// IDs that no provider knows are the caller's mistake; anything else is a
+// server error.
+func sendEncryptError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnknownKey) || errors.Is(err, ErrUnknownKeyProvider) {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Failed to encrypt data for transmission: %v", err)
+	sendError(w, "Failed to encrypt data for transmission", http.StatusInternalServerError)
+}
+
+// retrieveErrorStatus maps an error fetching an image from a TCP server to an
+// HTTP status: images the server refuses under their decrypt policy keep the
+// statuses of decryption, anything else is a server error
+func retrieveErrorStatus(err error) int {
+	if errors.Is(err, ErrImageExpired) || errors.Is(err, ErrImageNotYetValid) {
+		return decryptErrorStatus(err)
+	}
+	return http.StatusInternalServerError
+}
+
+// setSignatureHeaders reports the sender signature of a decrypted image in
+// the X-Signature-Status ("unsigned", "verified" or "trusted") and
+// X-Signature-Signer (key fingerprint) response headers
+func setSignatureHeaders(w http.ResponseWriter, info SignatureInfo) {
+	w.Header().Set("Access-Control-Expose-Headers", "X-Signature-Status, X-Signature-Signer")
+	switch {
+	case info.Trusted:
+		w.Header().Set("X-Signature-Status", "trusted")
+	case info.Verified:
+		w.Header().Set("X-Signature-Status", "verified")
+	default:
+		w.Header().Set("X-Signature-Status", "unsigned")
+	}
+	if info.Signer != "" {
+		w.Header().Set("X-Signature-Signer", info.Signer)
+	}
+}
+
+// setImageMetadataHeaders restores the original Content-Type and filename
+// from the image metadata of a decrypted container and passes the whole
+// record on in X-Image-Metadata. It reports whether there was a record.
+func setImageMetadataHeaders(w http.ResponseWriter, header *ContainerHeader) bool {
+	if header == nil || header.ImageMetadata == nil {
+		return false
+	}
+	meta := header.ImageMetadata
+	if meta.MIMEType != "" {
+		w.Header().Set("Content-Type", meta.MIMEType)
+	}
+	if disposition := meta.ContentDisposition(); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "Content-Disposition, X-Image-Metadata")
+	w.Header().Set("X-Image-Metadata", meta.HeaderValue())
+	return true
+}
+
+// imageMetadataFromForm describes an uploaded image for its container:
+// filename, type and dimensions come from the upload, "history" fields list
+// the processing applied so far and "created" is the original timestamp
+// (RFC 3339, or milliseconds since the epoch as in File.lastModified).
+// "metadata=false" leaves the record out.
+func imageMetadataFromForm(r *http.Request, file multipart.File, fh *multipart.FileHeader) (*ImageMetadata, error) {
+	if include, err := strconv.ParseBool(r.FormValue("metadata")); err == nil && !include {
+		return nil, nil
+	}
+
+	meta, err := DescribeImage(file, fh.Filename, fh.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	meta.History = formValues(r, "history")
+	meta.Encrypted = time.Now().UTC()
+
+	if v := r.FormValue("created"); v != "" {
+		if meta.Created, err = parseTimestamp(v); err != nil {
+			return nil, fmt.Errorf("invalid created timestamp %q", v)
+		}
+	}
+	return meta, nil
+}
+
+// handleGenerateKey generates a new keypair and returns both halves as PEM.
+// The "type" query parameter selects an X25519 recipient key (the default) or
+// an Ed25519 signing key. The server does not keep a copy of the private key.
+func handleGenerateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch keyType := r.URL.Query().Get("type"); keyType {
+	case "", keyTypeX25519:
+		priv, err := GenerateX25519Key()
+		if err != nil {
+			sendError(w, "Failed to generate key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendKeyResponse(w, keyTypeX25519, KeyFingerprint(priv.PublicKey()), priv.PublicKey(), priv)
+	case keyTypeEd25519:
+		priv, err := GenerateSigningKey()
+		if err != nil {
+			sendError(w, "Failed to generate key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pub := priv.Public().(ed25519.PublicKey)
+		sendKeyResponse(w, keyTypeEd25519, SignerFingerprint(pub), pub, priv)
+	default:
+		sendError(w, fmt.Sprintf("Unsupported key type %q", keyType), http.StatusBadRequest)
+	}
+}
+
+// handleImportKey validates a public or private key supplied as PEM or raw
+// base64 and returns it in canonical PEM form together with its fingerprint.
+// PEM keys are recognised by their algorithm; raw keys are taken to be X25519
+// unless "type" is "ed25519".
+func handleImportKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key  string `json:"key"`
+		Type string `json:"type,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Type != keyTypeEd25519 {
+		if priv, err := ParsePrivateKey(req.Key); err == nil {
+			sendKeyResponse(w, keyTypeX25519, KeyFingerprint(priv.PublicKey()), priv.PublicKey(), priv)
+			return
+		}
+		if pub, err := ParsePublicKey(req.Key); err == nil {
+			sendKeyResponse(w, keyTypeX25519, KeyFingerprint(pub), pub, nil)
+			return
+		}
+	}
+
+	if priv, err := ParseSigningKey(req.Key); err == nil {
+		pub := priv.Public().(ed25519.PublicKey)
+		sendKeyResponse(w, keyTypeEd25519, SignerFingerprint(pub), pub, priv)
+		return
+	}
+	pub, err := ParseVerifyingKey(req.Key)
+	if err != nil {
+		sendError(w, "Invalid key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sendKeyResponse(w, keyTypeEd25519, SignerFingerprint(pub), pub, nil)
+}
+
+// handleKeyring manages the server's local keyring. GET lists the key IDs;
+// POST with a JSON {"keyId": ...} body generates a new key under that ID.
+// Both need the key access token in the X-Key-Token header, or as "keyToken"
+// in the POST body, and only see the keys the access policy allows.
+// Key material never leaves the server, clients only get the key reference
+// to pass as "keyId" when encrypting and decrypting.
+func handleKeyring(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		KeyID    string `json:"keyId"`
+		KeyToken string `json:"keyToken"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.KeyID == "" {
+			sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	token := r.Header.Get("X-Key-Token")
+	if token == "" {
+		token = req.KeyToken
+	}
+	if err := keyAccess.authorizeToken(token); err != nil {
+		sendError(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	provider, err := lookupKeyProvider(defaultKeyProvider)
+	if err != nil {
+		sendError(w, "The keyring is not configured (set "+envKeyringPassphrase+")", http.StatusServiceUnavailable)
+		return
+	}
+	keyring, ok := provider.(*Keyring)
+	if !ok {
+		sendError(w, "The keyring provider does not support key management", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		refs := []string{}
+		for _, id := range keyring.KeyIDs() {
+			if ref := defaultKeyProvider + ":" + id; keyAccess.allows(ref) {
+				refs = append(refs, ref)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "keyIds": refs})
+	case http.MethodPost:
+		if ref := defaultKeyProvider + ":" + req.KeyID; !keyAccess.allows(ref) {
+			sendError(w, fmt.Sprintf("%v: key %s", ErrKeyAccessDenied, ref), http.StatusForbidden)
+			return
+		}
+		if err := keyring.GenerateKey(req.KeyID); err != nil {
+			sendError(w, "Failed to generate key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Generated keyring key '%s'", req.KeyID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "keyId": defaultKeyProvider + ":" + req.KeyID})
+	}
+}
+
+// Key types reported by the key endpoints
+const (
+	keyTypeX25519  = "x25519"
+	keyTypeEd25519 = "ed25519"
+)
+
+// KeyResponse is returned by the key generation and import endpoints
+type KeyResponse struct {
+	Success     bool   `json:"success"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"publicKey"`
+	PrivateKey  string `json:"privateKey,omitempty"`
+
+	// AgeRecipient and AgeIdentity are the age encodings of X25519 keys
+	AgeRecipient string `json:"ageRecipient,omitempty"`
+	AgeIdentity  string `json:"ageIdentity,omitempty"`
+}
+
+// sendKeyResponse exports a public key, and optionally its private key, as JSON
+func sendKeyResponse(w http.ResponseWriter, keyType, fingerprint string, pub, priv any) {
+	response := KeyResponse{Success: true, Type: keyType, Fingerprint: fingerprint}
+
+	var err error
+	if response.PublicKey, err = MarshalPublicKeyPEM(pub); err != nil {
+		sendError(w, "Failed to export public key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if priv != nil {
+		if response.PrivateKey, err = MarshalPrivateKeyPEM(priv); err != nil {
+			sendError(w, "Failed to export private key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if pub, ok := pub.(*ecdh.PublicKey); ok {
+		response.AgeRecipient = AgeRecipient(pub)
+	}
+	if priv, ok := priv.(*ecdh.PrivateKey); ok {
+		response.AgeIdentity = AgeIdentity(priv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleRekey rotates the keys of images stored on a TCP server. The JSON body
+// is a RekeyRequest plus "serverAddr"; leaving out "imageIDs" rekeys every
+// stored image. Progress is streamed back as one JSON object per line, ending
+// with a summary that has "finished" set.
+func handleRekey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ServerAddr string `json:"serverAddr"`
+		RekeyRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ServerAddr == "" {
+		sendError(w, "Missing serverAddr", http.StatusBadRequest)
+		return
+	}
+
+	// Check the keys here so that mistakes are reported as a normal error
+	unlock, opts, err := req.RekeyRequest.options()
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wipe(unlock.Password, opts.Password)
+
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	started := false
+
+	final, err := RekeyViaTCP(req.ServerAddr, req.RekeyRequest, func(progress RekeyProgress) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+		encoder.Encode(progress)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		log.Printf("Rekey via %s failed: %v", req.ServerAddr, err)
+		if !started {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrRekeyNotAllowed) {
+				status = http.StatusForbidden
+			}
+			sendError(w, "Rekey failed: "+err.Error(), status)
+			return
+		}
+		final.Error = err.Error()
+		final.Finished = true
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder.Encode(final)
+}
+
+// handleRequestImage handles requests to retrieve images from a TCP server
+func handleRequestImage(w http.ResponseWriter, r *http.Request) {
+	// Parse the JSON request
+	var req struct {
+		ServerAddr string `json:"serverAddr"`
+		ImageID    string `json:"imageID"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Requesting image with ID '%s' from server %s", req.ImageID, req.ServerAddr)
+
+	// Request the image from the TCP server into a temporary file
+	encryptedFile, size, err := requestImageToTempFile(req.ServerAddr, req.ImageID)
+	if err != nil {
+		log.Printf("Error requesting image from TCP server: %v", err)
+		sendError(w, "Failed to retrieve image: "+err.Error(), retrieveErrorStatus(err))
+		return
+	}
+	defer removeTempFile(encryptedFile)
+
+	log.Printf("Successfully retrieved encrypted image data (%d bytes)", size)
+
+	// Send the encrypted data back to the client, base64 encoded as it is read
+	response := struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}{
+		Success: true,
+		Message: "Image retrieved successfully",
+	}
+	if err := writeJSONWithBase64(w, response, "encryptedData", encryptedFile); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// handleRequestDecrypt retrieves the encrypted image via TCP, decrypts it, and returns base64 data
+func handleRequestDecrypt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RequestDecryptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ServerAddr == "" || req.ImageID == "" || (req.Key == "" && req.Identity == "" && len(req.KeyIDs) == 0 && len(req.Shares) == 0) {
+		sendError(w, "Missing serverAddr, imageID, or key", http.StatusBadRequest)
+		return
+	}
+	if err := ValidateKeyShares(req.Shares); err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := DecryptOptions{Password: secretBytes(req.Key), Shares: req.Shares}
+	defer wipe(opts.Password)
+	keyIDs, err := ParseKeyRefs(req.KeyIDs)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := keyAccess.authorize(req.KeyToken, keyIDs); err != nil {
+		sendError(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+	opts.KeyIDs = keyIDs
+	if req.Identity != "" {
+		identity, err := ParsePrivateKey(req.Identity)
+		if err != nil {
+			sendError(w, "Invalid identity: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Identities = append(opts.Identities, identity)
+	}
+	trustedSigners, err := ParseVerifyingKeys(req.TrustedSigners)
+	if err != nil {
+		sendError(w, "Invalid trustedSigners: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.TrustedSigners = trustedSigners
+	opts.RequireSignature = req.RequireSignature
+	opts.CountDecrypt = true
+
+	log.Printf("Decrypt request: serverAddr=%s, imageID=%s", req.ServerAddr, req.ImageID)
+
+	// Retrieve the encrypted image from the TCP server into a temporary file
+	encryptedFile, size, err := requestImageToTempFile(req.ServerAddr, req.ImageID)
+	if err != nil {
+		log.Printf("Error retrieving image: %v", err)
+		sendError(w, "Failed to retrieve image: "+err.Error(), retrieveErrorStatus(err))
+		return
+	}
+	defer removeTempFile(encryptedFile)
+	log.Printf("Retrieved encrypted data: %d bytes", size)
+
+	// The container header tells us exactly how the data was encrypted, and
+	// armored or base64 data is recognised by the decrypter
+	decryptedFile, containerHeader, err := decryptToTempFile(encryptedFile, opts)
+	if err != nil {
+		log.Printf("Decryption failed: %v", err)
+		sendError(w, "Failed to decrypt data: "+err.Error(), decryptErrorStatus(err))
+		return
+	}
+	defer removeTempFile(decryptedFile)
+	signature := SignatureStatus(containerHeader, opts.TrustedSigners)
+
+	// Now that we have decrypted data, see if it's an image or further encoded
+	contentType, err := detectFileContentType(decryptedFile)
+	if err != nil {
+		sendError(w, "Failed to read decrypted data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Decrypted data content type: %s", contentType)
+
+	response := RequestDecryptResponse{Success: true, Signature: &signature}
+	if containerHeader != nil {
+		response.Metadata = containerHeader.ImageMetadata
+	}
+
+	// If it doesn't look like an image, it might be a base64 encoded image.
+	// Only data small enough for the legacy format is checked.
+	if !strings.HasPrefix(contentType, "image/") {
+		if decryptedData, err := readAllLimited(decryptedFile, maxLegacySize); err == nil {
+			if possibleImageData, err := base64.StdEncoding.DecodeString(string(decryptedData)); err == nil {
+				possibleContentType := http.DetectContentType(possibleImageData)
+				log.Printf("After base64 decoding: content type: %s", possibleContentType)
+
+				if strings.HasPrefix(possibleContentType, "image/") {
+					log.Printf("Found base64-encoded image after decryption")
+					if err := writeJSONWithBase64(w, response, "data", bytes.NewReader(possibleImageData)); err != nil {
+						log.Printf("Error writing response: %v", err)
+					}
+					return
+				}
+			}
+		}
+		if _, err := decryptedFile.Seek(0, io.SeekStart); err != nil {
+			sendError(w, "Failed to read decrypted data: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Encode to base64 for JSON transmission to frontend
+	if err := writeJSONWithBase64(w, response, "data", decryptedFile); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
 // handleGetDecryptedImage handles requests for properly formatted decrypted images
 func handleGetDecryptedImage(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for browser compatibility
@@ -701,7 +1878,7 @@ func handleGetDecryptedImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse the multipart form
-	err := r.ParseMultipartForm(MaxUploadSize)
+	err := r.ParseMultipartForm(MaxUploadMemory)
 	if err != nil {
 		sendError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
@@ -715,55 +1892,63 @@ func handleGetDecryptedImage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	key := r.FormValue("key")
-	if key == "" {
-		sendError(w, "Decryption key is required", http.StatusBadRequest)
-		return
-	}
-
-	// Read the encrypted file
-	encryptedData, err := io.ReadAll(file)
+	// Get the password or private key from the form
+	opts, err := decryptOptionsFromForm(r)
 	if err != nil {
-		sendError(w, "Failed to read encrypted file: "+err.Error(), http.StatusInternalServerError)
+		sendError(w, err.Error(), requestErrorStatus(err))
 		return
 	}
+	defer wipe(opts.Password)
 
-	log.Printf("GetDecryptedImage: Received file: %s, size: %d bytes, key length: %d, attempting to decrypt",
-		header.Filename, len(encryptedData), len(key))
+	log.Printf("GetDecryptedImage: Received file: %s, size: %d bytes, attempting to decrypt",
+		header.Filename, header.Size)
 
-	// Try to decrypt the data
-	decryptedData, err := DecryptData(encryptedData, key)
+	// Decrypt the data into a temporary file
+	decryptedFile, containerHeader, err := decryptToTempFile(file, opts)
 	if err != nil {
 		log.Printf("Decryption error: %v", err)
-		sendError(w, "Failed to decrypt data: "+err.Error(), http.StatusInternalServerError)
+		sendError(w, "Failed to decrypt data: "+err.Error(), decryptErrorStatus(err))
 		return
 	}
-
-	log.Printf("Decryption successful, decrypted size: %d bytes", len(decryptedData))
+	defer removeTempFile(decryptedFile)
 
 	// Try to determine the content type
-	contentType := http.DetectContentType(decryptedData)
+	contentType, err := detectFileContentType(decryptedFile)
+	if err != nil {
+		sendError(w, "Failed to read decrypted data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	log.Printf("Detected content type: %s", contentType)
 
+	// Restore the original type and filename from the image metadata; older
+	// images without it are served as decrypted_image.png
+	setSignatureHeaders(w, SignatureStatus(containerHeader, opts.TrustedSigners))
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", attachmentDisposition("decrypted_image.png"))
+	hasMetadata := setImageMetadataHeaders(w, containerHeader)
+
 	// Ensure we're dealing with an image - if not, try to decode base64
-	if !strings.HasPrefix(contentType, "image/") {
-		// Try to decode as base64 in case it's a base64-encoded image
-		if possibleImageData, err := base64.StdEncoding.DecodeString(string(decryptedData)); err == nil {
-			possibleContentType := http.DetectContentType(possibleImageData)
-			if strings.HasPrefix(possibleContentType, "image/") {
-				log.Printf("Found base64-encoded image after decryption, content type: %s", possibleContentType)
-				decryptedData = possibleImageData
-				contentType = possibleContentType
+	if !hasMetadata && !strings.HasPrefix(contentType, "image/") {
+		if decryptedData, err := readAllLimited(decryptedFile, maxLegacySize); err == nil {
+			// Try to decode as base64 in case it's a base64-encoded image
+			if possibleImageData, err := base64.StdEncoding.DecodeString(string(decryptedData)); err == nil {
+				possibleContentType := http.DetectContentType(possibleImageData)
+				if strings.HasPrefix(possibleContentType, "image/") {
+					log.Printf("Found base64-encoded image after decryption, content type: %s", possibleContentType)
+					w.Header().Set("Content-Length", fmt.Sprintf("%d", len(possibleImageData)))
+					w.WriteHeader(http.StatusOK)
+					w.Write(possibleImageData)
+					return
+				}
 			}
 		}
+		if _, err := decryptedFile.Seek(0, io.SeekStart); err != nil {
+			sendError(w, "Failed to read decrypted data: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	// Force image/png content type and proper filename with .png extension
-	w.Header().Set("Content-Type", "image/png")
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="decrypted_image.png"`))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(decryptedData)))
-	w.WriteHeader(http.StatusOK)
-	w.Write(decryptedData)
+	serveTempFile(w, decryptedFile)
 }
 
 // handleServerDecrypt is a specialized function to handle decryption of images retrieved from TCP servers
@@ -779,7 +1964,7 @@ func handleServerDecrypt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse the multipart form
-	err := r.ParseMultipartForm(MaxUploadSize)
+	err := r.ParseMultipartForm(MaxUploadMemory)
 	if err != nil {
 		sendError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
@@ -793,70 +1978,174 @@ func handleServerDecrypt(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	key := r.FormValue("key")
-	if key == "" {
-		sendError(w, "Decryption key is required", http.StatusBadRequest)
+	// Get the password or private key from the form
+	opts, err := decryptOptionsFromForm(r)
+	if err != nil {
+		sendError(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+	defer wipe(opts.Password)
+
+	log.Printf("Server decrypt: Received file: %s, size: %d bytes", header.Filename, header.Size)
+
+	// First try direct decryption
+	log.Printf("handleServerDecrypt: attempting decryption, data size: %d bytes", header.Size)
+	// Binary, armored and base64 input are told apart by their first bytes
+	decryptedFile, containerHeader, err := decryptToTempFile(file, opts)
+	if err != nil {
+		log.Printf("handleServerDecrypt: decryption error: %v", err)
+		sendError(w, "Failed to decrypt data: "+err.Error(), decryptErrorStatus(err))
 		return
 	}
+	defer removeTempFile(decryptedFile)
 
-	// Read the encrypted file
-	encryptedData, err := io.ReadAll(file)
+	// Try to determine the content type
+	contentType, err := detectFileContentType(decryptedFile)
 	if err != nil {
-		sendError(w, "Failed to read encrypted file: "+err.Error(), http.StatusInternalServerError)
+		sendError(w, "Failed to read decrypted data: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Detected content type: %s", contentType)
+
+	// Set the appropriate content type and write the decrypted data
+	setSignatureHeaders(w, SignatureStatus(containerHeader, opts.TrustedSigners))
+	w.Header().Set("Content-Type", contentType)
+	setImageMetadataHeaders(w, containerHeader)
+	serveTempFile(w, decryptedFile)
+}
+
+// decryptToTempFile decrypts src into a temporary file so that large images
+// never have to be held in memory. On success the file is rewound to the start
+// and must be released with removeTempFile. On failure the file is removed
+// before anything is served from it, since it may hold unverified plaintext.
+func decryptToTempFile(src io.Reader, opts DecryptOptions) (*os.File, *ContainerHeader, error) {
+	tmp, err := os.CreateTemp("", "decrypted-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
 
-	log.Printf("Server decrypt: Received file: %s, size: %d bytes", header.Filename, len(encryptedData))
+	header, err := DecryptStreamWithOptions(tmp, src, opts)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, nil, err
+	}
 
-	// Generate a consistent key hash for debugging
-	hasher := sha256.New()
-	hasher.Write([]byte(key))
-	keyHash := fmt.Sprintf("%x", hasher.Sum(nil)[:8])
-	log.Printf("Using key with hash prefix: %s", keyHash)
+	return tmp, header, nil
+}
 
-	// First try direct decryption using DecryptData
-	log.Printf("handleServerDecrypt: attempting direct decryption, data size: %d bytes", len(encryptedData))
-	decryptedData, err := DecryptData(encryptedData, key)
+// requestImageToTempFile retrieves an encrypted image from a TCP server into
+// a temporary file, so that images of any size are received in constant
+// memory. On success the file is rewound to the start and must be released
+// with removeTempFile.
+func requestImageToTempFile(serverAddr, imageID string) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "retrieved-*")
 	if err != nil {
-		log.Printf("handleServerDecrypt: direct decryption failed: %v", err)
-		// Try base64 decoding first in case it's double-encoded
-		decodedData, decodeErr := base64.StdEncoding.DecodeString(string(encryptedData))
-		if decodeErr == nil {
-			log.Printf("handleServerDecrypt: base64 decode succeeded, new size: %d bytes", len(decodedData))
-			decryptedData, err = DecryptData(decodedData, key)
-			if err != nil {
-				log.Printf("handleServerDecrypt: secondary decryption attempt failed: %v", err)
-			}
-		} else {
-			log.Printf("handleServerDecrypt: base64 decode error: %v", decodeErr)
-		}
-		// If all attempts fail, return error
-		if err != nil {
-			log.Printf("handleServerDecrypt: final decryption error: %v", err)
-			sendError(w, "Failed to decrypt data: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+		return nil, 0, fmt.Errorf("failed to create temporary file: %w", err)
 	}
 
-	log.Printf("Decryption successful, decrypted size: %d bytes", len(decryptedData))
+	size, err := RequestImageStreamViaTCP(serverAddr, imageID, tmp)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, 0, err
+	}
 
-	// Try to determine the content type
-	contentType := http.DetectContentType(decryptedData)
-	log.Printf("Detected content type: %s", contentType)
+	return tmp, size, nil
+}
 
-	// Set the appropriate content type and write the decrypted data
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(decryptedData)))
+// writeJSONWithBase64 writes the JSON object v with one more string field,
+// name, holding data base64 encoded. The data is encoded as it is read, so
+// large images are never held in memory.
+func writeJSONWithBase64(w http.ResponseWriter, v any, name string, data io.Reader) error {
+	fields, err := json.Marshal(v)
+	if err != nil || len(fields) < 2 || fields[len(fields)-1] != '}' {
+		sendError(w, "Failed to encode response", http.StatusInternalServerError)
+		return fmt.Errorf("failed to encode response: %v", err)
+	}
+	key, err := json.Marshal(name)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	bw := bufio.NewWriter(w)
+	bw.Write(fields[:len(fields)-1])
+	if len(fields) > 2 {
+		bw.WriteByte(',')
+	}
+	bw.Write(key)
+	bw.WriteString(`:"`)
+	encoder := base64.NewEncoder(base64.StdEncoding, bw)
+	if _, err := io.Copy(encoder, data); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	bw.WriteString("\"}\n")
+	return bw.Flush()
+}
+
+// removeTempFile closes and deletes a temporary file
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// detectFileContentType sniffs the content type from the start of f and rewinds it
+func detectFileContentType(f *os.File) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// serveTempFile writes the contents of f with a Content-Length header
+func serveTempFile(w http.ResponseWriter, f *os.File) {
+	info, err := f.Stat()
+	if err != nil {
+		sendError(w, "Failed to read decrypted data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Decryption successful, decrypted size: %d bytes", info.Size())
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
 	w.WriteHeader(http.StatusOK)
-	w.Write(decryptedData)
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
 }
 
-// Helper function to check if a string is base64 encoded
-func isBase64(s string) bool {
-	_, err := base64.StdEncoding.DecodeString(s)
-	return err == nil
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
+// nopWriteCloser adds a no-op Close to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 // sendError sends an error response
 func sendError(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
@@ -874,17 +2163,19 @@ func sendJSON(w http.ResponseWriter, response ImageResponse) {
 }
 
 func main() {
+	// Keep secrets out of the logs (see secret.go)
+	InstallRedactingLogger()
+
+	// Register the key providers configured in the environment
+	ConfigureKeyProviders()
+
 	// Start the TCP server in a goroutine so it runs in the background
-	go StartTCPServer()
+	tcpConfig, err := TCPServerConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid TCP server configuration: ", err)
+	}
+	go StartTCPServer(tcpConfig)
 
 	// Start the HTTP server
 	StartServer(HTTPPort)
 }
-
-// Helper function for min of integers
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
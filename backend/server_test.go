@@ -0,0 +1,91 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hostileFilename tries to add a parameter to an unquoted Content-Disposition
+const hostileFilename = `photo"; filename*=UTF-8''evil.exe; x=".png`
+
+// attachmentFilename parses a Content-Disposition header and returns its filename
+func attachmentFilename(t *testing.T, header string) string {
+	t.Helper()
+	disposition, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		t.Fatalf("invalid Content-Disposition %q: %v", header, err)
+	}
+	if disposition != "attachment" || len(params) != 1 {
+		t.Fatalf("Content-Disposition %q is not an attachment with only a filename", header)
+	}
+	return params["filename"]
+}
+
+func TestAttachmentDisposition(t *testing.T) {
+	for _, name := range []string{"image.png", "two words.png", hostileFilename, "line\r\nbreak.png", "Ürlaub 写真.png"} {
+		header := attachmentDisposition(name)
+		if got := attachmentFilename(t, header); got != name {
+			t.Errorf("%q: Content-Disposition %q has filename %q", name, header, got)
+		}
+	}
+}
+
+func TestHandlersQuoteDownloadFilenames(t *testing.T) {
+	password := "filename password"
+	kdf := map[string]string{"kdf": "scrypt", "kdfTime": "10", "kdfMemory": "8", "kdfParallelism": "1"}
+	fields := func(extra map[string]string) map[string]string {
+		merged := map[string]string{}
+		for k, v := range kdf {
+			merged[k] = v
+		}
+		for k, v := range extra {
+			merged[k] = v
+		}
+		return merged
+	}
+
+	rec := postForm(t, handleEncrypt, hostileFilename, testPNG(t), fields(map[string]string{"key": password}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("encrypt: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := attachmentFilename(t, rec.Header().Get("Content-Disposition")); got != hostileFilename+".enc" {
+		t.Errorf("encrypt: filename %q", got)
+	}
+	encrypted := rec.Body.Bytes()
+
+	rec = postForm(t, handleEncrypt, hostileFilename, testPNG(t), fields(map[string]string{"key": password, "armor": "true"}))
+	if got := attachmentFilename(t, rec.Header().Get("Content-Disposition")); got != hostileFilename+".enc.asc" {
+		t.Errorf("armored encrypt: filename %q", got)
+	}
+
+	rec = postForm(t, handleRewrap, hostileFilename, encrypted, fields(map[string]string{"key": password, "addKey": "second password"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rewrap: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := attachmentFilename(t, rec.Header().Get("Content-Disposition")); got != hostileFilename {
+		t.Errorf("rewrap: filename %q", got)
+	}
+
+	// handleDownload serves files from the processed directory
+	t.Chdir(t.TempDir())
+	name := `shot"; x=".jpg`
+	if err := os.Mkdir("processed", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("processed", name), []byte("image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handleDownload(rec, httptest.NewRequest(http.MethodGet, "/download?data="+url.QueryEscape(name), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("download: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := attachmentFilename(t, rec.Header().Get("Content-Disposition")); got != name {
+		t.Errorf("download: filename %q", got)
+	}
+}
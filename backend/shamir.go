@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Key splitting
+//
+// The data key of a version 3 container can be split with Shamir's secret
+// sharing so that any threshold of count custodians must combine their shares
+// to decrypt the image. Each byte of the key is the constant term of a random
+// polynomial of degree threshold-1 over GF(2^8); share i holds the values of
+// all polynomials at x = i.
+//
+// The split is recorded in a stanza of type 0x05:
+//
+//	threshold(1) | count(1) | set ID(8) | count share commitments(16 each)
+//
+// A commitment is a truncated SHA-256 of the set ID, share index and share
+// value. It lets a reader tell exactly which share is wrong instead of
+// reconstructing a wrong key, without revealing anything about the shares.
+//
+// Shares are printed as "SIMG-SHARE-" followed by the base32 encoding of
+//
+//	version(1) | threshold(1) | index(1) | set ID(8) | value(32) | checksum(4)
+//
+// in dash separated groups. Uppercase base32 and dashes fit the QR code
+// alphanumeric mode; the checksum catches typing errors before decryption.
+
+const (
+	// shareVersion is the version of the printed share format
+	shareVersion = byte(1)
+
+	// sharePrefix starts every printed share
+	sharePrefix = "SIMG-SHARE-"
+
+	// shareSetIDSize is the size of the random ID tying shares to their split
+	shareSetIDSize = 8
+
+	// shareCommitmentSize is the size of a share commitment in the stanza
+	shareCommitmentSize = 16
+
+	// shareChecksumSize is the size of the checksum of a printed share
+	shareChecksumSize = 4
+
+	// shareGroupSize is the number of characters between dashes in a printed share
+	shareGroupSize = 8
+
+	shareChecksumInfo   = "simg/share/v1"
+	shareCommitmentInfo = "simg/share-commitment/v1"
+)
+
+// ErrInvalidShare is returned for key shares that are mistyped, belong to
+// another image or do not match the commitments of this image
+var ErrInvalidShare = errors.New("invalid key share")
+
+// shareEncoding is unpadded uppercase base32
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ShareOptions configures how a data key is split
+type ShareOptions struct {
+	// Threshold is the number of shares needed to recover the key
+	Threshold int
+
+	// Count is the number of shares handed out
+	Count int
+
+	// KeepExisting keeps the existing passwords, recipients and key IDs.
+	// By default they are removed so that only a quorum of shares can
+	// decrypt the image.
+	KeepExisting bool
+}
+
+// validate checks the threshold and count
+func (o ShareOptions) validate() error {
+	if o.Threshold < 2 {
+		return errors.New("the share threshold must be at least 2")
+	}
+	if o.Count < o.Threshold {
+		return errors.New("the share count must be at least the threshold")
+	}
+	if o.Count > 255 {
+		return errors.New("at most 255 shares are supported")
+	}
+	return nil
+}
+
+// keyShare is one decoded share
+type keyShare struct {
+	threshold byte
+	index     byte
+	setID     []byte
+	value     []byte
+}
+
+// String prints the share in its text form
+func (s keyShare) String() string {
+	raw := make([]byte, 0, 3+len(s.setID)+len(s.value)+shareChecksumSize)
+	raw = append(raw, shareVersion, s.threshold, s.index)
+	raw = append(raw, s.setID...)
+	raw = append(raw, s.value...)
+	raw = append(raw, shareChecksum(raw)...)
+
+	encoded := shareEncoding.EncodeToString(raw)
+	var groups []string
+	for len(encoded) > shareGroupSize {
+		groups = append(groups, encoded[:shareGroupSize])
+		encoded = encoded[shareGroupSize:]
+	}
+	groups = append(groups, encoded)
+	return sharePrefix + strings.Join(groups, "-")
+}
+
+// shareChecksum returns the checksum of an encoded share
+func shareChecksum(raw []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(shareChecksumInfo))
+	h.Write(raw)
+	return h.Sum(nil)[:shareChecksumSize]
+}
+
+// parseKeyShare decodes a printed share. Case, whitespace and dashes are
+// ignored so that shares can be typed back in from paper.
+func parseKeyShare(s string) (keyShare, error) {
+	s = strings.ToUpper(strings.ReplaceAll(strings.Join(strings.Fields(s), ""), "-", ""))
+	prefix := strings.ReplaceAll(sharePrefix, "-", "")
+	if !strings.HasPrefix(s, prefix) {
+		return keyShare{}, fmt.Errorf("%w: missing %s prefix", ErrInvalidShare, sharePrefix)
+	}
+	raw, err := shareEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return keyShare{}, fmt.Errorf("%w: not base32", ErrInvalidShare)
+	}
+	if len(raw) < 3+shareSetIDSize+1+shareChecksumSize {
+		return keyShare{}, fmt.Errorf("%w: too short", ErrInvalidShare)
+	}
+
+	body, checksum := raw[:len(raw)-shareChecksumSize], raw[len(raw)-shareChecksumSize:]
+	if subtle.ConstantTimeCompare(checksum, shareChecksum(body)) != 1 {
+		return keyShare{}, fmt.Errorf("%w: checksum mismatch, the share was probably mistyped", ErrInvalidShare)
+	}
+	if body[0] != shareVersion {
+		return keyShare{}, fmt.Errorf("%w: unsupported share version %d", ErrInvalidShare, body[0])
+	}
+	if body[1] < 2 || body[2] == 0 {
+		return keyShare{}, fmt.Errorf("%w: bad threshold or index", ErrInvalidShare)
+	}
+
+	return keyShare{
+		threshold: body[1],
+		index:     body[2],
+		setID:     body[3 : 3+shareSetIDSize],
+		value:     body[3+shareSetIDSize:],
+	}, nil
+}
+
+// ValidateKeyShares checks the checksums of printed shares, so that typing
+// errors are reported before any decryption is attempted
+func ValidateKeyShares(shares []string) error {
+	for i, s := range shares {
+		if _, err := parseKeyShare(s); err != nil {
+			return fmt.Errorf("share %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// shareCommitment commits to one share of a split
+func shareCommitment(setID []byte, index byte, value []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(shareCommitmentInfo))
+	h.Write(setID)
+	h.Write([]byte{index})
+	h.Write(value)
+	return h.Sum(nil)[:shareCommitmentSize]
+}
+
+// splitDataKey splits the DEK into printed shares and returns them together
+// with the stanza recording the split
+func splitDataKey(dek []byte, opts ShareOptions) (RecipientStanza, []string, error) {
+	if err := opts.validate(); err != nil {
+		return RecipientStanza{}, nil, err
+	}
+
+	setID := make([]byte, shareSetIDSize)
+	if _, err := io.ReadFull(rand.Reader, setID); err != nil {
+		return RecipientStanza{}, nil, err
+	}
+
+	// One random polynomial per key byte, with the key byte as constant term
+	coefficients := make([]byte, opts.Threshold-1)
+	values := make([][]byte, opts.Count)
+	for i := range values {
+		values[i] = make([]byte, len(dek))
+	}
+	for b, secret := range dek {
+		if _, err := io.ReadFull(rand.Reader, coefficients); err != nil {
+			return RecipientStanza{}, nil, err
+		}
+		for i := range values {
+			values[i][b] = evalPolynomial(secret, coefficients, byte(i+1))
+		}
+	}
+	clear(coefficients)
+
+	body := []byte{byte(opts.Threshold), byte(opts.Count)}
+	body = append(body, setID...)
+	shares := make([]string, opts.Count)
+	for i, value := range values {
+		share := keyShare{threshold: byte(opts.Threshold), index: byte(i + 1), setID: setID, value: value}
+		body = append(body, shareCommitment(setID, share.index, value)...)
+		shares[i] = share.String()
+		wipe(value)
+	}
+	return RecipientStanza{Type: stanzaKeyShares, Body: body}, shares, nil
+}
+
+// unwrapDataKeyShares recovers the DEK from printed shares, checking each of
+// them against the commitments in the stanza
+func unwrapDataKeyShares(body []byte, printed []string) ([]byte, error) {
+	if len(body) < 2+shareSetIDSize || len(body) != 2+shareSetIDSize+int(body[1])*shareCommitmentSize {
+		return nil, fmt.Errorf("%w: bad key share stanza length", ErrMalformedHeader)
+	}
+	threshold, count := int(body[0]), int(body[1])
+	setID := body[2 : 2+shareSetIDSize]
+	commitments := body[2+shareSetIDSize:]
+
+	var shares []keyShare
+	defer func() {
+		for _, share := range shares {
+			wipe(share.value)
+		}
+	}()
+	seen := make(map[byte]bool)
+	for i, s := range printed {
+		share, err := parseKeyShare(s)
+		if err != nil {
+			return nil, fmt.Errorf("share %d: %w", i+1, err)
+		}
+		if !bytes.Equal(share.setID, setID) {
+			return nil, fmt.Errorf("share %d: %w: it belongs to another image or split", i+1, ErrInvalidShare)
+		}
+		if int(share.index) > count || int(share.threshold) != threshold {
+			return nil, fmt.Errorf("share %d: %w: it does not fit this split", i+1, ErrInvalidShare)
+		}
+		commitment := commitments[(int(share.index)-1)*shareCommitmentSize : int(share.index)*shareCommitmentSize]
+		if subtle.ConstantTimeCompare(commitment, shareCommitment(setID, share.index, share.value)) != 1 {
+			return nil, fmt.Errorf("share %d: %w: it has been altered", i+1, ErrInvalidShare)
+		}
+		if seen[share.index] {
+			wipe(share.value)
+			continue
+		}
+		seen[share.index] = true
+		shares = append(shares, share)
+	}
+
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%w: %d of %d shares are needed, got %d", ErrInvalidShare, threshold, count, len(shares))
+	}
+	return combineShares(shares[:threshold])
+}
+
+// combineShares interpolates the polynomials of the shares at x = 0
+func combineShares(shares []keyShare) ([]byte, error) {
+	size := len(shares[0].value)
+	for _, share := range shares {
+		if len(share.value) != size {
+			return nil, fmt.Errorf("%w: shares have different lengths", ErrInvalidShare)
+		}
+	}
+
+	secret := make([]byte, size)
+	for i, share := range shares {
+		// Lagrange basis polynomial of share i at 0; subtraction is XOR in GF(2^8)
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(other.index, gfInverse(share.index^other.index)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share.value[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// evalPolynomial evaluates secret + c[0]*x + c[1]*x^2 + ... with Horner's rule
+func evalPolynomial(secret byte, coefficients []byte, x byte) byte {
+	y := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coefficients[i]
+	}
+	return gfMul(y, x) ^ secret
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without table lookups
+// or branches on the operands
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+		b >>= 1
+	}
+	return product
+}
+
+// gfInverse returns the multiplicative inverse of a non-zero element as a^254
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// SplitKeyStream copies the container in src to dst with its data key split
+// into shares, and returns the printed shares. The payload is not re-encrypted.
+func SplitKeyStream(dst io.Writer, src io.Reader, unlock DecryptOptions, opts ShareOptions) ([]string, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	var shares []string
+	_, err := rewrapStream(dst, bufio.NewReader(src), unlock, func(dek []byte, stanzas []RecipientStanza) ([]RecipientStanza, error) {
+		stanza, printed, err := splitDataKey(dek, opts)
+		if err != nil {
+			return nil, err
+		}
+		shares = printed
+
+		// An earlier split is dropped in any case, its shares would otherwise
+		// still open the image
+		var kept []RecipientStanza
+		if opts.KeepExisting {
+			for _, existing := range stanzas {
+				if existing.Type != stanzaKeyShares {
+					kept = append(kept, existing)
+				}
+			}
+		}
+		return append(kept, stanza), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
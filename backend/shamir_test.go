@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// alterShare returns the printed share with its value changed but a valid
+// checksum, as a dishonest custodian would hand it in
+func alterShare(t *testing.T, printed string) string {
+	t.Helper()
+	share, err := parseKeyShare(printed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share.value = bytes.Clone(share.value)
+	share.value[0] ^= 1
+	return share.String()
+}
+
+// mistypeShare changes one character of the printed share
+func mistypeShare(printed string) string {
+	i := len(sharePrefix) + 3
+	c := byte('A')
+	if printed[i] == 'A' {
+		c = 'B'
+	}
+	return printed[:i] + string(c) + printed[i+1:]
+}
+
+func TestKeyShares(t *testing.T) {
+	dek, err := newFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanza, shares, err := splitDataKey(dek, ShareOptions{Threshold: 3, Count: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherShares, err := splitDataKey(dek, ShareOptions{Threshold: 3, Count: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		shares []string
+		ok     bool
+	}{
+		{"first three", []string{shares[0], shares[1], shares[2]}, true},
+		{"last three", []string{shares[2], shares[3], shares[4]}, true},
+		{"scattered", []string{shares[4], shares[0], shares[3]}, true},
+		{"all five", shares, true},
+		{"typed in lowercase without dashes", []string{strings.ToLower(strings.ReplaceAll(shares[0], "-", "")), shares[1], shares[2]}, true},
+		{"duplicate share on top of a quorum", []string{shares[0], shares[1], shares[1], shares[2]}, true},
+		{"no shares", nil, false},
+		{"fewer than the threshold", []string{shares[0], shares[1]}, false},
+		{"duplicate share index", []string{shares[0], shares[1], shares[1]}, false},
+		{"altered share", []string{shares[0], shares[1], alterShare(t, shares[2])}, false},
+		{"mistyped share", []string{shares[0], mistypeShare(shares[1]), shares[2]}, false},
+		{"share of another split", []string{shares[0], shares[1], otherShares[2]}, false},
+		{"shares of another split only", otherShares[:3], false},
+		{"not a share", []string{shares[0], shares[1], "SIMG-SHARE-NOTASHARE"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unwrapDataKeyShares(stanza.Body, tt.shares)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidShare) {
+					t.Errorf("got %v, want ErrInvalidShare", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, dek) {
+				t.Error("recovered a different key")
+			}
+		})
+	}
+}
+
+func TestKeySharesTwoOfTwo(t *testing.T) {
+	dek, err := newFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanza, shares, err := splitDataKey(dek, ShareOptions{Threshold: 2, Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range [][]string{{shares[0], shares[1]}, {shares[1], shares[0]}} {
+		if got, err := unwrapDataKeyShares(stanza.Body, order); err != nil || !bytes.Equal(got, dek) {
+			t.Errorf("recovered a different key (%v)", err)
+		}
+	}
+	if _, err := unwrapDataKeyShares(stanza.Body, shares[:1]); !errors.Is(err, ErrInvalidShare) {
+		t.Errorf("one share returned %v, want ErrInvalidShare", err)
+	}
+}
+
+func TestShareOptions(t *testing.T) {
+	for _, opts := range []ShareOptions{{Threshold: 1, Count: 3}, {Threshold: 3, Count: 2}, {Threshold: 2, Count: 256}} {
+		if err := opts.validate(); err == nil {
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+}
+
+func TestValidateKeyShares(t *testing.T) {
+	_, shares, err := splitDataKey(bytes.Repeat([]byte{7}, FileKeySize), ShareOptions{Threshold: 2, Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateKeyShares(shares); err != nil {
+		t.Errorf("valid shares rejected: %v", err)
+	}
+	err = ValidateKeyShares([]string{shares[0], mistypeShare(shares[1])})
+	if !errors.Is(err, ErrInvalidShare) || !strings.HasPrefix(err.Error(), "share 2:") {
+		t.Errorf("got %v, want ErrInvalidShare for share 2", err)
+	}
+}
+
+func TestSplitKeyStream(t *testing.T) {
+	plaintext := []byte("an image split between custodians")
+	password := []byte("split password")
+	encrypted, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var split bytes.Buffer
+	shares, err := SplitKeyStream(&split, bytes.NewReader(encrypted), DecryptOptions{Password: password}, ShareOptions{Threshold: 2, Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _, err := DecryptDataWithOptions(split.Bytes(), DecryptOptions{Shares: []string{shares[2], shares[0]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("decrypted data differs from the original")
+	}
+
+	// The password was removed, and one share is not enough
+	if _, _, err := DecryptDataWithOptions(split.Bytes(), DecryptOptions{Password: password}); err == nil {
+		t.Error("the password still opens the split image")
+	}
+	if _, _, err := DecryptDataWithOptions(split.Bytes(), DecryptOptions{Shares: shares[:1]}); err == nil {
+		t.Error("a single share opened the image")
+	}
+}
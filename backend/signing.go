@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Sender signatures
+//
+// A version 3 container can be signed by its sender with Ed25519. The signer's
+// public key is stored in the signer header field and the 64-byte signature is
+// appended after the last segment:
+//
+//	header | segments | signature
+//
+// The signature is Ed25519ph (SHA-512 pre-hash, RFC 8032) with the context
+// "simg/signature/v1" over the segment additional data (the header without
+// the recipients and MAC fields) followed by every segment as stored. The
+// signer field is part of that additional data, so it cannot be stripped to
+// pass a signed image off as unsigned, and rewrapping the data key for other
+// recipients leaves the signature valid.
+//
+// The AEAD only proves that whoever encrypted the image knew its data key; the
+// signature proves which key holder produced it.
+
+const (
+	// signatureContext is the Ed25519ph context string for container signatures
+	signatureContext = "simg/signature/v1"
+)
+
+var (
+	// ErrBadSignature is returned when the sender signature does not verify
+	ErrBadSignature = errors.New("sender signature verification failed")
+
+	// ErrUnsignedImage is returned when a signature is required but the image is not signed
+	ErrUnsignedImage = errors.New("image is not signed and a signature is required")
+
+	// ErrUntrustedSigner is returned when a signature is required from a
+	// trusted key but the image was signed by another key
+	ErrUntrustedSigner = errors.New("image is signed by a key that is not trusted")
+)
+
+// SignatureInfo reports the sender signature of a decrypted image
+type SignatureInfo struct {
+	Signed   bool   `json:"signed"`
+	Verified bool   `json:"verified"`
+	Trusted  bool   `json:"trusted"`
+	Signer   string `json:"signer,omitempty"` // fingerprint of the signing key
+}
+
+// GenerateSigningKey generates a new Ed25519 sender keypair
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	return priv, err
+}
+
+// ParseSigningKey parses an Ed25519 private key given either as a PKCS #8 PEM
+// block or as the base64 encoding of the raw 32-byte seed
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		if block.Type != pemPrivateKeyType {
+			return nil, fmt.Errorf("expected a %s PEM block, got %s", pemPrivateKeyType, block.Type)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key: %v", err)
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("signing key is not an Ed25519 key")
+		}
+		return priv, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("signing key is neither PEM nor base64")
+	}
+	if len(raw) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing key: expected a %d-byte seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(raw), nil
+}
+
+// ParseVerifyingKey parses an Ed25519 public key given either as a PKIX PEM
+// block or as the base64 encoding of the raw 32-byte key
+func ParseVerifyingKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		if block.Type != pemPublicKeyType {
+			return nil, fmt.Errorf("expected a %s PEM block, got %s", pemPublicKeyType, block.Type)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signer key: %v", err)
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("signer key is not an Ed25519 key")
+		}
+		return pub, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("signer key is neither PEM nor base64")
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signer key: expected %d bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// ParseVerifyingKeys parses a list of signer public keys, split like ParsePublicKeys
+func ParseVerifyingKeys(values []string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, value := range values {
+		for _, entry := range splitKeyList(value) {
+			pub, err := ParseVerifyingKey(entry)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, pub)
+		}
+	}
+	return keys, nil
+}
+
+// SignerFingerprint returns a short identifier for a signer public key
+func SignerFingerprint(pub ed25519.PublicKey) string {
+	return fingerprint(pub)
+}
+
+// newSignatureHash starts the pre-hash of a signed container
+func newSignatureHash(ad []byte) hash.Hash {
+	h := sha512.New()
+	h.Write(ad)
+	return h
+}
+
+// signatureOptions are the Ed25519ph options used for container signatures
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext}
+
+// signDigest signs the pre-hash of a container
+func signDigest(priv ed25519.PrivateKey, digest []byte) ([]byte, error) {
+	return priv.Sign(nil, digest, signatureOptions)
+}
+
+// signatureVerifier passes the segments of a signed container through,
+// hashing them and holding back the trailing signature
+type signatureVerifier struct {
+	src     io.Reader
+	signer  ed25519.PublicKey
+	hash    hash.Hash
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+// newSignatureVerifier returns a reader over the segments read from src
+func newSignatureVerifier(src io.Reader, signer ed25519.PublicKey, ad []byte) *signatureVerifier {
+	return &signatureVerifier{
+		src:    src,
+		signer: signer,
+		hash:   newSignatureHash(ad),
+		buf:    make([]byte, 32*1024+ed25519.SignatureSize),
+	}
+}
+
+// Read returns segment bytes, never the last ed25519.SignatureSize bytes of src
+func (v *signatureVerifier) Read(p []byte) (int, error) {
+	for len(v.pending) <= ed25519.SignatureSize {
+		if v.err != nil {
+			return 0, v.err
+		}
+		n := copy(v.buf, v.pending)
+		m, err := v.src.Read(v.buf[n:])
+		v.pending = v.buf[:n+m]
+		v.err = err
+	}
+
+	n := copy(p, v.pending[:len(v.pending)-ed25519.SignatureSize])
+	v.hash.Write(p[:n])
+	v.pending = v.pending[n:]
+	return n, nil
+}
+
+// Verify checks the signature once all segments have been read
+func (v *signatureVerifier) Verify() error {
+	if v.err != io.EOF || len(v.pending) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: %v", ErrBadSignature, ErrStreamTruncated)
+	}
+	if err := ed25519.VerifyWithOptions(v.signer, v.hash.Sum(nil), v.pending, signatureOptions); err != nil {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// checkSignaturePolicy rejects an image before it is decrypted if the
+// options require a signature it does not have. header is nil for legacy data.
+func checkSignaturePolicy(header *ContainerHeader, opts DecryptOptions) error {
+	if !opts.RequireSignature {
+		return nil
+	}
+	if header == nil || header.Signer == nil {
+		return ErrUnsignedImage
+	}
+	if len(opts.TrustedSigners) > 0 && !isTrustedSigner(header.Signer, opts.TrustedSigners) {
+		return ErrUntrustedSigner
+	}
+	return nil
+}
+
+// isTrustedSigner reports whether signer is one of trusted
+func isTrustedSigner(signer ed25519.PublicKey, trusted []ed25519.PublicKey) bool {
+	for _, key := range trusted {
+		if signer.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignatureStatus describes the signature of a successfully decrypted image.
+// Decryption fails if a signature does not verify, so a signed image that
+// decrypted is always verified.
+func SignatureStatus(header *ContainerHeader, trusted []ed25519.PublicKey) SignatureInfo {
+	if header == nil || header.Signer == nil {
+		return SignatureInfo{}
+	}
+	return SignatureInfo{
+		Signed:   true,
+		Verified: true,
+		Trusted:  isTrustedSigner(header.Signer, trusted),
+		Signer:   SignerFingerprint(header.Signer),
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// newTestSigner generates an Ed25519 sender keypair
+func newTestSigner(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	priv, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	priv := newTestSigner(t)
+	pub := priv.Public().(ed25519.PublicKey)
+	privPEM, err := MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := MarshalPublicKeyPEM(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, encoded := range map[string]string{"PEM": privPEM, "base64 seed": base64.StdEncoding.EncodeToString(priv.Seed())} {
+		got, err := ParseSigningKey(encoded)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !got.Equal(priv) {
+			t.Errorf("%s: parsed a different signing key", name)
+		}
+	}
+	keys, err := ParseVerifyingKeys([]string{pubPEM, base64.StdEncoding.EncodeToString(pub)})
+	if err != nil || len(keys) != 2 || !keys[0].Equal(pub) || !keys[1].Equal(pub) {
+		t.Errorf("parsed %d signer keys (%v)", len(keys), err)
+	}
+
+	// X25519 keys are not signing keys
+	x25519Key := newTestIdentity(t)
+	x25519PEM, err := MarshalPrivateKeyPEM(x25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"", "not a key", base64.StdEncoding.EncodeToString(make([]byte, 31)), x25519PEM, pubPEM} {
+		if _, err := ParseSigningKey(bad); err == nil {
+			t.Errorf("%q parsed as a signing key", bad)
+		}
+	}
+	if _, err := ParseVerifyingKey(privPEM); err == nil {
+		t.Error("a private key parsed as a signer key")
+	}
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	sender, other := newTestSigner(t), newTestSigner(t)
+	senderPub := sender.Public().(ed25519.PublicKey)
+	password := []byte("signed password")
+	plaintext := make([]byte, 2*DefaultSegmentSize+5)
+	rand.Read(plaintext)
+
+	signed, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF, SigningKey: sender})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := EncryptDataWithOptions(plaintext, password, EncryptOptions{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed)-len(unsigned) != ed25519.SignatureSize+3+ed25519.PublicKeySize {
+		t.Errorf("signing added %d bytes", len(signed)-len(unsigned))
+	}
+
+	trusted := DecryptOptions{Password: password, RequireSignature: true, TrustedSigners: []ed25519.PublicKey{senderPub}}
+	got, header, err := DecryptDataWithOptions(signed, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("decrypted data differs from the original")
+	}
+	want := SignatureInfo{Signed: true, Verified: true, Trusted: true, Signer: SignerFingerprint(senderPub)}
+	if info := SignatureStatus(header, trusted.TrustedSigners); info != want {
+		t.Errorf("status %+v, want %+v", info, want)
+	}
+	if info := SignatureStatus(header, nil); !info.Verified || info.Trusted {
+		t.Errorf("status without trusted signers %+v", info)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		opts DecryptOptions
+		want error
+	}{
+		{"changed signature", flipByte(signed, len(signed)-1), DecryptOptions{Password: password}, ErrBadSignature},
+		{"changed last segment", flipByte(signed, len(signed)-ed25519.SignatureSize-1), DecryptOptions{Password: password}, ErrAuthenticationFailed},
+		// Without the signature the verifier holds back the end of the last segment
+		{"missing signature", signed[:len(signed)-ed25519.SignatureSize], DecryptOptions{Password: password}, ErrAuthenticationFailed},
+		{"other signer", signed, DecryptOptions{Password: password, RequireSignature: true, TrustedSigners: []ed25519.PublicKey{other.Public().(ed25519.PublicKey)}}, ErrUntrustedSigner},
+		{"unsigned", unsigned, DecryptOptions{Password: password, RequireSignature: true}, ErrUnsignedImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := DecryptDataWithOptions(tt.data, tt.opts); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// The signer field is authenticated, swapping in another key fails
+	i := bytes.Index(signed, senderPub)
+	if i < 0 {
+		t.Fatal("signer key not found in the header")
+	}
+	swapped := bytes.Clone(signed)
+	copy(swapped[i:], other.Public().(ed25519.PublicKey))
+	if _, _, err := DecryptDataWithOptions(swapped, DecryptOptions{Password: password}); err == nil {
+		t.Error("container decrypted with a swapped signer key")
+	}
+}
+
+func TestSignatureSurvivesRewrap(t *testing.T) {
+	sender := newTestSigner(t)
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	signed, err := EncryptDataWithOptions([]byte("signed image"), nil, EncryptOptions{Recipients: []*ecdh.PublicKey{alice.PublicKey()}, SigningKey: sender})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, err := RewrapData(signed, DecryptOptions{Identities: []*ecdh.PrivateKey{alice}}, RewrapOptions{AddRecipients: []*ecdh.PublicKey{bob.PublicKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DecryptOptions{Identities: []*ecdh.PrivateKey{bob}, RequireSignature: true, TrustedSigners: []ed25519.PublicKey{sender.Public().(ed25519.PublicKey)}}
+	if _, _, err := DecryptDataWithOptions(rewrapped, opts); err != nil {
+		t.Errorf("rewrapped image: %v", err)
+	}
+}
+
+func TestDecryptReportsSignature(t *testing.T) {
+	sender := newTestSigner(t)
+	senderPEM, err := MarshalPrivateKeyPEM(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := MarshalPublicKeyPEM(sender.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := "signed form password"
+	plaintext := testPNG(t)
+	fields := map[string]string{"key": password, "kdf": "scrypt", "kdfTime": "10", "kdfMemory": "8", "kdfParallelism": "1"}
+
+	rec := postForm(t, handleEncrypt, "image.png", plaintext, fields)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("encrypt: status %d: %s", rec.Code, rec.Body)
+	}
+	unsigned := rec.Body.Bytes()
+	fields["signingKey"] = senderPEM
+	rec = postForm(t, handleEncrypt, "image.png", plaintext, fields)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("encrypt signed: status %d: %s", rec.Code, rec.Body)
+	}
+	signed := rec.Body.Bytes()
+
+	tests := []struct {
+		name   string
+		data   []byte
+		fields map[string]string
+		code   int
+		status string
+	}{
+		{"unsigned", unsigned, map[string]string{"key": password}, http.StatusOK, "unsigned"},
+		{"signed", signed, map[string]string{"key": password}, http.StatusOK, "verified"},
+		{"trusted", signed, map[string]string{"key": password, "trustedSigners": pubPEM, "requireSignature": "true"}, http.StatusOK, "trusted"},
+		{"signature required", unsigned, map[string]string{"key": password, "requireSignature": "true"}, http.StatusForbidden, ""},
+		{"changed signature", flipByte(signed, len(signed)-1), map[string]string{"key": password}, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postForm(t, handleDecrypt, "image.png.enc", tt.data, tt.fields)
+			if rec.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if !bytes.Equal(rec.Body.Bytes(), plaintext) {
+				t.Error("decrypted image differs")
+			}
+			if got := rec.Header().Get("X-Signature-Status"); got != tt.status {
+				t.Errorf("X-Signature-Status %q, want %q", got, tt.status)
+			}
+			if signer := rec.Header().Get("X-Signature-Signer"); (tt.status != "unsigned") != (signer == SignerFingerprint(sender.Public().(ed25519.PublicKey))) {
+				t.Errorf("X-Signature-Signer %q", signer)
+			}
+		})
+	}
+}
+
+// flipByte returns a copy of data with one bit of byte i changed
+func flipByte(data []byte, i int) []byte {
+	changed := bytes.Clone(data)
+	changed[i] ^= 1
+	return changed
+}
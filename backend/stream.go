@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+)
+
+// Streaming payload (container versions 2 and 3)
+//
+// The plaintext is split into segments of SegmentSize bytes (the last one may
+// be shorter) and each segment is sealed on its own, following the STREAM
+// construction used by age and Tink:
+//
+//	nonce = noncePrefix || counter (4 bytes, big-endian) || lastFlag (1 byte)
+//
+// The counter starts at zero and increases by one per segment, and lastFlag is
+// 1 only for the final segment. Reordering segments changes their counter and
+// dropping trailing segments leaves a final segment sealed with lastFlag 0, so
+// both make decryption fail. Every segment authenticates the container header
+// as additional data (in version 3, without the recipients and MAC fields).
+
+const (
+	// DefaultSegmentSize is the plaintext size of each authenticated segment
+	DefaultSegmentSize = 64 * 1024
+
+	// maxSegmentSize bounds the segment size accepted from untrusted headers
+	maxSegmentSize = 16 * 1024 * 1024
+
+	// streamNonceSuffixSize is the counter and last-segment flag appended to the prefix
+	streamNonceSuffixSize = 4 + 1
+
+	// maxLegacySize bounds how much headerless or single-shot data is buffered,
+	// since those formats cannot be decrypted incrementally
+	maxLegacySize = 100 * 1024 * 1024
+)
+
+var (
+	// ErrStreamTruncated is returned when a stream ends before its final segment
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+)
+
+// streamNonce builds the nonce for one segment
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, len(prefix)+streamNonceSuffixSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// streamWriter seals everything written to it as a sequence of segments.
+// Close must be called to write the final segment.
+type streamWriter struct {
+	dst         io.Writer
+	aead        cipher.AEAD
+	prefix      []byte
+	ad          []byte
+	segmentSize int
+	buf         []byte
+	out         []byte
+	counter     uint32
+	closed      bool
+}
+
+// newStreamWriter returns a writer that seals segments with aead and writes them to dst
+func newStreamWriter(dst io.Writer, aead cipher.AEAD, prefix, ad []byte, segmentSize int) *streamWriter {
+	return &streamWriter{
+		dst:         dst,
+		aead:        aead,
+		prefix:      prefix,
+		ad:          ad,
+		segmentSize: segmentSize,
+		buf:         make([]byte, 0, segmentSize),
+		out:         make([]byte, 0, segmentSize+aead.Overhead()),
+	}
+}
+
+// Write buffers p and seals every segment that is known not to be the last one
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryption stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data arrives, because until
+		// then it might still turn out to be the final segment
+		if len(w.buf) == w.segmentSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):w.segmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals and writes the final segment
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// flush seals the buffered plaintext as one segment
+func (w *streamWriter) flush(last bool) error {
+	nonce := streamNonce(w.prefix, w.counter, last)
+	w.out = w.aead.Seal(w.out[:0], nonce, w.buf, w.ad)
+	if _, err := w.dst.Write(w.out); err != nil {
+		return err
+	}
+
+	w.buf = w.buf[:0]
+	if !last {
+		w.counter++
+		if w.counter == 0 {
+			return errors.New("encrypted stream too long: segment counter overflow")
+		}
+	}
+	return nil
+}
+
+// streamReader opens the segments written by streamWriter
+type streamReader struct {
+	src         *bufio.Reader
+	aead        cipher.AEAD
+	prefix      []byte
+	ad          []byte
+	segmentSize int
+	in          []byte
+	plain       []byte
+	counter     uint32
+	done        bool
+	err         error
+}
+
+// newStreamReader returns a reader that yields the plaintext of the segments read from src
+func newStreamReader(src io.Reader, aead cipher.AEAD, prefix, ad []byte, segmentSize int) *streamReader {
+	return &streamReader{
+		src:         bufio.NewReader(src),
+		aead:        aead,
+		prefix:      prefix,
+		ad:          ad,
+		segmentSize: segmentSize,
+		in:          make([]byte, segmentSize+aead.Overhead()),
+	}
+}
+
+// Read returns decrypted plaintext. Data is only returned once the segment it
+// belongs to has been authenticated.
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.readSegment()
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// readSegment reads and opens the next segment
+func (r *streamReader) readSegment() error {
+	n, err := io.ReadFull(r.src, r.in)
+	last := false
+	switch {
+	case err == io.EOF:
+		return ErrStreamTruncated
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		// A full-size segment is the last one if nothing follows it
+		if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+
+	if n < r.aead.Overhead() {
+		return ErrStreamTruncated
+	}
+
+	nonce := streamNonce(r.prefix, r.counter, last)
+	plaintext, err := r.aead.Open(r.in[:0], nonce, r.in[:n], r.ad)
+	if err != nil {
+		if last {
+			return fmt.Errorf("decryption failed: segment %d: %w, or %w",
+				r.counter, ErrAuthenticationFailed, ErrStreamTruncated)
+		}
+		return fmt.Errorf("decryption failed: segment %d: %w", r.counter, ErrAuthenticationFailed)
+	}
+
+	r.plain = plaintext
+	if last {
+		r.done = true
+		return nil
+	}
+
+	r.counter++
+	if r.counter == 0 {
+		return errors.New("encrypted stream too long: segment counter overflow")
+	}
+	return nil
+}
+
+// EncryptStream reads plaintext from src and writes an encrypted container to
+// dst, holding at most one segment in memory
+func EncryptStream(dst io.Writer, src io.Reader, password []byte, opts EncryptOptions) error {
+	header := &ContainerHeader{
+		Version:     ContainerVersion,
+		SegmentSize: DefaultSegmentSize,
+		Metadata:    opts.Metadata,
+	}
+
+	// Generate the data key, wrap it for every recipient and derive the
+	// payload and header MAC keys from it
+	dek, err := newFileKey()
+	if err != nil {
+		return err
+	}
+	defer wipe(dek)
+	header.Recipients, err = wrapDataKey(dek, password, opts)
+	if err != nil {
+		return err
+	}
+	key, macKey, err := envelopeKeys(dek)
+	if err != nil {
+		return err
+	}
+	defer wipe(key, macKey)
+
+	suite := opts.Cipher
+	if suite == 0 {
+		suite = SuiteAES256GCM
+	}
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return err
+	}
+
+	// Random per-file nonce prefix; the rest of each nonce is the segment counter
+	prefix := make([]byte, aead.NonceSize()-streamNonceSuffixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return err
+	}
+
+	header.Suite = suite
+	header.Nonce = prefix
+
+	// The image is compressed first and the result padded (see
+	// compression.go and padding.go)
+	if opts.Compression != CompressionNone {
+		compressed, stop, err := compressedSource(src, opts.Compression)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		src = compressed
+		header.Compression = opts.Compression
+	}
+
+	// Padded plaintext needs the data length up front
+	checkPadding := func() error { return nil }
+	if opts.Padding != PaddingNone {
+		bucket := int64(0)
+		if opts.Padding == PaddingBucket {
+			bucket = opts.PaddingBucket
+			if bucket == 0 {
+				bucket = DefaultPaddingBucket
+			}
+		}
+		padded, check, cleanup, err := paddedSource(src, opts.Padding, bucket)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		src, checkPadding = padded, check
+		header.Padding, header.PaddingBucket = opts.Padding, bucket
+	}
+
+	if opts.Policy != nil {
+		if header.Policy, err = opts.Policy.withID(); err != nil {
+			return err
+		}
+	}
+	if opts.ImageMetadata != nil {
+		if header.SealedMetadata, err = sealImageMetadata(dek, suite, opts.ImageMetadata); err != nil {
+			return err
+		}
+	}
+	if opts.SigningKey != nil {
+		header.Signer = opts.SigningKey.Public().(ed25519.PublicKey)
+	}
+	headerBytes, err := sealHeader(header, macKey)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(headerBytes); err != nil {
+		return err
+	}
+
+	// Signed containers hash the segments as they are written
+	ad := payloadAD(headerBytes)
+	segments := dst
+	var signatureHash hash.Hash
+	if opts.SigningKey != nil {
+		signatureHash = newSignatureHash(ad)
+		segments = io.MultiWriter(dst, signatureHash)
+	}
+
+	sw := newStreamWriter(segments, aead, prefix, ad, int(header.SegmentSize))
+	if _, err := io.Copy(sw, src); err != nil {
+		return err
+	}
+	if err := checkPadding(); err != nil {
+		return err
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+
+	if signatureHash != nil {
+		signature, err := signDigest(opts.SigningKey, signatureHash.Sum(nil))
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(signature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecryptStream reads a password-encrypted container from src and writes the
+// plaintext to dst
+func DecryptStream(dst io.Writer, src io.Reader, password []byte) (*ContainerHeader, error) {
+	return DecryptStreamWithOptions(dst, src, DecryptOptions{Password: password})
+}
+
+// DecryptStreamWithOptions reads an encrypted container from src and writes
+// the plaintext to dst, verifying the sender signature if there is one.
+// Streaming containers are processed one segment at a time; single-shot and
+// headerless legacy data is buffered (up to maxLegacySize) and decrypted in
+// one call. age and "openssl enc" files are recognised by their magic and
+// return a nil header.
+//
+// Each segment is authenticated before it is written, but the stream as a
+// whole is only known to be complete, and the sender signature is only
+// checked, once the last segment has been read. Until DecryptStreamWithOptions
+// returns nil, dst holds data that may be truncated or forged by someone who
+// knows the key, so dst must be discarded when an error is returned and must
+// not reach anyone before then.
+func DecryptStreamWithOptions(dst io.Writer, src io.Reader, opts DecryptOptions) (*ContainerHeader, error) {
+	// Armored and base64 input is decoded on the fly (see armor.go)
+	br, _, err := detectTextEncoding(bufio.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	magic, err := br.Peek(len(ageMagic) + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isAge(magic) {
+		// age files carry no container header (see age.go)
+		if err := checkSignaturePolicy(nil, opts); err != nil {
+			return nil, err
+		}
+		return nil, decryptAge(dst, br, opts)
+	}
+	if isOpenSSL(magic) {
+		// Neither is "openssl enc" data (see openssl.go)
+		if err := checkSignaturePolicy(nil, opts); err != nil {
+			return nil, err
+		}
+		log.Printf("Decrypting OpenSSL salted data, which is not authenticated")
+		return nil, decryptOpenSSL(dst, br, opts.Password, opts.OpenSSL)
+	}
+	if !bytes.HasPrefix(magic, containerMagic) {
+		if err := checkSignaturePolicy(nil, opts); err != nil {
+			return nil, err
+		}
+
+		encryptedData, err := readAllLimited(br, maxLegacySize)
+		if err != nil {
+			return nil, err
+		}
+		if len(encryptedData) == 0 {
+			return nil, errors.New("no data to decrypt")
+		}
+
+		log.Printf("No container header found, assuming legacy format")
+		plaintext, err := decryptLegacy(encryptedData, opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		_, err = dst.Write(plaintext)
+		return nil, err
+	}
+
+	header, headerBytes, err := readContainerHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Decrypting container version %d, suite %s, kdf %s, recipients %d, segment size %d",
+		header.Version, header.Suite, header.KDF.Algorithm, len(header.Recipients), header.SegmentSize)
+
+	if err := checkSignaturePolicy(header, opts); err != nil {
+		return nil, err
+	}
+
+	var key, ad []byte
+	if header.Version == ContainerVersion {
+		key, ad, err = openEnvelope(header, headerBytes, opts)
+	} else {
+		key, err = payloadKey(header, opts)
+		ad = headerBytes
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+
+	// The policy is enforced once the header MAC has shown it to be genuine.
+	// A decryption only counts once the whole image and its signature have
+	// been verified; any failure from here on gives the count back.
+	refund, err := enforcePolicy(header.Policy, opts.CountDecrypt)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	defer func() {
+		if !verified {
+			refund()
+		}
+	}()
+
+	aead, err := newAEAD(header.Suite, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Version == containerVersionSingleShot {
+		if len(header.Nonce) != aead.NonceSize() {
+			return nil, fmt.Errorf("%w: nonce must be %d bytes", ErrMalformedHeader, aead.NonceSize())
+		}
+		ciphertext, err := readAllLimited(br, maxLegacySize)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := openAEAD(aead, header.Nonce, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return nil, err
+		}
+		verified = true
+		return header, nil
+	}
+
+	if len(header.Nonce) != aead.NonceSize()-streamNonceSuffixSize {
+		return nil, fmt.Errorf("%w: nonce prefix must be %d bytes", ErrMalformedHeader,
+			aead.NonceSize()-streamNonceSuffixSize)
+	}
+
+	// The signature trailer is split off and checked once every segment has
+	// been read
+	var segments io.Reader = br
+	var verifier *signatureVerifier
+	if header.Signer != nil {
+		verifier = newSignatureVerifier(br, header.Signer, ad)
+		segments = verifier
+	}
+
+	// Padding is stripped and the image decompressed as it is read out
+	var payload io.Reader = newStreamReader(segments, aead, header.Nonce, ad, int(header.SegmentSize))
+	if header.Padding != PaddingNone {
+		payload = newUnpadReader(payload)
+	}
+	if header.Compression != CompressionNone {
+		decompressor, err := newDecompressReader(payload, header.Compression, opts.MaxDecompressionRatio)
+		if err != nil {
+			return nil, err
+		}
+		defer decompressor.Close()
+		payload = decompressor
+	}
+	if _, err := io.Copy(dst, payload); err != nil {
+		return nil, err
+	}
+	if verifier != nil {
+		if err := verifier.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	verified = true
+	return header, nil
+}
+
+// readContainerHeader reads and parses a container header from r, returning
+// it together with its raw bytes
+func readContainerHeader(r io.Reader) (*ContainerHeader, []byte, error) {
+	prefix := make([]byte, containerPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated prefix", ErrMalformedHeader)
+	}
+
+	headerLen := binary.BigEndian.Uint32(prefix[5:9])
+	if headerLen > maxHeaderSize {
+		return nil, nil, fmt.Errorf("%w: header length %d too large", ErrMalformedHeader, headerLen)
+	}
+
+	headerBytes := make([]byte, containerPrefixSize+int(headerLen))
+	copy(headerBytes, prefix)
+	if _, err := io.ReadFull(r, headerBytes[containerPrefixSize:]); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated header fields", ErrMalformedHeader)
+	}
+
+	header, _, err := ParseContainerHeader(headerBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, headerBytes, nil
+}
+
+// readAllLimited reads all of r, failing if it holds more than limit bytes
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("data exceeds %d bytes and cannot be decrypted in one piece", limit)
+	}
+	return data, nil
+}
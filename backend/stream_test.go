@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// testKDF is a cheap scrypt setting for tests that do not exercise the KDF
+var testKDF = KDFParams{Algorithm: KDFScrypt, Time: minScryptLogN, Memory: 8, Parallelism: 1}
+
+// streamSegments encrypts plaintext and splits the container into its header
+// and its sealed segments
+func streamSegments(t *testing.T, plaintext, password []byte) ([]byte, [][]byte) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := EncryptStream(&out, bytes.NewReader(plaintext), password, EncryptOptions{KDF: testKDF}); err != nil {
+		t.Fatal(err)
+	}
+	header, end, err := ParseContainerHeader(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealedSize := int(header.SegmentSize) + 16
+	payload := out.Bytes()[end:]
+	var segments [][]byte
+	for len(payload) > sealedSize {
+		segments = append(segments, payload[:sealedSize])
+		payload = payload[sealedSize:]
+	}
+	segments = append(segments, payload)
+	return out.Bytes()[:end], segments
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	password := []byte("stream password")
+	for _, size := range []int{0, 1, DefaultSegmentSize - 1, DefaultSegmentSize, DefaultSegmentSize + 1, 3*DefaultSegmentSize + 100} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		var encrypted, decrypted bytes.Buffer
+		if err := EncryptStream(&encrypted, bytes.NewReader(plaintext), password, EncryptOptions{KDF: testKDF}); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if _, err := DecryptStream(&decrypted, &encrypted, password); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: round trip changed the data", size)
+		}
+	}
+}
+
+func TestStreamRejectsModifiedSegments(t *testing.T) {
+	password := []byte("stream password")
+	plaintext := make([]byte, 3*DefaultSegmentSize+100)
+	rand.Read(plaintext)
+	header, segments := streamSegments(t, plaintext, password)
+	if len(segments) != 4 {
+		t.Fatalf("got %d segments, want 4", len(segments))
+	}
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, parts...), nil)
+	}
+	tests := []struct {
+		name      string
+		data      []byte
+		truncated bool
+	}{
+		{"final segment dropped", join(segments[0], segments[1], segments[2]), true},
+		{"all segments dropped", join(), true},
+		{"cut inside a segment", join(segments[0], segments[1][:100]), true},
+		{"final segment cut short", join(segments[0], segments[1], segments[2], segments[3][:50]), false},
+		{"middle segment dropped", join(segments[0], segments[2], segments[3]), false},
+		{"segments reordered", join(segments[1], segments[0], segments[2], segments[3]), false},
+		{"segment repeated", join(segments[0], segments[0], segments[1], segments[2], segments[3]), false},
+		{"data after the final segment", join(segments[0], segments[1], segments[2], segments[3], []byte("extra")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decrypted, _, err := decryptToTempFile(bytes.NewReader(tt.data), DecryptOptions{Password: password})
+			if err == nil {
+				removeTempFile(decrypted)
+				t.Fatal("modified stream decrypted")
+			}
+			if !errors.Is(err, ErrAuthenticationFailed) && !errors.Is(err, ErrStreamTruncated) {
+				t.Errorf("got %v, want an authentication or truncation error", err)
+			}
+			if tt.truncated && !errors.Is(err, ErrStreamTruncated) {
+				t.Errorf("got %v, want ErrStreamTruncated", err)
+			}
+		})
+	}
+
+	// The unmodified segments still decrypt
+	decrypted, _, err := decryptToTempFile(bytes.NewReader(join(segments...)), DecryptOptions{Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeTempFile(decrypted)
+}
@@ -2,11 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,16 +30,296 @@ const (
 	ImageDataResponse   = byte(2) // Response with image data
 	ImageDataTransfer   = byte(3) // Sending image data to server for storage
 	ConfirmationMessage = byte(4) // Confirmation of receipt
+	ImageStreamTransfer = byte(5) // Like ImageDataTransfer, with a 64-bit data length
+	ImageStreamRequest  = byte(6) // Like ImageDataRequest, answered with ImageStreamResponse
+	ImageStreamResponse = byte(7) // Like ImageDataResponse, with a 64-bit data length
+	ImageRekeyRequest   = byte(8) // Rekey stored images, with a JSON RekeyRequest
+	ImageRekeyProgress  = byte(9) // JSON RekeyProgress, sent after each image and at the end
+
+	// ImageRefused answers an image request that the decrypt policy of the
+	// image does not allow, with a 1-byte reason
+	ImageRefused       = byte(10)
+	refusedExpired     = byte(1)
+	refusedNotYetValid = byte(2)
+
+	// ImageStoreFailed answers an image transfer that the server did not
+	// store, with a 1-byte reason
+	ImageStoreFailed     = byte(11)
+	storeFailedTooLarge  = byte(1)
+	storeFailedBadHeader = byte(2)
+	storeFailedError     = byte(3)
+
+	// EncryptedStorePath is the directory where the TCP server keeps received
+	// images unless SIMG_STORE_DIR says otherwise
+	EncryptedStorePath = "./assets/encrypted"
+
+	// maxImageIDLength bounds the image IDs of requests and transfers
+	maxImageIDLength = 1024
+
+	// TCPIdleTimeout is how long a connection may go without any progress
+	TCPIdleTimeout = 1 * time.Minute
+
+	// maxRekeyMessageSize bounds the JSON body of rekey messages
+	maxRekeyMessageSize = 1 << 20
+
+	// DefaultMaxStoredImageSize is the largest image a client may store
+	// unless SIMG_MAX_STORED_IMAGE_SIZE says otherwise (4GB)
+	DefaultMaxStoredImageSize = 4 << 30
 )
 
+// Environment variables used to configure the TCP server
+const (
+	envMaxStoredImageSize = "SIMG_MAX_STORED_IMAGE_SIZE"
+	envStoreDir           = "SIMG_STORE_DIR"
+	envRekeyToken         = "SIMG_REKEY_TOKEN"
+	envAllowBulkRekey     = "SIMG_ALLOW_BULK_REKEY"
+)
+
+var (
+	// ErrImageTooLarge is returned for an image larger than the store accepts
+	ErrImageTooLarge = errors.New("image exceeds the maximum stored image size")
+
+	// ErrRekeyNotAllowed is returned for rekey requests the server does not accept
+	ErrRekeyNotAllowed = errors.New("rekey not allowed")
+
+	// ErrImageIDTooLong is returned for image IDs longer than the server accepts
+	ErrImageIDTooLong = fmt.Errorf("image ID exceeds %d bytes", maxImageIDLength)
+
+	// ErrStoredImageChanged is returned when a stored image is replaced while
+	// it is being rewritten
+	ErrStoredImageChanged = errors.New("stored image changed meanwhile")
+)
+
+// TCPServerConfig holds the settings of the TCP server
+type TCPServerConfig struct {
+	// MaxImageSize bounds the size in bytes of an image a client may store
+	MaxImageSize int64
+
+	// StoreDir is the directory of the stored images, EncryptedStorePath if
+	// empty
+	StoreDir string
+
+	// RekeyToken enables ImageRekeyRequest messages, which must carry it.
+	// Without a token the server refuses to rekey.
+	RekeyToken string
+
+	// AllowBulkRekey accepts rekey requests without image IDs, which rekey
+	// every stored image
+	AllowBulkRekey bool
+}
+
+// tcpServerConfig is the configuration of the running TCP server
+var tcpServerConfig = TCPServerConfig{MaxImageSize: DefaultMaxStoredImageSize}
+
+// storeDir returns the directory of the stored images
+func (c TCPServerConfig) storeDir() string {
+	if c.StoreDir == "" {
+		return EncryptedStorePath
+	}
+	return c.StoreDir
+}
+
+// TCPServerConfigFromEnv reads the TCP server settings from the environment,
+// using the defaults for those that are not set
+func TCPServerConfigFromEnv() (TCPServerConfig, error) {
+	config := TCPServerConfig{MaxImageSize: DefaultMaxStoredImageSize}
+	if v := os.Getenv(envMaxStoredImageSize); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return TCPServerConfig{}, fmt.Errorf("%s must be a positive number of bytes", envMaxStoredImageSize)
+		}
+		config.MaxImageSize = size
+	}
+	config.StoreDir = os.Getenv(envStoreDir)
+	config.RekeyToken = os.Getenv(envRekeyToken)
+	if v := os.Getenv(envAllowBulkRekey); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return TCPServerConfig{}, fmt.Errorf("%s must be true or false", envAllowBulkRekey)
+		}
+		config.AllowBulkRekey = allow
+	}
+	return config, nil
+}
+
+// authorizeRekey checks that a rekey request carries the rekey token and
+// only asks for every stored image if bulk rekeys are allowed
+func (c TCPServerConfig) authorizeRekey(req RekeyRequest) error {
+	if c.RekeyToken == "" {
+		return fmt.Errorf("%w: rekeying is disabled on this server", ErrRekeyNotAllowed)
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(c.RekeyToken)) != 1 {
+		return fmt.Errorf("%w: invalid rekey token", ErrRekeyNotAllowed)
+	}
+	if len(req.ImageIDs) == 0 && !c.AllowBulkRekey {
+		return fmt.Errorf("%w: rekeying every stored image is disabled on this server, list the imageIDs", ErrRekeyNotAllowed)
+	}
+	return nil
+}
+
+// storedImage describes an encrypted image held by the TCP server.
+// The data lives on disk so that large images do not have to fit in memory.
+type storedImage struct {
+	Path string
+	Size int64
+
+	// Generation is different for every version of the file written to the
+	// store
+	Generation uint64
+}
+
 var (
-	// Storage for the last encrypted image data with mutex for concurrent access
-	encryptedImageStore      = make(map[string][]byte)
+	// Index of the stored encrypted images with mutex for concurrent access
+	encryptedImageStore      = make(map[string]storedImage)
 	encryptedImageStoreMutex sync.RWMutex
+
+	// storeGeneration is the generation of the last file written to the
+	// store, guarded by encryptedImageStoreMutex
+	storeGeneration uint64
 )
 
+// idleTimeoutConn extends the connection deadline on every read and write, so
+// long transfers only fail when they stall rather than after a fixed time
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// storedImagePath returns the file used for an image ID. The ID is hashed so
+// that client-supplied IDs can never escape the store directory.
+func storedImagePath(imageID string) string {
+	sum := sha256.Sum256([]byte(imageID))
+	return filepath.Join(tcpServerConfig.storeDir(), hex.EncodeToString(sum[:])+".enc")
+}
+
+// storedImageIDPath returns the file next to a stored image that records its
+// ID, which its hashed name no longer carries
+func storedImageIDPath(path string) string {
+	return strings.TrimSuffix(path, ".enc") + ".id"
+}
+
+// LoadImageStore rebuilds the index of stored images from the store
+// directory, so that images received before a restart are served again, and
+// returns how many it found. Images without a record of their ID, or whose ID
+// does not hash to their name, are skipped.
+func LoadImageStore() (int, error) {
+	entries, err := os.ReadDir(tcpServerConfig.storeDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read store directory: %v", err)
+	}
+
+	images := make(map[string]storedImage)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".enc" {
+			continue
+		}
+		path := filepath.Join(tcpServerConfig.storeDir(), entry.Name())
+		id, err := os.ReadFile(storedImageIDPath(path))
+		if err != nil || storedImagePath(string(id)) != path {
+			log.Printf("Skipping stored image %s without a matching ID record", entry.Name())
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			log.Printf("Skipping stored image %s: %v", entry.Name(), err)
+			continue
+		}
+		images[string(id)] = storedImage{Path: path, Size: info.Size()}
+	}
+
+	encryptedImageStoreMutex.Lock()
+	defer encryptedImageStoreMutex.Unlock()
+	for id, img := range images {
+		encryptedImageStore[id] = img
+	}
+	return len(images), nil
+}
+
+// storeImage copies size bytes from r into the store under imageID. Sizes
+// beyond the configured maximum are refused before anything is written.
+func storeImage(imageID string, r io.Reader, size int64) error {
+	if size > tcpServerConfig.MaxImageSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrImageTooLarge, size, tcpServerConfig.MaxImageSize)
+	}
+	if err := os.MkdirAll(tcpServerConfig.storeDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create store directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(tcpServerConfig.storeDir(), "incoming-*")
+	if err != nil {
+		return fmt.Errorf("failed to create store file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.CopyN(tmp, r, size); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to read image data: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write image data: %v", err)
+	}
+
+	// The ID record goes first, so every image file on disk can be indexed
+	path := storedImagePath(imageID)
+	if err := os.WriteFile(storedImageIDPath(path), []byte(imageID), 0600); err != nil {
+		return fmt.Errorf("failed to record image ID: %v", err)
+	}
+	return commitStoredImage(imageID, tmp.Name(), path, size, nil)
+}
+
+// commitStoredImage moves the complete file tmp to path and indexes it as the
+// image imageID. The rename happens under the store lock, so two writers of
+// the same image cannot overwrite each other unnoticed: if replacing is not
+// nil, the image must still be that version or nothing is changed.
+func commitStoredImage(imageID, tmp, path string, size int64, replacing *storedImage) error {
+	encryptedImageStoreMutex.Lock()
+	defer encryptedImageStoreMutex.Unlock()
+
+	if replacing != nil {
+		if current, exists := encryptedImageStore[imageID]; !exists || current != *replacing {
+			return fmt.Errorf("%w: image %s", ErrStoredImageChanged, imageID)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to store image data: %v", err)
+	}
+	storeGeneration++
+	encryptedImageStore[imageID] = storedImage{Path: path, Size: size, Generation: storeGeneration}
+	return nil
+}
+
+// lookupStoredImage returns the stored image for an ID
+func lookupStoredImage(imageID string) (storedImage, bool) {
+	encryptedImageStoreMutex.RLock()
+	defer encryptedImageStoreMutex.RUnlock()
+	img, exists := encryptedImageStore[imageID]
+	return img, exists
+}
+
 // StartTCPServer starts the TCP server for image transmission
-func StartTCPServer() {
+func StartTCPServer(config TCPServerConfig) {
+	tcpServerConfig = config
+
+	// Serve the images stored before the last restart
+	count, err := LoadImageStore()
+	if err != nil {
+		log.Fatal("Failed to load the image store:", err)
+	}
+	log.Printf("Loaded %d stored images from %s", count, config.storeDir())
+
 	listener, err := net.Listen("tcp", ":"+TCPPort)
 	if err != nil {
 		log.Fatal("Failed to start TCP server:", err)
@@ -38,6 +328,9 @@ func StartTCPServer() {
 
 	log.Printf("TCP server started on port %s", TCPPort)
 
+	// Expired images are removed even if nobody asks for them
+	go purgeExpiredImagesEvery(ExpiredImagePurgeInterval)
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -49,13 +342,13 @@ func StartTCPServer() {
 }
 
 // handleConnection handles incoming TCP connections
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
+func handleConnection(rawConn net.Conn) {
+	defer rawConn.Close()
 
-	log.Printf("New connection from %s", conn.RemoteAddr().String())
+	log.Printf("New connection from %s", rawConn.RemoteAddr().String())
 
-	// Set a reasonable timeout
-	conn.SetDeadline(time.Now().Add(1 * time.Minute))
+	// Time out connections that stop making progress
+	conn := &idleTimeoutConn{Conn: rawConn, timeout: TCPIdleTimeout}
 
 	// Read message type first
 	msgTypeBuf := make([]byte, 1)
@@ -66,27 +359,39 @@ func handleConnection(conn net.Conn) {
 
 	// Handle the message based on its type
 	switch msgTypeBuf[0] {
-	case ImageDataRequest:
+	case ImageDataRequest, ImageStreamRequest:
 		log.Printf("Received image request from %s", conn.RemoteAddr().String())
-		handleImageRequest(conn)
+		if err := handleImageRequest(conn, msgTypeBuf[0] == ImageStreamRequest); err != nil {
+			log.Printf("Image request from %s failed: %v", conn.RemoteAddr().String(), err)
+		}
 
-	case ImageDataTransfer:
+	case ImageDataTransfer, ImageStreamTransfer:
 		log.Printf("Received image transfer from %s", conn.RemoteAddr().String())
-		handleImageTransfer(conn)
+		handleImageTransfer(conn, msgTypeBuf[0] == ImageStreamTransfer)
+
+	case ImageRekeyRequest:
+		log.Printf("Received rekey request from %s", conn.RemoteAddr().String())
+		if err := handleRekeyRequest(conn); err != nil {
+			log.Printf("Rekey request from %s failed: %v", conn.RemoteAddr().String(), err)
+		}
 
 	default:
 		log.Printf("Unknown message type %d from %s", msgTypeBuf[0], conn.RemoteAddr().String())
 	}
 }
 
-
-func handleImageRequest(conn net.Conn) error {
+// handleImageRequest sends a stored image back to the client. Stream requests
+// get a 64-bit length so that images larger than 4GB can be served.
+func handleImageRequest(conn net.Conn, stream bool) error {
 	// Read image ID length (4 bytes)
 	idLenBuf := make([]byte, 4)
 	if _, err := io.ReadFull(conn, idLenBuf); err != nil {
 		return fmt.Errorf("failed to read ID length: %v", err)
 	}
 	idLen := binary.BigEndian.Uint32(idLenBuf)
+	if idLen > maxImageIDLength {
+		return fmt.Errorf("%w: %d bytes", ErrImageIDTooLong, idLen)
+	}
 
 	// Read image ID
 	idBuf := make([]byte, idLen)
@@ -95,37 +400,59 @@ func handleImageRequest(conn net.Conn) error {
 	}
 	imageID := string(idBuf)
 
-	// Retrieve the encrypted image data from storage
-	encryptedImageStoreMutex.RLock()
-	imageData, exists := encryptedImageStore[imageID]
-	encryptedImageStoreMutex.RUnlock()
-
+	// Look up the encrypted image in storage
+	stored, exists := lookupStoredImage(imageID)
 	if !exists {
 		return fmt.Errorf("image with ID %s not found", imageID)
 	}
 
-	// Send response message type
-	if _, err := conn.Write([]byte{ImageDataResponse}); err != nil {
-		return fmt.Errorf("failed to send response type: %v", err)
+	// Images outside their decrypt policy are not handed out
+	if err := checkStoredImagePolicy(imageID, stored); err != nil {
+		reason := refusedExpired
+		if errors.Is(err, ErrImageNotYetValid) {
+			reason = refusedNotYetValid
+		}
+		if _, writeErr := conn.Write([]byte{ImageRefused, reason}); writeErr != nil {
+			return fmt.Errorf("failed to send refusal: %v", writeErr)
+		}
+		return fmt.Errorf("refused image %s: %w", imageID, err)
 	}
 
-	// Send data length
-	dataLenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(dataLenBuf, uint32(len(imageData)))
-	if _, err := conn.Write(dataLenBuf); err != nil {
-		return fmt.Errorf("failed to send data length: %v", err)
+	imageFile, err := os.Open(stored.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open stored image: %v", err)
+	}
+	defer imageFile.Close()
+
+	// Send response message type and data length
+	var header []byte
+	if stream {
+		header = make([]byte, 9)
+		header[0] = ImageStreamResponse
+		binary.BigEndian.PutUint64(header[1:], uint64(stored.Size))
+	} else {
+		if stored.Size > math.MaxUint32 {
+			return fmt.Errorf("image %s is too large for a non-stream request", imageID)
+		}
+		header = make([]byte, 5)
+		header[0] = ImageDataResponse
+		binary.BigEndian.PutUint32(header[1:], uint32(stored.Size))
+	}
+	if _, err := conn.Write(header); err != nil {
+		return fmt.Errorf("failed to send response header: %v", err)
 	}
 
 	// Send image data
-	if _, err := conn.Write(imageData); err != nil {
+	if _, err := io.CopyN(conn, imageFile, stored.Size); err != nil {
 		return fmt.Errorf("failed to send image data: %v", err)
 	}
 
 	return nil
 }
 
-// handleImageTransfer receives and stores encrypted image from client
-func handleImageTransfer(conn net.Conn) {
+// handleImageTransfer receives and stores encrypted image from client. A
+// transfer that is not stored is answered with ImageStoreFailed.
+func handleImageTransfer(conn net.Conn, stream bool) {
 	// Read image ID length
 	idLenBuf := make([]byte, 4)
 	if _, err := io.ReadFull(conn, idLenBuf); err != nil {
@@ -134,6 +461,11 @@ func handleImageTransfer(conn net.Conn) {
 	}
 
 	idLen := binary.BigEndian.Uint32(idLenBuf)
+	if idLen > maxImageIDLength {
+		log.Printf("Refusing image transfer: %v: %d bytes", ErrImageIDTooLong, idLen)
+		conn.Write([]byte{ImageStoreFailed, storeFailedBadHeader})
+		return
+	}
 	idBuf := make([]byte, idLen)
 	if _, err := io.ReadFull(conn, idBuf); err != nil {
 		log.Printf("Error reading image ID: %v", err)
@@ -144,33 +476,201 @@ func handleImageTransfer(conn net.Conn) {
 
 	// Read image data size
 	sizeBuf := make([]byte, 4)
+	if stream {
+		sizeBuf = make([]byte, 8)
+	}
 	if _, err := io.ReadFull(conn, sizeBuf); err != nil {
 		log.Printf("Error reading data size: %v", err)
 		return
 	}
 
-	dataSize := binary.BigEndian.Uint32(sizeBuf)
-
-	// Read the encrypted image data
-	data := make([]byte, dataSize)
-	if _, err := io.ReadFull(conn, data); err != nil {
-		log.Printf("Error reading image data: %v", err)
+	var dataSize int64
+	if stream {
+		dataSize = int64(binary.BigEndian.Uint64(sizeBuf))
+	} else {
+		dataSize = int64(binary.BigEndian.Uint32(sizeBuf))
+	}
+	if dataSize < 0 {
+		log.Printf("Invalid data size for image '%s'", imageID)
+		conn.Write([]byte{ImageStoreFailed, storeFailedBadHeader})
 		return
 	}
 
-	// Store the image data
-	encryptedImageStoreMutex.Lock()
-	encryptedImageStore[imageID] = data
-	encryptedImageStoreMutex.Unlock()
+	// Stream the encrypted image data to disk
+	if err := storeImage(imageID, conn, dataSize); err != nil {
+		log.Printf("Error storing image '%s': %v", imageID, err)
+		reason := storeFailedError
+		if errors.Is(err, ErrImageTooLarge) {
+			reason = storeFailedTooLarge
+		}
+		conn.Write([]byte{ImageStoreFailed, reason})
+		return
+	}
 
 	// Send confirmation
 	conn.Write([]byte{ConfirmationMessage})
 
 	log.Printf("Received and stored encrypted image '%s' (%d bytes)", imageID, dataSize)
+	if summary, err := describeStoredImage(imageID); err == nil {
+		log.Printf("Image '%s' is a %s", imageID, summary)
+	}
+}
+
+// describeStoredImage summarises the container header of a stored image,
+// including how many passwords and public keys its data key is wrapped for
+func describeStoredImage(imageID string) (string, error) {
+	img, exists := lookupStoredImage(imageID)
+	if !exists {
+		return "", fmt.Errorf("image '%s' not found", imageID)
+	}
+
+	f, err := os.Open(img.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header, _, err := readContainerHeader(f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("version %d container (%s) for %s",
+		header.Version, header.Suite, describeRecipients(header.Recipients)), nil
+}
+
+// handleRekeyRequest rekeys stored images and reports progress after each
+// one. Requests must carry the configured rekey token. They also carry the
+// old and new credentials, so they should only be sent over a trusted network.
+func handleRekeyRequest(conn net.Conn) error {
+	var req RekeyRequest
+	if err := readJSONMessage(conn, &req); err != nil {
+		return err
+	}
+
+	if err := tcpServerConfig.authorizeRekey(req); err != nil {
+		writeJSONMessage(conn, ImageRekeyProgress, RekeyProgress{Error: err.Error(), Finished: true})
+		return err
+	}
+
+	unlock, opts, err := req.options()
+	if err != nil {
+		writeJSONMessage(conn, ImageRekeyProgress, RekeyProgress{Error: err.Error(), Finished: true})
+		return err
+	}
+	defer wipe(unlock.Password, opts.Password)
+
+	// A client that goes away does not stop the operation half way; the
+	// remaining images are still rekeyed
+	var writeErr error
+	final := RekeyStore(req.ImageIDs, unlock, opts, func(progress RekeyProgress) {
+		if writeErr == nil {
+			writeErr = writeJSONMessage(conn, ImageRekeyProgress, progress)
+		}
+	})
+	log.Printf("Rekeyed %d of %d images (%d rewrapped, %d re-encrypted, %d skipped, %d failed)",
+		final.Rewrapped+final.Reencrypted, final.Total, final.Rewrapped, final.Reencrypted, final.Skipped, final.Failed)
+
+	if writeErr != nil {
+		return fmt.Errorf("failed to send progress: %v", writeErr)
+	}
+	return writeJSONMessage(conn, ImageRekeyProgress, final)
+}
+
+// readJSONMessage reads a 4-byte length followed by a JSON document
+func readJSONMessage(r io.Reader, v any) error {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return fmt.Errorf("failed to read message length: %v", err)
+	}
+	msgLen := binary.BigEndian.Uint32(lenBuf)
+	if msgLen > maxRekeyMessageSize {
+		return fmt.Errorf("message of %d bytes is too large", msgLen)
+	}
+
+	msg := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return fmt.Errorf("failed to read message: %v", err)
+	}
+	if err := json.Unmarshal(msg, v); err != nil {
+		return fmt.Errorf("invalid message: %v", err)
+	}
+	return nil
+}
+
+// writeJSONMessage writes a message type, a 4-byte length and a JSON document
+func writeJSONMessage(w io.Writer, msgType byte, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = msgType
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)))
+	_, err = w.Write(append(msg, body...))
+	return err
+}
+
+// RekeyViaTCP asks a TCP server to rekey its stored images and calls progress
+// for every image it reports. It returns the final summary.
+func RekeyViaTCP(serverAddr string, req RekeyRequest, progress func(RekeyProgress)) (RekeyProgress, error) {
+	log.Printf("RekeyViaTCP: Requesting rekey of %d images (0 = all) from %s", len(req.ImageIDs), serverAddr)
+
+	rawConn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		return RekeyProgress{}, fmt.Errorf("failed to connect to server: %v", err)
+	}
+	defer rawConn.Close()
+
+	// Re-encrypting a large image can take a while between progress messages
+	conn := &idleTimeoutConn{Conn: rawConn, timeout: 10 * TCPIdleTimeout}
+
+	if err := writeJSONMessage(conn, ImageRekeyRequest, req); err != nil {
+		return RekeyProgress{}, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	msgType := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, msgType); err != nil {
+			return RekeyProgress{}, fmt.Errorf("failed to read progress: %v", err)
+		}
+		if msgType[0] != ImageRekeyProgress {
+			return RekeyProgress{}, fmt.Errorf("unexpected response type: %d", msgType[0])
+		}
+
+		var status RekeyProgress
+		if err := readJSONMessage(conn, &status); err != nil {
+			return RekeyProgress{}, err
+		}
+		if status.Finished {
+			if status.Total == 0 && status.Error != "" {
+				if strings.HasPrefix(status.Error, ErrRekeyNotAllowed.Error()) {
+					return status, fmt.Errorf("rekey rejected: %w%s", ErrRekeyNotAllowed,
+						strings.TrimPrefix(status.Error, ErrRekeyNotAllowed.Error()))
+				}
+				return status, fmt.Errorf("rekey rejected: %s", status.Error)
+			}
+			return status, nil
+		}
+		if progress != nil {
+			progress(status)
+		}
+	}
 }
 
 // SendImageViaTCP sends an encrypted image to a TCP server
 func SendImageViaTCP(imageID string, encryptedData []byte, serverAddr string) error {
+	return SendImageStreamViaTCP(imageID, bytes.NewReader(encryptedData), int64(len(encryptedData)), serverAddr)
+}
+
+// SendImageStreamViaTCP sends size bytes of encrypted image data read from src
+// to a TCP server without buffering them. Images that fit a 32-bit length use
+// ImageDataTransfer so older servers can receive them; larger ones use
+// ImageStreamTransfer.
+func SendImageStreamViaTCP(imageID string, src io.Reader, size int64, serverAddr string) error {
+	if len(imageID) > maxImageIDLength {
+		return fmt.Errorf("%w: %d bytes", ErrImageIDTooLong, len(imageID))
+	}
 	log.Printf("SendImageViaTCP: Attempting to connect to %s", serverAddr)
 
 	// Set a dialer with timeout
@@ -178,24 +678,29 @@ func SendImageViaTCP(imageID string, encryptedData []byte, serverAddr string) er
 		Timeout: 10 * time.Second,
 	}
 
-	conn, err := dialer.Dial("tcp", serverAddr)
+	rawConn, err := dialer.Dial("tcp", serverAddr)
 	if err != nil {
 		log.Printf("SendImageViaTCP: Connection error: %v", err)
 		return fmt.Errorf("failed to connect to server %s: %v", serverAddr, err)
 	}
-	defer conn.Close()
+	defer rawConn.Close()
 
 	log.Printf("SendImageViaTCP: Connected to %s, sending image '%s' (%d bytes)",
-		serverAddr, imageID, len(encryptedData))
+		serverAddr, imageID, size)
 
 	// Set reasonable timeout
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	conn := &idleTimeoutConn{Conn: rawConn, timeout: 30 * time.Second}
 
-	// Create buffer for the complete message
+	// Create buffer for the message header
 	var buf bytes.Buffer
 
 	// Add message type
-	buf.WriteByte(ImageDataTransfer)
+	stream := size > math.MaxUint32
+	if stream {
+		buf.WriteByte(ImageStreamTransfer)
+	} else {
+		buf.WriteByte(ImageDataTransfer)
+	}
 
 	// Add image ID length and ID
 	idBytes := []byte(imageID)
@@ -204,16 +709,29 @@ func SendImageViaTCP(imageID string, encryptedData []byte, serverAddr string) er
 	buf.Write(idLenBytes)
 	buf.Write(idBytes)
 
-	// Add data size and data
-	sizeBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(sizeBytes, uint32(len(encryptedData)))
-	buf.Write(sizeBytes)
-	buf.Write(encryptedData)
+	// Add data size
+	if stream {
+		sizeBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(sizeBytes, uint64(size))
+		buf.Write(sizeBytes)
+	} else {
+		sizeBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(sizeBytes, uint32(size))
+		buf.Write(sizeBytes)
+	}
 
-	// Send the complete message
-	_, err = conn.Write(buf.Bytes())
-	if err != nil {
+	// Send the header followed by the data. A server that refuses the image
+	// answers and closes the connection without reading the rest, so a failed
+	// write is reported with the answer if there is one.
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		log.Printf("SendImageViaTCP: Failed to write header: %v", err)
+		return fmt.Errorf("failed to send data to server: %v", err)
+	}
+	if _, err := io.CopyN(conn, src, size); err != nil {
 		log.Printf("SendImageViaTCP: Failed to write data: %v", err)
+		if refusal := readStoreFailure(conn); refusal != nil {
+			return refusal
+		}
 		return fmt.Errorf("failed to send data to server: %v", err)
 	}
 
@@ -226,6 +744,9 @@ func SendImageViaTCP(imageID string, encryptedData []byte, serverAddr string) er
 		return fmt.Errorf("no confirmation received from server: %v", err)
 	}
 
+	if confirmBuf[0] == ImageStoreFailed {
+		return readStoreFailureReason(conn)
+	}
 	if confirmBuf[0] != ConfirmationMessage {
 		log.Printf("SendImageViaTCP: Received invalid confirmation code: %d", confirmBuf[0])
 		return fmt.Errorf("received invalid confirmation code from server")
@@ -237,6 +758,9 @@ func SendImageViaTCP(imageID string, encryptedData []byte, serverAddr string) er
 
 // RequestImageViaTCP requests and receives an encrypted image from a TCP server
 func RequestImageViaTCP(serverAddr, imageID string) ([]byte, error) {
+	if len(imageID) > maxImageIDLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrImageIDTooLong, len(imageID))
+	}
 	log.Printf("RequestImageViaTCP: Requesting image '%s' from %s", imageID, serverAddr)
 
 	// Connect to the TCP server
@@ -277,6 +801,9 @@ func RequestImageViaTCP(serverAddr, imageID string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read response type: %v", err)
 	}
 
+	if msgTypeBuf[0] == ImageRefused {
+		return nil, readRefusal(conn)
+	}
 	if msgTypeBuf[0] != ImageDataResponse {
 		return nil, fmt.Errorf("unexpected response type: %d", msgTypeBuf[0])
 	}
@@ -310,3 +837,100 @@ func RequestImageViaTCP(serverAddr, imageID string) ([]byte, error) {
 
 	return imageData, nil
 }
+
+// RequestImageStreamViaTCP requests an encrypted image from a TCP server and
+// copies it to dst as it arrives, returning the number of bytes received
+func RequestImageStreamViaTCP(serverAddr, imageID string, dst io.Writer) (int64, error) {
+	if len(imageID) > maxImageIDLength {
+		return 0, fmt.Errorf("%w: %d bytes", ErrImageIDTooLong, len(imageID))
+	}
+	log.Printf("RequestImageStreamViaTCP: Requesting image '%s' from %s", imageID, serverAddr)
+
+	// Connect to the TCP server
+	rawConn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to server: %v", err)
+	}
+	defer rawConn.Close()
+
+	// Time out only if the transfer stalls
+	conn := &idleTimeoutConn{Conn: rawConn, timeout: 30 * time.Second}
+
+	// Send message type, image ID length and image ID
+	idBytes := []byte(imageID)
+	request := make([]byte, 5, 5+len(idBytes))
+	request[0] = ImageStreamRequest
+	binary.BigEndian.PutUint32(request[1:], uint32(len(idBytes)))
+	if _, err := conn.Write(append(request, idBytes...)); err != nil {
+		return 0, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read the response message type and 64-bit data length
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return 0, fmt.Errorf("failed to read response header: %v", err)
+	}
+	if header[0] == ImageRefused {
+		return 0, readRefusal(conn)
+	}
+	if header[0] != ImageStreamResponse {
+		return 0, fmt.Errorf("unexpected response type: %d", header[0])
+	}
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		return 0, fmt.Errorf("failed to read response header: %v", err)
+	}
+
+	dataLen := int64(binary.BigEndian.Uint64(header[1:]))
+	if dataLen <= 0 {
+		return 0, fmt.Errorf("received invalid data length %d", dataLen)
+	}
+	log.Printf("RequestImageStreamViaTCP: Receiving %d bytes of image data", dataLen)
+
+	n, err := io.CopyN(dst, conn, dataLen)
+	if err != nil {
+		return n, fmt.Errorf("failed to read image data: %v (read %d of %d bytes)", err, n, dataLen)
+	}
+
+	log.Printf("RequestImageStreamViaTCP: Successfully received %d bytes", n)
+	return n, nil
+}
+
+// readRefusal reads the reason of an ImageRefused answer and returns it as
+// the matching policy error
+func readRefusal(r io.Reader) error {
+	reason := make([]byte, 1)
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return fmt.Errorf("failed to read refusal reason: %v", err)
+	}
+	if reason[0] == refusedNotYetValid {
+		return fmt.Errorf("server refused the image: %w", ErrImageNotYetValid)
+	}
+	return fmt.Errorf("server refused the image: %w", ErrImageExpired)
+}
+
+// readStoreFailure reads an ImageStoreFailed answer after a failed transfer
+// and returns it as an error, or nil if the server sent no such answer
+func readStoreFailure(r io.Reader) error {
+	msgType := make([]byte, 1)
+	if _, err := io.ReadFull(r, msgType); err != nil || msgType[0] != ImageStoreFailed {
+		return nil
+	}
+	return readStoreFailureReason(r)
+}
+
+// readStoreFailureReason reads the reason of an ImageStoreFailed answer and
+// returns it as an error
+func readStoreFailureReason(r io.Reader) error {
+	reason := make([]byte, 1)
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return fmt.Errorf("failed to read store failure reason: %v", err)
+	}
+	switch reason[0] {
+	case storeFailedTooLarge:
+		return fmt.Errorf("server refused the image: %w", ErrImageTooLarge)
+	case storeFailedBadHeader:
+		return errors.New("server refused the image: invalid image ID or size")
+	default:
+		return errors.New("server failed to store the image")
+	}
+}
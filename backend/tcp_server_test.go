@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startTestTCPServer serves image requests on a free local port with an
+// empty image store in a temporary directory and returns its address
+func startTestTCPServer(t *testing.T) string {
+	t.Helper()
+	previous := encryptedImageStore
+	encryptedImageStore = make(map[string]storedImage)
+	t.Cleanup(func() { encryptedImageStore = previous })
+	previousConfig := tcpServerConfig
+	tcpServerConfig.StoreDir = t.TempDir()
+	t.Cleanup(func() { tcpServerConfig = previousConfig })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// storeTestImage puts data into the image store under imageID
+func storeTestImage(t *testing.T, imageID string, data []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image.enc")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	encryptedImageStoreMutex.Lock()
+	encryptedImageStore[imageID] = storedImage{Path: path, Size: int64(len(data))}
+	encryptedImageStoreMutex.Unlock()
+}
+
+// postJSON sends v as a JSON request body to handler
+func postJSON(t *testing.T, handler http.HandlerFunc, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	return rec
+}
+
+// postForm sends a multipart form with one file to handler
+func postForm(t *testing.T, handler http.HandlerFunc, filename string, file []byte, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(file)
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// testPNG returns a small encoded PNG image
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 32), uint8(y * 32), 0x80, 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRequestImageStreamViaTCP(t *testing.T) {
+	addr := startTestTCPServer(t)
+	data := make([]byte, 300*1024)
+	rand.Read(data)
+	storeTestImage(t, "stored", data)
+
+	var got bytes.Buffer
+	n, err := RequestImageStreamViaTCP(addr, "stored", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("received %d bytes that differ from the stored image", n)
+	}
+
+	if _, err := RequestImageStreamViaTCP(addr, "missing", &got); err == nil {
+		t.Error("retrieved an image that does not exist")
+	}
+}
+
+func TestRequestImageAndDecryptOverTCP(t *testing.T) {
+	addr := startTestTCPServer(t)
+	password := "retrieval password"
+
+	// Several segments of image data behind a PNG header
+	plaintext := append(testPNG(t), make([]byte, 3*DefaultSegmentSize)...)
+	rand.Read(plaintext[len(plaintext)-3*DefaultSegmentSize:])
+	encrypted, err := EncryptDataWithOptions(plaintext, []byte(password), EncryptOptions{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeTestImage(t, "photo", encrypted)
+
+	rec := postJSON(t, handleRequestImage, map[string]string{"serverAddr": addr, "imageID": "photo"})
+	var retrieved struct {
+		Success       bool   `json:"success"`
+		EncryptedData string `json:"encryptedData"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &retrieved); err != nil || !retrieved.Success {
+		t.Fatalf("handleRequestImage returned %d %q (%v)", rec.Code, rec.Body.String(), err)
+	}
+	if got, err := base64.StdEncoding.DecodeString(retrieved.EncryptedData); err != nil || !bytes.Equal(got, encrypted) {
+		t.Errorf("handleRequestImage returned different encrypted data (%v)", err)
+	}
+
+	rec = postJSON(t, handleRequestDecrypt, RequestDecryptRequest{ServerAddr: addr, ImageID: "photo", Key: password})
+	var decrypted RequestDecryptResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &decrypted); err != nil || !decrypted.Success {
+		t.Fatalf("handleRequestDecrypt returned %d %q (%v)", rec.Code, rec.Body.String(), err)
+	}
+	if got, err := base64.StdEncoding.DecodeString(decrypted.Data); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("handleRequestDecrypt returned a different image (%v)", err)
+	}
+	if decrypted.Signature == nil {
+		t.Error("handleRequestDecrypt returned no signature status")
+	}
+
+	// A stored image with a corrupted segment is not returned at all
+	corrupted := bytes.Clone(encrypted)
+	corrupted[len(corrupted)-DefaultSegmentSize] ^= 1
+	storeTestImage(t, "corrupted", corrupted)
+	rec = postJSON(t, handleRequestDecrypt, RequestDecryptRequest{ServerAddr: addr, ImageID: "corrupted", Key: password})
+	if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), `"data"`) {
+		t.Errorf("corrupted image returned %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = postJSON(t, handleRequestDecrypt, RequestDecryptRequest{ServerAddr: addr, ImageID: "missing", Key: password})
+	if rec.Code == http.StatusOK {
+		t.Error("missing image was decrypted")
+	}
+}
+
+func TestImageStoreSurvivesRestart(t *testing.T) {
+	addr := startTestTCPServer(t)
+	data := make([]byte, 10*1024)
+	rand.Read(data)
+	if err := SendImageViaTCP("kept", data, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files without a matching ID record are not indexed
+	if err := os.WriteFile(filepath.Join(tcpServerConfig.StoreDir, "orphan.enc"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	wrongID := storedImagePath("wrong")
+	if err := os.WriteFile(wrongID, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(storedImageIDPath(wrongID), []byte("not wrong"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted server starts with an empty index
+	encryptedImageStoreMutex.Lock()
+	encryptedImageStore = make(map[string]storedImage)
+	encryptedImageStoreMutex.Unlock()
+	count, err := LoadImageStore()
+	if err != nil || count != 1 {
+		t.Fatalf("loaded %d images (%v), want 1", count, err)
+	}
+	var got bytes.Buffer
+	if _, err := RequestImageStreamViaTCP(addr, "kept", &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("image stored before the restart was not served (%v)", err)
+	}
+
+	tcpServerConfig.StoreDir = filepath.Join(t.TempDir(), "missing")
+	if count, err := LoadImageStore(); err != nil || count != 0 {
+		t.Errorf("missing store directory loaded %d images (%v)", count, err)
+	}
+}
+
+func TestImageTransferFailuresAreAnswered(t *testing.T) {
+	addr := startTestTCPServer(t)
+	tcpServerConfig.MaxImageSize = 1024
+
+	if err := SendImageViaTCP("large", make([]byte, 2048), addr); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("large image returned %v, want ErrImageTooLarge", err)
+	}
+	if _, exists := lookupStoredImage("large"); exists {
+		t.Error("large image was stored")
+	}
+	if err := SendImageViaTCP(strings.Repeat("x", maxImageIDLength+1), []byte("image"), addr); !errors.Is(err, ErrImageIDTooLong) {
+		t.Errorf("long image ID returned %v, want ErrImageIDTooLong", err)
+	}
+
+	// Oversized ID lengths are refused before any ID is read
+	for _, msgType := range []byte{ImageDataTransfer, ImageStreamRequest} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte{msgType, 0xff, 0xff, 0xff, 0xff}); err != nil {
+			t.Fatal(err)
+		}
+		answer, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []byte{}
+		if msgType == ImageDataTransfer {
+			want = []byte{ImageStoreFailed, storeFailedBadHeader}
+		}
+		if !bytes.Equal(answer, want) {
+			t.Errorf("message type %d: answered %v, want %v", msgType, answer, want)
+		}
+	}
+}
+
+func TestWriteJSONWithBase64(t *testing.T) {
+	data := []byte("some \x00 binary \xff data")
+	rec := httptest.NewRecorder()
+	response := RequestDecryptResponse{Success: true, Message: `quoted "message"`}
+	if err := writeJSONWithBase64(rec, response, "data", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got RequestDecryptResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	if !got.Success || got.Message != response.Message {
+		t.Errorf("fields changed: %+v", got)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(got.Data); err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("data field is %q (%v)", got.Data, err)
+	}
+
+	if err := writeJSONWithBase64(httptest.NewRecorder(), struct{}{}, "data", &failingReader{}); !errors.Is(err, errFailingReader) {
+		t.Errorf("read error returned %v", err)
+	}
+}
+
+var errFailingReader = errors.New("read failed")
+
+// failingReader fails every read
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errFailingReader }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Exact transforms
+//
+// Flips, transposes, turns by right angles and crops only move pixels, so
+// they copy the bytes of each pixel instead of converting colours, and the
+// result has the type of the source: a decoded JPEG stays an *image.YCbCr,
+// a GIF an *image.Paletted with the same palette. Chroma of subsampled
+// YCbCr images is copied to every pixel it covers, giving a 4:4:4 image,
+// since turning 4:2:2 by 90° would need 4:4:0 chroma. Images of other types
+// are converted to *image.RGBA first.
+//
+// Every transform is one of the eight ways to place an image on its
+// rectangle, described by an orientation. A pixel of the result is found by
+// undoing the flips, which work on the result, and then the transpose.
+
+// orientation places an image on a rectangle: transpose swaps the axes and
+// flipX and flipY then mirror the result left to right and top to bottom
+type orientation struct {
+	transpose, flipX, flipY bool
+}
+
+// FlipVertical flips an image upside-down
+func FlipVertical(ctx context.Context, img image.Image) (image.Image, error) {
+	return transformPixels(ctx, img, orientation{flipY: true})
+}
+
+// FlipHorizontal mirrors an image left to right
+func FlipHorizontal(ctx context.Context, img image.Image) (image.Image, error) {
+	return transformPixels(ctx, img, orientation{flipX: true})
+}
+
+// Transpose mirrors an image across the diagonal from its top left corner,
+// so that rows become columns
+func Transpose(ctx context.Context, img image.Image) (image.Image, error) {
+	return transformPixels(ctx, img, orientation{transpose: true})
+}
+
+// Transverse mirrors an image across the diagonal from its top right corner
+func Transverse(ctx context.Context, img image.Image) (image.Image, error) {
+	return transformPixels(ctx, img, orientation{transpose: true, flipX: true, flipY: true})
+}
+
+// Rotate90 turns an image clockwise by 90°, the direction RotateArbitrary
+// turns positive angles
+func Rotate90(ctx context.Context, img image.Image) (image.Image, error) {
+	return transformPixels(ctx, img, orientation{transpose: true, flipX: true})
+}
+
+// Rotate180 turns an image by 180°
+func Rotate180(ctx context.Context, img image.Image) (image.Image, error) {
+	return transformPixels(ctx, img, orientation{flipX: true, flipY: true})
+}
+
+// Rotate270 turns an image clockwise by 270°, or anticlockwise by 90°
+func Rotate270(ctx context.Context, img image.Image) (image.Image, error) {
+	return transformPixels(ctx, img, orientation{transpose: true, flipY: true})
+}
+
+// RotateQuarterTurns turns an image clockwise by turns times 90°; negative
+// turns go anticlockwise
+func RotateQuarterTurns(ctx context.Context, img image.Image, turns int) (image.Image, error) {
+	switch (turns%4 + 4) % 4 {
+	case 1:
+		return Rotate90(ctx, img)
+	case 2:
+		return Rotate180(ctx, img)
+	case 3:
+		return Rotate270(ctx, img)
+	default:
+		return transformPixels(ctx, img, orientation{})
+	}
+}
+
+// normalizeTurns reduces a whole number of quarter turns to 0 to 3
+// clockwise turns, so that -90° becomes three turns
+func normalizeTurns(turns float64) int {
+	n := int(math.Mod(turns, 4))
+	return (n%4 + 4) % 4
+}
+
+// cropRect returns the rectangle of a crop given by its offset from the top
+// left corner of an image of the given size and its own size. The crop has
+// to lie inside the image.
+func cropRect(imageWidth, imageHeight, x, y, width, height int) (image.Rectangle, error) {
+	if width <= 0 || height <= 0 {
+		return image.Rectangle{}, fmt.Errorf("%w: crop needs a width and a height", ErrInvalidSize)
+	}
+	// Written as differences so that huge values cannot overflow
+	if x < 0 || y < 0 || x > imageWidth-width || y > imageHeight-height {
+		return image.Rectangle{}, fmt.Errorf("%w: the %dx%d crop at %d,%d does not fit inside the %dx%d image",
+			ErrInvalidSize, width, height, x, y, imageWidth, imageHeight)
+	}
+	return image.Rect(x, y, x+width, y+height), nil
+}
+
+// Crop returns the part of an image inside rect, given relative to the top
+// left corner of the image, as a new image of the same type. Parts of rect
+// outside the image are left out.
+func Crop(ctx context.Context, img image.Image, rect image.Rectangle) (image.Image, error) {
+	bounds := img.Bounds()
+	rect = rect.Add(bounds.Min).Intersect(bounds)
+	if rect.Empty() {
+		return nil, fmt.Errorf("%w: the crop rectangle does not overlap the image", ErrInvalidSize)
+	}
+
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		rgba, err := rgbaPixels(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		sub = rgba
+	}
+	return transformPixels(ctx, sub.SubImage(rect), orientation{})
+}
+
+// pixelPlane is the Pix slice of an image, with its stride and the size of
+// a pixel
+type pixelPlane struct {
+	pix           []uint8
+	stride, bytes int
+}
+
+// transformPixels copies img into a new image of the same type, placed as o
+// says
+func transformPixels(ctx context.Context, img image.Image, o orientation) (image.Image, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rect := image.Rect(0, 0, width, height)
+	if o.transpose {
+		rect = image.Rect(0, 0, height, width)
+	}
+
+	// Pair the pixels of the source with those of a new image of its type
+	var out image.Image
+	var dst, src pixelPlane
+	switch img := img.(type) {
+	case *image.RGBA:
+		d := image.NewRGBA(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 4}, pixelPlane{img.Pix, img.Stride, 4}
+	case *image.RGBA64:
+		d := image.NewRGBA64(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 8}, pixelPlane{img.Pix, img.Stride, 8}
+	case *image.NRGBA:
+		d := image.NewNRGBA(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 4}, pixelPlane{img.Pix, img.Stride, 4}
+	case *image.NRGBA64:
+		d := image.NewNRGBA64(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 8}, pixelPlane{img.Pix, img.Stride, 8}
+	case *image.Gray:
+		d := image.NewGray(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 1}, pixelPlane{img.Pix, img.Stride, 1}
+	case *image.Gray16:
+		d := image.NewGray16(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 2}, pixelPlane{img.Pix, img.Stride, 2}
+	case *image.Alpha:
+		d := image.NewAlpha(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 1}, pixelPlane{img.Pix, img.Stride, 1}
+	case *image.Alpha16:
+		d := image.NewAlpha16(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 2}, pixelPlane{img.Pix, img.Stride, 2}
+	case *image.CMYK:
+		d := image.NewCMYK(rect)
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 4}, pixelPlane{img.Pix, img.Stride, 4}
+	case *image.Paletted:
+		d := image.NewPaletted(rect, append(color.Palette(nil), img.Palette...))
+		out, dst, src = d, pixelPlane{d.Pix, d.Stride, 1}, pixelPlane{img.Pix, img.Stride, 1}
+	case *image.YCbCr:
+		return transformYCbCr(ctx, img, rect, o)
+	default:
+		rgba, err := rgbaPixels(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		return transformPixels(ctx, rgba, o)
+	}
+
+	n := dst.bytes
+	err := parallelBands(ctx, rect.Dy(), 0, func(lo, hi int) {
+		for y := lo; y < hi; y++ {
+			row := dst.pix[y*dst.stride : y*dst.stride+rect.Dx()*n]
+
+			// Without a transpose or a mirror a row is copied whole
+			if !o.transpose && !o.flipX {
+				sy := y
+				if o.flipY {
+					sy = height - 1 - y
+				}
+				copy(row, src.pix[sy*src.stride:])
+				continue
+			}
+			for x := 0; x < rect.Dx(); x++ {
+				sx, sy := o.source(x, y, rect)
+				i := sy*src.stride + sx*n
+				copy(row[x*n:x*n+n], src.pix[i:i+n])
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// source returns the pixel of the source that lands on (x, y) of rect, the
+// rectangle of the result
+func (o orientation) source(x, y int, rect image.Rectangle) (int, int) {
+	if o.flipX {
+		x = rect.Dx() - 1 - x
+	}
+	if o.flipY {
+		y = rect.Dy() - 1 - y
+	}
+	if o.transpose {
+		return y, x
+	}
+	return x, y
+}
+
+// transformYCbCr copies a YCbCr image into a new 4:4:4 YCbCr image on rect,
+// placed as o says
+func transformYCbCr(ctx context.Context, img *image.YCbCr, rect image.Rectangle, o orientation) (image.Image, error) {
+	out := image.NewYCbCr(rect, image.YCbCrSubsampleRatio444)
+	origin := img.Rect.Min
+
+	err := parallelBands(ctx, rect.Dy(), 0, func(lo, hi int) {
+		for y := lo; y < hi; y++ {
+			i := y * out.YStride
+			for x := 0; x < rect.Dx(); x++ {
+				sx, sy := o.source(x, y, rect)
+				c := img.COffset(origin.X+sx, origin.Y+sy)
+				out.Y[i+x] = img.Y[img.YOffset(origin.X+sx, origin.Y+sy)]
+				out.Cb[i+x] = img.Cb[c]
+				out.Cr[i+x] = img.Cr[c]
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// grayRows returns the pixel values of a Gray image row by row
+func grayRows(t *testing.T, img image.Image) [][]uint8 {
+	t.Helper()
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("result is %T, want *image.Gray", img)
+	}
+	b := gray.Bounds()
+	if b.Min != (image.Point{}) {
+		t.Errorf("result starts at %v, want the origin", b.Min)
+	}
+	var rows [][]uint8
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := make([]uint8, b.Dx())
+		for x := range row {
+			row[x] = gray.GrayAt(b.Min.X+x, y).Y
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func sameRows(a, b [][]uint8) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// transforms maps the exact transforms to their result for the grid
+//
+//	1 2 3
+//	4 5 6
+var transforms = []struct {
+	name string
+	fn   func(context.Context, image.Image) (image.Image, error)
+	want [][]uint8
+}{
+	{"FlipVertical", FlipVertical, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+	{"FlipHorizontal", FlipHorizontal, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+	{"Transpose", Transpose, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+	{"Transverse", Transverse, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+	{"Rotate90", Rotate90, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+	{"Rotate180", Rotate180, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+	{"Rotate270", Rotate270, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+}
+
+func TestExactTransforms(t *testing.T) {
+	grid := grayGrid([]uint8{1, 2, 3}, []uint8{4, 5, 6})
+	for _, tt := range transforms {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.fn(context.Background(), grid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows := grayRows(t, got); !sameRows(rows, tt.want) {
+				t.Errorf("got %v, want %v", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestExactTransformsKeepPixels(t *testing.T) {
+	// Every transform applied twice, or with its inverse, gives back the
+	// source pixel for pixel in every format
+	inverse := map[string]func(context.Context, image.Image) (image.Image, error){
+		"FlipVertical":   FlipVertical,
+		"FlipHorizontal": FlipHorizontal,
+		"Transpose":      Transpose,
+		"Transverse":     Transverse,
+		"Rotate90":       Rotate270,
+		"Rotate180":      Rotate180,
+		"Rotate270":      Rotate90,
+	}
+	for _, input := range goldenImages(t) {
+		for _, tt := range transforms {
+			t.Run(input.name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				once, err := tt.fn(ctx, input.img)
+				if err != nil {
+					t.Fatal(err)
+				}
+				back, err := inverse[tt.name](ctx, once)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b := input.img.Bounds()
+				if back.Bounds() != image.Rect(0, 0, b.Dx(), b.Dy()) {
+					t.Fatalf("bounds %v, want %v", back.Bounds(), b.Sub(b.Min))
+				}
+				for y := 0; y < b.Dy(); y++ {
+					for x := 0; x < b.Dx(); x++ {
+						want := color.RGBA64Model.Convert(input.img.At(b.Min.X+x, b.Min.Y+y))
+						if got := color.RGBA64Model.Convert(back.At(x, y)); got != want {
+							t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRotateQuarterTurns(t *testing.T) {
+	grid := grayGrid([]uint8{1, 2, 3}, []uint8{4, 5, 6})
+	want := map[int][][]uint8{
+		0: {{1, 2, 3}, {4, 5, 6}},
+		1: transforms[4].want,
+		2: transforms[5].want,
+		3: transforms[6].want,
+	}
+	for turns := -9; turns <= 9; turns++ {
+		got, err := RotateQuarterTurns(context.Background(), grid, turns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows := grayRows(t, got); !sameRows(rows, want[((turns%4)+4)%4]) {
+			t.Errorf("%d turns: got %v", turns, rows)
+		}
+	}
+}
+
+func TestNormalizeTurns(t *testing.T) {
+	tests := []struct {
+		turns float64
+		want  int
+	}{
+		{0, 0}, {1, 1}, {2, 2}, {3, 3}, {4, 0}, {5, 1}, {400, 0},
+		{-1, 3}, {-2, 2}, {-3, 1}, {-4, 0}, {-5, 3}, {-401, 3},
+	}
+	for _, tt := range tests {
+		if got := normalizeTurns(tt.turns); got != tt.want {
+			t.Errorf("normalizeTurns(%v) = %d, want %d", tt.turns, got, tt.want)
+		}
+	}
+}
+
+func TestCropRect(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	tests := []struct {
+		name                string
+		x, y, width, height int
+		ok                  bool
+	}{
+		{"whole image", 0, 0, 30, 20, true},
+		{"inside", 5, 5, 10, 10, true},
+		{"bottom right corner", 29, 19, 1, 1, true},
+		{"no width", 0, 0, 0, 10, false},
+		{"negative height", 0, 0, 10, -1, false},
+		{"negative x", -1, 0, 10, 10, false},
+		{"negative y", 0, -1, 10, 10, false},
+		{"past the right edge", 21, 0, 10, 10, false},
+		{"past the bottom edge", 0, 11, 10, 10, false},
+		{"outside", 100, 100, 10, 10, false},
+		{"overflowing x", maxInt, 0, 1, 1, false},
+		{"overflowing width", 1, 0, maxInt, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rect, err := cropRect(30, 20, tt.x, tt.y, tt.width, tt.height)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rect != image.Rect(tt.x, tt.y, tt.x+tt.width, tt.y+tt.height) {
+					t.Errorf("got %v", rect)
+				}
+			} else if err == nil {
+				t.Errorf("accepted as %v", rect)
+			}
+		})
+	}
+}
+
+func TestCrop(t *testing.T) {
+	grid := grayGrid([]uint8{1, 2, 3}, []uint8{4, 5, 6}, []uint8{7, 8, 9})
+	got, err := Crop(context.Background(), grid, image.Rect(1, 1, 3, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := grayRows(t, got); !sameRows(rows, [][]uint8{{5, 6}, {8, 9}}) {
+		t.Errorf("got %v", rows)
+	}
+	if _, err := Crop(context.Background(), grid, image.Rect(5, 5, 8, 8)); err == nil {
+		t.Error("crop outside the image succeeded")
+	}
+}
+
+func TestProcessRejectsCropOutsideImage(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("uploads", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("uploads", "image.png"), testPNG(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bounds, err := png.DecodeConfig(bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process := func(body map[string]any) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		handleProcess(rec, httptest.NewRequest(http.MethodPost, "/process?filename=image.png", bytes.NewReader(data)))
+		return rec
+	}
+
+	for _, body := range []map[string]any{
+		{"operation": "crop", "x": -1, "y": 0, "width": 2, "height": 2},
+		{"operation": "crop", "x": 0, "y": 0, "width": bounds.Width + 1, "height": 2},
+		{"operation": "crop", "x": bounds.Width - 1, "y": 0, "width": 2, "height": 2},
+		{"operation": "crop", "x": 0, "y": 0, "width": 0, "height": 2},
+	} {
+		if rec := process(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", body, rec.Code)
+		}
+	}
+	if rec := process(map[string]any{"operation": "crop", "x": 1, "y": 1, "width": 2, "height": 3}); rec.Code != http.StatusOK {
+		t.Errorf("crop inside the image: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := process(map[string]any{"operation": "rotate", "angle": -90}); rec.Code != http.StatusOK {
+		t.Errorf("rotate by -90°: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VaultTransitProvider is a KeyProvider that wraps data keys with the transit
+// secrets engine of HashiCorp Vault (or any server speaking the same API).
+// The keys never leave Vault; the wrapped key is Vault's "vault:v1:..."
+// ciphertext string.
+type VaultTransitProvider struct {
+	Addr   string
+	Token  string
+	Mount  string
+	Client *http.Client
+}
+
+// NewVaultTransitProvider returns a provider for the transit engine mounted at
+// mount (default "transit") on the Vault server at addr
+func NewVaultTransitProvider(addr, token, mount string) *VaultTransitProvider {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &VaultTransitProvider{
+		Addr:   strings.TrimRight(addr, "/"),
+		Token:  token,
+		Mount:  strings.Trim(mount, "/"),
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name returns "vault"
+func (v *VaultTransitProvider) Name() string {
+	return "vault"
+}
+
+// WrapKey encrypts a data key with the transit key keyID
+func (v *VaultTransitProvider) WrapKey(keyID string, dek []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dek)}
+	if err := v.call("encrypt", keyID, req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("vault returned no ciphertext")
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// UnwrapKey decrypts a data key with the transit key keyID
+func (v *VaultTransitProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"ciphertext": string(wrapped)}
+	if err := v.call("decrypt", keyID, req, &resp); err != nil {
+		return nil, err
+	}
+
+	dek, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vault returned invalid plaintext: %v", err)
+	}
+	if len(dek) != FileKeySize {
+		wipe(dek)
+		return nil, fmt.Errorf("vault returned a %d-byte key, want %d bytes", len(dek), FileKeySize)
+	}
+	return dek, nil
+}
+
+// call posts a JSON request to /v1/<mount>/<operation>/<keyID>
+func (v *VaultTransitProvider) call(operation, keyID string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", v.Addr, v.Mount, operation, url.PathEscape(keyID))
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Vault-Token", v.Token)
+
+	httpResp, err := v.Client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("vault %s failed: %v", operation, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		// Vault reports problems as {"errors": [...]}
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(httpResp.Body).Decode(&vaultErr)
+		return fmt.Errorf("vault %s failed with status %d: %s",
+			operation, httpResp.StatusCode, strings.Join(vaultErr.Errors, "; "))
+	}
+
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("invalid vault response: %v", err)
+	}
+	return nil
+}
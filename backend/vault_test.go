@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// fakeVault mimics the encrypt and decrypt endpoints of the Vault transit
+// engine. Every transit key has numbered versions; encrypt uses the latest
+// and decrypt refuses versions that do not exist or are older than
+// minDecryptionVersion, as Vault does.
+type fakeVault struct {
+	t     *testing.T
+	token string
+	mount string
+
+	mu   sync.Mutex
+	keys map[string]*fakeTransitKey
+
+	// malformed makes every successful response invalid JSON
+	malformed bool
+}
+
+// fakeTransitKey is one named transit key
+type fakeTransitKey struct {
+	versions             [][]byte
+	minDecryptionVersion int
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	v := &fakeVault{t: t, token: "s.test-token", mount: "transit", keys: make(map[string]*fakeTransitKey)}
+	server := httptest.NewServer(v)
+	t.Cleanup(server.Close)
+	return v, server
+}
+
+// rotate adds a new version of the key name, creating the key if needed
+func (v *fakeVault) rotate(name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		v.t.Fatal(err)
+	}
+	if v.keys[name] == nil {
+		v.keys[name] = &fakeTransitKey{minDecryptionVersion: 1}
+	}
+	v.keys[name].versions = append(v.keys[name].versions, key)
+}
+
+// setMinDecryptionVersion stops the key name from decrypting older versions
+func (v *fakeVault) setMinDecryptionVersion(name string, version int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys[name].minDecryptionVersion = version
+}
+
+func (v *fakeVault) fail(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+}
+
+func (v *fakeVault) reply(w http.ResponseWriter, data map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	if v.malformed {
+		io.WriteString(w, `{"data": {"ciphertext": `)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		v.fail(w, http.StatusMethodNotAllowed, "unsupported operation")
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != v.token {
+		v.fail(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	route, mounted := strings.CutPrefix(r.URL.Path, "/v1/"+v.mount+"/")
+	operation, name, found := strings.Cut(route, "/")
+	if !mounted || !found {
+		v.fail(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		v.fail(w, http.StatusBadRequest, "failed to parse JSON input")
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := v.keys[name]
+	if key == nil {
+		v.fail(w, http.StatusBadRequest, "encryption key not found")
+		return
+	}
+
+	switch operation {
+	case "encrypt":
+		plaintext, err := base64.StdEncoding.DecodeString(req["plaintext"])
+		if err != nil {
+			v.fail(w, http.StatusBadRequest, "failed to base64-decode plaintext")
+			return
+		}
+		version := len(key.versions)
+		aead, _ := chacha20poly1305.NewX(key.versions[version-1])
+		nonce := make([]byte, aead.NonceSize())
+		io.ReadFull(rand.Reader, nonce)
+		sealed := aead.Seal(nonce, nonce, plaintext, []byte(name))
+		v.reply(w, map[string]string{
+			"ciphertext": fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(sealed)),
+		})
+	case "decrypt":
+		parts := strings.SplitN(req["ciphertext"], ":", 3)
+		if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+			v.fail(w, http.StatusBadRequest, "invalid ciphertext: no prefix")
+			return
+		}
+		version, err := strconv.Atoi(parts[1][1:])
+		if err != nil || version < 1 || version > len(key.versions) {
+			v.fail(w, http.StatusBadRequest, "invalid ciphertext: key version not found")
+			return
+		}
+		if version < key.minDecryptionVersion {
+			v.fail(w, http.StatusBadRequest, "ciphertext or signature version is disallowed by policy (too old)")
+			return
+		}
+		sealed, err := base64.StdEncoding.DecodeString(parts[2])
+		aead, _ := chacha20poly1305.NewX(key.versions[version-1])
+		if err != nil || len(sealed) < aead.NonceSize() {
+			v.fail(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+		if err != nil {
+			v.fail(w, http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		v.reply(w, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+	default:
+		v.fail(w, http.StatusNotFound, "no handler for route")
+	}
+}
+
+// useKeyProvider registers provider for the rest of the test
+func useKeyProvider(t *testing.T, provider KeyProvider) {
+	t.Helper()
+	keyProvidersMutex.Lock()
+	previous, existed := keyProviders[provider.Name()]
+	keyProvidersMutex.Unlock()
+
+	RegisterKeyProvider(provider)
+	t.Cleanup(func() {
+		keyProvidersMutex.Lock()
+		defer keyProvidersMutex.Unlock()
+		if existed {
+			keyProviders[provider.Name()] = previous
+		} else {
+			delete(keyProviders, provider.Name())
+		}
+	})
+}
+
+func TestVaultTransitRoundTrip(t *testing.T) {
+	vault, server := newFakeVault(t)
+	vault.rotate("images")
+	provider := NewVaultTransitProvider(server.URL+"/", vault.token, "")
+
+	dek, err := newFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := provider.WrapKey("images", dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(wrapped, []byte("vault:v1:")) {
+		t.Errorf("wrapped key %q is not a version 1 transit ciphertext", wrapped)
+	}
+	unwrapped, err := provider.UnwrapKey("images", wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Error("unwrapped key differs from the data key")
+	}
+
+	// After a rotation new keys use version 2 and old ones still unwrap
+	vault.rotate("images")
+	rewrapped, err := provider.WrapKey("images", dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(rewrapped, []byte("vault:v2:")) {
+		t.Errorf("wrapped key %q is not a version 2 transit ciphertext", rewrapped)
+	}
+	if _, err := provider.UnwrapKey("images", wrapped); err != nil {
+		t.Errorf("version 1 key no longer unwraps after a rotation: %v", err)
+	}
+}
+
+func TestVaultTransitContainer(t *testing.T) {
+	vault, server := newFakeVault(t)
+	vault.rotate("images")
+	provider := NewVaultTransitProvider(server.URL, vault.token, "transit")
+	useKeyProvider(t, provider)
+
+	plaintext := []byte("an image wrapped by vault")
+	ciphertext, err := EncryptDataWithOptions(plaintext, nil, EncryptOptions{KeyIDs: []string{"vault:images"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _, err := DecryptDataWithOptions(ciphertext, DecryptOptions{KeyIDs: []string{"vault:images"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("decrypted data differs from the original")
+	}
+
+	// A provider failure is reported as such, not as a key that does not match
+	provider.Token = "s.revoked"
+	_, _, err = DecryptDataWithOptions(ciphertext, DecryptOptions{KeyIDs: []string{"vault:images"}})
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("got error %v, want the vault error", err)
+	}
+}
+
+func TestVaultTransitErrors(t *testing.T) {
+	dek := make([]byte, FileKeySize)
+
+	tests := []struct {
+		name    string
+		setup   func(v *fakeVault, provider *VaultTransitProvider) []byte
+		wantErr string
+	}{
+		{
+			name: "wrong token",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				provider.Token = "s.revoked"
+				return nil
+			},
+			wantErr: "status 403: permission denied",
+		},
+		{
+			name: "wrong mount",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				provider.Mount = "kv"
+				return nil
+			},
+			wantErr: "status 404",
+		},
+		{
+			name: "unknown key",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				delete(v.keys, "images")
+				return nil
+			},
+			wantErr: "status 400: encryption key not found",
+		},
+		{
+			name: "malformed response",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				v.malformed = true
+				return nil
+			},
+			wantErr: "invalid vault response",
+		},
+		{
+			name: "key version not found",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				wrapped, err := provider.WrapKey("images", dek)
+				if err != nil {
+					v.t.Fatal(err)
+				}
+				return bytes.Replace(wrapped, []byte("vault:v1:"), []byte("vault:v7:"), 1)
+			},
+			wantErr: "status 400: invalid ciphertext: key version not found",
+		},
+		{
+			name: "key version too old",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				wrapped, err := provider.WrapKey("images", dek)
+				if err != nil {
+					v.t.Fatal(err)
+				}
+				v.rotate("images")
+				v.setMinDecryptionVersion("images", 2)
+				return wrapped
+			},
+			wantErr: "status 400: ciphertext or signature version is disallowed by policy",
+		},
+		{
+			name: "tampered ciphertext",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				wrapped, err := provider.WrapKey("images", dek)
+				if err != nil {
+					v.t.Fatal(err)
+				}
+				sealed, _ := base64.StdEncoding.DecodeString(string(wrapped[len("vault:v1:"):]))
+				sealed[len(sealed)-1] ^= 1
+				return []byte("vault:v1:" + base64.StdEncoding.EncodeToString(sealed))
+			},
+			wantErr: "status 400: cipher: message authentication failed",
+		},
+		{
+			name: "plaintext of the wrong length",
+			setup: func(v *fakeVault, provider *VaultTransitProvider) []byte {
+				// Vault decrypts whatever it was given, so a key wrapped
+				// elsewhere can come back with any length
+				wrapped, err := provider.WrapKey("images", make([]byte, FileKeySize+1))
+				if err != nil {
+					v.t.Fatal(err)
+				}
+				return wrapped
+			},
+			wantErr: "vault returned a 33-byte key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault, server := newFakeVault(t)
+			vault.rotate("images")
+			provider := NewVaultTransitProvider(server.URL, vault.token, "")
+
+			wrapped := tt.setup(vault, provider)
+			var err error
+			if wrapped == nil {
+				_, err = provider.WrapKey("images", dek)
+			} else {
+				_, err = provider.UnwrapKey("images", wrapped)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVaultTransitUnreachable(t *testing.T) {
+	_, server := newFakeVault(t)
+	server.Close()
+
+	provider := NewVaultTransitProvider(server.URL, "s.test-token", "")
+	_, err := provider.WrapKey("images", make([]byte, FileKeySize))
+	if err == nil || !strings.Contains(err.Error(), "vault encrypt failed") {
+		t.Errorf("got error %v, want a failed encrypt", err)
+	}
+}